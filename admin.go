@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultMaintenanceMessage = "Server is in maintenance mode; uploads are temporarily disabled"
+
+type MaintenanceStatus struct {
+	Enabled bool      `json:"enabled"`
+	Message string    `json:"message,omitempty"`
+	Since   time.Time `json:"since,omitzero"`
+}
+
+// MaintenanceMode pauses cleanup and rejects writes to the store while
+// leaving downloads available.
+type MaintenanceMode struct {
+	status MaintenanceStatus
+	mu     sync.RWMutex
+}
+
+var maintenance = &MaintenanceMode{}
+
+func (m *MaintenanceMode) Status() MaintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+func (m *MaintenanceMode) Enabled() bool {
+	return m.Status().Enabled
+}
+
+func (m *MaintenanceMode) Set(enabled bool, message string) MaintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !enabled {
+		m.status = MaintenanceStatus{}
+		return m.status
+	}
+
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	if !m.status.Enabled {
+		m.status.Since = time.Now()
+	}
+	m.status.Enabled = true
+	m.status.Message = message
+	return m.status
+}
+
+// adminKey lets requests from other hosts act as admin with an X-Admin-Key
+// header; it comes from SYNCIT_ADMIN_KEY.
+var adminKey = os.Getenv("SYNCIT_ADMIN_KEY")
+
+// isAdminRequest reports whether r may act as an admin, as the admin
+// endpoints and upload approval require: it comes from the server itself,
+// carries the admin key or an API key with admin scope.
+func isAdminRequest(r *http.Request) bool {
+	if isLocalRequest(r) || isAdminKey(r) {
+		return true
+	}
+	key := r.Header.Get("X-Admin-Key")
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) == 1
+}
+
+// rejectIfMaintenance writes a 503 and returns true when maintenance mode is on.
+func rejectIfMaintenance(w http.ResponseWriter) bool {
+	status := maintenance.Status()
+	if !status.Enabled {
+		return false
+	}
+	w.Header().Set("Retry-After", "300")
+	http.Error(w, status.Message, http.StatusServiceUnavailable)
+	return true
+}
+
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPost, http.MethodPut:
+		if !isAdminRequest(r) {
+			http.Error(w, "Only an admin can change maintenance mode", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Enabled bool   `json:"enabled"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		status := maintenance.Set(req.Enabled, req.Message)
+		slog.Info("Maintenance mode changed", "enabled", status.Enabled, "message", status.Message, "client", clientIP(r))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenance.Status())
+}
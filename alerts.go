@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AlertStorageUsage = "storage.usage"
+	AlertUploadSize   = "upload.size"
+	AlertSLOBurn      = "slo.burn"
+
+	// Usage has to drop this many points below a threshold before crossing
+	// it again raises another alert
+	alertHysteresis = 2.0
+)
+
+// Alert is what admins are told when storage is filling up, an unusually
+// large file arrives or a route is missing its SLO. It is logged, and posted as JSON to the webhook.
+type Alert struct {
+	Type       string        `json:"type"`
+	Message    string        `json:"message"`
+	Time       time.Time     `json:"time"`
+	Threshold  float64       `json:"threshold,omitempty"`
+	Percent    float64       `json:"percent,omitempty"`
+	UsedBytes  uint64        `json:"usedBytes,omitempty"`
+	TotalBytes uint64        `json:"totalBytes,omitempty"`
+	File       *FileMetadata `json:"file,omitempty"`
+	Route      string        `json:"route,omitempty"`
+	BurnRate   float64       `json:"burnRate,omitempty"`
+}
+
+type AlertConfig struct {
+	Thresholds   []float64 // percentages, ascending
+	StorageLimit int64     // measure usage against this instead of the disk
+	UploadSize   int64
+	Webhook      string
+	Email        []string
+	SMTPAddr     string
+	SMTPFrom     string
+}
+
+type Alerter struct {
+	config AlertConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	level int // number of thresholds currently crossed
+}
+
+func NewAlerter(config AlertConfig) (*Alerter, error) {
+	if len(config.Email) > 0 && (config.SMTPAddr == "" || config.SMTPFrom == "") {
+		return nil, fmt.Errorf("-alert-email needs -smtp and -smtp-from")
+	}
+	sort.Float64s(config.Thresholds)
+	return &Alerter{config: config, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// parseThresholds parses comma-separated percentages such as "80,95".
+func parseThresholds(s string) ([]float64, error) {
+	var thresholds []float64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSuffix(strings.TrimSpace(part), "%")
+		if part == "" {
+			continue
+		}
+		pct, err := strconv.ParseFloat(part, 64)
+		if err != nil || pct <= 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid threshold %q (use percentages, e.g. 80,95)", part)
+		}
+		thresholds = append(thresholds, pct)
+	}
+	return thresholds, nil
+}
+
+// storageUsage returns how much of the storage budget is in use: the bytes
+// stored against limit (-storage-limit) when set, otherwise the disk holding
+// -dir.
+func storageUsage(limit int64) (used, total uint64, err error) {
+	if limit > 0 {
+		return uint64(storage.StoredBytes()), uint64(limit), nil
+	}
+	return diskUsage(uploadsDir)
+}
+
+// CheckUsage raises an alert when usage has risen past another threshold.
+func (a *Alerter) CheckUsage() {
+	if len(a.config.Thresholds) == 0 {
+		return
+	}
+	used, total, err := storageUsage(a.config.StorageLimit)
+	if err != nil || total == 0 {
+		return
+	}
+	pct := float64(used) / float64(total) * 100
+
+	a.mu.Lock()
+	level := a.level
+	for level > 0 && pct < a.config.Thresholds[level-1]-alertHysteresis {
+		level--
+	}
+	crossed := level
+	for crossed < len(a.config.Thresholds) && pct >= a.config.Thresholds[crossed] {
+		crossed++
+	}
+	a.level = crossed
+	a.mu.Unlock()
+
+	if crossed <= level {
+		return
+	}
+	threshold := a.config.Thresholds[crossed-1]
+	a.raise(Alert{
+		Type:       AlertStorageUsage,
+		Message:    fmt.Sprintf("Storage is %.1f%% full (%s of %s), past the %g%% threshold", pct, formatSize(int64(used)), formatSize(int64(total)), threshold),
+		Threshold:  threshold,
+		Percent:    pct,
+		UsedBytes:  used,
+		TotalBytes: total,
+	})
+}
+
+func (a *Alerter) handleEvent(e Event) {
+	if e.Type != EventFileUploaded || e.File == nil {
+		return
+	}
+	if a.config.UploadSize > 0 && e.File.Size > a.config.UploadSize {
+		a.raise(Alert{
+			Type:    AlertUploadSize,
+			Message: fmt.Sprintf("%s was uploaded at %s, over the %s alert size", e.File.Name, formatSize(e.File.Size), formatSize(a.config.UploadSize)),
+			File:    e.File,
+		})
+	}
+	a.CheckUsage()
+}
+
+func (a *Alerter) raise(alert Alert) {
+	alert.Time = time.Now()
+	slog.Warn("Alert", "type", alert.Type, "message", alert.Message)
+
+	// Delivery can be slow, and callers may be holding up the cleanup loop
+	go func() {
+		if a.config.Webhook != "" {
+			if err := a.postWebhook(alert); err != nil {
+				slog.Error("Failed to send alert webhook", "error", err)
+			}
+		}
+		if len(a.config.Email) > 0 {
+			if err := a.sendEmail(alert); err != nil {
+				slog.Error("Failed to send alert email", "error", err)
+			}
+		}
+	}()
+}
+
+func (a *Alerter) postWebhook(alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.config.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// sendEmail sends alert over SMTP, authenticating with SYNCIT_SMTP_USERNAME
+// and SYNCIT_SMTP_PASSWORD when set.
+func (a *Alerter) sendEmail(alert Alert) error {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", a.config.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(a.config.Email, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "[sync-it] "+alert.Message))
+	fmt.Fprintf(&msg, "Date: %s\r\n", alert.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nServer: %s\r\n", alert.Message, publicBaseURL()+"/")
+
+	return smtp.SendMail(a.config.SMTPAddr, smtpAuth(a.config.SMTPAddr), a.config.SMTPFrom, a.config.Email, []byte(msg.String()))
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API keys are long-lived bearer tokens for devices and scripts, created by
+// an admin at /api/admin/keys instead of exchanged for the PIN. Each has a
+// scope limiting what it may do, and optionally an expiry and a rate limit.
+// Only a hash of each key is stored; the key itself is shown once.
+const (
+	apiKeyPrefix = "sik_"
+
+	scopeUpload   = "upload"
+	scopeDownload = "download"
+	scopeAdmin    = "admin"
+)
+
+var errAPIKeyNotFound = errors.New("API key not found")
+
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scope     string    `json:"scope"`
+	Prefix    string    `json:"prefix"`              // first characters of the key, to tell keys apart
+	RateLimit int       `json:"rateLimit,omitempty"` // requests per minute, 0 for no limit
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+}
+
+func (k *APIKey) expired() bool {
+	return !k.ExpiresAt.IsZero() && time.Now().After(k.ExpiresAt)
+}
+
+// allows reports whether the key's scope covers r. Upload keys may only
+// send files (and check their quota), download keys may only read, and
+// admin keys may do anything a PIN token can.
+func (k *APIKey) allows(r *http.Request) bool {
+	switch k.Scope {
+	case scopeAdmin:
+		return true
+	case scopeDownload:
+		return (r.Method == http.MethodGet || r.Method == http.MethodHead) && !strings.HasPrefix(r.URL.Path, "/api/admin/")
+	case scopeUpload:
+		switch path := r.URL.Path; {
+		case path == "/api/upload", path == "/api/upload/raw", path == "/api/share", path == "/api/uploads", path == "/api/fetch", path == "/ipp/print":
+			return r.Method == http.MethodPost
+		case strings.HasPrefix(path, "/api/uploads/"):
+			return true
+		case strings.HasPrefix(path, "/api/upload/"):
+			return r.Method == http.MethodPut
+		case strings.HasPrefix(path, "/api/fetch/"):
+			return true
+		case path == "/api/quota":
+			return r.Method == http.MethodGet
+		}
+	}
+	return false
+}
+
+// storedAPIKey is how a key is saved: with the hash it is checked against.
+type storedAPIKey struct {
+	APIKey
+	Hash string `json:"hash"`
+}
+
+// rateWindow counts a key's requests in the current minute.
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+type APIKeyStore struct {
+	file string
+	keys []storedAPIKey
+	mu   sync.Mutex
+
+	windows map[string]*rateWindow
+}
+
+// apiKeys is always set; keys are only accepted with -pin.
+var apiKeys = &APIKeyStore{windows: map[string]*rateWindow{}}
+
+func NewAPIKeyStore(dir string) (*APIKeyStore, error) {
+	ks := &APIKeyStore{
+		file:    stateFile(dir, "apikeys.json"),
+		keys:    []storedAPIKey{},
+		windows: map[string]*rateWindow{},
+	}
+
+	data, err := os.ReadFile(ks.file)
+	if os.IsNotExist(err) {
+		return ks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &ks.keys); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys: %w", err)
+	}
+
+	return ks, nil
+}
+
+func (ks *APIKeyStore) save() error {
+	data, err := json.MarshalIndent(ks.keys, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal API keys: %w", err)
+	}
+
+	if err := writeStateFile(ks.file, data, 0600); err != nil {
+		return fmt.Errorf("failed to write API keys: %w", err)
+	}
+
+	return nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create adds a key and returns it along with the secret to hand out, which
+// can't be recovered later.
+func (ks *APIKeyStore) Create(name, scope string, rateLimit int, ttl time.Duration) (*APIKey, string, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, "", err
+	}
+	token := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	id, err := generateID(func(id string) bool {
+		for _, k := range ks.keys {
+			if k.ID == id {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := APIKey{
+		ID:        id,
+		Name:      name,
+		Scope:     scope,
+		Prefix:    token[:len(apiKeyPrefix)+6],
+		RateLimit: rateLimit,
+		CreatedAt: time.Now(),
+	}
+	if ttl > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(ttl)
+	}
+	ks.keys = append(ks.keys, storedAPIKey{APIKey: key, Hash: hashAPIKey(token)})
+	if err := ks.save(); err != nil {
+		ks.keys = ks.keys[:len(ks.keys)-1]
+		return nil, "", err
+	}
+	return &key, token, nil
+}
+
+func (ks *APIKeyStore) List() []APIKey {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	keys := make([]APIKey, len(ks.keys))
+	for i, k := range ks.keys {
+		keys[i] = k.APIKey
+	}
+	return keys
+}
+
+// Revoke deletes key id, so it is refused from then on.
+func (ks *APIKeyStore) Revoke(id string) (*APIKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for i, k := range ks.keys {
+		if k.ID != id {
+			continue
+		}
+		previous := ks.keys
+		ks.keys = append(ks.keys[:i:i], ks.keys[i+1:]...)
+		if err := ks.save(); err != nil {
+			ks.keys = previous
+			return nil, err
+		}
+		delete(ks.windows, id)
+		return &k.APIKey, nil
+	}
+	return nil, errAPIKeyNotFound
+}
+
+// Lookup returns the key token stands for, or nil if there is none.
+func (ks *APIKeyStore) Lookup(token string) *APIKey {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return nil
+	}
+	hash := hashAPIKey(token)
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	for _, k := range ks.keys {
+		if k.Hash == hash {
+			key := k.APIKey
+			return &key
+		}
+	}
+	return nil
+}
+
+// allowRequest counts a request against the key's rate limit, returning how
+// long to wait when the limit is used up for this minute.
+func (ks *APIKeyStore) allowRequest(key *APIKey) (bool, time.Duration) {
+	if key.RateLimit <= 0 {
+		return true, 0
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	now := time.Now()
+	win := ks.windows[key.ID]
+	if win == nil || now.Sub(win.start) >= time.Minute {
+		win = &rateWindow{start: now}
+		ks.windows[key.ID] = win
+	}
+	if win.count >= key.RateLimit {
+		return false, win.start.Add(time.Minute).Sub(now)
+	}
+	win.count++
+	return true, 0
+}
+
+// checkAPIKey authorizes r with the API key in token, writing the answer and
+// returning false when it is unknown, expired, out of scope or over its rate
+// limit.
+func checkAPIKey(w http.ResponseWriter, r *http.Request, token string) bool {
+	key := apiKeys.Lookup(token)
+	if key == nil || key.expired() {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="sync-it"`)
+		message := "Authentication required"
+		if key != nil {
+			message = "This API key has expired"
+		}
+		http.Error(w, message, http.StatusUnauthorized)
+		return false
+	}
+	if !key.allows(r) {
+		message := "This API key can only download files"
+		if key.Scope == scopeUpload {
+			message = "This API key can only upload files"
+		}
+		http.Error(w, message, http.StatusForbidden)
+		return false
+	}
+	if ok, wait := apiKeys.allowRequest(key); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		http.Error(w, "Rate limit reached for this API key, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// isAdminKey reports whether r carries an API key with the admin scope.
+func isAdminKey(r *http.Request) bool {
+	key := apiKeys.Lookup(requestToken(r))
+	return auth != nil && key != nil && key.Scope == scopeAdmin && !key.expired()
+}
+
+type apiKeyRequest struct {
+	Name           string `json:"name"`
+	Scope          string `json:"scope"`
+	RateLimit      int    `json:"rateLimit"`
+	ExpiresInHours int    `json:"expiresInHours"`
+}
+
+type APIKeyResponse struct {
+	APIKey
+	Key string `json:"key,omitempty"`
+}
+
+// handleAPIKeys lists the API keys: GET /api/admin/keys. POST creates one
+// from {"name", "scope", "rateLimit", "expiresInHours"}, answering with the
+// key itself, which is never shown again.
+func handleAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can manage API keys", http.StatusForbidden)
+		return
+	}
+	if auth == nil {
+		http.Error(w, "API keys need a PIN (-pin) to be required", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]APIKey{"keys": apiKeys.List()})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req apiKeyRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid API key request", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		http.Error(w, "API key name required (at most 64 characters)", http.StatusBadRequest)
+		return
+	}
+	if req.Scope != scopeUpload && req.Scope != scopeDownload && req.Scope != scopeAdmin {
+		http.Error(w, "Scope must be upload, download or admin", http.StatusBadRequest)
+		return
+	}
+	if req.RateLimit < 0 || req.ExpiresInHours < 0 {
+		http.Error(w, "Rate limit and expiry can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	key, token, err := apiKeys.Create(req.Name, req.Scope, req.RateLimit, time.Duration(req.ExpiresInHours)*time.Hour)
+	if err != nil {
+		slog.Error("Failed to create API key", "error", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("API key created", "id", key.ID, "name", key.Name, "scope", key.Scope, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(APIKeyResponse{APIKey: *key, Key: token})
+}
+
+// handleAPIKey revokes a key: DELETE /api/admin/keys/{id}.
+func handleAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can manage API keys", http.StatusForbidden)
+		return
+	}
+	if auth == nil {
+		http.Error(w, "API keys need a PIN (-pin) to be required", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/admin/keys/")
+	key, err := apiKeys.Revoke(id)
+	if errors.Is(err, errAPIKeyNotFound) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to revoke API key", "id", id, "error", err)
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("API key revoked", "id", key.ID, "name", key.Name, "client", clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var errNotPending = errors.New("file is not waiting for approval")
+
+// approveUploads holds guest uploads for an admin to approve, set by
+// -approve-uploads.
+var approveUploads bool
+
+// needsApproval reports whether an upload made by r waits for approval
+// before it is listed.
+func needsApproval(r *http.Request) bool {
+	return approveUploads && !isAdminRequest(r)
+}
+
+// ListPending returns the room's uploads waiting for approval, oldest first.
+func (fs *FileStorage) ListPending(room string) []FileMetadata {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	result := []FileMetadata{}
+	for _, meta := range fs.files {
+		if meta.Room == room && meta.Pending && !meta.deleted() {
+			result = append(result, meta)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UploadedAt.Before(result[j].UploadedAt)
+	})
+	return result
+}
+
+// ApproveFile lists a pending upload, announcing it as uploaded only now.
+func (fs *FileStorage) ApproveFile(id string) (*FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for i := range fs.files {
+		meta := &fs.files[i]
+		if meta.ID != id || !meta.Pending || meta.deleted() {
+			continue
+		}
+		meta.Pending = false
+		approved := *meta
+		if err := fs.commit([]FileMetadata{approved}, nil); err != nil {
+			meta.Pending = true
+			return nil, err
+		}
+		events.Publish(Event{Type: EventFileUploaded, File: &approved})
+		return &approved, nil
+	}
+	return nil, errNotPending
+}
+
+// RejectFile removes a pending upload for good, skipping the trash.
+func (fs *FileStorage) RejectFile(id string) (*FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	for i, meta := range fs.files {
+		if meta.ID != id || !meta.Pending || meta.deleted() {
+			continue
+		}
+		previous := fs.files
+		fs.files = append(fs.files[:i:i], fs.files[i+1:]...)
+		if err := fs.commit(nil, []string{id}); err != nil {
+			fs.files = previous
+			return nil, err
+		}
+		fs.releaseBlobs([]FileMetadata{meta})
+		return &meta, nil
+	}
+	return nil, errNotPending
+}
+
+type PendingResponse struct {
+	Files []FileMetadata `json:"files"`
+}
+
+// handlePending lists the uploads waiting for approval: GET /api/pending.
+func handlePending(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can review uploads", http.StatusForbidden)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PendingResponse{Files: storage.ListPending(roomCode(room))})
+}
+
+// handleApproval approves (POST /api/pending/{id}/approve) or rejects
+// (POST /api/pending/{id}/reject) a pending upload.
+func handleApproval(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/pending/"), "/")
+	if id == "" || action != "approve" && action != "reject" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can review uploads", http.StatusForbidden)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	if meta, _, err := storage.GetPendingFile(id); err != nil || !inRoom(meta, room) {
+		http.Error(w, "No such upload waiting for approval", http.StatusNotFound)
+		return
+	}
+
+	if action == "reject" {
+		if _, err := storage.RejectFile(id); errors.Is(err, errNotPending) {
+			http.Error(w, "No such upload waiting for approval", http.StatusNotFound)
+			return
+		} else if err != nil {
+			slog.Error("Failed to reject upload", "id", id, "error", err)
+			http.Error(w, "Failed to reject upload", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Upload rejected", "id", id, "client", clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	meta, err := storage.ApproveFile(id)
+	if errors.Is(err, errNotPending) {
+		http.Error(w, "No such upload waiting for approval", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to approve upload", "id", id, "error", err)
+		http.Error(w, "Failed to approve upload", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Upload approved", "id", id, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newShareResponse(meta))
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNotArchived = errors.New("file not in archive")
+
+// ArchivedFile is an expired file kept in the archive.
+type ArchivedFile struct {
+	FileMetadata
+	ArchivedAt time.Time `json:"archivedAt"`
+}
+
+type ArchiveResponse struct {
+	Files []ArchivedFile `json:"files"`
+}
+
+// Archive keeps the files that expire in a directory of their own instead
+// of letting them be removed: their blobs, as stored, laid out as in -dir,
+// and an archive.json describing them. Archived files are no longer listed
+// or served; only an admin can browse, download and restore them.
+type Archive struct {
+	dir       string
+	retention time.Duration // 0 keeps archived files for good
+	blobs     dirBlobStore
+
+	mu    sync.Mutex
+	files []ArchivedFile
+}
+
+// archive is nil unless -archive-dir is set.
+var archive *Archive
+
+// OpenArchive loads the archive in dir, creating the directory if needed.
+func OpenArchive(dir string, retention time.Duration) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	a := &Archive{dir: dir, retention: retention, blobs: dirBlobStore{dir: dir}, files: []ArchivedFile{}}
+	data, err := os.ReadFile(a.indexPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.files); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", a.indexPath(), err)
+	}
+	return a, nil
+}
+
+func (a *Archive) indexPath() string {
+	return filepath.Join(a.dir, "archive.json")
+}
+
+// save writes archive.json. Must be called with a.mu held.
+func (a *Archive) save() error {
+	data, err := json.MarshalIndent(a.files, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal archive: %w", err)
+	}
+	return writeFileAtomic(a.indexPath(), data, 0644)
+}
+
+// Holds reports whether file id has been archived, and so may be removed
+// from the store. A nil archive holds everything, as nothing needs keeping.
+func (a *Archive) Holds(id string) bool {
+	if a == nil {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.find(id) >= 0
+}
+
+func (a *Archive) find(id string) int {
+	for i := range a.files {
+		if a.files[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Collect copies the files that have expired into the archive, ahead of
+// DeleteExpiredFiles removing them, and drops archived files older than
+// the retention. It returns how many files were archived. Files it fails
+// to copy stay in the store, expired, until a later pass manages to.
+func (a *Archive) Collect() (int, error) {
+	now := time.Now()
+	archived := 0
+	var firstErr error
+	for _, meta := range storage.allFiles() {
+		if meta.deleted() || !now.After(meta.ExpiresAt) || a.Holds(meta.ID) {
+			continue
+		}
+		if err := a.copyBlob(meta.blobName()); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to archive %s: %w", meta.ID, err)
+			}
+			continue
+		}
+
+		meta.Renditions = nil
+		a.mu.Lock()
+		a.files = append(a.files, ArchivedFile{FileMetadata: meta, ArchivedAt: now})
+		err := a.save()
+		a.mu.Unlock()
+		if err != nil {
+			return archived, err
+		}
+		archived++
+		slog.Info("File archived", "id", meta.ID, "name", meta.Name)
+	}
+
+	if a.retention > 0 {
+		a.mu.Lock()
+		var old []string
+		for _, f := range a.files {
+			if now.Sub(f.ArchivedAt) > a.retention {
+				old = append(old, f.ID)
+			}
+		}
+		a.mu.Unlock()
+		for _, id := range old {
+			if err := a.Remove(id); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return archived, firstErr
+}
+
+// copyBlob copies blob, as stored, into the archive unless it is there
+// already, as when another archived file has the same contents.
+func (a *Archive) copyBlob(blob string) error {
+	if _, err := os.Stat(a.blobs.LocalPath(blob)); err == nil {
+		return nil
+	}
+
+	done := storage.BeginRead(blob)
+	defer done()
+	src, err := storage.blobs.Open(blob)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := a.blobs.Create(blob)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Abort()
+		return err
+	}
+	return dst.Close()
+}
+
+// List returns the archived files, most recently archived first.
+func (a *Archive) List() []ArchivedFile {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	result := append([]ArchivedFile{}, a.files...)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ArchivedAt.After(result[j].ArchivedAt)
+	})
+	return result
+}
+
+// Open returns archived file id and its contents, decompressed and
+// decrypted as the store would.
+func (a *Archive) Open(id string) (*ArchivedFile, io.ReadCloser, error) {
+	a.mu.Lock()
+	i := a.find(id)
+	if i < 0 {
+		a.mu.Unlock()
+		return nil, nil, errNotArchived
+	}
+	f := a.files[i]
+	a.mu.Unlock()
+
+	r, err := openDecoded(a.blobs, f.blobName(), f.Compression)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &f, r, nil
+}
+
+// Remove drops file id from the archive, and its blob unless another
+// archived file shares it.
+func (a *Archive) Remove(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i := a.find(id)
+	if i < 0 {
+		return errNotArchived
+	}
+	blob := a.files[i].blobName()
+	a.files = append(a.files[:i], a.files[i+1:]...)
+	if err := a.save(); err != nil {
+		return err
+	}
+	for _, f := range a.files {
+		if f.blobName() == blob {
+			return nil
+		}
+	}
+	if err := a.blobs.Remove(blob); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Restore puts archived file id back in the store as a new upload that
+// expires after expiration, and removes it from the archive.
+func (a *Archive) Restore(id string, expiration time.Duration) (*FileMetadata, error) {
+	f, r, err := a.Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	meta, err := storage.SaveNewFile(FileMetadata{Name: f.Name, Room: f.Room, Folder: f.Folder, Uploader: f.Uploader, Source: f.Source}, r, expiration)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Remove(id); err != nil {
+		slog.Warn("Failed to remove restored file from archive", "id", id, "error", err)
+	}
+	return meta, nil
+}
+
+// handleArchive serves the archive to admins: GET /api/admin/archive lists
+// it, GET /api/admin/archive/{id} downloads a file, POST
+// /api/admin/archive/{id}/restore puts it back in the store and DELETE
+// /api/admin/archive/{id} removes it for good.
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	if archive == nil {
+		http.Error(w, "No archive directory configured", http.StatusNotFound)
+		return
+	}
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can browse the archive", http.StatusForbidden)
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/archive"), "/"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ArchiveResponse{Files: archive.List()})
+	case id != "" && action == "" && r.Method == http.MethodGet:
+		serveArchived(w, r, id)
+	case id != "" && action == "" && r.Method == http.MethodDelete:
+		err := archive.Remove(id)
+		if errors.Is(err, errNotArchived) {
+			http.Error(w, "File not found in archive", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to remove archived file", "id", id, "error", err)
+			http.Error(w, "Failed to remove archived file", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Archived file removed", "id", id, "client", clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	case id != "" && action == "restore" && r.Method == http.MethodPost:
+		if rejectIfMaintenance(w) {
+			return
+		}
+		meta, err := archive.Restore(id, defaultExpiration)
+		if errors.Is(err, errNotArchived) {
+			http.Error(w, "File not found in archive", http.StatusNotFound)
+			return
+		}
+		if rejectStorageFull(w, err) {
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to restore archived file", "id", id, "error", err)
+			http.Error(w, "Failed to restore archived file", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Archived file restored", "id", id, "newId", meta.ID, "client", clientIP(r))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newShareResponse(meta))
+	case action != "" && action != "restore":
+		http.NotFound(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func serveArchived(w http.ResponseWriter, r *http.Request, id string) {
+	f, body, err := archive.Open(id)
+	if errors.Is(err, errNotArchived) {
+		http.Error(w, "File not found in archive", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to open archived file", "id", id, "error", err)
+		http.Error(w, "Failed to open archived file", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": f.Name}))
+	w.Header().Set("Content-Length", strconv.FormatInt(f.Size, 10))
+	if _, err := io.Copy(w, body); err != nil && r.Context().Err() == nil {
+		slog.Error("Failed to send archived file", "id", id, "error", err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With -pin set, API calls need a bearer token from /api/bootstrap, which
+// hands one out in exchange for the PIN. Tokens are signed with a key kept
+// in the uploads directory, so they survive restarts and are accepted by
+// every cluster node.
+const (
+	authKeyFile       = "auth.key"
+	authTokenTTL      = 12 * time.Hour
+	authMaxFailures   = 5
+	authFailureWindow = 5 * time.Minute
+)
+
+type Authenticator struct {
+	pin string
+	key []byte
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+}
+
+// auth is nil when no PIN is configured.
+var auth *Authenticator
+
+type BootstrapResponse struct {
+	Required  bool      `json:"required"`
+	Token     string    `json:"token,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt,omitzero"`
+}
+
+func NewAuthenticator(dir, pin string) (*Authenticator, error) {
+	key, err := loadOrCreateAuthKey(stateFile(dir, authKeyFile))
+	if err != nil {
+		return nil, err
+	}
+	return &Authenticator{pin: pin, key: key, failures: map[string][]time.Time{}}, nil
+}
+
+func loadOrCreateAuthKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read auth key: %w", err)
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return key, nil
+	}
+	// O_EXCL so cluster peers starting together agree on one key
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return loadOrCreateAuthKey(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create auth key: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(key); err != nil {
+		return nil, fmt.Errorf("failed to write auth key: %w", err)
+	}
+	return key, nil
+}
+
+// IssueToken returns a token valid until the returned time. The token is the
+// expiry and its HMAC, so verifying it needs no server-side state.
+func (a *Authenticator) IssueToken() (string, time.Time) {
+	expires := time.Now().Add(authTokenTTL).Truncate(time.Second)
+	payload := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(a.sign(payload)), expires
+}
+
+func (a *Authenticator) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (a *Authenticator) ValidToken(token string) bool {
+	payloadPart, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	enc := base64.RawURLEncoding
+	payload, err := enc.DecodeString(payloadPart)
+	if err != nil || len(payload) != 8 {
+		return false
+	}
+	sig, err := enc.DecodeString(sigPart)
+	if err != nil || !hmac.Equal(sig, a.sign(payload)) {
+		return false
+	}
+	return time.Now().Unix() < int64(binary.BigEndian.Uint64(payload))
+}
+
+// allowAttempt reports whether client may try another PIN.
+func (a *Authenticator) allowAttempt(client string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	recent := a.failures[client][:0]
+	for _, t := range a.failures[client] {
+		if time.Since(t) < authFailureWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(a.failures, client)
+	} else {
+		a.failures[client] = recent
+	}
+	return len(recent) < authMaxFailures
+}
+
+func (a *Authenticator) recordFailure(client string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.failures[client] = append(a.failures[client], time.Now())
+}
+
+func (a *Authenticator) checkPIN(pin string) bool {
+	return subtle.ConstantTimeCompare([]byte(pin), []byte(a.pin)) == 1
+}
+
+// requestToken returns the bearer token from the Authorization header.
+func requestToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// authExempt reports whether path is served without a token: the UI itself,
+// the bootstrap endpoint, and the links that are meant to be shared.
+func authExempt(path string) bool {
+	if !strings.HasPrefix(path, "/api/") && !strings.HasPrefix(path, "/ipp/") {
+		return true
+	}
+	for _, prefix := range []string{"/api/bootstrap", "/api/info", "/api/download/", "/api/thumbnail/", "/api/push/key"} {
+		if path == prefix || strings.HasPrefix(path, prefix) && strings.HasSuffix(prefix, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// withAuth rejects API requests without a valid token or API key when a PIN
+// is set.
+func withAuth(h http.Handler) http.Handler {
+	if auth == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := requestToken(r)
+		if !authExempt(r.URL.Path) && !auth.ValidToken(token) && !checkAPIKey(w, r, token) {
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// handleBootstrap exchanges the PIN for a token: POST /api/bootstrap with
+// {"pin": "..."}. A GET reports whether a PIN is required at all.
+func handleBootstrap(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BootstrapResponse{Required: auth != nil})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if auth == nil {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BootstrapResponse{Required: false})
+		return
+	}
+
+	client := clientIP(r)
+	if !auth.allowAttempt(client) {
+		w.Header().Set("Retry-After", fmt.Sprint(int(authFailureWindow.Seconds())))
+		http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var req struct {
+		PIN string `json:"pin"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !auth.checkPIN(req.PIN) {
+		auth.recordFailure(client)
+		slog.Warn("Rejected PIN", "client", client)
+		http.Error(w, "Wrong PIN", http.StatusForbidden)
+		return
+	}
+
+	token, expires := auth.IssueToken()
+	slog.Info("Issued API token", "client", client, "expiresAt", expires)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BootstrapResponse{Required: true, Token: token, ExpiresAt: expires})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BlobStore holds the contents of uploaded files by name; metadata stays in
+// FileStorage.
+type BlobStore interface {
+	// Create starts writing name. The blob is committed by Close, or
+	// discarded by Abort if writing fails part way.
+	Create(name string) (BlobWriter, error)
+	Open(name string) (io.ReadCloser, error)
+	Remove(name string) error
+}
+
+type BlobWriter interface {
+	io.WriteCloser
+	Abort()
+}
+
+// localBlobStore is implemented by stores that keep blobs as plain files, so
+// they can be served with http.ServeFile and handed to external commands.
+type localBlobStore interface {
+	LocalPath(name string) string
+}
+
+// blobRenamer is implemented by stores that can move a blob without
+// copying it through the server.
+type blobRenamer interface {
+	Rename(from, to string) error
+}
+
+// dirBlobStore keeps blobs as files in a directory, fanned out into two
+// levels of subdirectories by the first four hex digits of their name
+// (ab/cd/sha256-abcd...), so no directory grows large enough to make
+// listings slow. Renditions land next to the file they belong to.
+type dirBlobStore struct {
+	dir string
+}
+
+// partialSuffix marks a blob that is still being written. dirBlobStore only
+// renames it to its name once it is complete, so a blob is never seen
+// half-written, and Reconcile removes any a crash left behind.
+const partialSuffix = ".partial"
+
+// blobShard returns the subdirectory blob name (or its partial file) belongs
+// in, or "" for names that aren't blobs, which stay at the top level.
+func blobShard(name string) string {
+	name = strings.TrimSuffix(name, partialSuffix)
+	if !isBlobName(name) {
+		return ""
+	}
+	digits := strings.TrimPrefix(strings.TrimPrefix(name, "sha256-"), "upload-")
+	return filepath.Join(digits[:2], digits[2:4])
+}
+
+func isShardDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// List returns the names of all blobs in the store.
+func (d dirBlobStore) List() ([]string, error) {
+	return d.list(isBlobName)
+}
+
+// Partials returns the names, suffix included, of the partial files of
+// blobs being written or abandoned half-way.
+func (d dirBlobStore) Partials() ([]string, error) {
+	return d.list(isPartialBlob)
+}
+
+func (d dirBlobStore) list(match func(name string) bool) ([]string, error) {
+	var names []string
+	top, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, first := range top {
+		if !first.IsDir() || !isShardDir(first.Name()) {
+			continue
+		}
+		second, err := os.ReadDir(filepath.Join(d.dir, first.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, shard := range second {
+			if !shard.IsDir() || !isShardDir(shard.Name()) {
+				continue
+			}
+			entries, err := os.ReadDir(filepath.Join(d.dir, first.Name(), shard.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.Type().IsRegular() && match(e.Name()) {
+					names = append(names, e.Name())
+				}
+			}
+		}
+	}
+	return names, nil
+}
+
+// migrateFlat moves blobs left at the top level by versions without
+// fanout into their subdirectories.
+func (d dirBlobStore) migrateFlat() (int, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isBlobName(e.Name()) {
+			continue
+		}
+		path := d.LocalPath(e.Name())
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(filepath.Join(d.dir, e.Name()), path); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// dirBlobWriter writes a blob to its partial file.
+type dirBlobWriter struct {
+	*os.File
+	path string
+}
+
+// Close syncs the blob to disk and only then renames it into place, so
+// metadata never outlives the contents it describes and readers never see
+// them half-written.
+func (w dirBlobWriter) Close() error {
+	err := w.File.Sync()
+	if closeErr := w.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.File.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.File.Name())
+	}
+	return err
+}
+
+func (w dirBlobWriter) Abort() {
+	w.File.Close()
+	os.Remove(w.File.Name())
+}
+
+func (d dirBlobStore) LocalPath(name string) string {
+	return filepath.Join(d.dir, blobShard(name), name)
+}
+
+// Create always starts a new file, which replaces any existing blob of the
+// same name when it is complete rather than being written through it: that
+// may be a hard link to a file imported from elsewhere on the host.
+func (d dirBlobStore) Create(name string) (BlobWriter, error) {
+	path := d.LocalPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	partial := path + partialSuffix
+	if err := os.Remove(partial); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return dirBlobWriter{File: f, path: path}, nil
+}
+
+func (d dirBlobStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(d.LocalPath(name))
+}
+
+func (d dirBlobStore) Rename(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(d.LocalPath(to)), 0755); err != nil {
+		return err
+	}
+	return os.Rename(d.LocalPath(from), d.LocalPath(to))
+}
+
+// Remove leaves the emptied subdirectory behind: there are at most 65536 of
+// them, and removing one could race with a blob being created in it.
+func (d dirBlobStore) Remove(name string) error {
+	return os.Remove(d.LocalPath(name))
+}
@@ -0,0 +1,100 @@
+//go:build bolt
+
+package main
+
+// Adds -meta bolt, a bbolt key/value file with one JSON value per file ID.
+// Add the package to go.mod first:
+//
+//	go get go.etcd.io/bbolt
+//	go build -tags bolt -o sync-it
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltFilesBucket = []byte("files")
+
+type boltMetadataDB struct {
+	db *bolt.DB
+}
+
+func init() {
+	metadataBackends["bolt"] = openBoltMetadata
+}
+
+func openBoltMetadata(path string) (metadataDB, error) {
+	// The timeout turns a second instance on the same file into an error
+	// instead of a hang
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltFilesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	return &boltMetadataDB{db: db}, nil
+}
+
+func (m *boltMetadataDB) Load() ([]FileMetadata, error) {
+	files := []FileMetadata{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltFilesBucket).ForEach(func(k, v []byte) error {
+			var meta FileMetadata
+			if err := json.Unmarshal(v, &meta); err != nil {
+				return fmt.Errorf("invalid metadata for %s: %w", k, err)
+			}
+			files = append(files, meta)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are IDs, so restore upload order
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].UploadedAt.Before(files[j].UploadedAt)
+	})
+	return files, nil
+}
+
+func (m *boltMetadataDB) Apply(put []FileMetadata, removed []string) error {
+	if len(put) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	return m.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltFilesBucket)
+		for _, meta := range put {
+			data, err := json.Marshal(meta)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(meta.ID), data); err != nil {
+				return fmt.Errorf("failed to write metadata: %w", err)
+			}
+		}
+		for _, id := range removed {
+			if err := b.Delete([]byte(id)); err != nil {
+				return fmt.Errorf("failed to delete metadata: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func (m *boltMetadataDB) Close() error {
+	return m.db.Close()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// FindByHash returns the newest file in room whose contents have the given
+// SHA-256 and can be downloaded.
+func (fs *FileStorage) FindByHash(room, digest string) (*FileMetadata, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	now := time.Now()
+	var found *FileMetadata
+	for i := range fs.files {
+		meta := &fs.files[i]
+		if meta.SHA256 != digest || meta.Room != room || !meta.listed() || meta.Quarantined || meta.expired(now) || meta.embargoed(now) {
+			continue
+		}
+		if found == nil || meta.UploadedAt.After(found.UploadedAt) {
+			found = meta
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("file not found")
+	}
+	meta := *found
+	return &meta, nil
+}
+
+// handleByHash downloads a file by the SHA-256 of its contents:
+// GET /api/by-hash/{sha256}, for scripts that know the digest but not the
+// current ID. When several files share the contents, the newest is served.
+func handleByHash(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	digest := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/api/by-hash/"))
+	if _, err := hex.DecodeString(digest); err != nil || len(digest) != 64 {
+		http.Error(w, "Expected a SHA-256 as 64 hex digits", http.StatusBadRequest)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	meta, err := storage.FindByHash(roomCode(room), digest)
+	if err != nil {
+		fileNotFound(w, r)
+		return
+	}
+	serveDownload(w, r, meta.ID)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// contentSHA256Header carries the hex SHA-256 of an uploaded file. Clients
+// that know it up front send it as a header. Ones streaming a file they
+// haven't hashed yet name it in a Trailer header and send it as an HTTP
+// trailer after the body, or, in a multipart upload, as a sha256 field after
+// the file, so they needn't read the file twice or buffer it.
+const contentSHA256Header = "X-Content-SHA256"
+
+// requestChecksum returns a func reporting the SHA-256 r declares for its
+// upload, or nil when it declares none. A trailer is only known once the
+// body has been read, so the func must not be called before then. A
+// malformed header or field is answered with 400 and false.
+func requestChecksum(w http.ResponseWriter, r *http.Request) (func() string, bool) {
+	declared := r.Header.Get(contentSHA256Header)
+	if declared == "" {
+		declared = r.FormValue("sha256")
+	}
+	if declared != "" {
+		declared = strings.ToLower(strings.TrimSpace(declared))
+		if !isSHA256(declared) {
+			http.Error(w, contentSHA256Header+" must be a hex SHA-256", http.StatusBadRequest)
+			return nil, false
+		}
+		return func() string { return declared }, true
+	}
+	if _, ok := r.Trailer[http.CanonicalHeaderKey(contentSHA256Header)]; ok && r.MultipartForm == nil {
+		return func() string { return strings.ToLower(strings.TrimSpace(r.Trailer.Get(contentSHA256Header))) }, true
+	}
+	return nil, true
+}
+
+// checksumReader hashes an upload as it is read and fails the final read,
+// and so the upload, when the digest isn't the one declared.
+type checksumReader struct {
+	r    io.Reader
+	want func() string
+	hash hash.Hash
+}
+
+func verifyChecksum(r io.Reader, want func() string) io.Reader {
+	return &checksumReader{r: r, want: want, hash: sha256.New()}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	if err != io.EOF {
+		return n, err
+	}
+	switch want, sum := c.want(), hex.EncodeToString(c.hash.Sum(nil)); {
+	case want == "":
+		return n, errExpectMismatch{"no " + contentSHA256Header + " trailer was sent"}
+	case !isSHA256(want):
+		return n, errExpectMismatch{contentSHA256Header + " trailer isn't a hex SHA-256"}
+	case sum != want:
+		return n, errExpectMismatch{"SHA-256 is " + sum + ", expected " + want}
+	}
+	return n, err
+}
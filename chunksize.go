@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The chunk size of an upload can change while it runs. The server times
+// every chunk it receives and offers the size that would take about
+// chunkTargetDuration to send: large on a fast network, where each request's
+// overhead adds up, and small on a slow one, where a dropped connection
+// would otherwise throw away minutes of progress. When the host is short of
+// memory the offer shrinks too, as a reverse proxy in front, and the browser
+// sending it, may hold a whole chunk in memory.
+const (
+	chunkTargetDuration  = 5 * time.Second
+	chunkMemoryShare     = 64 // offer at most this fraction of available memory
+	chunkLockFile        = "lock"
+	preferredChunkHeader = "X-Preferred-Chunk-Size"
+)
+
+// ChunkSegment is a run of chunks of one size, from chunk FirstChunk at
+// byte Offset on. An upload whose chunk size was renegotiated has one per
+// size it used, in order.
+type ChunkSegment struct {
+	FirstChunk int   `json:"firstChunk"`
+	Offset     int64 `json:"offset"`
+	ChunkSize  int64 `json:"chunkSize"`
+}
+
+// segments returns the upload's chunk layout.
+func (u *ChunkedUpload) segments() []ChunkSegment {
+	if len(u.Segments) == 0 {
+		return []ChunkSegment{{ChunkSize: u.ChunkSize}}
+	}
+	return u.Segments
+}
+
+// chunkSpan returns where in the file chunk n starts and how many bytes it
+// must contain.
+func (u *ChunkedUpload) chunkSpan(n int) (offset, length int64) {
+	segments := u.segments()
+	seg := segments[0]
+	for _, s := range segments {
+		if s.FirstChunk <= n {
+			seg = s
+		}
+	}
+	offset = seg.Offset + int64(n-seg.FirstChunk)*seg.ChunkSize
+	return offset, min(seg.ChunkSize, u.Size-offset)
+}
+
+// resize switches the upload to chunks of size from chunk first, which must
+// be one of its chunks, to the end of the file.
+func (u *ChunkedUpload) resize(first int, size int64) {
+	offset, _ := u.chunkSpan(first)
+	segments := []ChunkSegment{}
+	for _, s := range u.segments() {
+		if s.FirstChunk < first {
+			segments = append(segments, s)
+		}
+	}
+	u.Segments = append(segments, ChunkSegment{FirstChunk: first, Offset: offset, ChunkSize: size})
+	u.ChunkSize = size
+	u.TotalChunks = first + int((u.Size-offset+size-1)/size)
+}
+
+// chunkRates tracks how fast each upload's chunks arrive, in bytes a second,
+// smoothed so one slow chunk doesn't swing the offer.
+type chunkRates struct {
+	mu    sync.Mutex
+	rates map[string]float64
+}
+
+var chunkThroughput = &chunkRates{rates: map[string]float64{}}
+
+func (c *chunkRates) observe(id string, bytes int64, took time.Duration) {
+	if took <= 0 || bytes < minChunkSize {
+		// The last chunk may be tiny, and says little about the link
+		return
+	}
+	rate := float64(bytes) / took.Seconds()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev, ok := c.rates[id]; ok {
+		rate = 0.7*prev + 0.3*rate
+	}
+	c.rates[id] = rate
+}
+
+func (c *chunkRates) rate(id string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rates[id]
+}
+
+func (c *chunkRates) forget(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.rates, id)
+}
+
+// preferredChunkSize is the chunk size the server would like upload id to
+// use from now on: a power of two from minChunkSize to maxChunkSize, so
+// offers only change when the rate does by half or more.
+func preferredChunkSize(id string) int64 {
+	want := int64(defaultChunkSize)
+	if rate := chunkThroughput.rate(id); rate > 0 {
+		want = int64(rate * chunkTargetDuration.Seconds())
+	}
+	if avail, err := availableMemory(); err == nil {
+		want = min(want, int64(avail/chunkMemoryShare))
+	}
+
+	size := int64(minChunkSize)
+	for size*2 <= want && size*2 <= maxChunkSize {
+		size *= 2
+	}
+	return size
+}
+
+// saveChunkedUpload replaces the upload's session file.
+func saveChunkedUpload(u *ChunkedUpload) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(chunkUploadPath(u.ID, chunkSessionFile), data, 0644)
+}
+
+// lockChunkedUpload serialises changes to the upload's chunk layout with
+// chunks being stored, so no chunk sized for the old layout lands in the new
+// one, across cluster nodes too.
+func lockChunkedUpload(id string) (func(), error) {
+	return lockFile(chunkUploadPath(id, chunkLockFile))
+}
+
+// handleChunkResize renegotiates the chunk size: PATCH /api/uploads/{id}
+// with {"chunkSize": n}, or 0 for the size the server prefers. The new size
+// applies from the first chunk not yet received; chunks already received
+// after that are dropped, having been cut for the old size, and must be
+// sent again. The response is the upload's status with its new layout.
+func handleChunkResize(w http.ResponseWriter, r *http.Request, u *ChunkedUpload) {
+	var req struct {
+		ChunkSize int64 `json:"chunkSize"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil || req.ChunkSize < 0 {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	size := req.ChunkSize
+	if size == 0 {
+		size = preferredChunkSize(u.ID)
+	}
+	size = min(max(size, minChunkSize), maxChunkSize)
+
+	unlock, err := lockChunkedUpload(u.ID)
+	if err != nil {
+		slog.Error("Failed to lock chunked upload", "id", u.ID, "error", err)
+		http.Error(w, "Failed to change chunk size", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+
+	// Reloaded under the lock, as it may have changed or been completed
+	u, err = loadChunkedUpload(u.ID)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	received := receivedChunks(u)
+	first := 0
+	for first < len(received) && received[first] == first {
+		first++
+	}
+	if first < u.TotalChunks && size != u.ChunkSize {
+		for _, n := range received[first:] {
+			os.Remove(chunkUploadPath(u.ID, strconv.Itoa(n)))
+		}
+		from := u.ChunkSize
+		u.resize(first, size)
+		if err := saveChunkedUpload(u); err != nil {
+			slog.Error("Failed to change chunk size", "id", u.ID, "error", err)
+			http.Error(w, "Failed to change chunk size", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Chunk size changed", "id", u.ID, "from", from, "to", size, "fromChunk", first, "dropped", len(received)-first)
+	}
+
+	writeChunkedStatus(w, u, http.StatusOK)
+}
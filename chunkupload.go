@@ -0,0 +1,519 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Chunked uploads let the web UI send large files as a series of small,
+// individually checksummed requests, so a flaky mobile connection only costs
+// the chunk in flight. State lives entirely in a staging directory per
+// upload, which survives restarts and is visible to every cluster node.
+const (
+	chunkUploadDir     = ".chunks"
+	chunkUploadMaxAge  = 24 * time.Hour
+	chunkSessionFile   = "session.json"
+	chunkChecksumField = "X-Chunk-SHA256"
+)
+
+type ChunkedUpload struct {
+	ID              string            `json:"id"`
+	Name            string            `json:"name"`
+	Size            int64             `json:"size"`
+	ChunkSize       int64             `json:"chunkSize"`
+	TotalChunks     int               `json:"totalChunks"`
+	Segments        []ChunkSegment    `json:"segments,omitempty"` // set once the chunk size changes
+	ExpirationHours int               `json:"expirationHours,omitempty"`
+	Room            string            `json:"room,omitempty"`
+	Folder          string            `json:"folder,omitempty"`
+	Persist         bool              `json:"persistAcrossRestart,omitempty"`
+	Tags            []string          `json:"tags,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	Expect          string            `json:"expect,omitempty"`
+	Pending         bool              `json:"pending,omitempty"`
+	AvailableFrom   time.Time         `json:"availableFrom,omitzero"`
+	CreatedAt       time.Time         `json:"createdAt"`
+}
+
+// chunkLength is the exact number of bytes chunk n must contain.
+func (u *ChunkedUpload) chunkLength(n int) int64 {
+	_, length := u.chunkSpan(n)
+	return length
+}
+
+type ChunkedUploadStatus struct {
+	ChunkedUpload
+	Received           []int `json:"received"`
+	PreferredChunkSize int64 `json:"preferredChunkSize"`
+}
+
+type chunkedUploadRequest struct {
+	Name            string            `json:"name"`
+	Size            int64             `json:"size"`
+	ChunkSize       int64             `json:"chunkSize"`
+	ExpirationHours int               `json:"expirationHours"`
+	Path            string            `json:"path"`
+	Persist         bool              `json:"persistAcrossRestart"`
+	Tags            []string          `json:"tags"`
+	Metadata        map[string]string `json:"metadata"`
+	Expect          string            `json:"expect"`
+	AvailableFrom   time.Time         `json:"availableFrom"`
+}
+
+func chunkUploadPath(id string, parts ...string) string {
+	return filepath.Join(append([]string{uploadsDir, chunkUploadDir, id}, parts...)...)
+}
+
+func loadChunkedUpload(id string) (*ChunkedUpload, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, os.ErrNotExist
+	}
+	data, err := os.ReadFile(chunkUploadPath(id, chunkSessionFile))
+	if err != nil {
+		return nil, err
+	}
+	var u ChunkedUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// receivedChunks lists the indexes of chunks already stored, in order.
+func receivedChunks(u *ChunkedUpload) []int {
+	entries, _ := os.ReadDir(chunkUploadPath(u.ID))
+	received := []int{}
+	for _, e := range entries {
+		if n, err := strconv.Atoi(e.Name()); err == nil && n >= 0 && n < u.TotalChunks {
+			received = append(received, n)
+		}
+	}
+	sort.Ints(received)
+	return received
+}
+
+// chunkReader streams the stored chunks of an upload in order.
+type chunkReader struct {
+	upload *ChunkedUpload
+	next   int
+	cur    io.ReadCloser
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.next >= r.upload.TotalChunks {
+				return 0, io.EOF
+			}
+			f, err := os.Open(chunkUploadPath(r.upload.ID, strconv.Itoa(r.next)))
+			if err != nil {
+				return 0, err
+			}
+			if r.cur, err = decorateReader(f); err != nil {
+				f.Close()
+				return 0, err
+			}
+			r.next++
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() {
+	if r.cur != nil {
+		r.cur.Close()
+	}
+}
+
+// CleanStaleChunkedUploads removes uploads that were started but not
+// completed within chunkUploadMaxAge, returning how many it removed and the
+// bytes that freed.
+func CleanStaleChunkedUploads() (removed int, freed int64) {
+	entries, err := os.ReadDir(filepath.Join(uploadsDir, chunkUploadDir))
+	if err != nil {
+		return 0, 0
+	}
+	for _, e := range entries {
+		info, err := os.Stat(chunkUploadPath(e.Name(), chunkSessionFile))
+		if err != nil {
+			info, err = os.Stat(chunkUploadPath(e.Name(), chunkSessionFile+".assembling"))
+		}
+		if err == nil && time.Since(info.ModTime()) < chunkUploadMaxAge {
+			continue
+		}
+		size := dirSize(chunkUploadPath(e.Name()))
+		if err := os.RemoveAll(chunkUploadPath(e.Name())); err != nil {
+			slog.Warn("Failed to remove stale chunked upload", "id", e.Name(), "error", err)
+			continue
+		}
+		chunkThroughput.forget(e.Name())
+		slog.Info("Removed stale chunked upload", "id", e.Name())
+		removed++
+		freed += size
+	}
+	return removed, freed
+}
+
+// dirSize totals the sizes of the files under dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+func writeChunkedStatus(w http.ResponseWriter, u *ChunkedUpload, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ChunkedUploadStatus{ChunkedUpload: *u, Received: receivedChunks(u), PreferredChunkSize: preferredChunkSize(u.ID)})
+}
+
+// handleChunkedUploads starts an upload: POST /api/uploads with the file's
+// name and size and an optional preferred chunk size. The response carries
+// the chunk size the server settled on, by default the one it prefers.
+func handleChunkedUploads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+	if inMemory {
+		// Chunks are staged on disk
+		http.Error(w, "Chunked uploads aren't available with in-memory storage", http.StatusNotImplemented)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	var req chunkedUploadRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" || req.Size < 0 {
+		http.Error(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
+
+	folder, err := cleanFolder(req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metadata, err := validateMetadata(req.Metadata)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := checkAvailableFrom(req.AvailableFrom); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rejectTooLarge(w, checkUploadSize(req.Size)) || rejectOverQuota(w, requestAllowance(r).check(req.Size)) {
+		return
+	}
+	evictor.MakeRoom(req.Size)
+
+	var expect string
+	if req.Expect != "" {
+		e, ok := lookupExpectation(w, roomCode(room), req.Expect)
+		if !ok {
+			return
+		}
+		if e.Size > 0 && e.Size != req.Size {
+			http.Error(w, fmt.Sprintf("Upload doesn't match the expected file: %d bytes, expected %d", req.Size, e.Size), http.StatusUnprocessableEntity)
+			return
+		}
+		expect = e.ID
+	}
+
+	chunkSize := req.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = preferredChunkSize("")
+	}
+	chunkSize = min(max(chunkSize, minChunkSize), maxChunkSize)
+
+	id, err := generateID(func(id string) bool {
+		_, err := os.Lstat(chunkUploadPath(id))
+		return err == nil
+	})
+	if err != nil {
+		slog.Error("Failed to start chunked upload", "error", err)
+		http.Error(w, "Failed to start upload", http.StatusInternalServerError)
+		return
+	}
+
+	u := ChunkedUpload{
+		ID:              id,
+		Name:            req.Name,
+		Size:            req.Size,
+		ChunkSize:       chunkSize,
+		TotalChunks:     int((req.Size + chunkSize - 1) / chunkSize),
+		ExpirationHours: req.ExpirationHours,
+		Room:            roomCode(room),
+		Folder:          folder,
+		Persist:         req.Persist,
+		Tags:            tags,
+		Metadata:        metadata,
+		Expect:          expect,
+		Pending:         needsApproval(r),
+		AvailableFrom:   req.AvailableFrom,
+		CreatedAt:       time.Now(),
+	}
+
+	data, err := json.Marshal(u)
+	if err == nil {
+		// Mkdir rather than MkdirAll, so an ID a peer just took fails
+		// instead of sharing its directory
+		if err = os.MkdirAll(filepath.Dir(chunkUploadPath(u.ID)), 0755); err == nil {
+			err = os.Mkdir(chunkUploadPath(u.ID), 0755)
+		}
+		if err == nil {
+			err = os.WriteFile(chunkUploadPath(u.ID, chunkSessionFile), data, 0644)
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to start chunked upload", "error", err)
+		http.Error(w, "Failed to start upload", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Chunked upload started", "id", u.ID, "filename", u.Name, "size", u.Size, "chunks", u.TotalChunks, "client", clientIP(r))
+
+	writeChunkedStatus(w, &u, http.StatusCreated)
+}
+
+// handleChunkedUpload serves the rest of the protocol:
+//
+//	GET    /api/uploads/{id}              status, including chunks received so far
+//	PATCH  /api/uploads/{id}              change the chunk size for the rest of the file
+//	PUT    /api/uploads/{id}/chunks/{n}   store chunk n; X-Chunk-SHA256 is required
+//	POST   /api/uploads/{id}/complete     assemble the chunks into a file
+//	DELETE /api/uploads/{id}              abandon the upload
+func handleChunkedUpload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/uploads/"), "/")
+
+	u, err := loadChunkedUpload(parts[0])
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	if u.Room != roomCode(room) {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeChunkedStatus(w, u, http.StatusOK)
+
+	case len(parts) == 1 && r.Method == http.MethodPatch:
+		if rejectIfMaintenance(w) {
+			return
+		}
+		handleChunkResize(w, r, u)
+
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		os.RemoveAll(chunkUploadPath(u.ID))
+		chunkThroughput.forget(u.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(parts) == 3 && parts[1] == "chunks" && r.Method == http.MethodPut:
+		if rejectIfMaintenance(w) {
+			return
+		}
+		handleChunkPut(w, r, u, parts[2])
+
+	case len(parts) == 2 && parts[1] == "complete" && r.Method == http.MethodPost:
+		if rejectIfMaintenance(w) {
+			return
+		}
+		handleChunkedComplete(w, r, u, room)
+
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func handleChunkPut(w http.ResponseWriter, r *http.Request, u *ChunkedUpload, index string) {
+	n, err := strconv.Atoi(index)
+	if err != nil || n < 0 || n >= u.TotalChunks {
+		http.Error(w, "Invalid chunk index", http.StatusBadRequest)
+		return
+	}
+
+	want := strings.ToLower(r.Header.Get(chunkChecksumField))
+	if len(want) != sha256.Size*2 {
+		http.Error(w, chunkChecksumField+" header required", http.StatusBadRequest)
+		return
+	}
+
+	tmp, err := os.CreateTemp(chunkUploadPath(u.ID), "chunk-*.tmp")
+	if err != nil {
+		http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	// Staged chunks go through the storage decorators like stored files, so
+	// encryption at rest covers them too
+	dst, err := decorateWriter(tmp)
+	if err != nil {
+		tmp.Close()
+		http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+
+	offset, expected := u.chunkSpan(n)
+	h := sha256.New()
+	started := time.Now()
+	written, err := io.Copy(io.MultiWriter(dst, h), io.LimitReader(r.Body, expected+1))
+	if cerr := dst.Close(); err == nil && cerr != nil {
+		http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read chunk", http.StatusBadRequest)
+		return
+	}
+	if written != expected {
+		http.Error(w, fmt.Sprintf("Chunk %d must be %d bytes, got %d", n, expected, written), http.StatusBadRequest)
+		return
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		slog.Warn("Chunk failed verification", "id", u.ID, "chunk", n, "client", clientIP(r))
+		http.Error(w, "Checksum mismatch", http.StatusUnprocessableEntity)
+		return
+	}
+
+	chunkThroughput.observe(u.ID, written, time.Since(started))
+
+	unlock, err := lockChunkedUpload(u.ID)
+	if err != nil {
+		http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+	// The chunk size may have changed while this chunk was on its way
+	cur, err := loadChunkedUpload(u.ID)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if curOffset, curLength := cur.chunkSpan(n); n >= cur.TotalChunks || curOffset != offset || curLength != expected {
+		http.Error(w, "Chunk size has changed; get the upload's status and send chunk again", http.StatusConflict)
+		return
+	}
+
+	if err := os.Rename(tmp.Name(), chunkUploadPath(u.ID, strconv.Itoa(n))); err != nil {
+		http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+		return
+	}
+	// Keep active uploads from being treated as stale
+	now := time.Now()
+	os.Chtimes(chunkUploadPath(u.ID, chunkSessionFile), now, now)
+
+	w.Header().Set(preferredChunkHeader, strconv.FormatInt(preferredChunkSize(u.ID), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleChunkedComplete(w http.ResponseWriter, r *http.Request, u *ChunkedUpload, room *Room) {
+	opts := uploadOptions{Persist: u.Persist, Tags: u.Tags, Metadata: u.Metadata, Quota: requestAllowance(r), Pending: u.Pending, Source: requestSource(r), AvailableFrom: u.AvailableFrom}
+	if u.Expect != "" {
+		var ok bool
+		if opts.Expect, ok = lookupExpectation(w, u.Room, u.Expect); !ok {
+			return
+		}
+	}
+	// The whole file's checksum, on top of each chunk's
+	var ok bool
+	if opts.SHA256, ok = requestChecksum(w, r); !ok {
+		return
+	}
+
+	// Claim the upload so a repeated request can't assemble it twice, nor
+	// its chunk size change meanwhile
+	session := chunkUploadPath(u.ID, chunkSessionFile)
+	unlock, err := lockChunkedUpload(u.ID)
+	if err == nil {
+		if u, err = loadChunkedUpload(u.ID); err == nil && len(receivedChunks(u)) != u.TotalChunks {
+			unlock()
+			writeChunkedStatus(w, u, http.StatusConflict)
+			return
+		}
+		if err == nil {
+			err = os.Rename(session, session+".assembling")
+		}
+		unlock()
+	}
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	body := &chunkReader{upload: u}
+	meta, err := storage.SaveNewFile(opts.file(u.Room, u.Folder, u.Name), opts.body(body), room.clampExpiration(expirationFor(u.ExpirationHours)))
+	body.Close()
+	if rejectMismatch(w, err) || rejectTooLarge(w, err) {
+		// The chunks are what the expectation or limit won't accept; start over
+		os.RemoveAll(chunkUploadPath(u.ID))
+		return
+	}
+	if rejectOverQuota(w, err) {
+		// Kept, so the upload can finish once the client frees up space
+		os.Rename(session+".assembling", session)
+		return
+	}
+	if err != nil {
+		os.Rename(session+".assembling", session)
+		slog.Error("Failed to assemble chunked upload", "id", u.ID, "error", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	os.RemoveAll(chunkUploadPath(u.ID))
+	chunkThroughput.forget(u.ID)
+	slog.Info("File uploaded", "id", meta.ID, "filename", meta.Name, "size", meta.Size, "chunks", u.TotalChunks, "client", clientIP(r))
+	meta = opts.apply(meta)
+
+	resp := newShareResponse(meta)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cleanupHistory is how many recent cleanup runs are kept for the admin API.
+const cleanupHistory = 60
+
+// CleanupRun is what one pass of the cleanup loop did.
+type CleanupRun struct {
+	Started               time.Time `json:"started"`
+	DurationSeconds       float64   `json:"durationSeconds"`
+	FilesExpired          int       `json:"filesExpired"`
+	FilesRemoved          int       `json:"filesRemoved"`
+	RoomsExpired          int       `json:"roomsExpired"`
+	ChunkedUploadsRemoved int       `json:"chunkedUploadsRemoved"`
+	BytesReclaimed        int64     `json:"bytesReclaimed"`
+	Errors                int       `json:"errors"`
+}
+
+// CleanupTotals adds up every cleanup run since the server started.
+type CleanupTotals struct {
+	Runs                  int     `json:"runs"`
+	DurationSeconds       float64 `json:"durationSeconds"`
+	FilesExpired          int     `json:"filesExpired"`
+	FilesRemoved          int     `json:"filesRemoved"`
+	RoomsExpired          int     `json:"roomsExpired"`
+	ChunkedUploadsRemoved int     `json:"chunkedUploadsRemoved"`
+	BytesReclaimed        int64   `json:"bytesReclaimed"`
+	Errors                int     `json:"errors"`
+}
+
+// CleanupStats records how effective each cleanup run was, so retention
+// settings can be tuned from real numbers.
+type CleanupStats struct {
+	mu     sync.Mutex
+	totals CleanupTotals
+	recent []CleanupRun
+}
+
+var cleanupStats = &CleanupStats{}
+
+func (c *CleanupStats) Record(run CleanupRun) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.totals.Runs++
+	c.totals.DurationSeconds += run.DurationSeconds
+	c.totals.FilesExpired += run.FilesExpired
+	c.totals.FilesRemoved += run.FilesRemoved
+	c.totals.RoomsExpired += run.RoomsExpired
+	c.totals.ChunkedUploadsRemoved += run.ChunkedUploadsRemoved
+	c.totals.BytesReclaimed += run.BytesReclaimed
+	c.totals.Errors += run.Errors
+
+	c.recent = append(c.recent, run)
+	if len(c.recent) > cleanupHistory {
+		c.recent = c.recent[len(c.recent)-cleanupHistory:]
+	}
+}
+
+// Snapshot returns the totals and the recent runs, newest first.
+func (c *CleanupStats) Snapshot() (CleanupTotals, []CleanupRun) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	runs := make([]CleanupRun, len(c.recent))
+	for i, run := range c.recent {
+		runs[len(runs)-1-i] = run
+	}
+	return c.totals, runs
+}
+
+// runCleanup archives and expires files, expires rooms and removes abandoned
+// chunked uploads, recording what it reclaimed.
+func runCleanup() {
+	run := CleanupRun{Started: time.Now()}
+
+	if archive != nil {
+		if _, err := archive.Collect(); err != nil {
+			slog.Error("Error archiving expired files", "error", err)
+			run.Errors++
+		}
+	}
+	if result, err := storage.DeleteExpiredFiles(); err != nil {
+		slog.Error("Error cleaning up expired files", "error", err)
+		run.Errors++
+	} else {
+		run.FilesExpired = result.Expired
+		run.FilesRemoved += result.Removed
+		run.BytesReclaimed += result.Freed
+	}
+	if result, err := DeleteExpiredRooms(); err != nil {
+		slog.Error("Error cleaning up expired rooms", "error", err)
+		run.Errors++
+	} else {
+		run.RoomsExpired = result.Rooms
+		run.FilesRemoved += result.Files
+		run.BytesReclaimed += result.Freed
+	}
+	removed, freed := CleanStaleChunkedUploads()
+	run.ChunkedUploadsRemoved = removed
+	run.BytesReclaimed += freed
+
+	run.DurationSeconds = time.Since(run.Started).Seconds()
+	cleanupStats.Record(run)
+	if run.FilesRemoved > 0 || run.RoomsExpired > 0 || run.ChunkedUploadsRemoved > 0 {
+		slog.Info("Cleanup finished", "filesExpired", run.FilesExpired, "filesRemoved", run.FilesRemoved, "rooms", run.RoomsExpired, "chunkedUploads", run.ChunkedUploadsRemoved, "reclaimed", formatSize(run.BytesReclaimed), "duration", time.Duration(run.DurationSeconds*float64(time.Second)).String())
+	}
+}
+
+type CleanupResponse struct {
+	Totals CleanupTotals `json:"totals"`
+	Runs   []CleanupRun  `json:"runs"`
+}
+
+// handleCleanupStats reports the cleanup totals and recent runs:
+// GET /api/admin/cleanup.
+func handleCleanupStats(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can see cleanup statistics", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	totals, runs := cleanupStats.Snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(CleanupResponse{Totals: totals, Runs: runs})
+}
+
+// handleMetrics serves the cleanup counters, request latency histograms and
+// SLO burn rates in the Prometheus text format, for scraping at /metrics when
+// -metrics is set.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	totals, runs := cleanupStats.Snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	counter := func(name, help string, value any) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %v\n", name, help, name, name, value)
+	}
+	counter("sync_it_cleanup_runs_total", "Cleanup runs since the server started.", totals.Runs)
+	counter("sync_it_cleanup_errors_total", "Cleanup steps that failed.", totals.Errors)
+	counter("sync_it_cleanup_files_expired_total", "Files that reached their expiry.", totals.FilesExpired)
+	counter("sync_it_cleanup_files_removed_total", "Files removed from storage, including those of expired rooms.", totals.FilesRemoved)
+	counter("sync_it_cleanup_rooms_expired_total", "Rooms torn down after expiring.", totals.RoomsExpired)
+	counter("sync_it_cleanup_chunked_uploads_removed_total", "Abandoned chunked uploads removed.", totals.ChunkedUploadsRemoved)
+	counter("sync_it_cleanup_bytes_reclaimed_total", "Bytes of storage freed by cleanup.", totals.BytesReclaimed)
+
+	fmt.Fprintf(w, "# HELP sync_it_cleanup_duration_seconds How long cleanup runs take.\n# TYPE sync_it_cleanup_duration_seconds summary\n")
+	fmt.Fprintf(w, "sync_it_cleanup_duration_seconds_sum %g\nsync_it_cleanup_duration_seconds_count %d\n", totals.DurationSeconds, totals.Runs)
+
+	if len(runs) > 0 {
+		fmt.Fprintf(w, "# HELP sync_it_cleanup_last_run_timestamp_seconds When the last cleanup run started.\n# TYPE sync_it_cleanup_last_run_timestamp_seconds gauge\n")
+		fmt.Fprintf(w, "sync_it_cleanup_last_run_timestamp_seconds %d\n", runs[0].Started.Unix())
+	}
+
+	requestStats.writePrometheus(w)
+	requestStats.writeSLOMetrics(w)
+}
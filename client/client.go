@@ -0,0 +1,209 @@
+// Package client talks to a sync-it server over its HTTP API, so Go programs
+// can upload, list, download and watch files without shelling out to curl.
+//
+//	c, err := client.New("http://192.168.1.10:8080", client.Options{PIN: "1234"})
+//	if err != nil {
+//		return err
+//	}
+//	file, err := c.Upload(ctx, "report.pdf", f, nil)
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options configure a Client. The zero value talks to a server without a PIN
+// using http.DefaultClient's settings.
+type Options struct {
+	// PIN signs in to servers started with -pin. Tokens are renewed before
+	// they expire, so long-running clients keep working.
+	PIN string
+
+	// Room scopes every request to the room with this code.
+	Room string
+
+	// Device names this client in the uploader details of its files,
+	// e.g. "alex-laptop".
+	Device string
+
+	// HTTPClient is used for requests; its Transport is wrapped to add the
+	// API token. Leave Timeout at 0 for large transfers.
+	HTTPClient *http.Client
+}
+
+// Client is a sync-it server. It is safe for concurrent use.
+type Client struct {
+	server string
+	room   string
+	device string
+	http   *http.Client
+}
+
+// New returns a client for the server at URL server, e.g.
+// "http://192.168.1.10:8080". With a PIN it signs in straight away, so a
+// wrong PIN is reported here.
+func New(server string, opts Options) (*Client, error) {
+	server = strings.TrimSuffix(server, "/")
+	if _, err := url.ParseRequestURI(server); err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+
+	hc := opts.HTTPClient
+	if hc == nil {
+		hc = &http.Client{}
+	}
+	if opts.PIN != "" {
+		base := hc.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		t := &bearerTransport{base: base, server: server, pin: opts.PIN}
+		if err := t.refresh(); err != nil {
+			return nil, err
+		}
+		authed := *hc
+		authed.Transport = t
+		hc = &authed
+	}
+
+	return &Client{server: server, room: opts.Room, device: opts.Device, http: hc}, nil
+}
+
+// Server returns the server's URL, without a trailing slash.
+func (c *Client) Server() string {
+	return c.server
+}
+
+// HTTPClient returns the client requests are made with, which adds the API
+// token, for calling endpoints this package doesn't cover.
+func (c *Client) HTTPClient() *http.Client {
+	return c.http
+}
+
+// Error is a response from the server other than success.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server returned %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Message)
+}
+
+// newRequest builds a request for path on the server, scoped to the room.
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.room != "" {
+		req.Header.Set("X-Room-Code", c.room)
+	}
+	if c.device != "" {
+		req.Header.Set("X-Device-Name", c.device)
+	}
+	return req, nil
+}
+
+// do sends req, turning error statuses into *Error. The caller closes the
+// body.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
+
+// getJSON decodes the JSON response to GET path into v.
+func (c *Client) getJSON(ctx context.Context, path string, v any) error {
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", path, err)
+	}
+	return nil
+}
+
+type bootstrapResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// bearerTransport adds an API token obtained with the PIN, renewing it
+// shortly before it expires.
+type bearerTransport struct {
+	base   http.RoundTripper
+	server string
+	pin    string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (t *bearerTransport) refresh() error {
+	body, _ := json.Marshal(map[string]string{"pin": t.pin})
+	req, err := http.NewRequest(http.MethodPost, t.server+"/api/bootstrap", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("authentication failed: %s", strings.TrimSpace(string(msg)))
+	}
+	var boot bootstrapResponse
+	if err := json.NewDecoder(resp.Body).Decode(&boot); err != nil {
+		return err
+	}
+	t.token, t.expires = boot.Token, boot.ExpiresAt
+	return nil
+}
+
+func (t *bearerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	if t.token != "" && time.Until(t.expires) < time.Minute {
+		if err := t.refresh(); err != nil {
+			t.mu.Unlock()
+			return nil, err
+		}
+	}
+	token := t.token
+	t.mu.Unlock()
+
+	r = r.Clone(r.Context())
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// PartialSuffix names the journal kept next to an unfinished download. It
+// holds the server's chunk hashes; the bytes themselves go to a .part file.
+const PartialSuffix = ".syncit-partial"
+
+type downloadJournal struct {
+	ID        string   `json:"id"`
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunkSize"`
+	Chunks    []string `json:"chunks"`
+}
+
+type chunkList struct {
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunkSize"`
+	Chunks    []string `json:"chunks"`
+}
+
+func (c *Client) chunks(ctx context.Context, id string) (*chunkList, error) {
+	var chunks chunkList
+	if err := c.getJSON(ctx, "/api/chunks/"+url.PathEscape(id), &chunks); err != nil {
+		return nil, err
+	}
+	return &chunks, nil
+}
+
+// verifiedPrefix returns how many leading bytes of path match the expected
+// chunk hashes, stopping at the first chunk that is short or differs.
+func verifiedPrefix(path string, chunks *chunkList) int64 {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	var offset int64
+	for i, want := range chunks.Chunks {
+		expected := min(chunks.ChunkSize, chunks.Size-int64(i)*chunks.ChunkSize)
+		h := sha256.New()
+		n, _ := io.CopyN(h, f, expected)
+		if n != expected || hex.EncodeToString(h.Sum(nil)) != want {
+			break
+		}
+		offset += n
+	}
+	return offset
+}
+
+// chunkVerifier checks bytes against the chunk hashes as they are written,
+// starting at a chunk boundary.
+type chunkVerifier struct {
+	w      io.Writer
+	chunks *chunkList
+	index  int
+	filled int64
+	hash   hash.Hash
+}
+
+func (v *chunkVerifier) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if v.index >= len(v.chunks.Chunks) {
+			return written, fmt.Errorf("server sent more data than expected")
+		}
+
+		n := int(min(int64(len(p)), v.chunks.ChunkSize-v.filled))
+		if _, err := v.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		v.hash.Write(p[:n])
+		v.filled += int64(n)
+		written += n
+		p = p[n:]
+
+		expected := min(v.chunks.ChunkSize, v.chunks.Size-int64(v.index)*v.chunks.ChunkSize)
+		if v.filled == expected {
+			if hex.EncodeToString(v.hash.Sum(nil)) != v.chunks.Chunks[v.index] {
+				return written, fmt.Errorf("chunk %d failed verification", v.index)
+			}
+			v.index++
+			v.filled = 0
+			v.hash.Reset()
+		}
+	}
+	return written, nil
+}
+
+// DownloadFile saves file id to dest. An interrupted download leaves
+// dest.part and a dest.syncit-partial journal behind; the next attempt keeps
+// every chunk of the .part file that still matches the server's hashes and
+// requests only the rest, even after a reboot.
+func (c *Client) DownloadFile(ctx context.Context, id, dest string) error {
+	chunks, err := c.chunks(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	journalPath := dest + PartialSuffix
+	partPath := dest + ".part"
+	journal := downloadJournal{ID: id, Size: chunks.Size, ChunkSize: chunks.ChunkSize, Chunks: chunks.Chunks}
+
+	var offset int64
+	if data, err := os.ReadFile(journalPath); err == nil {
+		var prev downloadJournal
+		if json.Unmarshal(data, &prev) == nil && prev.ID == journal.ID && prev.Size == journal.Size &&
+			prev.ChunkSize == journal.ChunkSize && slices.Equal(prev.Chunks, journal.Chunks) {
+			offset = verifiedPrefix(partPath, chunks)
+		}
+	}
+
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(journalPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write journal: %w", err)
+	}
+
+	f, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if offset < chunks.Size {
+		req, err := c.newRequest(ctx, http.MethodGet, "/api/download/"+url.PathEscape(id), nil)
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		case resp.StatusCode == http.StatusOK:
+			if offset > 0 {
+				// Range not honoured; start over
+				offset = 0
+				if err := f.Truncate(0); err != nil {
+					return err
+				}
+				if _, err := f.Seek(0, io.SeekStart); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("download returned %s", resp.Status)
+		}
+
+		verifier := &chunkVerifier{w: f, chunks: chunks, index: int(offset / chunks.ChunkSize), hash: sha256.New()}
+		if _, err := io.Copy(verifier, resp.Body); err != nil {
+			return err
+		}
+		if verifier.index != len(chunks.Chunks) {
+			return fmt.Errorf("download ended early")
+		}
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	f.Close()
+
+	if err := os.Rename(partPath, dest); err != nil {
+		return err
+	}
+	os.Remove(journalPath)
+	return nil
+}
@@ -0,0 +1,226 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File is a file stored on the server, as listed by the API.
+type File struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	DisplayName string            `json:"displayName,omitempty"`
+	Size        int64             `json:"size"`
+	UploadedAt  time.Time         `json:"uploadedAt"`
+	ExpiresAt   time.Time         `json:"expiresAt"`
+	Room        string            `json:"room,omitempty"`
+	Folder      string            `json:"folder,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Persist     bool              `json:"persistAcrossRestart,omitempty"`
+	Pending     bool              `json:"pending,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	Renditions  []Rendition       `json:"renditions,omitempty"`
+	Source      *Source           `json:"source,omitempty"`
+}
+
+// Source is where a file was uploaded from.
+type Source struct {
+	IP        string `json:"ip"`
+	Device    string `json:"device,omitempty"`
+	Token     string `json:"token,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// Rendition is an alternative version of a file the server produced, such
+// as a JPEG copy of a HEIC photo.
+type Rendition struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// List returns the files the server is currently sharing.
+func (c *Client) List(ctx context.Context) ([]File, error) {
+	var list struct {
+		Files []File `json:"files"`
+	}
+	if err := c.getJSON(ctx, "/api/files", &list); err != nil {
+		return nil, err
+	}
+	return list.Files, nil
+}
+
+// Page is one page of the file list.
+type Page struct {
+	Files      []File `json:"files"`
+	Total      int    `json:"total"`      // files in the whole list
+	NextOffset int    `json:"nextOffset"` // where the next page starts, 0 after the last
+}
+
+// ListPage returns up to limit files of the list, newest first, from offset
+// on. The server takes a limit of at most 1000.
+func (c *Client) ListPage(ctx context.Context, offset, limit int) (*Page, error) {
+	query := url.Values{"offset": {strconv.Itoa(offset)}, "limit": {strconv.Itoa(limit)}}
+	var page Page
+	if err := c.getJSON(ctx, "/api/files?"+query.Encode(), &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// Get returns one file's details.
+func (c *Client) Get(ctx context.Context, id string) (*File, error) {
+	var file File
+	if err := c.getJSON(ctx, "/api/files/"+url.PathEscape(id), &file); err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// UploadOptions are optional settings for Upload.
+type UploadOptions struct {
+	// ExpirationHours overrides the server's default expiry, within its
+	// limits.
+	ExpirationHours int
+
+	// Folder places the file in a folder such as "/photos/2024".
+	Folder string
+
+	Tags     []string
+	Metadata map[string]string
+
+	// Persist keeps the file across restarts of an ephemeral server.
+	Persist bool
+
+	// Expect fulfils an upload reserved with /api/expect, by ID or slug.
+	Expect string
+}
+
+// Upload stores the contents of r on the server as name. The body is
+// streamed, so r may be larger than memory, and the server checks it
+// against the SHA-256 sent after it.
+func (c *Client) Upload(ctx context.Context, name string, r io.Reader, opts *UploadOptions) (*File, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	var metadata []byte
+	if len(opts.Metadata) > 0 {
+		var err error
+		if metadata, err = json.Marshal(opts.Metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		fields := map[string]string{
+			"path":     opts.Folder,
+			"tags":     strings.Join(opts.Tags, ","),
+			"metadata": string(metadata),
+			"expect":   opts.Expect,
+		}
+		if opts.ExpirationHours > 0 {
+			fields["expirationHours"] = strconv.Itoa(opts.ExpirationHours)
+		}
+		if opts.Persist {
+			fields["persistAcrossRestart"] = "true"
+		}
+		for key, value := range fields {
+			if value != "" {
+				if err := mw.WriteField(key, value); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+		}
+		// The checksum follows the file, so the server can verify it
+		// without the file being read twice
+		h := sha256.New()
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, io.TeeReader(r, h))
+		}
+		if err == nil {
+			err = mw.WriteField("sha256", hex.EncodeToString(h.Sum(nil)))
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := c.newRequest(ctx, http.MethodPost, "/api/upload", pr)
+	if err != nil {
+		pr.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.do(req)
+	pr.Close()
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var file File
+	if err := json.NewDecoder(resp.Body).Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid upload response: %w", err)
+	}
+	return &file, nil
+}
+
+// Download writes file id's contents to w. Use DownloadFile to save it to
+// disk with resuming.
+func (c *Client) Download(ctx context.Context, id string, w io.Writer) (int64, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/api/download/"+url.PathEscape(id), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, resp.Body)
+}
+
+// Watch calls fn with each file that appears on the server, checking every
+// interval, until ctx is done or fn returns an error, which Watch returns.
+// Files already there when it starts are passed to fn too if existing is
+// set. Failed checks are retried at the next interval.
+func (c *Client) Watch(ctx context.Context, interval time.Duration, existing bool, fn func(File) error) error {
+	var seen map[string]bool
+	for {
+		files, err := c.List(ctx)
+		if err == nil {
+			present := make(map[string]bool, len(files))
+			for _, file := range files {
+				present[file.ID] = true
+				if seen != nil && !seen[file.ID] || seen == nil && existing {
+					if err := fn(file); err != nil {
+						return err
+					}
+				}
+			}
+			seen = present
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
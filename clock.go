@@ -0,0 +1,33 @@
+package main
+
+import "time"
+
+// clockJumpThreshold is how far the wall clock may drift from the monotonic
+// clock between checks before it counts as a jump rather than NTP slewing.
+const clockJumpThreshold = 30 * time.Second
+
+// ClockWatcher detects wall-clock jumps (NTP step corrections, resume from
+// suspend, manual changes) by comparing elapsed wall time with elapsed
+// monotonic time between calls.
+type ClockWatcher struct {
+	last time.Time
+}
+
+func NewClockWatcher() *ClockWatcher {
+	return &ClockWatcher{last: time.Now()}
+}
+
+// Check returns how far the wall clock jumped since the previous call, or 0
+// if it kept pace with the monotonic clock.
+func (c *ClockWatcher) Check() time.Duration {
+	now := time.Now()
+	monotonic := now.Sub(c.last)
+	wall := now.Round(0).Sub(c.last.Round(0))
+	c.last = now
+
+	skew := wall - monotonic
+	if skew > -clockJumpThreshold && skew < clockJumpThreshold {
+		return 0
+	}
+	return skew
+}
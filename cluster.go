@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	clusterLeaseTTL      = 45 * time.Second
+	clusterLeaseInterval = 15 * time.Second
+	clusterSyncInterval  = 2 * time.Second
+)
+
+type clusterLease struct {
+	Node      string    `json:"node"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Cluster coordinates several sync-it processes sharing one uploads
+// directory (e.g. over NFS). One node holds a lease file and runs the
+// cleanup job; every node reloads metadata when a peer rewrites it.
+type Cluster struct {
+	nodeID    string
+	leaseFile string
+	leader    atomic.Bool
+}
+
+func NewCluster(dir, nodeID string) *Cluster {
+	if nodeID == "" {
+		host, _ := os.Hostname()
+		nodeID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	return &Cluster{
+		nodeID:    nodeID,
+		leaseFile: filepath.Join(dir, "cluster.lease"),
+	}
+}
+
+// IsLeader reports whether this process should run singleton jobs.
+// A nil Cluster means standalone mode, which always leads.
+func (c *Cluster) IsLeader() bool {
+	if c == nil {
+		return true
+	}
+	return c.leader.Load()
+}
+
+func (c *Cluster) readLease() (*clusterLease, error) {
+	data, err := os.ReadFile(c.leaseFile)
+	if os.IsNotExist(err) {
+		return &clusterLease{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lease: %w", err)
+	}
+
+	var lease clusterLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		// A torn write from a peer; treat as unowned
+		return &clusterLease{}, nil
+	}
+	return &lease, nil
+}
+
+func (c *Cluster) writeLease(lease clusterLease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lease: %w", err)
+	}
+
+	tmp := fmt.Sprintf("%s.%s.tmp", c.leaseFile, c.nodeID)
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write lease: %w", err)
+	}
+	if err := os.Rename(tmp, c.leaseFile); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write lease: %w", err)
+	}
+	return nil
+}
+
+// renewLease takes or extends the lease when it is free, expired, or ours.
+// After writing it re-reads the file so that of two nodes racing for an
+// expired lease only the one whose rename landed last considers itself leader.
+func (c *Cluster) renewLease() error {
+	lease, err := c.readLease()
+	if err != nil {
+		c.setLeader(false)
+		return err
+	}
+
+	now := time.Now()
+	if lease.Node != c.nodeID && now.Before(lease.ExpiresAt) {
+		c.setLeader(false)
+		return nil
+	}
+
+	if err := c.writeLease(clusterLease{Node: c.nodeID, ExpiresAt: now.Add(clusterLeaseTTL)}); err != nil {
+		c.setLeader(false)
+		return err
+	}
+
+	lease, err = c.readLease()
+	if err != nil {
+		c.setLeader(false)
+		return err
+	}
+	c.setLeader(lease.Node == c.nodeID)
+	return nil
+}
+
+func (c *Cluster) setLeader(leader bool) {
+	if c.leader.Swap(leader) != leader {
+		slog.Info("Cluster leadership changed", "node", c.nodeID, "leader", leader)
+	}
+}
+
+// releaseLease gives up leadership so a peer can take over without waiting
+// for the lease to expire.
+func (c *Cluster) releaseLease() {
+	if !c.leader.Load() {
+		return
+	}
+	lease, err := c.readLease()
+	if err == nil && lease.Node == c.nodeID {
+		os.Remove(c.leaseFile)
+	}
+	c.leader.Store(false)
+}
+
+// Run maintains the lease and keeps local metadata in sync until stop is closed.
+func (c *Cluster) Run(stop <-chan bool) {
+	if err := c.renewLease(); err != nil {
+		slog.Error("Failed to renew cluster lease", "error", err)
+	}
+
+	leaseTicker := time.NewTicker(clusterLeaseInterval)
+	defer leaseTicker.Stop()
+	syncTicker := time.NewTicker(clusterSyncInterval)
+	defer syncTicker.Stop()
+
+	for {
+		select {
+		case <-leaseTicker.C:
+			if err := c.renewLease(); err != nil {
+				slog.Error("Failed to renew cluster lease", "error", err)
+			}
+		case <-syncTicker.C:
+			if changed, err := storage.ReloadIfChanged(); err != nil {
+				slog.Error("Failed to reload metadata", "error", err)
+			} else if changed {
+				slog.Info("Reloaded metadata changed by peer")
+			}
+		case <-stop:
+			c.releaseLease()
+			return
+		}
+	}
+}
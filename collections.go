@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errCollectionNotFound = errors.New("collection not found")
+
+const (
+	defaultGalleryPageSize = 24
+	maxGalleryPageSize     = 100
+)
+
+// Collection groups uploaded files under a shareable name. Files are
+// referenced by ID, so members that expire or are deleted simply drop out.
+type Collection struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	FileIDs   []string  `json:"fileIds"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type CollectionStorage struct {
+	file        string
+	collections []Collection
+	mu          sync.RWMutex
+}
+
+func NewCollectionStorage(dir string) (*CollectionStorage, error) {
+	cs := &CollectionStorage{
+		file:        stateFile(dir, "collections.json"),
+		collections: []Collection{},
+	}
+
+	data, err := os.ReadFile(cs.file)
+	if os.IsNotExist(err) {
+		return cs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collections: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &cs.collections); err != nil {
+		return nil, fmt.Errorf("failed to parse collections: %w", err)
+	}
+
+	return cs, nil
+}
+
+func (cs *CollectionStorage) save() error {
+	data, err := json.MarshalIndent(cs.collections, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal collections: %w", err)
+	}
+
+	if err := writeStateFile(cs.file, data, 0644); err != nil {
+		return fmt.Errorf("failed to write collections: %w", err)
+	}
+
+	return nil
+}
+
+func (cs *CollectionStorage) find(id string) int {
+	for i, c := range cs.collections {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (cs *CollectionStorage) ListCollections() []Collection {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	result := make([]Collection, len(cs.collections))
+	copy(result, cs.collections)
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UpdatedAt.After(result[j].UpdatedAt)
+	})
+
+	return result
+}
+
+func (cs *CollectionStorage) CreateCollection(name string, fileIDs []string) (*Collection, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	id, err := generateID(func(id string) bool { return cs.find(id) != -1 })
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	collection := Collection{
+		ID:        id,
+		Name:      name,
+		FileIDs:   appendUnique(nil, fileIDs),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	cs.collections = append(cs.collections, collection)
+
+	if err := cs.save(); err != nil {
+		cs.collections = cs.collections[:len(cs.collections)-1]
+		return nil, err
+	}
+
+	return &collection, nil
+}
+
+func (cs *CollectionStorage) GetCollection(id string) (*Collection, error) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	idx := cs.find(id)
+	if idx == -1 {
+		return nil, errCollectionNotFound
+	}
+
+	collection := cs.collections[idx]
+	collection.FileIDs = append([]string{}, collection.FileIDs...)
+	return &collection, nil
+}
+
+// AddFiles appends fileIDs to the collection, skipping ones already in it.
+func (cs *CollectionStorage) AddFiles(id string, fileIDs []string) (*Collection, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	idx := cs.find(id)
+	if idx == -1 {
+		return nil, errCollectionNotFound
+	}
+
+	prev := cs.collections[idx]
+	collection := prev
+	collection.FileIDs = appendUnique(append([]string{}, prev.FileIDs...), fileIDs)
+	collection.UpdatedAt = time.Now()
+	cs.collections[idx] = collection
+
+	if err := cs.save(); err != nil {
+		cs.collections[idx] = prev
+		return nil, err
+	}
+
+	return &collection, nil
+}
+
+func (cs *CollectionStorage) DeleteCollection(id string) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	idx := cs.find(id)
+	if idx == -1 {
+		return errCollectionNotFound
+	}
+
+	prev := cs.collections
+	cs.collections = append(append([]Collection{}, cs.collections[:idx]...), cs.collections[idx+1:]...)
+
+	if err := cs.save(); err != nil {
+		cs.collections = prev
+		return err
+	}
+
+	return nil
+}
+
+func appendUnique(ids []string, add []string) []string {
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, id := range add {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if ids == nil {
+		ids = []string{}
+	}
+	return ids
+}
+
+type CollectionsResponse struct {
+	Collections []Collection `json:"collections"`
+}
+
+type collectionRequest struct {
+	Name    string   `json:"name"`
+	FileIDs []string `json:"fileIds"`
+}
+
+type GalleryItem struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	UploadedAt   time.Time `json:"uploadedAt"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnailUrl"`
+}
+
+type GalleryResponse struct {
+	ID         string        `json:"id"`
+	Name       string        `json:"name"`
+	UpdatedAt  time.Time     `json:"updatedAt"`
+	Page       int           `json:"page"`
+	PerPage    int           `json:"perPage"`
+	Total      int           `json:"total"`
+	TotalPages int           `json:"totalPages"`
+	Items      []GalleryItem `json:"items"`
+}
+
+// galleryItems resolves the collection's images that still exist, newest
+// additions first.
+func galleryItems(c *Collection) []GalleryItem {
+	items := []GalleryItem{}
+	for i := len(c.FileIDs) - 1; i >= 0; i-- {
+		meta, _, err := storage.GetFile(c.FileIDs[i])
+		if err != nil || !hasPreview(meta) {
+			continue
+		}
+		item := GalleryItem{
+			ID:           meta.ID,
+			Name:         meta.Name,
+			Size:         meta.Size,
+			UploadedAt:   meta.UploadedAt,
+			URL:          downloadURL(meta),
+			ThumbnailURL: thumbnailURL(meta),
+		}
+		if jpeg := meta.Rendition("jpeg"); jpeg != nil {
+			item.URL = renditionURL(meta, jpeg)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func queryInt(r *http.Request, key string, def int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil || n < 1 {
+		return def
+	}
+	return n
+}
+
+func decodeCollectionRequest(r *http.Request) (*collectionRequest, error) {
+	var req collectionRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// checkCollectionFiles refuses file IDs that aren't files of the
+// request's room.
+func checkCollectionFiles(w http.ResponseWriter, ids []string, room *Room) bool {
+	for _, id := range ids {
+		meta, _, err := storage.GetFile(id)
+		if err != nil || !inRoom(meta, room) {
+			http.Error(w, "File not found: "+id, http.StatusNotFound)
+			return false
+		}
+	}
+	return true
+}
+
+func writeCollection(w http.ResponseWriter, c *Collection, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(c)
+}
+
+func handleCollections(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		resp := CollectionsResponse{Collections: collections.ListCollections()}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+	case http.MethodPost:
+		if rejectIfMaintenance(w) {
+			return
+		}
+
+		room, ok := requestRoom(w, r)
+		if !ok {
+			return
+		}
+		req, err := decodeCollectionRequest(r)
+		if err != nil || strings.TrimSpace(req.Name) == "" {
+			http.Error(w, "Invalid collection", http.StatusBadRequest)
+			return
+		}
+		if !checkCollectionFiles(w, req.FileIDs, room) {
+			return
+		}
+
+		collection, err := collections.CreateCollection(strings.TrimSpace(req.Name), req.FileIDs)
+		if err != nil {
+			slog.Error("Failed to create collection", "error", err)
+			http.Error(w, "Failed to create collection", http.StatusInternalServerError)
+			return
+		}
+
+		writeCollection(w, collection, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleCollection(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/collections/")
+	id, sub, _ := strings.Cut(rest, "/")
+	if id == "" {
+		http.Error(w, "Collection ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch sub {
+	case "":
+	case "gallery":
+		handleGallery(w, r, id)
+		return
+	case "files":
+		handleCollectionFiles(w, r, id)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		collection, err := collections.GetCollection(id)
+		if err != nil {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		}
+
+		writeCollection(w, collection, http.StatusOK)
+
+	case http.MethodDelete:
+		if rejectIfMaintenance(w) {
+			return
+		}
+
+		// Only the grouping is removed; member files are left alone
+		if err := collections.DeleteCollection(id); err != nil {
+			if errors.Is(err, errCollectionNotFound) {
+				http.Error(w, "Collection not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to delete collection", "id", id, "error", err)
+			http.Error(w, "Failed to delete collection", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleCollectionFiles(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	req, err := decodeCollectionRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if !checkCollectionFiles(w, req.FileIDs, room) {
+		return
+	}
+
+	collection, err := collections.AddFiles(id, req.FileIDs)
+	if errors.Is(err, errCollectionNotFound) {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to update collection", "id", id, "error", err)
+		http.Error(w, "Failed to update collection", http.StatusInternalServerError)
+		return
+	}
+
+	writeCollection(w, collection, http.StatusOK)
+}
+
+func handleGallery(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	collection, err := collections.GetCollection(id)
+	if err != nil {
+		http.Error(w, "Collection not found", http.StatusNotFound)
+		return
+	}
+
+	items := galleryItems(collection)
+	page := queryInt(r, "page", 1)
+	perPage := min(queryInt(r, "perPage", defaultGalleryPageSize), maxGalleryPageSize)
+
+	start := min((page-1)*perPage, len(items))
+	end := min(start+perPage, len(items))
+
+	resp := GalleryResponse{
+		ID:         collection.ID,
+		Name:       collection.Name,
+		UpdatedAt:  collection.UpdatedAt,
+		Page:       page,
+		PerPage:    perPage,
+		Total:      len(items),
+		TotalPages: (len(items) + perPage - 1) / perPage,
+		Items:      items[start:end],
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(resp)
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Name}} - Sync-It</title>
+    <meta property="og:type" content="website">
+    <meta property="og:site_name" content="Sync-It">
+    <meta property="og:title" content="{{.Name}}">
+    <meta property="og:url" content="{{.PageURL}}">
+{{- if .CoverURL}}
+    <meta property="og:image" content="{{.CoverURL}}">
+    <meta name="twitter:card" content="summary_large_image">
+{{- end}}
+    <link rel="stylesheet" href="{{.BasePath}}/style.css">
+</head>
+<body>
+    <div class="container gallery-page">
+        <header>
+            <h1>{{.Name}}</h1>
+            <p id="gallery-count"></p>
+        </header>
+        <main id="gallery" class="gallery-grid"></main>
+        <button id="gallery-more" class="download-btn" hidden>Load more</button>
+    </div>
+    <script>
+    (() => {
+        const endpoint = {{.GalleryURL}};
+        const grid = document.getElementById('gallery');
+        const count = document.getElementById('gallery-count');
+        const more = document.getElementById('gallery-more');
+        let pages = 1;
+
+        async function render() {
+            const items = [];
+            let data;
+            for (let page = 1; page <= pages; page++) {
+                const response = await fetch(endpoint + '?page=' + page);
+                if (!response.ok) return;
+                data = await response.json();
+                items.push(...data.items);
+            }
+
+            grid.replaceChildren(...items.map(item => {
+                const link = document.createElement('a');
+                link.href = item.url;
+                link.title = item.name;
+                const img = document.createElement('img');
+                img.src = item.thumbnailUrl;
+                img.alt = item.name;
+                img.loading = 'lazy';
+                link.appendChild(img);
+                return link;
+            }));
+            count.textContent = data.total + (data.total === 1 ? ' photo' : ' photos');
+            more.hidden = data.page >= data.totalPages;
+        }
+
+        more.addEventListener('click', () => { pages++; render(); });
+        render();
+        // New photos added to the collection show up without reloading
+        setInterval(() => { if (!document.hidden) render(); }, 15000);
+    })();
+    </script>
+</body>
+</html>
+`))
+
+type galleryPage struct {
+	Name       string
+	PageURL    string
+	GalleryURL string
+	CoverURL   string
+	BasePath   string
+}
+
+func collectionURL(id string) string {
+	return publicBaseURL() + "/c/" + id
+}
+
+func handleGalleryPage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/c/")
+	collection, err := collections.GetCollection(id)
+	if err != nil {
+		pageError(w, r, "Collection not found", http.StatusNotFound, "Collection not found",
+			"This gallery doesn't exist any more. Ask the person who shared it for a new link.")
+		return
+	}
+
+	page := galleryPage{
+		Name:       collection.Name,
+		PageURL:    collectionURL(collection.ID),
+		GalleryURL: basePath + "/api/collections/" + collection.ID + "/gallery",
+		BasePath:   basePath,
+	}
+	if items := galleryItems(collection); len(items) > 0 {
+		page.CoverURL = items[0].ThumbnailURL
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := galleryTemplate.Execute(w, page); err != nil {
+		slog.Error("Failed to render gallery page", "id", id, "error", err)
+	}
+}
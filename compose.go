@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A4 in PDF points
+const (
+	pdfPageWidth  = 595.0
+	pdfPageHeight = 842.0
+)
+
+// Limits on what one PDF is composed of, as each image is read into memory
+const (
+	maxComposeImages    = 100
+	maxComposeImageSize = 50 << 20
+)
+
+type ComposePDFRequest struct {
+	IDs             []string `json:"ids"`
+	Name            string   `json:"name"`
+	ExpirationHours int      `json:"expirationHours"`
+}
+
+// pdfWriter tracks byte offsets of objects for the cross-reference table.
+type pdfWriter struct {
+	w       *bufio.Writer
+	offset  int64
+	offsets []int64
+}
+
+func (pw *pdfWriter) write(format string, args ...any) {
+	n, _ := fmt.Fprintf(pw.w, format, args...)
+	pw.offset += int64(n)
+}
+
+func (pw *pdfWriter) writeBytes(b []byte) {
+	n, _ := pw.w.Write(b)
+	pw.offset += int64(n)
+}
+
+func (pw *pdfWriter) beginObject(num int) {
+	for len(pw.offsets) < num {
+		pw.offsets = append(pw.offsets, 0)
+	}
+	pw.offsets[num-1] = pw.offset
+	pw.write("%d 0 obj\n", num)
+}
+
+func (pw *pdfWriter) stream(dict string, data []byte) {
+	pw.write("<< %s /Length %d >>\nstream\n", dict, len(data))
+	pw.writeBytes(data)
+	pw.write("\nendstream\nendobj\n")
+}
+
+// errBadImage reports an image that can't be put in a PDF, as opposed to
+// failing to store the PDF.
+var errBadImage = errors.New("unusable image")
+
+type pdfImage struct {
+	width, height int
+	colorSpace    string
+	filter        string
+	extra         string
+	data          []byte
+}
+
+// loadPDFImage returns image data ready to embed. JPEGs are passed through
+// unchanged; other formats are decoded and stored as Flate-compressed RGB.
+func loadPDFImage(id string) (*pdfImage, error) {
+	blob, err := storage.OpenBlob(id)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := io.ReadAll(io.LimitReader(blob, maxComposeImageSize+1))
+	blob.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > maxComposeImageSize {
+		return nil, fmt.Errorf("%w: %s is larger than %s", errBadImage, id, formatSize(maxComposeImageSize))
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s isn't a supported image: %v", errBadImage, id, err)
+	}
+
+	if format == "jpeg" {
+		img := &pdfImage{width: cfg.Width, height: cfg.Height, filter: "/DCTDecode", data: raw}
+		switch cfg.ColorModel {
+		case color.GrayModel:
+			img.colorSpace = "/DeviceGray"
+		case color.CMYKModel:
+			// Adobe CMYK JPEGs are stored inverted
+			img.colorSpace = "/DeviceCMYK"
+			img.extra = "/Decode [1 0 1 0 1 0 1 0]"
+		default:
+			img.colorSpace = "/DeviceRGB"
+		}
+		return img, nil
+	}
+
+	if int64(cfg.Width)*int64(cfg.Height) > maxDecodePixels {
+		return nil, fmt.Errorf("%w: %s is %dx%d, too large to convert", errBadImage, id, cfg.Width, cfg.Height)
+	}
+	decoded, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s failed to decode: %v", errBadImage, id, err)
+	}
+
+	b := decoded.Bounds()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	row := make([]byte, 0, b.Dx()*3)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row = row[:0]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+			// Flatten transparency onto white
+			a := uint32(c.A)
+			row = append(row,
+				byte((uint32(c.R)*a+255*(255-a))/255),
+				byte((uint32(c.G)*a+255*(255-a))/255),
+				byte((uint32(c.B)*a+255*(255-a))/255))
+		}
+		zw.Write(row)
+	}
+	zw.Close()
+
+	return &pdfImage{
+		width:      b.Dx(),
+		height:     b.Dy(),
+		colorSpace: "/DeviceRGB",
+		filter:     "/FlateDecode",
+		data:       buf.Bytes(),
+	}, nil
+}
+
+// writeImagesPDF writes one page per image, each image fitted onto an A4
+// page in the orientation that matches its aspect ratio.
+func writeImagesPDF(w io.Writer, ids []string) error {
+	pw := &pdfWriter{w: bufio.NewWriter(w)}
+	pw.write("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+
+	// Objects: 1 catalog, 2 pages, then (page, content, image) per image
+	pageCount := len(ids)
+	pw.beginObject(1)
+	pw.write("<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")
+
+	kids := make([]string, pageCount)
+	for i := range ids {
+		kids[i] = fmt.Sprintf("%d 0 R", 3+i*3)
+	}
+	pw.beginObject(2)
+	pw.write("<< /Type /Pages /Kids [%s] /Count %d >>\nendobj\n", strings.Join(kids, " "), pageCount)
+
+	for i, id := range ids {
+		img, err := loadPDFImage(id)
+		if err != nil {
+			return err
+		}
+
+		pageW, pageH := pdfPageWidth, pdfPageHeight
+		if img.width > img.height {
+			pageW, pageH = pageH, pageW
+		}
+		scale := min(pageW/float64(img.width), pageH/float64(img.height))
+		drawW, drawH := float64(img.width)*scale, float64(img.height)*scale
+		x, y := (pageW-drawW)/2, (pageH-drawH)/2
+
+		pageObj, contentObj, imageObj := 3+i*3, 4+i*3, 5+i*3
+
+		pw.beginObject(pageObj)
+		pw.write("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /XObject << /Im%d %d 0 R >> >> /Contents %d 0 R >>\nendobj\n",
+			pageW, pageH, i, imageObj, contentObj)
+
+		pw.beginObject(contentObj)
+		pw.stream("", []byte(fmt.Sprintf("q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q", drawW, drawH, x, y, i)))
+
+		pw.beginObject(imageObj)
+		pw.stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s /BitsPerComponent 8 /Filter %s %s",
+			img.width, img.height, img.colorSpace, img.filter, img.extra), img.data)
+	}
+
+	xref := pw.offset
+	pw.write("xref\n0 %d\n0000000000 65535 f \n", len(pw.offsets)+1)
+	for _, off := range pw.offsets {
+		pw.write("%010d 00000 n \n", off)
+	}
+	pw.write("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(pw.offsets)+1, xref)
+
+	return pw.w.Flush()
+}
+
+func handleComposePDF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	var req ComposePDFRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil || len(req.IDs) == 0 {
+		http.Error(w, "A list of image IDs is required", http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) > maxComposeImages {
+		http.Error(w, fmt.Sprintf("At most %d images can be composed into one PDF", maxComposeImages), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	for _, id := range req.IDs {
+		meta, _, err := storage.GetFile(id)
+		if err != nil || !inRoom(meta, room) {
+			http.Error(w, "File not found: "+id, http.StatusNotFound)
+			return
+		}
+		if meta.expired(now) {
+			http.Error(w, "File has expired: "+id, http.StatusGone)
+			return
+		}
+		if meta.Quarantined {
+			http.Error(w, "File is damaged: "+id, http.StatusUnprocessableEntity)
+			return
+		}
+		if meta.embargoed(now) {
+			http.Error(w, "File isn't available until "+meta.AvailableFrom.UTC().Format(shareTimeFormat)+": "+id, http.StatusForbidden)
+			return
+		}
+		if meta.Size > maxComposeImageSize {
+			http.Error(w, fmt.Sprintf("Images can be at most %s: %s", formatSize(maxComposeImageSize), id), http.StatusRequestEntityTooLarge)
+			return
+		}
+	}
+
+	name := req.Name
+	if name == "" {
+		name = "scan-" + now.Format("20060102-150405")
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".pdf") {
+		name += ".pdf"
+	}
+
+	opts, ok := requestUploadOptions(w, r, room)
+	if !ok {
+		return
+	}
+
+	pr, pwr := io.Pipe()
+	go func() {
+		pwr.CloseWithError(writeImagesPDF(pwr, req.IDs))
+	}()
+
+	meta, err := storage.SaveNewFile(opts.file(roomCode(room), "", name), opts.body(pr), room.clampExpiration(expirationFor(req.ExpirationHours)))
+	pr.Close()
+	if rejectOverQuota(w, err) || rejectStorageFull(w, err) || rejectTooLarge(w, err) {
+		return
+	}
+	if errors.Is(err, errBadImage) {
+		slog.Warn("Failed to compose PDF", "filename", name, "error", err)
+		http.Error(w, "An image can't be put in a PDF: damaged, unsupported or too large", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to compose PDF", "filename", name, "error", err)
+		http.Error(w, "Failed to compose PDF", http.StatusInternalServerError)
+		return
+	}
+	meta = opts.apply(meta)
+
+	resp := newShareResponse(meta)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
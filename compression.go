@@ -0,0 +1,107 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// compressionCodec compresses file contents at rest. The codec a file was
+// stored with is recorded in its metadata, so changing -compress only
+// affects new uploads.
+type compressionCodec struct {
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+// compressionCodecs are the -compress choices. Codecs that need a third-party
+// package register themselves from a file behind a build tag.
+var compressionCodecs = map[string]compressionCodec{
+	"gzip": {
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+}
+
+// compressionCodecTags names the build tag that enables each optional codec.
+var compressionCodecTags = map[string]string{
+	"zstd": "zstd",
+}
+
+func lookupCodec(name string) (compressionCodec, error) {
+	codec, ok := compressionCodecs[name]
+	if !ok {
+		if tag, known := compressionCodecTags[name]; known {
+			return codec, fmt.Errorf("this build has no %s support; rebuild with -tags %s", name, tag)
+		}
+		return codec, fmt.Errorf("unknown compression %q (use zstd or gzip)", name)
+	}
+	return codec, nil
+}
+
+// incompressibleTypes are MIME types, or prefixes ending in "/", whose
+// contents are already compressed.
+var incompressibleTypes = []string{
+	"image/", "video/", "audio/", "font/woff",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/vnd.rar",
+	"application/x-bzip2", "application/x-xz", "application/pdf",
+	"application/vnd.openxmlformats-officedocument.", "application/epub+zip",
+}
+
+// compressibleImages are image formats stored uncompressed.
+var compressibleImages = []string{"image/svg+xml", "image/bmp", "image/x-ms-bmp", "image/tiff"}
+
+// worthCompressing guesses from the file's name and first bytes whether
+// compressing it would save space.
+func worthCompressing(filename string, head []byte) bool {
+	for _, mediaType := range []string{mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))), http.DetectContentType(head)} {
+		mediaType, _, _ = strings.Cut(mediaType, ";")
+		if mediaType == "" || hasAnyPrefix(mediaType, compressibleImages) {
+			continue
+		}
+		if hasAnyPrefix(mediaType, incompressibleTypes) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// codecReadCloser closes both the decompressor and the blob beneath it.
+type codecReadCloser struct {
+	io.ReadCloser
+	blob io.Closer
+}
+
+func (r codecReadCloser) Close() error {
+	err := r.ReadCloser.Close()
+	if cerr := r.blob.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	conversionTimeout = 2 * time.Minute
+	transcodeTimeout  = time.Hour
+)
+
+// heicConverters are tried in order; each turns {in} into a JPEG at {out}.
+var heicConverters = [][]string{
+	{"heif-convert", "-q", "90", "{in}", "{out}"},
+	{"magick", "{in}", "-quality", "90", "{out}"},
+	{"convert", "{in}", "-quality", "90", "{out}"},
+}
+
+// webTranscode re-encodes a video to H.264/AAC in an MP4 that starts playing
+// before it has fully downloaded.
+var webTranscode = []string{
+	"ffmpeg", "-y", "-nostdin", "-i", "{in}",
+	"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+	"-c:a", "aac", "-b:a", "128k",
+	"-movflags", "+faststart", "{out}",
+}
+
+// Converter produces renditions for uploads in formats many devices can't
+// open, using external tools found on the PATH.
+type Converter struct {
+	heic  []string
+	video bool
+
+	// Transcodes run one at a time so a burst of uploads can't starve the box
+	transcodeMu sync.Mutex
+}
+
+// EnableHEIC finds a tool able to decode HEIC/HEIF.
+func (c *Converter) EnableHEIC() error {
+	for _, args := range heicConverters {
+		if _, err := exec.LookPath(args[0]); err == nil {
+			c.heic = args
+			return nil
+		}
+	}
+	return fmt.Errorf("no HEIC converter found; install libheif (heif-convert) or ImageMagick")
+}
+
+// EnableVideo checks that ffmpeg and ffprobe are available.
+func (c *Converter) EnableVideo() error {
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			return fmt.Errorf("%s not found on PATH", tool)
+		}
+	}
+	c.video = true
+	return nil
+}
+
+func isVideoName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".mp4", ".m4v", ".mov", ".mkv", ".webm", ".avi", ".wmv", ".flv", ".3gp", ".ts", ".mts":
+		return true
+	}
+	return false
+}
+
+// playsInBrowsers reports whether the video at path is already H.264 with
+// AAC or MP3 audio in an MP4 container, which every browser can play.
+func playsInBrowsers(ctx context.Context, path string) (bool, error) {
+	output, err := exec.CommandContext(ctx, "ffprobe", "-v", "error",
+		"-show_entries", "format=format_name:stream=codec_type,codec_name",
+		"-of", "json", path).Output()
+	if err != nil {
+		return false, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	var probe struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return false, fmt.Errorf("ffprobe: %w", err)
+	}
+
+	if !strings.Contains(probe.Format.FormatName, "mp4") {
+		return false, nil
+	}
+	for _, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			if s.CodecName != "h264" {
+				return false, nil
+			}
+		case "audio":
+			if s.CodecName != "aac" && s.CodecName != "mp3" {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+func isHEICName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".heic", ".heif":
+		return true
+	}
+	return false
+}
+
+// plainBlobPath returns a path to the original bytes of file id, which is a
+// temporary copy when the blob store isn't local or storage decorators
+// change what is on disk.
+func plainBlobPath(id string) (string, func(), error) {
+	if path := storage.BlobPath(id); path != "" && !hasStorageDecorators() {
+		return path, func() {}, nil
+	}
+
+	blob, err := storage.OpenBlob(id)
+	if err != nil {
+		return "", nil, err
+	}
+	defer blob.Close()
+
+	tmp, err := os.CreateTemp("", "sync-it-src-*")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(tmp.Name()) }
+	_, err = io.Copy(tmp, blob)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return tmp.Name(), cleanup, nil
+}
+
+// runConversion expands {in} and {out} in args and executes the command.
+func runConversion(ctx context.Context, args []string, in, out string) error {
+	expanded := make([]string, len(args))
+	for i, arg := range args {
+		arg = strings.ReplaceAll(arg, "{in}", in)
+		expanded[i] = strings.ReplaceAll(arg, "{out}", out)
+	}
+
+	output, err := exec.CommandContext(ctx, expanded[0], expanded[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", expanded[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// convert runs args on file meta and stores the result as rendition key.
+func (c *Converter) convert(meta *FileMetadata, key, name string, args []string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	src, cleanup, err := plainBlobPath(meta.ID)
+	if err != nil {
+		slog.Error("Conversion failed", "id", meta.ID, "rendition", key, "error", err)
+		return
+	}
+	defer cleanup()
+
+	if key == "web" {
+		ok, err := playsInBrowsers(ctx, src)
+		if err != nil {
+			slog.Error("Conversion failed", "id", meta.ID, "rendition", key, "error", err)
+			return
+		}
+		if ok {
+			return
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp("", "sync-it-convert-*")
+	if err != nil {
+		slog.Error("Conversion failed", "id", meta.ID, "rendition", key, "error", err)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Converters pick the output format from the extension
+	out := filepath.Join(tmpDir, "out"+filepath.Ext(name))
+
+	start := time.Now()
+	if err := runConversion(ctx, args, src, out); err != nil {
+		slog.Error("Conversion failed", "id", meta.ID, "rendition", key, "error", err)
+		return
+	}
+
+	f, err := os.Open(out)
+	if err != nil {
+		slog.Error("Conversion failed", "id", meta.ID, "rendition", key, "error", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := storage.AddRendition(meta.ID, key, name, f); err != nil {
+		slog.Error("Failed to store rendition", "id", meta.ID, "rendition", key, "error", err)
+		return
+	}
+	slog.Info("Rendition created", "id", meta.ID, "rendition", key, "filename", name, "duration", time.Since(start).String())
+}
+
+func (c *Converter) handleEvent(e Event) {
+	if e.Type != EventFileUploaded {
+		return
+	}
+
+	if c.heic != nil && isHEICName(e.File.Name) {
+		name := strings.TrimSuffix(e.File.Name, filepath.Ext(e.File.Name)) + ".jpg"
+		c.convert(e.File, "jpeg", name, c.heic, conversionTimeout)
+	}
+
+	if c.video && isVideoName(e.File.Name) {
+		c.transcodeMu.Lock()
+		defer c.transcodeMu.Unlock()
+
+		name := strings.TrimSuffix(e.File.Name, filepath.Ext(e.File.Name)) + ".web.mp4"
+		c.convert(e.File, "web", name, webTranscode, transcodeTimeout)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Limits on the custom metadata clients can attach to a file.
+const (
+	maxMetadataKeys   = 50
+	maxMetadataKey    = 64
+	maxMetadataValue  = 1024
+	maxMetadataLength = 8 << 10
+)
+
+// validateMetadata checks custom metadata against the limits. Empty maps
+// come back nil, so clearing metadata leaves nothing stored.
+func validateMetadata(metadata map[string]string) (map[string]string, error) {
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	if len(metadata) > maxMetadataKeys {
+		return nil, fmt.Errorf("at most %d metadata keys per file", maxMetadataKeys)
+	}
+	total := 0
+	for key, value := range metadata {
+		switch {
+		case key == "":
+			return nil, fmt.Errorf("metadata keys can't be empty")
+		case len(key) > maxMetadataKey:
+			return nil, fmt.Errorf("metadata key %q is longer than %d bytes", key, maxMetadataKey)
+		case len(value) > maxMetadataValue:
+			return nil, fmt.Errorf("metadata value for %q is longer than %d bytes", key, maxMetadataValue)
+		case !utf8.ValidString(key) || !utf8.ValidString(value):
+			return nil, fmt.Errorf("metadata must be valid UTF-8")
+		}
+		total += len(key) + len(value)
+	}
+	if total > maxMetadataLength {
+		return nil, fmt.Errorf("metadata is larger than %d bytes", maxMetadataLength)
+	}
+	return metadata, nil
+}
+
+// parseMetadata reads custom metadata sent as a JSON object of strings, as
+// in the metadata form field or X-Metadata header.
+func parseMetadata(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+		return nil, fmt.Errorf("metadata must be a JSON object of strings, e.g. {\"build\": \"1234\"}")
+	}
+	return validateMetadata(metadata)
+}
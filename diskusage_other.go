@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// diskUsage isn't implemented here; set -storage-limit to get usage alerts.
+func diskUsage(path string) (used, total uint64, err error) {
+	return 0, 0, errors.New("disk usage is not supported on this platform")
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// diskUsage returns the bytes used and the total size of the filesystem
+// holding path, counting space reserved for root as used.
+func diskUsage(path string) (used, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	bsize := uint64(st.Bsize)
+	total = uint64(st.Blocks) * bsize
+	return total - uint64(st.Bavail)*bsize, total, nil
+}
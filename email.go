@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// emailsPerHour is how many files one client may email in an hour, so the
+// server can't be used to flood someone's inbox.
+const emailsPerHour = 20
+
+// Mailer sends files by email through the -smtp server.
+type Mailer struct {
+	addr, from string
+	attachMax  int64 // larger files are sent as a link
+
+	mu   sync.Mutex
+	sent map[string][]time.Time // recent sends by client
+}
+
+// mailer is nil unless -smtp and -smtp-from are set.
+var mailer *Mailer
+
+func NewMailer(addr, from string, attachMax int64) *Mailer {
+	return &Mailer{addr: addr, from: from, attachMax: attachMax, sent: map[string][]time.Time{}}
+}
+
+// smtpAuth authenticates with SYNCIT_SMTP_USERNAME and SYNCIT_SMTP_PASSWORD
+// when set, and returns nil otherwise.
+func smtpAuth(addr string) smtp.Auth {
+	user := os.Getenv("SYNCIT_SMTP_USERNAME")
+	if user == "" {
+		return nil
+	}
+	host, _, _ := strings.Cut(addr, ":")
+	return smtp.PlainAuth("", user, os.Getenv("SYNCIT_SMTP_PASSWORD"), host)
+}
+
+// allow counts an email from client against emailsPerHour.
+func (m *Mailer) allow(client string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-time.Hour)
+	recent := m.sent[client][:0]
+	for _, t := range m.sent[client] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= emailsPerHour {
+		m.sent[client] = recent
+		return false
+	}
+	m.sent[client] = append(recent, time.Now())
+	return true
+}
+
+// send delivers one message to to, whose body write streams after the
+// headers, upgrading to TLS when the server offers it as smtp.SendMail does.
+func (m *Mailer) send(to string, write func(io.Writer) error) error {
+	c, err := smtp.Dial(m.addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	host, _, _ := strings.Cut(m.addr, ":")
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth := smtpAuth(m.addr); auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if err := write(w); err != nil {
+		// Hanging up without ending the data discards the message
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// SendFile emails meta to to with message in the body: attached when it is
+// at most attachMax, else as a link to its share page. It reports whether the
+// file was attached.
+func (m *Mailer) SendFile(meta *FileMetadata, to, message string) (bool, error) {
+	attach := meta.Size <= m.attachMax
+	var blob io.ReadCloser
+	if attach {
+		defer storage.BeginRead(meta.blobName())()
+		var err error
+		if blob, err = storage.OpenBlob(meta.ID); err != nil {
+			return false, err
+		}
+		defer blob.Close()
+	}
+
+	err := m.send(to, func(w io.Writer) error {
+		fmt.Fprintf(w, "From: %s\r\n", m.from)
+		fmt.Fprintf(w, "To: %s\r\n", to)
+		fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", meta.Name+" via sync-it"))
+		fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+		w.Write([]byte("MIME-Version: 1.0\r\n"))
+
+		text := strings.TrimSpace(message)
+		if text != "" {
+			text += "\r\n\r\n"
+		}
+		if !attach {
+			text += fmt.Sprintf("%s (%s) was shared with you: %s\r\n", meta.Name, formatSize(meta.Size), shareURL(meta))
+			if !meta.ExpiresAt.IsZero() {
+				text += "The link works until " + meta.ExpiresAt.UTC().Format(shareTimeFormat) + ".\r\n"
+			}
+			fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s", text)
+			return nil
+		}
+		text += fmt.Sprintf("%s (%s) is attached.\r\n", meta.Name, formatSize(meta.Size))
+
+		boundary := make([]byte, 12)
+		rand.Read(boundary)
+		b := "sync-it-" + hex.EncodeToString(boundary)
+		fmt.Fprintf(w, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", b)
+		fmt.Fprintf(w, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n", b, text)
+		fmt.Fprintf(w, "--%s\r\nContent-Type: %s\r\nContent-Disposition: %s\r\nContent-Transfer-Encoding: base64\r\n\r\n", b,
+			mime.FormatMediaType("application/octet-stream", map[string]string{"name": meta.Name}),
+			mime.FormatMediaType("attachment", map[string]string{"filename": meta.Name}))
+
+		enc := base64.NewEncoder(base64.StdEncoding, &lineWriter{w: w})
+		if _, err := io.Copy(enc, blob); err != nil {
+			return err
+		}
+		enc.Close()
+		fmt.Fprintf(w, "\r\n--%s--\r\n", b)
+		return nil
+	})
+	return attach, err
+}
+
+// lineWriter breaks base64 into the 76-character lines mail allows.
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := min(len(p), 76-l.col)
+		if _, err := l.w.Write(p[:chunk]); err != nil {
+			return 0, err
+		}
+		p = p[chunk:]
+		if l.col += chunk; l.col == 76 {
+			if _, err := l.w.Write([]byte("\r\n")); err != nil {
+				return 0, err
+			}
+			l.col = 0
+		}
+	}
+	return n, nil
+}
+
+type emailRequest struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+type EmailResponse struct {
+	To       string `json:"to"`
+	Attached bool   `json:"attached"`
+}
+
+// handleFileEmail sends a file to an email address: POST
+// /api/files/{id}/email with {"to", "message"}.
+func handleFileEmail(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if mailer == nil {
+		http.Error(w, "Email needs -smtp and -smtp-from", http.StatusNotFound)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	meta, _, err := storage.GetFile(id)
+	if err != nil || !inRoom(meta, room) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if meta.expired(time.Now()) {
+		http.Error(w, "File has expired", http.StatusGone)
+		return
+	}
+	if meta.Quarantined {
+		http.Error(w, "File is damaged", http.StatusInternalServerError)
+		return
+	}
+	if meta.embargoed(time.Now()) {
+		http.Error(w, "File isn't available until "+meta.AvailableFrom.UTC().Format(shareTimeFormat), http.StatusForbidden)
+		return
+	}
+
+	var req emailRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	to, err := mail.ParseAddress(req.To)
+	if err != nil {
+		http.Error(w, "Invalid email address", http.StatusBadRequest)
+		return
+	}
+
+	client := clientIP(r)
+	if !mailer.allow(client) {
+		w.Header().Set("Retry-After", "3600")
+		http.Error(w, fmt.Sprintf("At most %d emails an hour, try again later", emailsPerHour), http.StatusTooManyRequests)
+		return
+	}
+
+	attached, err := mailer.SendFile(meta, to.Address, req.Message)
+	if err != nil {
+		slog.Error("Failed to email file", "id", id, "error", err)
+		http.Error(w, "Failed to send email", http.StatusBadGateway)
+		return
+	}
+	slog.Info("File emailed", "id", id, "name", meta.Name, "attached", attached, "client", client)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EmailResponse{To: to.Address, Attached: attached})
+}
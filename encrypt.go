@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Encrypted blobs are a header followed by AES-256-GCM sealed segments of
+// up to encryptSegment plaintext bytes. Each segment's nonce is the random
+// prefix from the header, the segment number and a flag marking the last
+// segment, so segments can't be reordered, dropped or truncated unnoticed.
+const (
+	encryptMagic      = "SYNCITE1"
+	encryptSegment    = 64 << 10
+	encryptNonceFixed = 7
+	encryptKeyEnv     = "SYNCIT_ENCRYPTION_KEY"
+)
+
+// aesGCMDecorator is the StorageDecorator behind -encryption-key.
+type aesGCMDecorator struct {
+	aead cipher.AEAD
+}
+
+func newAESGCMDecorator(key []byte) (*aesGCMDecorator, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesGCMDecorator{aead: aead}, nil
+}
+
+// loadEncryptionKey returns the key given as a flag value, the environment
+// variable, or the contents of keyFile, in that order of preference. A
+// missing keyFile is created with a new random key.
+func loadEncryptionKey(value, keyFile string) ([]byte, error) {
+	if value == "" {
+		value = os.Getenv(encryptKeyEnv)
+	}
+	if value != "" {
+		return parseEncryptionKey(value)
+	}
+	if keyFile == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		rand.Read(key)
+		if err := os.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, fmt.Errorf("failed to create key file: %w", err)
+		}
+		slog.Warn("Created a new encryption key; back it up, files can't be read without it", "path", keyFile)
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if len(data) == 32 {
+		return data, nil
+	}
+	return parseEncryptionKey(string(data))
+}
+
+// parseEncryptionKey accepts 32 bytes as hex or base64.
+func parseEncryptionKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key must be 32 bytes as hex or base64 (e.g. from `openssl rand -hex 32`)")
+}
+
+func (d *aesGCMDecorator) Name() string {
+	return "aes-gcm"
+}
+
+func (d *aesGCMDecorator) nonce(prefix []byte, segment uint32, last bool) []byte {
+	nonce := make([]byte, 0, d.aead.NonceSize())
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, segment)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func (d *aesGCMDecorator) WrapWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	prefix := make([]byte, encryptNonceFixed)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(encryptMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{d: d, w: w, prefix: prefix, buf: make([]byte, 0, encryptSegment)}, nil
+}
+
+type encryptWriter struct {
+	d       *aesGCMDecorator
+	w       io.WriteCloser
+	prefix  []byte
+	segment uint32
+	buf     []byte
+	sealed  []byte
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more data arrives, so the
+		// last one is always the segment flushed by Close
+		if len(e.buf) == encryptSegment {
+			if err := e.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptSegment], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) flush(last bool) error {
+	if e.segment == ^uint32(0) {
+		return fmt.Errorf("file too large to encrypt")
+	}
+	e.sealed = e.d.aead.Seal(e.sealed[:0], e.d.nonce(e.prefix, e.segment, last), e.buf, nil)
+	e.segment++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.sealed)
+	return err
+}
+
+func (e *encryptWriter) Close() error {
+	if err := e.flush(true); err != nil {
+		return err
+	}
+	return e.w.Close()
+}
+
+// WrapReader decrypts blobs written by WrapWriter. Blobs without the header,
+// stored before encryption was turned on, are read as they are.
+func (d *aesGCMDecorator) WrapReader(r io.ReadCloser) (io.ReadCloser, error) {
+	br := bufio.NewReaderSize(r, encryptSegment+d.aead.Overhead()+1)
+	header, err := br.Peek(len(encryptMagic) + encryptNonceFixed)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(encryptMagic)) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, r}, nil
+	}
+	if len(header) < len(encryptMagic)+encryptNonceFixed {
+		return nil, fmt.Errorf("truncated encrypted file")
+	}
+
+	prefix := bytes.Clone(header[len(encryptMagic):])
+	br.Discard(len(header))
+	dr := &decryptReader{d: d, r: br, closer: r, prefix: prefix, sealed: make([]byte, encryptSegment+d.aead.Overhead())}
+	// Decrypting the first segment now reports a wrong key when the file is
+	// opened rather than partway through a response
+	if err := dr.next(); err != nil {
+		return nil, err
+	}
+	return dr, nil
+}
+
+type decryptReader struct {
+	d       *aesGCMDecorator
+	r       *bufio.Reader
+	closer  io.Closer
+	prefix  []byte
+	segment uint32
+	sealed  []byte
+	plain   []byte
+	done    bool
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plain) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plain)
+	d.plain = d.plain[n:]
+	return n, nil
+}
+
+func (d *decryptReader) next() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		d.done = true
+	case err != nil:
+		return err
+	default:
+		// A full segment is the last one when nothing follows it
+		if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+			d.done = true
+		}
+	}
+
+	plain, err := d.d.aead.Open(d.sealed[:0], d.d.nonce(d.prefix, d.segment, d.done), d.sealed[:n], nil)
+	if err != nil {
+		return fmt.Errorf("encrypted file is corrupt or was written with another key")
+	}
+	d.segment++
+	d.plain = plain
+	return nil
+}
+
+func (d *decryptReader) Close() error {
+	return d.closer.Close()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <meta name="robots" content="noindex">
+    <title>{{.Title}} - Sync-It</title>
+    <link rel="stylesheet" href="{{.BasePath}}/style.css">
+</head>
+<body>
+    <div class="container share-page error-page">
+        <header>
+            <h1>Sync-It</h1>
+        </header>
+        <main class="file-item">
+            <div class="file-info">
+                <div class="file-name">{{.Title}}</div>
+                <div class="file-meta">{{.Reason}}</div>
+                <div class="error-status">Error {{.Status}}</div>
+            </div>
+        </main>
+    </div>
+</body>
+</html>
+`))
+
+type errorPage struct {
+	Status   int
+	Title    string
+	Reason   string
+	BasePath string
+}
+
+// prefersHTML reports whether the client asked for an HTML page, as browsers
+// following a link do, rather than accepting anything like curl or fetch.
+func prefersHTML(r *http.Request) bool {
+	htmlQ, otherQ := 0.0, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				q, _ = strconv.ParseFloat(v, 64)
+			}
+		}
+		switch {
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			htmlQ = max(htmlQ, q)
+		case !strings.HasSuffix(mediaType, "/*"):
+			otherQ = max(otherQ, q)
+		}
+	}
+	return htmlQ > 0 && htmlQ >= otherQ
+}
+
+// pageError reports an error on a link people open in a browser: as a page
+// explaining reason when the client prefers HTML, and otherwise as the plain
+// text message, as http.Error would.
+func pageError(w http.ResponseWriter, r *http.Request, message string, status int, title, reason string) {
+	if !prefersHTML(r) {
+		http.Error(w, message, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Del("Content-Disposition")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	page := errorPage{Status: status, Title: title, Reason: reason, BasePath: basePath}
+	if err := errorTemplate.Execute(w, page); err != nil {
+		slog.Error("Failed to render error page", "error", err)
+	}
+}
+
+// fileNotFound and fileExpired are the pages for shared links to files that
+// are gone.
+func fileNotFound(w http.ResponseWriter, r *http.Request) {
+	pageError(w, r, "File not found", http.StatusNotFound, "File not found",
+		"This link doesn't lead to a file any more. Shared files are removed when they expire or when the person who shared them deletes them; ask them to send it again.")
+}
+
+func fileQuarantined(w http.ResponseWriter, r *http.Request, meta *FileMetadata) {
+	pageError(w, r, "File is damaged", http.StatusInternalServerError, "This file is damaged",
+		"The stored copy of "+meta.Name+" failed an integrity check, so it isn't being served. Ask the person who shared it to upload it again.")
+}
+
+// fileEmbargoed is the page for files held back by availableFrom, which
+// names the time and suggests retrying then.
+func fileEmbargoed(w http.ResponseWriter, r *http.Request, meta *FileMetadata) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(meta.AvailableFrom).Seconds())+1))
+	available := meta.AvailableFrom.In(requestLocation(r)).Format(shareTimeFormat)
+	pageError(w, r, "File isn't available until "+available, http.StatusForbidden, "Not available yet",
+		meta.Name+" can be downloaded from "+available+". Come back then.")
+}
+
+func fileExpired(w http.ResponseWriter, r *http.Request, meta *FileMetadata) {
+	pageError(w, r, "File has expired", http.StatusGone, "This file has expired",
+		meta.Name+" was only available until "+meta.ExpiresAt.In(requestLocation(r)).Format(shareTimeFormat)+". Ask the person who shared it to send it again.")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventFileUploaded   = "file.uploaded"
+	EventFileDeleted    = "file.deleted"
+	EventFileDownloaded = "file.downloaded"
+	EventFileExpired    = "file.expired"
+	EventFileRestored   = "file.restored"
+	EventFilePending    = "file.pending"
+	EventFileEvicted    = "file.evicted"
+	EventNoteCreated    = "note.created"
+	EventNoteUpdated    = "note.updated"
+	EventNoteDeleted    = "note.deleted"
+	EventRoomClosed     = "room.closed"
+	EventRoomExpired    = "room.expired"
+)
+
+type Event struct {
+	Type string        `json:"type"`
+	Time time.Time     `json:"time"`
+	File *FileMetadata `json:"file,omitempty"`
+	Note *Note         `json:"note,omitempty"`
+	Room *Room         `json:"room,omitempty"`
+
+	// Files lists what was purged with a closed or expired room.
+	Files []FileMetadata `json:"files,omitempty"`
+}
+
+// EventBus delivers events to in-process subscribers. Handlers run on their
+// own goroutine so publishers (often holding storage locks) never block.
+type EventBus struct {
+	handlers []func(Event)
+	mu       sync.RWMutex
+}
+
+var events = &EventBus{}
+
+func (b *EventBus) Subscribe(handler func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, h := range b.handlers {
+		go h(e)
+	}
+}
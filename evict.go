@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// downloadTouchInterval is how stale a file's LastDownloadedAt may get
+// before a download records it again, so streaming a video in ranges
+// doesn't rewrite the metadata for every request.
+const downloadTouchInterval = time.Minute
+
+// MarkDownloaded records that file id was just downloaded.
+func (fs *FileStorage) MarkDownloaded(id string) {
+	if meta, _, err := fs.GetFile(id); err != nil || meta.Imported || time.Since(meta.LastDownloadedAt) < downloadTouchInterval {
+		return
+	}
+	if _, err := fs.UpdateFile(id, func(meta *FileMetadata) { meta.LastDownloadedAt = time.Now() }); err != nil {
+		slog.Warn("Failed to record download", "id", id, "error", err)
+	}
+}
+
+// lastUsed is when the file was last downloaded, or uploaded if never.
+func (m *FileMetadata) lastUsed() time.Time {
+	if m.LastDownloadedAt.After(m.UploadedAt) {
+		return m.LastDownloadedAt
+	}
+	return m.UploadedAt
+}
+
+// EvictNext removes the file that can best be spared for good, skipping the
+// trash: the one longest in the trash, else the live file least recently
+// used. It returns nil when there is nothing left to evict, and the bytes
+// freed, which are 0 when other files share the contents.
+func (fs *FileStorage) EvictNext() (*FileMetadata, int64, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	victim := -1
+	for i := range fs.files {
+		meta := &fs.files[i]
+		if meta.deleted() && !meta.Trashed {
+			// Being kept for downloads in progress
+			continue
+		}
+		if victim < 0 {
+			victim = i
+			continue
+		}
+		best := &fs.files[victim]
+		switch {
+		case meta.Trashed != best.Trashed:
+			if meta.Trashed {
+				victim = i
+			}
+		case meta.Trashed:
+			if meta.DeletedAt.Before(best.DeletedAt) {
+				victim = i
+			}
+		case meta.lastUsed().Before(best.lastUsed()):
+			victim = i
+		}
+	}
+	if victim < 0 {
+		return nil, 0, nil
+	}
+
+	meta := fs.files[victim]
+	previous := fs.files
+	fs.files = append(fs.files[:victim:victim], fs.files[victim+1:]...)
+	if err := fs.commit(nil, []string{meta.ID}); err != nil {
+		fs.files = previous
+		return nil, 0, err
+	}
+	freed := fs.releaseBlobs([]FileMetadata{meta})
+	events.Publish(Event{Type: EventFileEvicted, File: &meta})
+	return &meta, freed, nil
+}
+
+// Evictor keeps a minimum of free space by evicting files early, so new
+// uploads don't fail when the disk fills up.
+type Evictor struct {
+	minFree    int64   // bytes, or
+	minFreePct float64 // percent of the total
+	limit      int64   // -storage-limit, measured against instead of the disk
+
+	mu sync.Mutex
+}
+
+// evictor is nil unless -evict-below is set.
+var evictor *Evictor
+
+// NewEvictor keeps threshold free, a size such as "5GB" or a percentage
+// such as "10%".
+func NewEvictor(threshold string, limit int64) (*Evictor, error) {
+	e := &Evictor{limit: limit}
+	if pct, ok := strings.CutSuffix(strings.TrimSpace(threshold), "%"); ok {
+		v, err := strconv.ParseFloat(pct, 64)
+		if err != nil || v <= 0 || v >= 100 {
+			return nil, fmt.Errorf("invalid -evict-below %q (use e.g. 10%% or 5GB)", threshold)
+		}
+		e.minFreePct = v
+		return e, nil
+	}
+	size, err := parseSize(threshold)
+	if err != nil || size <= 0 {
+		return nil, fmt.Errorf("invalid -evict-below %q (use e.g. 10%% or 5GB)", threshold)
+	}
+	e.minFree = size
+	return e, nil
+}
+
+func (e *Evictor) String() string {
+	if e.minFreePct > 0 {
+		return strconv.FormatFloat(e.minFreePct, 'g', -1, 64) + "%"
+	}
+	return formatSize(e.minFree)
+}
+
+// MakeRoom evicts files until need more bytes fit without free space
+// dropping below the threshold, or nothing is left to evict.
+func (e *Evictor) MakeRoom(need int64) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	used, total, err := storageUsage(e.limit)
+	if err != nil || total == 0 {
+		return
+	}
+	minFree := e.minFree
+	if e.minFreePct > 0 {
+		minFree = int64(float64(total) * e.minFreePct / 100)
+	}
+	free := int64(total) - int64(used)
+	deficit := minFree + need - free
+	if deficit <= 0 {
+		return
+	}
+
+	var evicted int
+	var reclaimed int64
+	for reclaimed < deficit {
+		meta, freed, err := storage.EvictNext()
+		if err != nil {
+			slog.Error("Failed to evict file", "error", err)
+			break
+		}
+		if meta == nil {
+			slog.Warn("Nothing left to evict", "free", formatSize(free+reclaimed), "wanted", formatSize(minFree+need))
+			break
+		}
+		evicted++
+		reclaimed += freed
+		slog.Warn("Evicted file to free space", "id", meta.ID, "name", meta.Name, "lastUsed", meta.lastUsed().Format(time.RFC3339), "trashed", meta.Trashed, "freed", formatSize(freed))
+	}
+	if evicted > 0 {
+		slog.Info("Eviction finished", "files", evicted, "reclaimed", formatSize(reclaimed), "free", formatSize(free+reclaimed))
+	}
+}
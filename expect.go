@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errExpectationNotFound = errors.New("expected upload not found")
+	errExpectationReceived = errors.New("expected upload was already received")
+	errSlugTaken           = errors.New("slug is already in use")
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// Expectation reserves a place for a file someone will upload later, such
+// as "Dad's video", and what it should be, so the upload can be checked
+// against it. Once received it points at the file until it expires.
+type Expectation struct {
+	ID         string    `json:"id"`
+	Slug       string    `json:"slug,omitempty"`
+	Room       string    `json:"room,omitempty"`
+	Label      string    `json:"label,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	SHA256     string    `json:"sha256,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	FileID     string    `json:"fileId,omitempty"`
+	ReceivedAt time.Time `json:"receivedAt,omitzero"`
+}
+
+func (e *Expectation) matches(ref string) bool {
+	return e.ID == ref || e.Slug != "" && e.Slug == strings.ToLower(ref)
+}
+
+type ExpectStorage struct {
+	file         string
+	expectations []Expectation
+	mu           sync.RWMutex
+}
+
+func NewExpectStorage(dir string) (*ExpectStorage, error) {
+	es := &ExpectStorage{
+		file:         stateFile(dir, "expectations.json"),
+		expectations: []Expectation{},
+	}
+
+	data, err := os.ReadFile(es.file)
+	if os.IsNotExist(err) {
+		return es, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read expected uploads: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &es.expectations); err != nil {
+		return nil, fmt.Errorf("failed to parse expected uploads: %w", err)
+	}
+
+	return es, nil
+}
+
+func (es *ExpectStorage) save() error {
+	data, err := json.MarshalIndent(es.expectations, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal expected uploads: %w", err)
+	}
+
+	if err := writeStateFile(es.file, data, 0644); err != nil {
+		return fmt.Errorf("failed to write expected uploads: %w", err)
+	}
+
+	return nil
+}
+
+// live returns the unexpired expectations. Must be called with es.mu held.
+func (es *ExpectStorage) live() []Expectation {
+	now := time.Now()
+	var live []Expectation
+	for _, e := range es.expectations {
+		if now.Before(e.ExpiresAt) {
+			live = append(live, e)
+		}
+	}
+	return live
+}
+
+func (es *ExpectStorage) Create(e Expectation) (*Expectation, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	live := es.live()
+	if e.Slug != "" {
+		for _, other := range live {
+			if other.Room == e.Room && other.Slug == e.Slug {
+				return nil, errSlugTaken
+			}
+		}
+	}
+
+	id, err := generateID(func(id string) bool {
+		for _, other := range es.expectations {
+			if other.ID == id {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	e.ID = id
+	e.CreatedAt = time.Now()
+
+	previous := es.expectations
+	es.expectations = append(live, e)
+	if err := es.save(); err != nil {
+		es.expectations = previous
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// List returns the room's unexpired expectations, received or not.
+func (es *ExpectStorage) List(room string) []Expectation {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+
+	result := []Expectation{}
+	for _, e := range es.live() {
+		if e.Room == room {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Get looks up an expectation in room by ID or slug.
+func (es *ExpectStorage) Get(room, ref string) (*Expectation, error) {
+	for _, e := range es.List(room) {
+		if e.matches(ref) {
+			return &e, nil
+		}
+	}
+	return nil, errExpectationNotFound
+}
+
+// Receive records file as the upload expectation id was waiting for.
+func (es *ExpectStorage) Receive(id string, file *FileMetadata) (*Expectation, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	for i := range es.expectations {
+		e := &es.expectations[i]
+		if e.ID != id {
+			continue
+		}
+		if e.FileID != "" {
+			return nil, errExpectationReceived
+		}
+		e.FileID, e.ReceivedAt = file.ID, time.Now()
+		if err := es.save(); err != nil {
+			e.FileID, e.ReceivedAt = "", time.Time{}
+			return nil, err
+		}
+		received := *e
+		return &received, nil
+	}
+	return nil, errExpectationNotFound
+}
+
+// Remove cancels expectations in room: the one matching ref, or all of them
+// if ref is empty.
+func (es *ExpectStorage) Remove(room, ref string) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	previous := es.expectations
+	kept := []Expectation{}
+	for _, e := range es.expectations {
+		if e.Room != room || ref != "" && !e.matches(ref) {
+			kept = append(kept, e)
+		}
+	}
+	if len(kept) == len(previous) {
+		if ref == "" {
+			return nil
+		}
+		return errExpectationNotFound
+	}
+
+	es.expectations = kept
+	if err := es.save(); err != nil {
+		es.expectations = previous
+		return err
+	}
+	return nil
+}
+
+// errExpectMismatch reports an upload that isn't the file its expectation
+// described.
+type errExpectMismatch struct{ reason string }
+
+func (e errExpectMismatch) Error() string {
+	return "upload doesn't match the expected file: " + e.reason
+}
+
+// expectReader checks an upload's size and checksum against an expectation
+// as it is read, failing the read, and so the upload, on a mismatch.
+type expectReader struct {
+	r    io.Reader
+	exp  *Expectation
+	n    int64
+	hash hash.Hash
+}
+
+func (e *Expectation) verify(r io.Reader) io.Reader {
+	return &expectReader{r: r, exp: e, hash: sha256.New()}
+}
+
+func (er *expectReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	er.n += int64(n)
+	er.hash.Write(p[:n])
+	if er.exp.Size > 0 && er.n > er.exp.Size {
+		return n, errExpectMismatch{fmt.Sprintf("larger than the expected %d bytes", er.exp.Size)}
+	}
+	if err == io.EOF {
+		if er.exp.Size > 0 && er.n != er.exp.Size {
+			return n, errExpectMismatch{fmt.Sprintf("%d bytes, expected %d", er.n, er.exp.Size)}
+		}
+		if sum := hex.EncodeToString(er.hash.Sum(nil)); er.exp.SHA256 != "" && sum != er.exp.SHA256 {
+			return n, errExpectMismatch{"SHA-256 is " + sum + ", expected " + er.exp.SHA256}
+		}
+	}
+	return n, err
+}
+
+func isSHA256(s string) bool {
+	_, err := hex.DecodeString(s)
+	return len(s) == 64 && err == nil
+}
+
+// rejectMismatch answers 422 and returns true when a save failed because
+// the upload didn't match its expectation.
+func rejectMismatch(w http.ResponseWriter, err error) bool {
+	var mismatch errExpectMismatch
+	if !errors.As(err, &mismatch) {
+		return false
+	}
+	http.Error(w, mismatch.Error(), http.StatusUnprocessableEntity)
+	return true
+}
+
+// requestExpectation finds the expectation an upload is for, named by ID or
+// slug in an expect form field or query parameter, or an X-Expect header
+// for raw uploads. It returns nil without one, and false after responding
+// when it can't be used.
+func requestExpectation(w http.ResponseWriter, r *http.Request, room string) (*Expectation, bool) {
+	ref := r.FormValue("expect")
+	if ref == "" {
+		ref = r.Header.Get("X-Expect")
+	}
+	if ref == "" {
+		return nil, true
+	}
+	return lookupExpectation(w, room, ref)
+}
+
+// lookupExpectation returns room's pending expectation ref, or false after
+// responding when it's unknown or already received.
+func lookupExpectation(w http.ResponseWriter, room, ref string) (*Expectation, bool) {
+	e, err := expectations.Get(room, ref)
+	if err != nil {
+		http.Error(w, "Expected upload not found", http.StatusNotFound)
+		return nil, false
+	}
+	if e.FileID != "" {
+		http.Error(w, "Expected upload was already received", http.StatusConflict)
+		return nil, false
+	}
+	return e, true
+}
+
+type expectRequest struct {
+	Slug           string `json:"slug"`
+	Label          string `json:"label"`
+	Name           string `json:"name"`
+	Size           int64  `json:"size"`
+	SHA256         string `json:"sha256"`
+	ExpiresInHours int    `json:"expiresInHours"`
+}
+
+type ExpectationsResponse struct {
+	Expected []Expectation `json:"expected"`
+}
+
+// handleExpectations lists the room's expected uploads (GET /api/expect) or
+// reserves one (POST /api/expect).
+func handleExpectations(w http.ResponseWriter, r *http.Request) {
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	code := roomCode(room)
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ExpectationsResponse{Expected: expectations.List(code)})
+
+	case http.MethodPost:
+		if rejectIfMaintenance(w) {
+			return
+		}
+		var req expectRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		req.Slug = strings.ToLower(strings.TrimSpace(req.Slug))
+		req.SHA256 = strings.ToLower(strings.TrimSpace(req.SHA256))
+		switch {
+		case req.Slug != "" && !slugPattern.MatchString(req.Slug):
+			http.Error(w, "Slug must be up to 64 lowercase letters, digits and dashes", http.StatusBadRequest)
+			return
+		case req.SHA256 != "" && !isSHA256(req.SHA256):
+			http.Error(w, "Invalid SHA-256", http.StatusBadRequest)
+			return
+		case req.Size < 0 || len(req.Label) > 256 || len(req.Name) > 256:
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		e, err := expectations.Create(Expectation{
+			Slug:      req.Slug,
+			Room:      code,
+			Label:     strings.TrimSpace(req.Label),
+			Name:      strings.TrimSpace(req.Name),
+			Size:      req.Size,
+			SHA256:    req.SHA256,
+			ExpiresAt: time.Now().Add(room.clampExpiration(expirationFor(req.ExpiresInHours))),
+		})
+		if errors.Is(err, errSlugTaken) {
+			http.Error(w, "Slug is already in use", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to reserve expected upload", "error", err)
+			http.Error(w, "Failed to reserve upload", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Upload expected", "id", e.ID, "slug", e.Slug, "label", e.Label, "size", e.Size, "client", clientIP(r))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(e)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleExpectation looks up (GET /api/expect/{id}) or cancels
+// (DELETE /api/expect/{id}) an expected upload, by ID or slug.
+func handleExpectation(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/api/expect/")
+	if ref == "" || strings.Contains(ref, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	code := roomCode(room)
+
+	switch r.Method {
+	case http.MethodGet:
+		e, err := expectations.Get(code, ref)
+		if err != nil {
+			http.Error(w, "Expected upload not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(e)
+
+	case http.MethodDelete:
+		if rejectIfMaintenance(w) {
+			return
+		}
+		err := expectations.Remove(code, ref)
+		if errors.Is(err, errExpectationNotFound) {
+			http.Error(w, "Expected upload not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to cancel expected upload", "ref", ref, "error", err)
+			http.Error(w, "Failed to cancel expected upload", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Expected upload cancelled", "ref", ref, "client", clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Limits on what one archive may unpack into, so a small upload can't
+// expand into something that fills the disk.
+const (
+	maxExtractFiles = 10000
+	maxExtractRatio = 100 // extracted bytes per archive byte
+)
+
+// errUnsafeEntry rejects an archive with an entry that would land outside
+// the folder it is extracted into.
+type errUnsafeEntry struct{ name string }
+
+func (e errUnsafeEntry) Error() string {
+	return fmt.Sprintf("archive entry %q points outside the archive", e.name)
+}
+
+// archiveEntry is one file in an archive.
+type archiveEntry struct {
+	name    string
+	size    int64
+	regular bool
+	open    func() (io.ReadCloser, error)
+}
+
+// archiveFormat tells which archive filename is by its extension, or ""
+// when it isn't one that can be extracted.
+func archiveFormat(filename string) string {
+	name := strings.ToLower(filename)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	}
+	return ""
+}
+
+// walkArchive calls fn for every entry of the archive in file, in order.
+func walkArchive(format string, file multipart.File, size int64, fn func(archiveEntry) error) error {
+	if format == "zip" {
+		zr, err := zip.NewReader(file, size)
+		if err != nil {
+			return fmt.Errorf("not a valid zip file: %w", err)
+		}
+		for _, f := range zr.File {
+			entry := archiveEntry{name: f.Name, size: int64(f.UncompressedSize64), regular: f.Mode().IsRegular(), open: f.Open}
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var r io.Reader = file
+	if format == "tar.gz" {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return fmt.Errorf("not a valid gzip file: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("not a valid tar file: %w", err)
+		}
+		// Links, devices and the like aren't files to share
+		entry := archiveEntry{name: hdr.Name, size: hdr.Size, regular: hdr.Typeflag == tar.TypeReg}
+		entry.open = func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+}
+
+// entryPath splits an entry's name into the folder below folder it is
+// extracted into and its file name. Names escaping the archive, by ".." or
+// an absolute path, are errUnsafeEntry. skip is true for directories and
+// the metadata macOS adds to archives.
+func entryPath(folder, name string) (dir, base string, skip bool, err error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || len(name) > 1 && name[1] == ':' {
+		return "", "", false, errUnsafeEntry{name}
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", "", false, errUnsafeEntry{name}
+		}
+	}
+	dir, base = path.Split(name)
+	if base == "" || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, "._") || base == ".DS_Store" {
+		return "", "", true, nil
+	}
+	dir, err = cleanFolder(folder + "/" + dir)
+	return dir, base, false, err
+}
+
+type ExtractResponse struct {
+	Files   []FileMetadata `json:"files"`
+	Skipped []string       `json:"skipped,omitempty"`
+}
+
+// handleExtract stores each file in the archive uploaded to /api/upload
+// with extract=true as a file of its own, in folders below folder matching
+// the archive's directories. The archive is checked in full before anything
+// is stored: entries escaping it are refused, as are archives with more than
+// maxExtractFiles files or expanding to more than maxExtractRatio times their
+// size. If storing an entry fails, the entries already stored are deleted
+// again, so the archive is extracted entirely or not at all.
+func handleExtract(w http.ResponseWriter, r *http.Request, room *Room, folder string, opts uploadOptions, file multipart.File, header *multipart.FileHeader, expiration time.Duration) {
+	format := archiveFormat(header.Filename)
+	if format == "" {
+		http.Error(w, "extract needs a .zip, .tar.gz or .tar file", http.StatusBadRequest)
+		return
+	}
+	if opts.Expect != nil {
+		http.Error(w, "An extracted archive can't fulfil an expected upload", http.StatusBadRequest)
+		return
+	}
+	if opts.SHA256 != nil {
+		// The archive is spooled already, so check it before unpacking
+		h := sha256.New()
+		if _, err := io.Copy(h, file); err != nil {
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != opts.SHA256() {
+			rejectMismatch(w, errExpectMismatch{"SHA-256 is " + sum + ", expected " + opts.SHA256()})
+			return
+		}
+	}
+
+	// Check it all first; sizes are those the archive declares, which the
+	// readers hold each entry to
+	var files int
+	var total int64
+	var skipped []string
+	err := walkArchive(format, file, header.Size, func(e archiveEntry) error {
+		_, _, skip, err := entryPath(folder, e.name)
+		switch {
+		case err != nil:
+			return err
+		case skip:
+			return nil
+		case !e.regular:
+			skipped = append(skipped, e.name)
+			return nil
+		}
+		files++
+		total += e.size
+		if files > maxExtractFiles {
+			return fmt.Errorf("archive has more than %d files", maxExtractFiles)
+		}
+		if total > max(header.Size, 1)*maxExtractRatio {
+			return fmt.Errorf("archive expands to more than %d times its size", maxExtractRatio)
+		}
+		return checkUploadSize(e.size)
+	})
+	if rejectTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if files == 0 {
+		http.Error(w, "Archive has no files", http.StatusBadRequest)
+		return
+	}
+	if rejectOverQuota(w, opts.Quota.check(total)) {
+		return
+	}
+	evictor.MakeRoom(total)
+
+	stored := []FileMetadata{}
+	err = walkArchive(format, file, header.Size, func(e archiveEntry) error {
+		dir, base, skip, _ := entryPath(folder, e.name)
+		if skip || !e.regular {
+			return nil
+		}
+		body, err := e.open()
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		meta, err := storage.SaveNewFile(opts.file(roomCode(room), dir, base), opts.Quota.limit(body), expiration)
+		if err != nil {
+			return err
+		}
+		stored = append(stored, *opts.apply(meta))
+		return nil
+	})
+	if err != nil {
+		for _, meta := range stored {
+			storage.DeleteFile(meta.ID)
+		}
+		if rejectOverQuota(w, err) || rejectStorageFull(w, err) || rejectTooLarge(w, err) {
+			return
+		}
+		if errors.Is(err, zip.ErrFormat) || errors.Is(err, zip.ErrChecksum) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, tar.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+			http.Error(w, "Archive is damaged", http.StatusBadRequest)
+			return
+		}
+		slog.Error("Failed to extract archive", "filename", header.Filename, "error", err)
+		http.Error(w, "Failed to extract archive", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Archive extracted", "filename", header.Filename, "files", len(stored), "size", total, "skipped", len(skipped), "client", clientIP(r))
+
+	now := time.Now()
+	for i := range stored {
+		stored[i].humanize(now)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ExtractResponse{Files: stored, Skipped: skipped})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// faultStreamWindow bounds how far into a stream an injected failure can
+// happen, so small files fail part way through as well as large ones.
+const faultStreamWindow = 4 << 20
+
+var errInjectedFault = errors.New("injected storage fault")
+
+// faultInjector is a storage decorator that makes reads and writes of file
+// contents randomly stall or fail, for testing how clients retry and resume.
+// Set with -fault-injection; never use it on a server people rely on.
+type faultInjector struct {
+	failRate  float64 // chance an open fails, at once or part way through
+	delayRate float64 // chance an open stalls first
+	maxDelay  time.Duration
+}
+
+// parseFaultInjection reads settings such as "fail=5%,delay=20%,max-delay=2s".
+func parseFaultInjection(s string) (*faultInjector, error) {
+	f := &faultInjector{maxDelay: time.Second}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault setting %q (use e.g. fail=5%%,delay=20%%,max-delay=2s)", entry)
+		}
+		switch key {
+		case "fail", "delay":
+			pct, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil || pct < 0 || pct > 100 {
+				return nil, fmt.Errorf("invalid %s rate %q (use a percentage)", key, value)
+			}
+			if key == "fail" {
+				f.failRate = pct / 100
+			} else {
+				f.delayRate = pct / 100
+			}
+		case "max-delay":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid max-delay %q", value)
+			}
+			f.maxDelay = d
+		default:
+			return nil, fmt.Errorf("unknown fault setting %q (use fail, delay or max-delay)", key)
+		}
+	}
+	if f.failRate == 0 && f.delayRate == 0 {
+		return nil, fmt.Errorf("fault injection needs a fail or delay rate")
+	}
+	return f, nil
+}
+
+// rejectInjectedFault answers 503 and returns true when err is an injected
+// fault, which would otherwise look like a missing file.
+func rejectInjectedFault(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errInjectedFault) {
+		return false
+	}
+	http.Error(w, "Storage temporarily unavailable", http.StatusServiceUnavailable)
+	return true
+}
+
+func (f *faultInjector) Name() string { return "fault-injection" }
+
+func (f *faultInjector) String() string {
+	return fmt.Sprintf("fail=%g%%,delay=%g%%,max-delay=%s", f.failRate*100, f.delayRate*100, f.maxDelay)
+}
+
+// roll stalls the caller by chance, then decides whether its stream fails:
+// it returns 0 to fail straight away, the offset to fail at, or -1 for no
+// fault.
+func (f *faultInjector) roll(op string) int64 {
+	if rand.Float64() < f.delayRate {
+		d := rand.N(f.maxDelay)
+		slog.Debug("Injected storage delay", "op", op, "delay", d.String())
+		time.Sleep(d)
+	}
+	if rand.Float64() >= f.failRate {
+		return -1
+	}
+	// Half fail at once, half part way through
+	if rand.IntN(2) == 0 {
+		slog.Info("Injected storage fault", "op", op)
+		return 0
+	}
+	return 1 + rand.Int64N(faultStreamWindow)
+}
+
+func (f *faultInjector) WrapWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	failAt := f.roll("write")
+	if failAt == 0 {
+		return nil, errInjectedFault
+	}
+	return &faultyWriter{WriteCloser: w, failAt: failAt}, nil
+}
+
+func (f *faultInjector) WrapReader(r io.ReadCloser) (io.ReadCloser, error) {
+	failAt := f.roll("read")
+	if failAt == 0 {
+		return nil, errInjectedFault
+	}
+	return &faultyReader{ReadCloser: r, failAt: failAt}, nil
+}
+
+// faultyWriter fails once failAt bytes have been written, unless it is -1.
+type faultyWriter struct {
+	io.WriteCloser
+	failAt, n int64
+}
+
+func (w *faultyWriter) Write(p []byte) (int, error) {
+	if w.failAt >= 0 && w.n+int64(len(p)) >= w.failAt {
+		n, _ := w.WriteCloser.Write(p[:w.failAt-w.n])
+		w.n += int64(n)
+		slog.Info("Injected storage fault", "op", "write", "after", w.n)
+		return n, errInjectedFault
+	}
+	n, err := w.WriteCloser.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// faultyReader fails once failAt bytes have been read, unless it is -1.
+type faultyReader struct {
+	io.ReadCloser
+	failAt, n int64
+}
+
+func (r *faultyReader) Read(p []byte) (int, error) {
+	if r.failAt >= 0 {
+		if r.n >= r.failAt {
+			slog.Info("Injected storage fault", "op", "read", "after", r.n)
+			return 0, errInjectedFault
+		}
+		p = p[:min(int64(len(p)), r.failAt-r.n)]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	maxFetches     = 4         // downloads running at once
+	fetchKeepAfter = time.Hour // how long finished fetches stay listed
+)
+
+// fetchEnabled turns on POST /api/fetch. Set with -fetch.
+var fetchEnabled bool
+
+// Fetch states.
+const (
+	fetchRunning  = "downloading"
+	fetchDone     = "done"
+	fetchFailed   = "failed"
+	fetchCanceled = "canceled"
+)
+
+// FetchJob is a URL the server is downloading into storage for a client.
+type FetchJob struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Name     string `json:"name,omitempty"` // set once known
+	Status   string `json:"status"`
+	Received int64  `json:"received"`
+	Size     int64  `json:"size"` // -1 until known, as when the server sends none
+	Error    string `json:"error,omitempty"`
+
+	StartedAt  time.Time      `json:"startedAt"`
+	FinishedAt *time.Time     `json:"finishedAt,omitempty"`
+	File       *ShareResponse `json:"file,omitempty"`
+
+	room, folder string
+	cancel       context.CancelFunc
+}
+
+// Fetches keeps the fetches of the last fetchKeepAfter in memory; they
+// aren't worth keeping across restarts, which cut running ones short.
+type Fetches struct {
+	mu   sync.Mutex
+	jobs map[string]*FetchJob
+}
+
+var fetches = &Fetches{jobs: map[string]*FetchJob{}}
+
+// fetchClient refuses to connect to the server's own addresses and to
+// link-local ones such as cloud metadata services, which a client on the
+// LAN couldn't reach itself. Other LAN addresses are allowed, as any client
+// on the network can reach those anyway. It never goes through an
+// HTTP(S)_PROXY, where only the proxy's address could be checked.
+var fetchClient = &http.Client{Transport: &http.Transport{
+	DialContext:           (&net.Dialer{Timeout: 30 * time.Second, Control: refuseLocalAddress}).DialContext,
+	TLSHandshakeTimeout:   30 * time.Second,
+	ResponseHeaderTimeout: time.Minute,
+}}
+
+func refuseLocalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || isOwnAddress(ip) {
+		return fmt.Errorf("fetching from %s isn't allowed", host)
+	}
+	return nil
+}
+
+// isOwnAddress reports whether ip belongs to one of the server's network
+// interfaces.
+func isOwnAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		// Can't tell, so don't risk it
+		return true
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Start registers a fetch of u and runs it in the background.
+func (f *Fetches) Start(room, folder string, u *url.URL, name string, opts uploadOptions, expiration time.Duration) (*FetchJob, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prune()
+	running := 0
+	for _, job := range f.jobs {
+		if job.Status == fetchRunning {
+			running++
+		}
+	}
+	if running >= maxFetches {
+		return nil, errTooManyFetches
+	}
+	id, err := generateID(func(id string) bool { return f.jobs[id] != nil })
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &FetchJob{ID: id, URL: u.String(), Name: name, Status: fetchRunning, Size: -1, StartedAt: time.Now(), room: room, folder: folder, cancel: cancel}
+	f.jobs[id] = job
+	go f.run(ctx, job, opts, expiration)
+	return job.clone(), nil
+}
+
+var errTooManyFetches = fmt.Errorf("at most %d downloads can run at once", maxFetches)
+
+// prune drops fetches that finished over fetchKeepAfter ago. Must be called
+// with f.mu held.
+func (f *Fetches) prune() {
+	cutoff := time.Now().Add(-fetchKeepAfter)
+	for id, job := range f.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) {
+			delete(f.jobs, id)
+		}
+	}
+}
+
+func (f *Fetches) run(ctx context.Context, job *FetchJob, opts uploadOptions, expiration time.Duration) {
+	defer job.cancel()
+	meta, err := f.download(ctx, job, opts, expiration)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	job.FinishedAt = &now
+	switch {
+	case job.Status == fetchCanceled:
+		slog.Info("Fetch canceled", "id", job.ID, "url", job.URL)
+	case err != nil:
+		job.Status = fetchFailed
+		job.Error = err.Error()
+		slog.Warn("Fetch failed", "id", job.ID, "url", job.URL, "error", err)
+	default:
+		job.Status = fetchDone
+		resp := newShareResponse(meta)
+		job.File = &resp
+		slog.Info("File fetched", "id", meta.ID, "filename", meta.Name, "size", meta.Size, "url", job.URL, "took", time.Since(job.StartedAt).Round(time.Second).String())
+	}
+}
+
+func (f *Fetches) download(ctx context.Context, job *FetchJob, opts uploadOptions, expiration time.Duration) (*FileMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, job.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "sync-it")
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("server answered %s", resp.Status)
+	}
+
+	// Refused up front when the size is known, like uploads
+	if resp.ContentLength >= 0 {
+		if err := checkUploadSize(resp.ContentLength); err != nil {
+			return nil, err
+		}
+		if err := opts.Quota.check(resp.ContentLength); err != nil {
+			return nil, err
+		}
+		evictor.MakeRoom(resp.ContentLength)
+	}
+
+	name := job.Name
+	if name == "" {
+		name = fetchFilename(resp)
+	}
+	f.mu.Lock()
+	job.Name, job.Size = name, resp.ContentLength
+	f.mu.Unlock()
+
+	body := &fetchProgress{r: resp.Body, fetches: f, job: job}
+	var stalled atomic.Bool
+	if uploadTimeout > 0 {
+		// A fetch that stops making progress is dropped like a stalled upload
+		body.stall = time.AfterFunc(uploadTimeout, func() {
+			stalled.Store(true)
+			job.cancel()
+		})
+		defer body.stall.Stop()
+	}
+	meta, err := storage.SaveNewFile(opts.file(job.room, job.folder, name), opts.body(body), expiration)
+	if stalled.Load() {
+		return nil, fmt.Errorf("stalled, nothing received for %s", uploadTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return opts.apply(meta), nil
+}
+
+// fetchFilename names a fetched file after the response's
+// Content-Disposition, or else the last element of the URL it came from.
+func fetchFilename(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." {
+		return name
+	}
+	return "download-" + time.Now().Format("20060102-150405")
+}
+
+// fetchProgress counts the bytes of a fetch as they arrive.
+type fetchProgress struct {
+	r       io.Reader
+	fetches *Fetches
+	job     *FetchJob
+	stall   *time.Timer
+}
+
+func (p *fetchProgress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.fetches.mu.Lock()
+		p.job.Received += int64(n)
+		p.fetches.mu.Unlock()
+		if p.stall != nil {
+			p.stall.Reset(uploadTimeout)
+		}
+	}
+	return n, err
+}
+
+// clone copies the job for a response. Must be called with f.mu held.
+func (job *FetchJob) clone() *FetchJob {
+	c := *job
+	return &c
+}
+
+// Get returns fetch id of room.
+func (f *Fetches) Get(room, id string) (*FetchJob, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, ok := f.jobs[id]
+	if !ok || job.room != room {
+		return nil, false
+	}
+	return job.clone(), true
+}
+
+// List returns room's fetches, newest first.
+func (f *Fetches) List(room string) []*FetchJob {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.prune()
+	result := []*FetchJob{}
+	for _, job := range f.jobs {
+		if job.room == room {
+			result = append(result, job.clone())
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].StartedAt.After(result[j].StartedAt)
+	})
+	return result
+}
+
+// Cancel stops fetch id if it is still running, and forgets it otherwise.
+func (f *Fetches) Cancel(room, id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, ok := f.jobs[id]
+	if !ok || job.room != room {
+		return false
+	}
+	if job.Status == fetchRunning {
+		job.Status = fetchCanceled
+		job.cancel()
+	} else {
+		delete(f.jobs, id)
+	}
+	return true
+}
+
+type fetchRequest struct {
+	URL             string `json:"url"`
+	Name            string `json:"name"`
+	Path            string `json:"path"`
+	ExpirationHours int    `json:"expirationHours"`
+}
+
+type FetchesResponse struct {
+	Fetches []*FetchJob `json:"fetches"`
+}
+
+// handleFetches starts a fetch, POST /api/fetch with {"url", "name",
+// "path", "expirationHours"}, answering 202 with the job to poll, and lists
+// the room's fetches on GET. Tags, metadata and checksums come from the
+// same X- headers as raw uploads.
+func handleFetches(w http.ResponseWriter, r *http.Request) {
+	if !fetchEnabled {
+		http.Error(w, "Fetching URLs needs -fetch", http.StatusNotFound)
+		return
+	}
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(FetchesResponse{Fetches: fetches.List(roomCode(room))})
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+	var req fetchRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an http or https URL", http.StatusBadRequest)
+		return
+	}
+	folder, err := cleanFolder(req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, ok := requestUploadOptions(w, r, room)
+	if !ok {
+		return
+	}
+
+	job, err := fetches.Start(roomCode(room), folder, u, strings.TrimSpace(req.Name), opts, room.clampExpiration(expirationFor(req.ExpirationHours)))
+	if errors.Is(err, errTooManyFetches) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to start fetch", "url", req.URL, "error", err)
+		http.Error(w, "Failed to start fetch", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Fetch started", "id", job.ID, "url", job.URL, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", publicBaseURL()+"/api/fetch/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// handleFetch reports a fetch's progress (GET /api/fetch/{id}) or cancels
+// it (DELETE).
+func handleFetch(w http.ResponseWriter, r *http.Request) {
+	if !fetchEnabled {
+		http.Error(w, "Fetching URLs needs -fetch", http.StatusNotFound)
+		return
+	}
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/fetch/")
+
+	switch r.Method {
+	case http.MethodGet:
+		job, ok := fetches.Get(roomCode(room), id)
+		if !ok {
+			http.Error(w, "Fetch not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	case http.MethodDelete:
+		if !fetches.Cancel(roomCode(room), id) {
+			http.Error(w, "Fetch not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
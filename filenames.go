@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Filename policies for -filename-unicode.
+const (
+	filenameKeep  = "keep"  // names are left as sent, apart from always-applied cleaning
+	filenameNFC   = "nfc"   // accents sent as separate marks (as macOS does) are composed
+	filenameASCII = "ascii" // names are transliterated to ASCII
+)
+
+// The policy names of stored files are cleaned with, set with
+// -filename-unicode and -filename-max-length.
+var (
+	filenameUnicode   = filenameNFC
+	maxFilenameLength = 255
+)
+
+// validFilenamePolicy reports an error for an unknown -filename-unicode.
+func validFilenamePolicy(policy string) error {
+	switch policy {
+	case filenameKeep, filenameNFC, filenameASCII:
+		return nil
+	}
+	return fmt.Errorf("unknown filename policy %q (use keep, nfc or ascii)", policy)
+}
+
+// sanitizeFilename cleans a client-supplied name before it is stored, as
+// it later ends up in headers, archives and file systems: control and
+// invisible formatting characters are removed, path separators become "_",
+// surrounding spaces are trimmed, Unicode is handled as -filename-unicode
+// says, and the name is shortened to -filename-max-length bytes keeping its
+// extension. A name left empty becomes "unnamed".
+func sanitizeFilename(name string) string {
+	if !utf8.ValidString(name) {
+		name = strings.ToValidUTF8(name, "_")
+	}
+	switch filenameUnicode {
+	case filenameNFC:
+		name = composeLatin(name)
+	case filenameASCII:
+		name = transliterate(name)
+	}
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r == '/' || r == '\\':
+			b.WriteByte('_')
+		case unicode.IsControl(r) || unicode.Is(unicode.Cf, r):
+			// Includes bidi overrides that disguise an extension
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = strings.TrimSpace(b.String())
+	if name == "." || name == ".." {
+		name = ""
+	}
+
+	name = truncateFilename(name, maxFilenameLength)
+	if name == "" {
+		return "unnamed"
+	}
+	return name
+}
+
+// truncateFilename shortens name to at most limit bytes, on a character
+// boundary, cutting the stem rather than a short extension.
+func truncateFilename(name string, limit int) string {
+	if limit <= 0 || len(name) <= limit {
+		return name
+	}
+	ext := filepath.Ext(name)
+	if len(ext) > 16 || len(ext) >= limit {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	cut := limit - len(ext)
+	for cut > 0 && !utf8.RuneStart(stem[cut]) {
+		cut--
+	}
+	return strings.TrimSpace(stem[:cut]) + ext
+}
+
+// latinMarks lists the Latin letters that combine with each accent into a
+// single character. The standard library has no Unicode normalization
+// tables, so this covers the accented letters of Latin-1 and Latin
+// Extended-A/B, which is what file names from European languages use;
+// other scripts are left alone.
+var latinMarks = []struct {
+	mark            rune
+	bases, composed string
+}{
+	{'\u0300', "AEIOUaeiouNn", "ÀÈÌÒÙàèìòùǸǹ"},                                           // grave accent
+	{'\u0301', "AEIOUYaeiouyCcLlNnRrSsZzGg", "ÁÉÍÓÚÝáéíóúýĆćĹĺŃńŔŕŚśŹźǴǵ"},               // acute accent
+	{'\u0302', "AEIOUaeiouCcGgHhJjSsWwYy", "ÂÊÎÔÛâêîôûĈĉĜĝĤĥĴĵŜŝŴŵŶŷ"},                   // circumflex accent
+	{'\u0303', "ANOanoIiUu", "ÃÑÕãñõĨĩŨũ"},                                               // tilde
+	{'\u0304', "AaEeIiOoUuYy", "ĀāĒēĪīŌōŪūȲȳ"},                                           // macron
+	{'\u0306', "AaEeGgIiOoUu", "ĂăĔĕĞğĬĭŎŏŬŭ"},                                           // breve
+	{'\u0307', "CcEeGgIZzAaOo", "ĊċĖėĠġİŻżȦȧȮȯ"},                                         // dot above
+	{'\u0308', "AEIOUaeiouyY", "ÄËÏÖÜäëïöüÿŸ"},                                           // diaeresis
+	{'\u030a', "AaUu", "ÅåŮů"},                                                           // ring above
+	{'\u030b', "OoUu", "ŐőŰű"},                                                           // double acute accent
+	{'\u030c', "CcDdEeLlNnRrSsTtZzAaIiOoUuGgKkjHh", "ČčĎďĚěĽľŇňŘřŠšŤťŽžǍǎǏǐǑǒǓǔǦǧǨǩǰȞȟ"}, // caron
+	{'\u030f', "AaEeIiOoRrUu", "ȀȁȄȅȈȉȌȍȐȑȔȕ"},                                           // double grave accent
+	{'\u0311', "AaEeIiOoRrUu", "ȂȃȆȇȊȋȎȏȒȓȖȗ"},                                           // inverted breve
+	{'\u031b', "OoUu", "ƠơƯư"},                                                           // horn
+	{'\u0326', "SsTt", "ȘșȚț"},                                                           // comma below
+	{'\u0327', "CcGgKkLlNnRrSsTtEe", "ÇçĢģĶķĻļŅņŖŗŞşŢţȨȩ"},                               // cedilla
+	{'\u0328', "AaEeIiUuOo", "ĄąĘęĮįŲųǪǫ"},                                               // ogonek
+}
+
+var (
+	latinComposed = map[[2]rune]rune{} // base and mark to the composed letter
+	latinBaseOf   = map[rune]rune{}    // composed letter to its base
+	asciiLetters  = map[rune]string{
+		'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'ß': "ss", 'Ø': "O", 'ø': "o",
+		'Ł': "L", 'ł': "l", 'Đ': "D", 'đ': "d", 'Ð': "D", 'ð': "d", 'Þ': "Th",
+		'þ': "th", 'ı': "i", 'Ħ': "H", 'ħ': "h",
+		'‘': "'", '’': "'", '“': "\"", '”': "\"", '–': "-", '—': "-", '…': "...",
+		'\u00a0': " ",
+	}
+)
+
+func init() {
+	for _, m := range latinMarks {
+		composed := []rune(m.composed)
+		for i, base := range m.bases {
+			latinComposed[[2]rune{base, m.mark}] = composed[i]
+			latinBaseOf[composed[i]] = base
+		}
+	}
+}
+
+// composeLatin joins Latin letters followed by a combining accent into the
+// single accented letter, so names sent from macOS, which keeps accents
+// separate, match the same names typed elsewhere.
+func composeLatin(s string) string {
+	runes := []rune(s)
+	out := runes[:0]
+	for _, r := range runes {
+		if n := len(out); n > 0 {
+			if c, ok := latinComposed[[2]rune{out[n-1], r}]; ok {
+				out[n-1] = c
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+	return string(out)
+}
+
+// transliterate spells s in ASCII: accents are dropped, letters such as "ß"
+// and "æ" are written out and anything else outside ASCII becomes "_".
+func transliterate(s string) string {
+	var b strings.Builder
+	for _, r := range composeLatin(s) {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r):
+			// An accent that didn't compose with its letter
+		case latinBaseOf[r] != 0:
+			b.WriteRune(latinBaseOf[r])
+		case asciiLetters[r] != "":
+			b.WriteString(asciiLetters[r])
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+// lockFile is a no-op on platforms without flock; cluster mode there only
+// has the in-process mutex.
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errFolderExists = errors.New("folder already exists")
+
+const maxFolderPath = 1024
+
+// Folder is one created through the API, so it exists before anything is
+// uploaded to it. Folders that files are in exist regardless, and go away
+// with their last file.
+type Folder struct {
+	Room      string    `json:"room,omitempty"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type FolderStorage struct {
+	file    string
+	folders []Folder
+	mu      sync.RWMutex
+}
+
+func NewFolderStorage(dir string) (*FolderStorage, error) {
+	fd := &FolderStorage{
+		file:    stateFile(dir, "folders.json"),
+		folders: []Folder{},
+	}
+
+	data, err := os.ReadFile(fd.file)
+	if os.IsNotExist(err) {
+		return fd, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read folders: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &fd.folders); err != nil {
+		return nil, fmt.Errorf("failed to parse folders: %w", err)
+	}
+
+	return fd, nil
+}
+
+func (fd *FolderStorage) save() error {
+	data, err := json.MarshalIndent(fd.folders, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal folders: %w", err)
+	}
+
+	if err := writeStateFile(fd.file, data, 0644); err != nil {
+		return fmt.Errorf("failed to write folders: %w", err)
+	}
+
+	return nil
+}
+
+// cleanFolder normalizes a folder path to "/a/b" form, with "" for the top
+// level. Dot segments are rejected rather than resolved.
+func cleanFolder(p string) (string, error) {
+	var segments []string
+	for _, segment := range strings.Split(strings.TrimSpace(p), "/") {
+		segment = strings.TrimSpace(segment)
+		switch {
+		case segment == "":
+			continue
+		case segment == "." || segment == "..":
+			return "", fmt.Errorf("folder path can't contain %q", segment)
+		case strings.ContainsAny(segment, "\\\x00"):
+			return "", fmt.Errorf("invalid folder name %q", segment)
+		}
+		segments = append(segments, segment)
+	}
+	if len(segments) == 0 {
+		return "", nil
+	}
+	folder := "/" + strings.Join(segments, "/")
+	if len(folder) > maxFolderPath {
+		return "", fmt.Errorf("folder path is too long")
+	}
+	return folder, nil
+}
+
+// inFolder reports whether folder is dir or somewhere beneath it.
+func inFolder(folder, dir string) bool {
+	return dir == "" || folder == dir || strings.HasPrefix(folder, dir+"/")
+}
+
+// List returns the room's created folders.
+func (fd *FolderStorage) List(room string) []string {
+	fd.mu.RLock()
+	defer fd.mu.RUnlock()
+
+	var paths []string
+	for _, f := range fd.folders {
+		if f.Room == room {
+			paths = append(paths, f.Path)
+		}
+	}
+	return paths
+}
+
+func (fd *FolderStorage) Create(room, path string) (*Folder, error) {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	for _, f := range fd.folders {
+		if f.Room == room && f.Path == path {
+			return nil, errFolderExists
+		}
+	}
+
+	folder := Folder{Room: room, Path: path, CreatedAt: time.Now()}
+	fd.folders = append(fd.folders, folder)
+
+	if err := fd.save(); err != nil {
+		fd.folders = fd.folders[:len(fd.folders)-1]
+		return nil, err
+	}
+
+	return &folder, nil
+}
+
+// Rename moves the created folders at or beneath from to sit under to.
+func (fd *FolderStorage) Rename(room, from, to string) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	for i, f := range fd.folders {
+		if f.Room == room && inFolder(f.Path, from) {
+			fd.folders[i].Path = to + strings.TrimPrefix(f.Path, from)
+		}
+	}
+	return fd.save()
+}
+
+// Remove forgets the room's created folders at or beneath path, or all of
+// them when path is "".
+func (fd *FolderStorage) Remove(room, path string) error {
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+
+	kept := []Folder{}
+	for _, f := range fd.folders {
+		if f.Room != room || !inFolder(f.Path, path) {
+			kept = append(kept, f)
+		}
+	}
+	if len(kept) == len(fd.folders) {
+		return nil
+	}
+	fd.folders = kept
+	return fd.save()
+}
+
+// folderExists reports whether path has been created or holds files.
+func folderExists(room, path string, files []FileMetadata) bool {
+	if path == "" {
+		return true
+	}
+	for _, f := range folders.List(room) {
+		if inFolder(f, path) {
+			return true
+		}
+	}
+	for _, meta := range files {
+		if inFolder(meta.Folder, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// MoveFolder moves the room's files at or beneath from to sit under to,
+// including those in the trash, and returns how many moved.
+func (fs *FileStorage) MoveFolder(room, from, to string) (int, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	var moved []FileMetadata
+	for i, meta := range fs.files {
+		if meta.Room == room && meta.Folder != "" && inFolder(meta.Folder, from) {
+			fs.files[i].Folder = to + strings.TrimPrefix(meta.Folder, from)
+			moved = append(moved, fs.files[i])
+		}
+	}
+	if len(moved) == 0 {
+		return 0, nil
+	}
+	return len(moved), fs.commit(moved, nil)
+}
+
+type FolderInfo struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Files int    `json:"files"` // including those in subfolders
+}
+
+// subfolders returns the folders directly inside dir, from both the created
+// folders and where files are.
+func subfolders(room, dir string, files []FileMetadata) []FolderInfo {
+	children := map[string]*FolderInfo{}
+	child := func(path string) *FolderInfo {
+		if path == dir || !inFolder(path, dir) {
+			return nil
+		}
+		name, _, _ := strings.Cut(strings.TrimPrefix(path, dir+"/"), "/")
+		info := children[name]
+		if info == nil {
+			info = &FolderInfo{Name: name, Path: dir + "/" + name}
+			children[name] = info
+		}
+		return info
+	}
+
+	for _, path := range folders.List(room) {
+		child(path)
+	}
+	for _, meta := range files {
+		if info := child(meta.Folder); info != nil {
+			info.Files++
+		}
+	}
+
+	result := []FolderInfo{}
+	for _, info := range children {
+		result = append(result, *info)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.ToLower(result[i].Name) < strings.ToLower(result[j].Name)
+	})
+	return result
+}
+
+// requestFolder reads the folder to upload to from the path form field or
+// query parameter.
+func requestFolder(w http.ResponseWriter, r *http.Request) (string, bool) {
+	folder, err := cleanFolder(r.FormValue("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return "", false
+	}
+	return folder, true
+}
+
+type FoldersResponse struct {
+	Folders []FolderInfo `json:"folders"`
+}
+
+type folderRequest struct {
+	Path string `json:"path"`
+}
+
+// handleFolders lists every folder in the room (GET /api/folders) or
+// creates one (POST /api/folders with {"path": "/photos/2024"}).
+func handleFolders(w http.ResponseWriter, r *http.Request) {
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	code := roomCode(room)
+
+	switch r.Method {
+	case http.MethodGet:
+		files := storage.ListRoomFiles(code)
+		var walk func(dir string) []FolderInfo
+		walk = func(dir string) []FolderInfo {
+			var all []FolderInfo
+			for _, info := range subfolders(code, dir, files) {
+				all = append(all, info)
+				all = append(all, walk(info.Path)...)
+			}
+			return all
+		}
+		resp := FoldersResponse{Folders: append([]FolderInfo{}, walk("")...)}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+	case http.MethodPost:
+		if rejectIfMaintenance(w) {
+			return
+		}
+		var req folderRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		path, err := cleanFolder(req.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if path == "" {
+			http.Error(w, "Folder path required", http.StatusBadRequest)
+			return
+		}
+		if folderExists(code, path, storage.ListRoomFiles(code)) {
+			http.Error(w, "Folder already exists", http.StatusConflict)
+			return
+		}
+		folder, err := folders.Create(code, path)
+		if errors.Is(err, errFolderExists) {
+			http.Error(w, "Folder already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to create folder", "path", path, "error", err)
+			http.Error(w, "Failed to create folder", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Folder created", "path", path, "client", clientIP(r))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(folder)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleFolder renames a folder (PATCH /api/folders/{path} with the new
+// {"path"}) or deletes it (DELETE /api/folders/{path}). A folder with files
+// in it is only deleted with ?recursive=true, and its files go to the trash.
+func handleFolder(w http.ResponseWriter, r *http.Request) {
+	path, err := cleanFolder(strings.TrimPrefix(r.URL.Path, "/api/folders/"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if path == "" {
+		http.Error(w, "Folder path required", http.StatusBadRequest)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	code := roomCode(room)
+
+	switch r.Method {
+	case http.MethodPatch, http.MethodDelete:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	files := storage.ListRoomFiles(code)
+	if !folderExists(code, path, files) {
+		http.Error(w, "Folder not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		var req folderRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		to, err := cleanFolder(req.Path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if to == "" || inFolder(to, path) {
+			http.Error(w, "Can't move a folder into itself or the top level", http.StatusBadRequest)
+			return
+		}
+		if folderExists(code, to, files) {
+			http.Error(w, "Folder already exists", http.StatusConflict)
+			return
+		}
+
+		moved, err := storage.MoveFolder(code, path, to)
+		if err == nil {
+			err = folders.Rename(code, path, to)
+		}
+		if err != nil {
+			slog.Error("Failed to rename folder", "path", path, "to", to, "error", err)
+			http.Error(w, "Failed to rename folder", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Folder renamed", "path", path, "to", to, "files", moved, "client", clientIP(r))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(FolderInfo{Name: to[strings.LastIndex(to, "/")+1:], Path: to, Files: moved})
+		return
+	}
+
+	var contained []string
+	for _, meta := range files {
+		if meta.Folder != "" && inFolder(meta.Folder, path) {
+			contained = append(contained, meta.ID)
+		}
+	}
+	if len(contained) > 0 && r.URL.Query().Get("recursive") != "true" {
+		http.Error(w, "Folder is not empty (use ?recursive=true to delete its files too)", http.StatusConflict)
+		return
+	}
+	for _, id := range contained {
+		if err := storage.DeleteFile(id); err != nil {
+			slog.Error("Failed to delete file in folder", "id", id, "error", err)
+			http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := folders.Remove(code, path); err != nil {
+		slog.Error("Failed to delete folder", "path", path, "error", err)
+		http.Error(w, "Failed to delete folder", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Folder deleted", "path", path, "files", len(contained), "client", clientIP(r))
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,3 +1,3 @@
-module sync-it
+module github.com/orange-puff/sync-it
 
 go 1.25.4
@@ -1,19 +1,88 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type InfoResponse struct {
-	IP   string `json:"ip"`
-	Port int    `json:"port"`
+	IP       string              `json:"ip"`
+	Port     int                 `json:"port"`
+	BasePath string              `json:"basePath,omitempty"`
+	URL      string              `json:"url"`
+	Plugins  map[string][]string `json:"plugins,omitempty"`
+
+	DefaultExpirationHours int `json:"defaultExpirationHours"`
+	MinExpirationHours     int `json:"minExpirationHours,omitempty"`
+	MaxExpirationHours     int `json:"maxExpirationHours,omitempty"`
+
+	// ClearsOnRestart is set when files not marked persistAcrossRestart
+	// are removed whenever the server restarts.
+	ClearsOnRestart bool `json:"clearsOnRestart,omitempty"`
+
+	// InMemory is set with -storage memory, where nothing survives a
+	// restart and chunked uploads aren't available.
+	InMemory bool `json:"inMemory,omitempty"`
+
+	// MaxUploadSize is the largest file accepted, in bytes, when limited.
+	MaxUploadSize int64 `json:"maxUploadSize,omitempty"`
 }
 
 type FilesResponse struct {
 	Files []FileMetadata `json:"files"`
+
+	// Total counts the files matching, over every page; NextOffset is where
+	// the next page starts when a ?limit= left some out.
+	Total      int `json:"total"`
+	NextOffset int `json:"nextOffset,omitempty"`
+
+	// Path and Folders are set when listing one folder with ?path=
+	Path    string       `json:"path,omitempty"`
+	Folders []FolderInfo `json:"folders,omitempty"`
+}
+
+type ShareResponse struct {
+	FileMetadata
+	URL      string `json:"url"`
+	ShareURL string `json:"shareUrl"`
+}
+
+func newShareResponse(meta *FileMetadata) ShareResponse {
+	resp := ShareResponse{FileMetadata: *meta, URL: downloadURL(meta), ShareURL: shareURL(meta)}
+	resp.humanize(time.Now())
+	return resp
+}
+
+// downloadURL ends in the original filename so saved links and tools like
+// wget name the file sensibly; only the ID is used to look it up.
+// Files in a room carry its code, which downloads require.
+func downloadURL(meta *FileMetadata) string {
+	u := publicBaseURL() + "/api/download/" + meta.ID + "/" + url.PathEscape(meta.Name)
+	if meta.Room != "" {
+		u += "?room=" + url.QueryEscape(meta.Room)
+	}
+	return u
+}
+
+func renditionURL(meta *FileMetadata, r *Rendition) string {
+	query := url.Values{"rendition": {r.Key}}
+	if meta.Room != "" {
+		query.Set("room", meta.Room)
+	}
+	return publicBaseURL() + "/api/download/" + meta.ID + "/" + url.PathEscape(r.Name) + "?" + query.Encode()
 }
 
 func handleInfo(w http.ResponseWriter, r *http.Request) {
@@ -23,8 +92,18 @@ func handleInfo(w http.ResponseWriter, r *http.Request) {
 	}
 
 	resp := InfoResponse{
-		IP:   localIP,
-		Port: port,
+		IP:       localIP,
+		Port:     port,
+		BasePath: basePath,
+		URL:      publicBaseURL() + "/",
+		Plugins:  PluginNames(),
+
+		DefaultExpirationHours: expirationHours(defaultExpiration),
+		MinExpirationHours:     expirationHours(minExpiration),
+		MaxExpirationHours:     expirationHours(maxExpiration),
+		ClearsOnRestart:        clearsOnRestart(),
+		InMemory:               inMemory,
+		MaxUploadSize:          maxUploadSize,
 	}
 	slog.Info("Info Response", "ip", localIP, "port", port)
 	w.Header().Set("Content-Type", "application/json")
@@ -37,32 +116,452 @@ func handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	r.ParseMultipartForm(100 << 20) // 100 MB max
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	if rejectTooLarge(w, parseUploadForm(w, r)) {
+		return
+	}
 
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		slog.Error("Failed to read file", "filename", header.Filename)
+		slog.Error("Failed to read file", "client", clientIP(r), "error", err)
 		http.Error(w, "Failed to read file", http.StatusBadRequest)
 		return
 	}
 	defer file.Close()
+	if rejectTooLarge(w, checkUploadSize(header.Size)) {
+		return
+	}
+
+	folder, ok := requestFolder(w, r)
+	if !ok {
+		return
+	}
+	opts, ok := requestUploadOptions(w, r, room)
+	if !ok {
+		return
+	}
 
-	expirationHours := 24 // Default to 24 hours
+	var expirationHours int
 	if expStr := r.FormValue("expirationHours"); expStr != "" {
 		if exp, err := json.Number(expStr).Int64(); err == nil && exp > 0 {
 			expirationHours = int(exp)
 		}
 	}
 
-	meta, err := storage.SaveFile(header.Filename, file, expirationHours)
+	if r.FormValue("extract") == "true" {
+		handleExtract(w, r, room, folder, opts, file, header, room.clampExpiration(expirationFor(expirationHours)))
+		return
+	}
+
+	meta, err := storage.SaveNewFile(opts.file(roomCode(room), folder, header.Filename), opts.body(file), room.clampExpiration(expirationFor(expirationHours)))
+	if rejectMismatch(w, err) || rejectOverQuota(w, err) || rejectStorageFull(w, err) || rejectTooLarge(w, err) {
+		return
+	}
 	if err != nil {
 		slog.Error("Failed to save file", "filename", header.Filename)
 		http.Error(w, "Failed to save file", http.StatusInternalServerError)
 		return
 	}
+	slog.Info("File uploaded", "id", meta.ID, "filename", meta.Name, "size", meta.Size, "client", clientIP(r))
+	meta = opts.apply(meta)
 
+	// A copy, as event subscribers share meta
+	resp := *meta
+	resp.humanize(time.Now())
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(meta)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleRawUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		// A file called raw
+		handlePutUpload(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		http.Error(w, "Content-Type must be an image type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	filename := headerFilename(r)
+	if filename == "" {
+		filename = "screenshot-" + time.Now().Format("20060102-150405")
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			filename += exts[0]
+		}
+	}
+	expiration := room.clampExpiration(expirationFor(headerExpirationHours(r)))
+	folder, ok := requestFolder(w, r)
+	if !ok {
+		return
+	}
+	opts, ok := requestUploadOptions(w, r, room)
+	if !ok {
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, 100<<20) // 100 MB max
+	meta, err := storage.SaveNewFile(opts.file(roomCode(room), folder, filename), opts.body(body), expiration)
+	if rejectMismatch(w, err) || rejectOverQuota(w, err) || rejectStorageFull(w, err) || rejectTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to save file", "filename", filename, "error", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("File uploaded", "id", meta.ID, "filename", meta.Name, "size", meta.Size, "client", clientIP(r))
+	meta = opts.apply(meta)
+
+	resp := newShareResponse(meta)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handlePutUpload stores the raw request body as the file named in the
+// path, PUT /api/upload/{filename}, so `curl -T bigfile
+// http://host/api/upload/` uploads from anywhere without building a form.
+// Folder, tags and the rest come from the query string and the same
+// headers as the other raw uploads. It answers with the download URL as
+// plain text, ready to hand to curl or wget.
+func handlePutUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	filename := strings.TrimPrefix(r.URL.Path, "/api/upload/")
+	if filename == "" {
+		http.Error(w, "Filename required: PUT /api/upload/{filename}", http.StatusBadRequest)
+		return
+	}
+	// Reading form values would consume a form body as fields
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" || strings.HasPrefix(mediaType, "multipart/") {
+		http.Error(w, "Send the file itself as the body, or POST the form to /api/upload", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	folder, ok := requestFolder(w, r)
+	if !ok {
+		return
+	}
+	opts, ok := requestUploadOptions(w, r, room)
+	if !ok {
+		return
+	}
+
+	expirationHours := headerExpirationHours(r)
+	if exp, err := strconv.Atoi(r.URL.Query().Get("expirationHours")); err == nil && exp > 0 {
+		expirationHours = exp
+	}
+
+	meta, err := storage.SaveNewFile(opts.file(roomCode(room), folder, filename), opts.body(r.Body), room.clampExpiration(expirationFor(expirationHours)))
+	if rejectMismatch(w, err) || rejectOverQuota(w, err) || rejectStorageFull(w, err) || rejectTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to save file", "filename", filename, "error", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("File uploaded", "id", meta.ID, "filename", meta.Name, "size", meta.Size, "client", clientIP(r))
+	meta = opts.apply(meta)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Location", downloadURL(meta))
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, downloadURL(meta))
+}
+
+// headerFilename reads the name for a raw-body upload from X-Filename
+// (optionally percent-encoded, for clients that can't send UTF-8 headers)
+// or a Content-Disposition filename parameter.
+func headerFilename(r *http.Request) string {
+	if name := r.Header.Get("X-Filename"); name != "" {
+		if decoded, err := url.PathUnescape(name); err == nil {
+			return decoded
+		}
+		return name
+	}
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+		return params["filename"]
+	}
+	return ""
+}
+
+func headerExpirationHours(r *http.Request) int {
+	if expStr := r.Header.Get("X-Expiration-Hours"); expStr != "" {
+		if exp, err := strconv.Atoi(expStr); err == nil && exp > 0 {
+			return exp
+		}
+	}
+	return 0
+}
+
+// uploadOptions are settings an upload asks for that are applied once the
+// file is stored.
+type uploadOptions struct {
+	Persist  bool
+	Tags     []string
+	Metadata map[string]string
+	Expect   *Expectation
+	Quota    clientAllowance
+	Pending  bool
+	Source   *UploadSource
+	SHA256   func() string // the checksum the client declared, if any
+
+	AvailableFrom time.Time
+}
+
+// requestUploadOptions reads persistAcrossRestart, tags, metadata,
+// availableFrom and the expected upload being fulfilled from the form or
+// query, or from the X-Persist-Across-Restart, X-Tags, X-Metadata,
+// X-Available-From and X-Expect headers that raw uploads use. Tags are
+// comma-separated and may be repeated; metadata is a JSON object of
+// strings. Raw uploads that declare a length too large for the client's
+// quota are refused here. A declared checksum comes from the
+// X-Content-SHA256 header or trailer, or a sha256 field.
+func requestUploadOptions(w http.ResponseWriter, r *http.Request, room *Room) (uploadOptions, bool) {
+	opts := uploadOptions{Persist: requestPersist(r), Quota: requestAllowance(r), Pending: needsApproval(r), Source: requestSource(r)}
+	if r.MultipartForm == nil && (rejectTooLarge(w, checkUploadSize(r.ContentLength)) || rejectOverQuota(w, opts.Quota.check(r.ContentLength))) {
+		return opts, false
+	}
+	// Make room first rather than let the upload fail
+	evictor.MakeRoom(max(r.ContentLength, 0))
+	values := r.Form["tags"]
+	if len(values) == 0 {
+		values = r.Header.Values("X-Tags")
+	}
+	var err error
+	if opts.Tags, err = splitTags(values); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return opts, false
+	}
+	metadata := r.FormValue("metadata")
+	if metadata == "" {
+		metadata = r.Header.Get("X-Metadata")
+	}
+	if opts.Metadata, err = parseMetadata(metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return opts, false
+	}
+	availableFrom := r.FormValue("availableFrom")
+	if availableFrom == "" {
+		availableFrom = r.Header.Get("X-Available-From")
+	}
+	if opts.AvailableFrom, err = parseAvailableFrom(availableFrom); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return opts, false
+	}
+	var ok bool
+	if opts.SHA256, ok = requestChecksum(w, r); !ok {
+		return opts, false
+	}
+	opts.Expect, ok = requestExpectation(w, r, roomCode(room))
+	return opts, ok
+}
+
+// file describes the new file for SaveNewFile.
+func (o uploadOptions) file(room, folder, name string) FileMetadata {
+	return FileMetadata{Room: room, Folder: folder, Name: name, Uploader: o.Quota.client, Source: o.Source, Pending: o.Pending, AvailableFrom: o.AvailableFrom}
+}
+
+// parseAvailableFrom reads an RFC 3339 time a file is held back until, ""
+// for none. Times past -max-expiration from now are refused.
+func parseAvailableFrom(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("availableFrom must be an RFC 3339 time such as 2026-06-01T09:00:00Z")
+	}
+	return t, checkAvailableFrom(t)
+}
+
+// checkAvailableFrom refuses an availableFrom further ahead than files may
+// be kept.
+func checkAvailableFrom(t time.Time) error {
+	if maxExpiration > 0 && time.Until(t) > maxExpiration {
+		return fmt.Errorf("availableFrom can be at most %s ahead", maxExpiration)
+	}
+	return nil
+}
+
+// requestSource describes the client sending r, trimming what it says about
+// itself to a sensible length.
+func requestSource(r *http.Request) *UploadSource {
+	source := &UploadSource{
+		IP:        clientIP(r),
+		Device:    truncateString(strings.TrimSpace(r.Header.Get("X-Device-Name")), 64),
+		UserAgent: truncateString(r.UserAgent(), 256),
+	}
+	if token := requestToken(r); token != "" {
+		sum := sha256.Sum256([]byte("token:" + token))
+		source.Token = hex.EncodeToString(sum[:4])
+	}
+	return source
+}
+
+// truncateString cuts s to at most n bytes without splitting a character.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// body checks the upload against -max-upload-size, its expectation and
+// declared checksum if it has them, and the client's quota.
+func (o uploadOptions) body(r io.Reader) io.Reader {
+	r = o.Quota.limit(limitUpload(r))
+	if o.Expect != nil {
+		r = o.Expect.verify(r)
+	}
+	if o.SHA256 != nil {
+		r = verifyChecksum(r, o.SHA256)
+	}
+	return r
+}
+
+// apply saves the options to a file just uploaded. Failing to is logged
+// rather than failing the upload.
+func (o uploadOptions) apply(meta *FileMetadata) *FileMetadata {
+	if o.Expect != nil {
+		if _, err := expectations.Receive(o.Expect.ID, meta); err != nil {
+			slog.Error("Failed to record expected upload", "expect", o.Expect.ID, "id", meta.ID, "error", err)
+		} else {
+			slog.Info("Expected upload received", "expect", o.Expect.ID, "label", o.Expect.Label, "id", meta.ID)
+		}
+	}
+	if !o.Persist && len(o.Tags) == 0 && len(o.Metadata) == 0 {
+		return meta
+	}
+	updated, err := storage.UpdateFile(meta.ID, func(m *FileMetadata) {
+		m.Persist = m.Persist || o.Persist
+		if len(o.Tags) > 0 {
+			m.Tags = o.Tags
+		}
+		if len(o.Metadata) > 0 {
+			m.Metadata = o.Metadata
+		}
+	})
+	if err != nil {
+		slog.Error("Failed to apply upload options", "id", meta.ID, "error", err)
+		return meta
+	}
+	return updated
+}
+
+// Retention envelope, set by -default-expiration, -min-expiration and
+// -max-expiration
+var (
+	defaultExpiration = 24 * time.Hour
+	minExpiration     time.Duration
+	maxExpiration     time.Duration
+)
+
+// expirationHours rounds d up to whole hours for clients that only offer
+// hour granularity.
+func expirationHours(d time.Duration) int {
+	return int((d + time.Hour - 1) / time.Hour)
+}
+
+// expirationFor turns a client-requested lifetime into the one to store:
+// hours <= 0 means the client didn't ask and gets the default, and requests
+// outside the minimum and maximum are clamped to them.
+func expirationFor(hours int) time.Duration {
+	expiration := defaultExpiration
+	if hours > 0 {
+		expiration = time.Duration(hours) * time.Hour
+	}
+	if maxExpiration > 0 && expiration > maxExpiration {
+		expiration = maxExpiration
+	}
+	return max(expiration, minExpiration)
+}
+
+// handleShareTarget accepts a raw body from share sheets and automation tools
+// and answers with just the share link, so no response parsing is needed.
+func handleShareTarget(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	filename := headerFilename(r)
+	if filename == "" {
+		filename = "shared-" + time.Now().Format("20060102-150405")
+	}
+	folder, ok := requestFolder(w, r)
+	if !ok {
+		return
+	}
+	opts, ok := requestUploadOptions(w, r, room)
+	if !ok {
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, 100<<20) // 100 MB max
+	meta, err := storage.SaveNewFile(opts.file(roomCode(room), folder, filename), opts.body(body), room.clampExpiration(expirationFor(headerExpirationHours(r))))
+	if rejectMismatch(w, err) || rejectOverQuota(w, err) || rejectStorageFull(w, err) || rejectTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to save file", "filename", filename, "error", err)
+		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("File uploaded", "id", meta.ID, "filename", meta.Name, "size", meta.Size, "client", clientIP(r))
+	meta = opts.apply(meta)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Location", shareURL(meta))
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, shareURL(meta))
 }
 
 func handleListFiles(w http.ResponseWriter, r *http.Request) {
@@ -71,34 +570,409 @@ func handleListFiles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	files := storage.ListFiles()
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	files := storage.ListRoomFiles(roomCode(room))
 
 	resp := FilesResponse{Files: files}
+	if r.URL.Query().Has("path") {
+		// Just one folder's files, and the folders inside it
+		folder, err := cleanFolder(r.URL.Query().Get("path"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !folderExists(roomCode(room), folder, files) {
+			http.Error(w, "Folder not found", http.StatusNotFound)
+			return
+		}
+		resp.Files = []FileMetadata{}
+		for _, meta := range files {
+			if meta.Folder == folder {
+				resp.Files = append(resp.Files, meta)
+			}
+		}
+		resp.Path = folder
+		resp.Folders = subfolders(roomCode(room), folder, files)
+	}
+	if values := r.URL.Query()["tag"]; len(values) > 0 {
+		// Only files with all of the tags
+		tags, err := splitTags(values)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tagged := []FileMetadata{}
+		for i := range resp.Files {
+			if hasTags(&resp.Files[i], tags) {
+				tagged = append(tagged, resp.Files[i])
+			}
+		}
+		resp.Files = tagged
+	}
+
+	var err error
+	if resp.Files, err = filterFiles(r, resp.Files); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := sortFiles(r, resp.Files); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// ?offset= and ?limit= take one page of the sorted list
+	offset, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp.Total = len(resp.Files)
+	if offset > 0 || limit > 0 {
+		start := min(offset, resp.Total)
+		end := resp.Total
+		if limit > 0 && start+limit < resp.Total {
+			end = start + limit
+			resp.NextOffset = end
+		}
+		resp.Files = resp.Files[start:end]
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
 
-func handleDownload(w http.ResponseWriter, r *http.Request) {
+// maxFilesPage is the largest ?limit= a file listing takes.
+const maxFilesPage = 1000
+
+// pageParams reads ?offset= and ?limit=, 0 when absent.
+func pageParams(r *http.Request) (offset, limit int, err error) {
+	q := r.URL.Query()
+	if v := q.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be a number from 0 up")
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxFilesPage {
+			return 0, 0, fmt.Errorf("limit must be a number from 1 to %d", maxFilesPage)
+		}
+	}
+	return offset, limit, nil
+}
+
+type FileGroup struct {
+	Name  string         `json:"name"`
+	Files []FileMetadata `json:"files"`
+}
+
+type FileGroupsResponse struct {
+	Groups []FileGroup `json:"groups"`
+}
+
+// handleFileGroups lists files grouped by name (ignoring case), oldest
+// upload first within each group. With ?duplicates=true only names shared by
+// more than one file are returned.
+func handleFileGroups(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	id := strings.TrimPrefix(r.URL.Path, "/api/download/")
+	onlyDuplicates := r.URL.Query().Get("duplicates") == "true"
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	files := storage.ListRoomFiles(roomCode(room))
+
+	index := map[string]int{}
+	groups := []FileGroup{}
+	for i := len(files) - 1; i >= 0; i-- {
+		key := strings.ToLower(files[i].Name)
+		idx, ok := index[key]
+		if !ok {
+			idx = len(groups)
+			index[key] = idx
+			groups = append(groups, FileGroup{Name: files[i].Name})
+		}
+		groups[idx].Files = append(groups[idx].Files, files[i])
+	}
+
+	resp := FileGroupsResponse{Groups: []FileGroup{}}
+	for _, g := range groups {
+		if !onlyDuplicates || len(g.Files) > 1 {
+			resp.Groups = append(resp.Groups, g)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Accept /api/download/{id} and /api/download/{id}/{filename}
+	id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/download/"), "/")
 	if id == "" {
 		http.Error(w, "File ID required", http.StatusBadRequest)
 		return
 	}
+	serveDownload(w, r, id)
+}
+
+// serveDownload sends file id, or one of its renditions, to a client in the
+// request's room.
+func serveDownload(w http.ResponseWriter, r *http.Request, id string) {
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
 
 	meta, path, err := storage.GetFile(id)
+	resuming := false
+	if err != nil && r.Header.Get("Range") != "" {
+		// A download that was under way when the file was deleted or
+		// expired may finish during the grace period
+		meta, path, err = storage.GetDeletedFile(id)
+		resuming = err == nil
+	}
+	if err != nil && isAdminRequest(r) {
+		// So an admin can look at an upload before approving it
+		meta, path, err = storage.GetPendingFile(id)
+	}
+	if err != nil || !inRoom(meta, room) {
+		fileNotFound(w, r)
+		return
+	}
+	if meta.expired(time.Now()) && !resuming {
+		// Not cleaned up yet, but no longer on offer
+		fileExpired(w, r, meta)
+		return
+	}
+	if meta.Quarantined {
+		fileQuarantined(w, r, meta)
+		return
+	}
+	if meta.embargoed(time.Now()) && !isAdminRequest(r) {
+		fileEmbargoed(w, r, meta)
+		return
+	}
+
+	name, size, stored := meta.Name, meta.Size, meta.blobName()
+	open := func() (io.ReadCloser, error) { return storage.OpenBlob(id) }
+	if key := r.URL.Query().Get("rendition"); key != "" {
+		rendition := meta.Rendition(key)
+		if rendition == nil {
+			pageError(w, r, "Rendition not found", http.StatusNotFound, "Version not available",
+				"This version of "+meta.Name+" isn't available. The original can still be downloaded from the link it was shared with.")
+			return
+		}
+		name, size, path = rendition.Name, rendition.Size, storage.renditionPath(id, key)
+		stored = renditionBlob(id, key)
+		open = func() (io.ReadCloser, error) { return storage.OpenRendition(id, key) }
+	}
+
+	etag := ""
+	if r.URL.Query().Get("rendition") == "" && meta.SHA256 != "" {
+		// Lets receivers verify what they got against what was uploaded
+		w.Header().Set("X-Checksum-SHA256", meta.SHA256)
+		// Contents never change under an ID, so the checksum identifies them
+		etag = `"` + meta.SHA256 + `"`
+		w.Header().Set("ETag", etag)
+	}
+	// Quoted, and encoded per RFC 2231 when the name isn't plain ASCII
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Header().Set("Content-Type", "application/octet-stream")
+
+	if r.Method == http.MethodHead || notModified(r, etag, meta.UploadedAt) {
+		// A preflight of the size and checksum, or a client that has the
+		// file already; neither waits for a download slot nor counts as a
+		// download. Nothing is read, so the contents needn't be opened.
+		http.ServeContent(w, r, name, meta.UploadedAt, &streamSeeker{r: http.NoBody, size: size})
+		return
+	}
+
+	release, ok := queueDownload(w, r, id, size)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Cleanup waits for the transfer before removing the contents
+	defer storage.BeginRead(stored)()
+
+	var content io.ReadSeeker
+	if path == "" || hasStorageDecorators() {
+		// Not a plain local file, so stream the decoded content
+		blob, err := open()
+		if rejectInjectedFault(w, err) {
+			return
+		}
+		if err != nil {
+			fileNotFound(w, r)
+			return
+		}
+		defer blob.Close()
+		content = &streamSeeker{r: blob, size: size}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			fileNotFound(w, r)
+			return
+		}
+		defer f.Close()
+		content = f
+	}
+	// Handles Range, and If-Range against the upload time, so browsers and
+	// download managers can resume a transfer that broke off
+	http.ServeContent(w, r, name, meta.UploadedAt, content)
+
+	events.Publish(Event{Type: EventFileDownloaded, File: meta})
+	if !resuming && !meta.Pending {
+		storage.MarkDownloaded(id)
+	}
+}
+
+// notModified reports whether r's If-None-Match, or without one its
+// If-Modified-Since, shows the client has these contents already.
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || etag != "" && candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modtime.Truncate(time.Second).After(since)
+}
+
+// streamSeeker lets http.ServeContent serve contents of a known size that
+// can only be read forward, such as decrypted or decompressed blobs. Seeking
+// ahead skips the bytes in between once reading resumes; seeking back past
+// what was read already fails, so a multi-range request out of order is cut
+// short.
+type streamSeeker struct {
+	r    io.Reader
+	size int64
+	pos  int64 // where the next Read starts
+	read int64 // how far r has been read
+}
+
+func (s *streamSeeker) Read(p []byte) (int, error) {
+	if s.pos > s.read {
+		n, err := io.CopyN(io.Discard, s.r, s.pos-s.read)
+		s.read += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.r.Read(p)
+	s.read += int64(n)
+	s.pos = s.read
+	return n, err
+}
+
+func (s *streamSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	}
+	if offset < s.read {
+		return 0, errors.New("can't seek back in a stream")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+type ChunksResponse struct {
+	Size      int64    `json:"size"`
+	ChunkSize int64    `json:"chunkSize"`
+	Chunks    []string `json:"chunks"`
+}
+
+const (
+	defaultChunkSize = 4 << 20 // 4 MB
+	minChunkSize     = 64 << 10
+	maxChunkSize     = 64 << 20
+)
+
+// handleChunks returns SHA-256 hashes of consecutive chunks of a file, so
+// clients can check which parts of an interrupted download are intact.
+func handleChunks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/chunks/")
+	meta, _, err := storage.GetFile(id)
+	now := time.Now()
+	// The hashes fingerprint the contents, so only for files on offer
+	if err != nil || !inRoom(meta, room) || meta.expired(now) || meta.Quarantined || meta.embargoed(now) && !isAdminRequest(r) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	chunkSize := int64(defaultChunkSize)
+	if s := r.URL.Query().Get("size"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < minChunkSize || n > maxChunkSize {
+			http.Error(w, "Invalid chunk size", http.StatusBadRequest)
+			return
+		}
+		chunkSize = n
+	}
+
+	blob, err := storage.OpenBlob(id)
+	if rejectInjectedFault(w, err) {
+		return
+	}
 	if err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+	defer blob.Close()
 
-	w.Header().Set("Content-Disposition", "attachment; filename=\""+meta.Name+"\"")
-	w.Header().Set("Content-Type", "application/octet-stream")
-	http.ServeFile(w, r, path)
+	resp := ChunksResponse{Size: meta.Size, ChunkSize: chunkSize, Chunks: []string{}}
+	for {
+		h := sha256.New()
+		n, err := io.CopyN(h, blob, chunkSize)
+		if n > 0 {
+			resp.Chunks = append(resp.Chunks, hex.EncodeToString(h.Sum(nil)))
+		}
+		if err == io.EOF {
+			break
+		}
+		if rejectInjectedFault(w, err) {
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to hash file", "id", id, "error", err)
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
 
 func handleDelete(w http.ResponseWriter, r *http.Request) {
@@ -107,16 +981,30 @@ func handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if rejectIfMaintenance(w) {
+		return
+	}
+
 	id := strings.TrimPrefix(r.URL.Path, "/api/delete/")
 	if id == "" {
 		http.Error(w, "File ID required", http.StatusBadRequest)
 		return
 	}
 
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	if meta, _, err := storage.GetFile(id); err != nil || !inRoom(meta, room) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
 	if err := storage.DeleteFile(id); err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+	slog.Info("File deleted", "id", id, "client", clientIP(r))
 
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const hookTimeout = 5 * time.Minute
+
+// hookEvents maps the names accepted by -hook to event types.
+var hookEvents = map[string]string{
+	"upload":   EventFileUploaded,
+	"download": EventFileDownloaded,
+	"delete":   EventFileDeleted,
+	"expire":   EventFileExpired,
+	"restore":  EventFileRestored,
+	"pending":  EventFilePending,
+	"evict":    EventFileEvicted,
+
+	"room-close":  EventRoomClosed,
+	"room-expire": EventRoomExpired,
+}
+
+// hookFlag collects repeated -hook event=command flags.
+type hookFlag map[string][]string
+
+func (h hookFlag) String() string {
+	var parts []string
+	for event, cmds := range h {
+		for _, cmd := range cmds {
+			parts = append(parts, event+"="+cmd)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (h hookFlag) Set(value string) error {
+	name, command, ok := strings.Cut(value, "=")
+	if !ok || strings.TrimSpace(command) == "" {
+		return fmt.Errorf("expected event=command")
+	}
+	eventType, ok := hookEvents[strings.TrimSpace(name)]
+	if !ok {
+		return fmt.Errorf("unknown hook event %q (use upload, download, delete, expire, restore, pending, evict, room-close or room-expire)", name)
+	}
+	h[eventType] = append(h[eventType], command)
+	return nil
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// hookEnv describes the file or room an event is about in SYNCIT_*
+// variables, and returns the ID to log it under.
+func hookEnv(e Event) ([]string, string) {
+	if e.Room != nil {
+		return []string{
+			"SYNCIT_EVENT=" + e.Type,
+			"SYNCIT_ROOM_CODE=" + e.Room.Code,
+			"SYNCIT_ROOM_NAME=" + e.Room.Name,
+			"SYNCIT_ROOM_FILES=" + strconv.Itoa(len(e.Files)),
+		}, e.Room.Code
+	}
+
+	path := storage.plainPath(e.File)
+	if abs, err := filepath.Abs(path); err == nil && path != "" {
+		path = abs
+	}
+	return []string{
+		"SYNCIT_EVENT=" + e.Type,
+		"SYNCIT_FILE_ID=" + e.File.ID,
+		"SYNCIT_FILE_NAME=" + e.File.Name,
+		"SYNCIT_FILE_SIZE=" + strconv.FormatInt(e.File.Size, 10),
+		"SYNCIT_FILE_PATH=" + path,
+	}, e.File.ID
+}
+
+// runHook executes command for e, passing file or room details in SYNCIT_*
+// variables and the full event as JSON on stdin.
+func runHook(command string, e Event) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	env, id := hookEnv(e)
+	cmd := shellCommand(ctx, command)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(), env...)
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		slog.Error("Hook failed", "event", e.Type, "command", command, "id", id, "error", err, "output", string(output))
+		return
+	}
+	slog.Info("Hook completed", "event", e.Type, "command", command, "id", id, "duration", time.Since(start).String())
+}
+
+func (h hookFlag) handleEvent(e Event) {
+	if e.File == nil && e.Room == nil {
+		return
+	}
+	for _, command := range h[e.Type] {
+		runHook(command, e)
+	}
+}
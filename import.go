@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// importRoot is the directory /api/import may read from; importing is off
+// when it is empty.
+var importRoot string
+
+// errCannotLink means a file has to be copied into the store instead.
+var errCannotLink = errors.New("file can't be hard-linked into the store")
+
+// LinkFile adds the file at path by hard-linking it into the storage
+// directory, which takes no extra space or copying. It returns errCannotLink
+// when the stored bytes would differ from the file (compression, decorators,
+// processors), the store isn't local, or path is on another filesystem.
+func (fs *FileStorage) LinkFile(room, path string, expiration time.Duration) (*FileMetadata, error) {
+	name := sanitizeFilename(filepath.Base(path))
+
+	local, ok := fs.blobs.(dirBlobStore)
+	if !ok || hasStorageDecorators() || hasProcessors() {
+		return nil, errCannotLink
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if fs.compression != "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		if worthCompressing(name, head[:n]) {
+			return nil, errCannotLink
+		}
+	}
+
+	// Hashing a large file takes a while, so only the ID is picked locked
+	fs.mu.Lock()
+	id, err := generateID(fs.idTaken)
+	fs.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	tmp := "upload-" + id
+	if err := os.MkdirAll(filepath.Dir(local.LocalPath(tmp)), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Link(path, local.LocalPath(tmp)); err != nil {
+		return nil, errCannotLink
+	}
+
+	// Hash through the link so the digest matches what is stored
+	h := sha256.New()
+	linked, err := os.Open(local.LocalPath(tmp))
+	var size int64
+	if err == nil {
+		size, err = io.Copy(h, linked)
+		linked.Close()
+	}
+	if err != nil {
+		fs.blobs.Remove(tmp)
+		return nil, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	meta := FileMetadata{ID: id, Name: name, Size: size, Room: room, SHA256: hex.EncodeToString(h.Sum(nil))}
+	return fs.addFile(tmp, meta, expiration)
+}
+
+// isLocalRequest reports whether r comes from the server's own host, which is
+// all that is trusted with admin actions. Behind a proxy -trusted-proxies
+// doesn't name, no request is, as they could all be the proxy's.
+func isLocalRequest(r *http.Request) bool {
+	if unnamedProxy() {
+		return false
+	}
+	ip := net.ParseIP(clientIP(r))
+	return ip != nil && ip.IsLoopback()
+}
+
+// resolveImportPath returns the real path of p, which must lie inside
+// importRoot once symlinks are followed.
+func resolveImportPath(p string) (string, error) {
+	root, err := filepath.EvalSymlinks(importRoot)
+	if err != nil {
+		return "", err
+	}
+	root, _ = filepath.Abs(root)
+
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(root, p)
+	}
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	real, _ = filepath.Abs(real)
+
+	rel, err := filepath.Rel(root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the import root", p)
+	}
+	return real, nil
+}
+
+type ImportError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type ImportResponse struct {
+	Files  []ShareResponse `json:"files"`
+	Linked int             `json:"linked"`
+	Copied int             `json:"copied"`
+	Errors []ImportError   `json:"errors,omitempty"`
+}
+
+// importPaths lists the regular files to import for path: itself, or every
+// file below it, skipping hidden entries and the storage directory.
+func importPaths(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	store, _ := filepath.Abs(uploadsDir)
+	var paths []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != path && strings.HasPrefix(d.Name(), ".") || p == store {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			paths = append(paths, p)
+		}
+		return nil
+	})
+	slices.Sort(paths)
+	return paths, err
+}
+
+// handleImport adds files already on the server's disk: POST /api/import
+// with {"path": "...", "expirationHours": n}. Paths are resolved against
+// -import-root and must stay inside it. Only requests from the server's own
+// host are accepted.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if importRoot == "" {
+		http.Error(w, "Importing is disabled; start the server with -import-root", http.StatusNotFound)
+		return
+	}
+	if !isLocalRequest(r) {
+		http.Error(w, "Importing is only allowed from the server itself", http.StatusForbidden)
+		return
+	}
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Path            string `json:"path"`
+		ExpirationHours int    `json:"expirationHours"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil || req.Path == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	path, err := resolveImportPath(req.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paths, err := importPaths(path)
+	if err != nil {
+		http.Error(w, "Failed to read "+req.Path, http.StatusBadRequest)
+		return
+	}
+
+	expiration := room.clampExpiration(expirationFor(req.ExpirationHours))
+	resp := ImportResponse{Files: []ShareResponse{}}
+	for _, p := range paths {
+		meta, err := storage.LinkFile(roomCode(room), p, expiration)
+		if errors.Is(err, errCannotLink) {
+			var f *os.File
+			if f, err = os.Open(p); err == nil {
+				meta, err = storage.SaveRoomFile(roomCode(room), filepath.Base(p), f, expiration)
+				f.Close()
+			}
+			if err == nil {
+				resp.Copied++
+			}
+		} else if err == nil {
+			resp.Linked++
+		}
+		if err != nil {
+			slog.Warn("Failed to import file", "path", p, "error", err)
+			resp.Errors = append(resp.Errors, ImportError{Path: p, Error: err.Error()})
+			continue
+		}
+		resp.Files = append(resp.Files, newShareResponse(meta))
+	}
+	slog.Info("Imported files", "path", path, "linked", resp.Linked, "copied", resp.Copied, "failed", len(resp.Errors), "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// ImportDir serves every file below dir in place, without copying it into
+// the store, until the server stops. The files get IDs that stay the same
+// across restarts, so links to them keep working, and never expire.
+// It must be called before the server starts handling requests.
+func (fs *FileStorage) ImportDir(dir string) (int, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return 0, err
+	}
+	paths, err := importPaths(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	imported := make([]FileMetadata, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			slog.Warn("Skipping imported file", "path", path, "error", err)
+			continue
+		}
+		sum := sha256.Sum256([]byte("import:" + path))
+		rel, _ := filepath.Rel(dir, filepath.Dir(path))
+		folder, _ := cleanFolder(filepath.ToSlash(rel))
+		imported = append(imported, FileMetadata{
+			ID:         hex.EncodeToString(sum[:16]),
+			Name:       sanitizeFilename(filepath.Base(path)),
+			Size:       info.Size(),
+			UploadedAt: info.ModTime(),
+			Folder:     folder,
+			Imported:   true,
+			localFile:  path,
+		})
+	}
+	fs.imported = imported
+	return len(imported), nil
+}
+
+// importedPath returns where imported file id is on disk, or "" when id
+// isn't an imported file.
+func (fs *FileStorage) importedPath(id string) string {
+	for i := range fs.imported {
+		if fs.imported[i].ID == id {
+			return fs.imported[i].localFile
+		}
+	}
+	return ""
+}
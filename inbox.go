@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/orange-puff/sync-it/client"
+)
+
+const inboxStateFile = ".sync-it-inbox.json"
+
+// inboxState remembers which files were already fetched so restarts don't
+// download them again.
+type inboxState struct {
+	Downloaded map[string]time.Time `json:"downloaded"`
+}
+
+// loadInboxState reads the state file, reporting whether one existed.
+func loadInboxState(path string) (*inboxState, bool) {
+	state := &inboxState{Downloaded: map[string]time.Time{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return state, false
+	}
+	json.Unmarshal(data, state)
+	if state.Downloaded == nil {
+		state.Downloaded = map[string]time.Time{}
+	}
+	return state, true
+}
+
+func (s *inboxState) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// uniquePath returns path, or "name (n).ext" next to it if path exists.
+func uniquePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = fmt.Sprintf("%s (%d)%s", base, n, ext)
+	}
+}
+
+func inboxDownload(ctx context.Context, c *client.Client, dir string, meta client.File) (string, error) {
+	name := meta.Name
+	if meta.DisplayName != "" {
+		name = meta.DisplayName
+	}
+	// Never trust the server with a path
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		name = meta.ID
+	}
+
+	// An interrupted download of the same file resumes into the same path
+	dest := filepath.Join(dir, name)
+	if data, err := os.ReadFile(dest + client.PartialSuffix); err != nil || !strings.Contains(string(data), `"id":"`+meta.ID+`"`) {
+		dest = uniquePath(dest)
+	}
+
+	if err := c.DownloadFile(ctx, meta.ID, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+func runInbox(args []string) error {
+	fs := flag.NewFlagSet("inbox", flag.ExitOnError)
+	server := fs.String("server", "", "Server URL, e.g. http://192.168.1.10:8080")
+	match := fs.String("match", "", "Only download files whose name matches this glob, e.g. '*.pdf'")
+	interval := fs.Duration("interval", 10*time.Second, "How often to check for new files")
+	existing := fs.Bool("existing", false, "Also download files already on the server when starting a new inbox")
+	pin := fs.String("pin", "", "PIN for servers started with -pin")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sync-it inbox <dir> -server URL [options]")
+		fs.PrintDefaults()
+	}
+
+	// Allow the directory before or after the flags
+	var dir string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		dir, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if dir == "" {
+		dir = fs.Arg(0)
+	}
+	if dir == "" || *server == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *match != "" {
+		if _, err := filepath.Match(*match, ""); err != nil {
+			return fmt.Errorf("invalid -match pattern: %w", err)
+		}
+	}
+
+	c, err := client.New(*server, client.Options{PIN: *pin})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	statePath := filepath.Join(dir, inboxStateFile)
+	state, resumed := loadInboxState(statePath)
+	ctx := context.Background()
+
+	// A fresh inbox starts from what is uploaded next; a resumed one also
+	// catches up on files uploaded while it wasn't running
+	first := !resumed && !*existing
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+
+	fmt.Printf("Watching %s, saving into %s\n", c.Server(), dir)
+	for {
+		listCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		files, err := c.List(listCtx)
+		cancel()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "inbox: failed to list files:", err)
+		} else {
+			// Forget files the server no longer has
+			present := make(map[string]bool, len(files))
+			for _, meta := range files {
+				present[meta.ID] = true
+			}
+			for id := range state.Downloaded {
+				if !present[id] {
+					delete(state.Downloaded, id)
+				}
+			}
+		}
+
+		skipExisting := first
+		first = first && err != nil
+
+		for _, meta := range files {
+			if _, done := state.Downloaded[meta.ID]; done {
+				continue
+			}
+			if skipExisting {
+				// Files already there at startup count as handled
+				state.Downloaded[meta.ID] = time.Time{}
+				continue
+			}
+			if *match != "" {
+				if ok, _ := filepath.Match(*match, meta.Name); !ok {
+					continue
+				}
+			}
+
+			dest, err := inboxDownload(ctx, c, dir, meta)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "inbox: failed to download %s: %v\n", meta.Name, err)
+				continue
+			}
+			fmt.Printf("Downloaded %s (%s)\n", dest, formatSize(meta.Size))
+
+			state.Downloaded[meta.ID] = time.Now()
+		}
+		if err := state.save(statePath); err != nil {
+			fmt.Fprintln(os.Stderr, "inbox: failed to save state:", err)
+		}
+
+		select {
+		case <-time.After(*interval):
+		case <-stop:
+			return nil
+		}
+	}
+}
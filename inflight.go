@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// blobReaders counts the downloads streaming each blob. Blobs released while
+// they are being read are only removed once the last reader is done, so
+// cleanup can't cut a transfer short.
+type blobReaders struct {
+	mu      sync.Mutex
+	open    map[string]int
+	pending map[string]bool
+}
+
+// BeginRead marks blob as being read until the returned function is called.
+func (fs *FileStorage) BeginRead(blob string) func() {
+	r := &fs.readers
+	r.mu.Lock()
+	if r.open == nil {
+		r.open, r.pending = map[string]int{}, map[string]bool{}
+	}
+	r.open[blob]++
+	r.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { fs.endRead(blob) })
+	}
+}
+
+func (fs *FileStorage) endRead(blob string) {
+	r := &fs.readers
+	r.mu.Lock()
+	r.open[blob]--
+	remove := r.open[blob] == 0 && r.pending[blob]
+	if r.open[blob] == 0 {
+		delete(r.open, blob)
+		delete(r.pending, blob)
+	}
+	r.mu.Unlock()
+	if !remove {
+		return
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	// A new upload may have brought the contents back in the meantime
+	if fs.blobInUse(blob) || fs.storing[blob] > 0 {
+		return
+	}
+	slog.Debug("Removing contents released during a download", "blob", blob)
+	if err := fs.blobs.Remove(blob); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Failed to delete file contents", "blob", blob, "error", err)
+	}
+}
+
+// removeBlob deletes blob now, or once the downloads reading it finish.
+// Must be called with fs.mu held.
+func (fs *FileStorage) removeBlob(blob string) error {
+	r := &fs.readers
+	r.mu.Lock()
+	reading := r.open[blob] > 0
+	if reading {
+		r.pending[blob] = true
+	}
+	r.mu.Unlock()
+	if reading {
+		return nil
+	}
+	return fs.blobs.Remove(blob)
+}
+
+// blobInUse reports whether any file, or rendition of one, is stored in
+// blob. Must be called with fs.mu held.
+func (fs *FileStorage) blobInUse(blob string) bool {
+	for i := range fs.files {
+		meta := &fs.files[i]
+		if meta.blobName() == blob {
+			return true
+		}
+		for _, r := range meta.Renditions {
+			if renditionBlob(meta.ID, r.Key) == blob {
+				return true
+			}
+		}
+	}
+	return false
+}
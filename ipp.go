@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Minimal IPP (RFC 8010/8011) printer so devices can "print" documents
+// straight into the file list.
+
+const (
+	ippOpPrintJob             = 0x0002
+	ippOpValidateJob          = 0x0004
+	ippOpCancelJob            = 0x0008
+	ippOpGetJobAttributes     = 0x0009
+	ippOpGetJobs              = 0x000A
+	ippOpGetPrinterAttributes = 0x000B
+
+	ippStatusOK                        = 0x0000
+	ippStatusBadRequest                = 0x0400
+	ippStatusNotFound                  = 0x0406
+	ippStatusRequestEntityTooLarge     = 0x0408
+	ippStatusNotPossible               = 0x0418
+	ippStatusDocumentFormatUnsupported = 0x040A
+	ippStatusInternalError             = 0x0500
+	ippStatusOperationNotSupported     = 0x0501
+	ippStatusVersionNotSupported       = 0x0503
+	ippStatusNotAcceptingJobs          = 0x0506
+
+	ippTagOperation = 0x01
+	ippTagJob       = 0x02
+	ippTagEnd       = 0x03
+	ippTagPrinter   = 0x04
+
+	ippTagInteger  = 0x21
+	ippTagBoolean  = 0x22
+	ippTagEnum     = 0x23
+	ippTagText     = 0x41
+	ippTagName     = 0x42
+	ippTagKeyword  = 0x44
+	ippTagURI      = 0x45
+	ippTagCharset  = 0x47
+	ippTagLanguage = 0x48
+	ippTagMimeType = 0x49
+)
+
+var ippDocumentFormats = map[string]string{
+	"application/pdf":          ".pdf",
+	"image/jpeg":               ".jpg",
+	"application/octet-stream": "",
+}
+
+var (
+	ippJobCounter atomic.Int32
+	ippStartTime  = time.Now()
+)
+
+type ippAttribute struct {
+	tag    byte
+	name   string
+	values [][]byte
+}
+
+type ippMessage struct {
+	version   [2]byte
+	code      uint16
+	requestID uint32
+	// groups maps a delimiter tag to its attributes, in order.
+	groups map[byte][]ippAttribute
+	order  []byte
+}
+
+func (m *ippMessage) get(group byte, name string) *ippAttribute {
+	for i, attr := range m.groups[group] {
+		if attr.name == name {
+			return &m.groups[group][i]
+		}
+	}
+	return nil
+}
+
+func (m *ippMessage) getString(group byte, name string) string {
+	if attr := m.get(group, name); attr != nil && len(attr.values) > 0 {
+		return string(attr.values[0])
+	}
+	return ""
+}
+
+func (m *ippMessage) add(group byte, tag byte, name string, values ...[]byte) {
+	if m.groups == nil {
+		m.groups = make(map[byte][]ippAttribute)
+	}
+	if _, ok := m.groups[group]; !ok {
+		m.order = append(m.order, group)
+	}
+	m.groups[group] = append(m.groups[group], ippAttribute{tag: tag, name: name, values: values})
+}
+
+func (m *ippMessage) addStrings(group byte, tag byte, name string, values ...string) {
+	raw := make([][]byte, len(values))
+	for i, v := range values {
+		raw[i] = []byte(v)
+	}
+	m.add(group, tag, name, raw...)
+}
+
+func (m *ippMessage) addInts(group byte, tag byte, name string, values ...int) {
+	raw := make([][]byte, len(values))
+	for i, v := range values {
+		raw[i] = binary.BigEndian.AppendUint32(nil, uint32(v))
+	}
+	m.add(group, tag, name, raw...)
+}
+
+func (m *ippMessage) addBool(group byte, name string, value bool) {
+	b := byte(0)
+	if value {
+		b = 1
+	}
+	m.add(group, ippTagBoolean, name, []byte{b})
+}
+
+// readIPPMessage parses the IPP header and attribute groups, leaving r
+// positioned at the start of any document data.
+func readIPPMessage(r *bufio.Reader) (*ippMessage, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("failed to read ipp header: %w", err)
+	}
+
+	m := &ippMessage{
+		version:   [2]byte{header[0], header[1]},
+		code:      binary.BigEndian.Uint16(header[2:4]),
+		requestID: binary.BigEndian.Uint32(header[4:8]),
+		groups:    make(map[byte][]ippAttribute),
+	}
+
+	var group byte
+	for {
+		tag, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ipp tag: %w", err)
+		}
+		if tag == ippTagEnd {
+			return m, nil
+		}
+		if tag < 0x10 {
+			group = tag
+			if _, ok := m.groups[group]; !ok {
+				m.order = append(m.order, group)
+				m.groups[group] = nil
+			}
+			continue
+		}
+
+		name, err := readIPPField(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readIPPField(r)
+		if err != nil {
+			return nil, err
+		}
+
+		attrs := m.groups[group]
+		if len(name) == 0 && len(attrs) > 0 {
+			// Additional value of the previous attribute
+			attrs[len(attrs)-1].values = append(attrs[len(attrs)-1].values, value)
+			continue
+		}
+		m.groups[group] = append(attrs, ippAttribute{tag: tag, name: string(name), values: [][]byte{value}})
+	}
+}
+
+func readIPPField(r *bufio.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, fmt.Errorf("failed to read ipp field length: %w", err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read ipp field: %w", err)
+	}
+	return buf, nil
+}
+
+func (m *ippMessage) encode() []byte {
+	var buf bytes.Buffer
+	buf.Write(m.version[:])
+	binary.Write(&buf, binary.BigEndian, m.code)
+	binary.Write(&buf, binary.BigEndian, m.requestID)
+
+	for _, group := range m.order {
+		buf.WriteByte(group)
+		for _, attr := range m.groups[group] {
+			for i, v := range attr.values {
+				buf.WriteByte(attr.tag)
+				name := attr.name
+				if i > 0 {
+					name = ""
+				}
+				binary.Write(&buf, binary.BigEndian, uint16(len(name)))
+				buf.WriteString(name)
+				binary.Write(&buf, binary.BigEndian, uint16(len(v)))
+				buf.Write(v)
+			}
+		}
+	}
+	buf.WriteByte(ippTagEnd)
+
+	return buf.Bytes()
+}
+
+func newIPPResponse(req *ippMessage, status uint16) *ippMessage {
+	resp := &ippMessage{version: req.version, code: status, requestID: req.requestID}
+	if resp.version[0] == 0 {
+		resp.version = [2]byte{1, 1}
+	}
+	resp.addStrings(ippTagOperation, ippTagCharset, "attributes-charset", "utf-8")
+	resp.addStrings(ippTagOperation, ippTagLanguage, "attributes-natural-language", "en")
+	return resp
+}
+
+func ippPrinterURI(r *http.Request) string {
+	return "ipp://" + r.Host + basePath + "/ipp/print"
+}
+
+func addPrinterAttributes(resp *ippMessage, req *ippMessage, r *http.Request) {
+	requested := map[string]bool{}
+	if attr := req.get(ippTagOperation, "requested-attributes"); attr != nil {
+		for _, v := range attr.values {
+			requested[string(v)] = true
+		}
+	}
+	want := func(name string) bool {
+		return len(requested) == 0 || requested["all"] || requested["printer-description"] || requested[name]
+	}
+
+	formats := make([]string, 0, len(ippDocumentFormats))
+	for f := range ippDocumentFormats {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+
+	const g = ippTagPrinter
+	if want("printer-uri-supported") {
+		resp.addStrings(g, ippTagURI, "printer-uri-supported", ippPrinterURI(r))
+	}
+	if want("uri-security-supported") {
+		resp.addStrings(g, ippTagKeyword, "uri-security-supported", "none")
+	}
+	if want("uri-authentication-supported") {
+		resp.addStrings(g, ippTagKeyword, "uri-authentication-supported", "none")
+	}
+	if want("printer-name") {
+		resp.addStrings(g, ippTagName, "printer-name", "sync-it")
+	}
+	if want("printer-info") {
+		resp.addStrings(g, ippTagText, "printer-info", "Sync-It file drop")
+	}
+	if want("printer-make-and-model") {
+		resp.addStrings(g, ippTagText, "printer-make-and-model", "Sync-It Virtual Printer")
+	}
+	if want("printer-state") {
+		resp.addInts(g, ippTagEnum, "printer-state", 3) // idle
+	}
+	if want("printer-state-reasons") {
+		resp.addStrings(g, ippTagKeyword, "printer-state-reasons", "none")
+	}
+	if want("printer-is-accepting-jobs") {
+		resp.addBool(g, "printer-is-accepting-jobs", !maintenance.Enabled())
+	}
+	if want("ipp-versions-supported") {
+		resp.addStrings(g, ippTagKeyword, "ipp-versions-supported", "1.1", "2.0")
+	}
+	if want("operations-supported") {
+		resp.addInts(g, ippTagEnum, "operations-supported",
+			ippOpPrintJob, ippOpValidateJob, ippOpCancelJob,
+			ippOpGetJobAttributes, ippOpGetJobs, ippOpGetPrinterAttributes)
+	}
+	if want("charset-configured") {
+		resp.addStrings(g, ippTagCharset, "charset-configured", "utf-8")
+	}
+	if want("charset-supported") {
+		resp.addStrings(g, ippTagCharset, "charset-supported", "utf-8")
+	}
+	if want("natural-language-configured") {
+		resp.addStrings(g, ippTagLanguage, "natural-language-configured", "en")
+	}
+	if want("generated-natural-language-supported") {
+		resp.addStrings(g, ippTagLanguage, "generated-natural-language-supported", "en")
+	}
+	if want("document-format-default") {
+		resp.addStrings(g, ippTagMimeType, "document-format-default", "application/pdf")
+	}
+	if want("document-format-supported") {
+		resp.addStrings(g, ippTagMimeType, "document-format-supported", formats...)
+	}
+	if want("pdl-override-supported") {
+		resp.addStrings(g, ippTagKeyword, "pdl-override-supported", "not-attempted")
+	}
+	if want("compression-supported") {
+		resp.addStrings(g, ippTagKeyword, "compression-supported", "none")
+	}
+	if want("color-supported") {
+		resp.addBool(g, "color-supported", true)
+	}
+	if want("media-default") {
+		resp.addStrings(g, ippTagKeyword, "media-default", "iso_a4_210x297mm")
+	}
+	if want("media-supported") {
+		resp.addStrings(g, ippTagKeyword, "media-supported", "iso_a4_210x297mm", "na_letter_8.5x11in")
+	}
+	if want("queued-job-count") {
+		resp.addInts(g, ippTagInteger, "queued-job-count", 0)
+	}
+	if want("printer-up-time") {
+		resp.addInts(g, ippTagInteger, "printer-up-time", int(time.Since(ippStartTime).Seconds())+1)
+	}
+}
+
+func addJobAttributes(resp *ippMessage, r *http.Request, jobID int) {
+	resp.addInts(ippTagJob, ippTagInteger, "job-id", jobID)
+	resp.addStrings(ippTagJob, ippTagURI, "job-uri", fmt.Sprintf("%s/%d", ippPrinterURI(r), jobID))
+	resp.addInts(ippTagJob, ippTagEnum, "job-state", 9) // completed
+	resp.addStrings(ippTagJob, ippTagKeyword, "job-state-reasons", "job-completed-successfully")
+}
+
+func ippJobID(req *ippMessage) int {
+	if attr := req.get(ippTagOperation, "job-id"); attr != nil && len(attr.values) > 0 && len(attr.values[0]) == 4 {
+		return int(int32(binary.BigEndian.Uint32(attr.values[0])))
+	}
+	if uri := req.getString(ippTagOperation, "job-uri"); uri != "" {
+		var id int
+		if _, err := fmt.Sscanf(uri[strings.LastIndex(uri, "/")+1:], "%d", &id); err == nil {
+			return id
+		}
+	}
+	return 0
+}
+
+func ippDocumentName(req *ippMessage, format string) string {
+	name := req.getString(ippTagOperation, "document-name")
+	if name == "" {
+		name = req.getString(ippTagOperation, "job-name")
+	}
+	if name == "" {
+		name = "print-" + time.Now().Format("20060102-150405")
+	}
+	name = filepath.Base(name)
+
+	if ext := ippDocumentFormats[format]; ext != "" && !strings.EqualFold(filepath.Ext(name), ext) {
+		name += ext
+	}
+	return name
+}
+
+// ippUploadRefused answers a print job that can't be stored, as when it is
+// too large or over the client's quota.
+func ippUploadRefused(req *ippMessage, err error) *ippMessage {
+	resp := newIPPResponse(req, ippStatusRequestEntityTooLarge)
+	resp.addStrings(ippTagOperation, ippTagText, "status-message", err.Error())
+	return resp
+}
+
+func handleIPP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/ipp" {
+		http.Error(w, "Content-Type must be application/ipp", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body := bufio.NewReader(r.Body)
+	req, err := readIPPMessage(body)
+	if err != nil {
+		slog.Warn("Invalid IPP request", "error", err)
+		http.Error(w, "Invalid IPP request", http.StatusBadRequest)
+		return
+	}
+
+	resp := processIPP(req, body, r)
+
+	w.Header().Set("Content-Type", "application/ipp")
+	w.Write(resp.encode())
+}
+
+func processIPP(req *ippMessage, body io.Reader, r *http.Request) *ippMessage {
+	if req.version[0] < 1 || req.version[0] > 2 {
+		return newIPPResponse(req, ippStatusVersionNotSupported)
+	}
+
+	switch req.code {
+	case ippOpGetPrinterAttributes:
+		resp := newIPPResponse(req, ippStatusOK)
+		addPrinterAttributes(resp, req, r)
+		return resp
+
+	case ippOpValidateJob, ippOpPrintJob:
+		format := req.getString(ippTagOperation, "document-format")
+		if format == "" {
+			format = "application/pdf"
+		}
+		if _, ok := ippDocumentFormats[format]; !ok {
+			resp := newIPPResponse(req, ippStatusDocumentFormatUnsupported)
+			resp.addStrings(ippTagOperation, ippTagText, "status-message", "Unsupported document format")
+			return resp
+		}
+		if maintenance.Enabled() {
+			resp := newIPPResponse(req, ippStatusNotAcceptingJobs)
+			resp.addStrings(ippTagOperation, ippTagText, "status-message", maintenance.Status().Message)
+			return resp
+		}
+		if req.code == ippOpValidateJob {
+			return newIPPResponse(req, ippStatusOK)
+		}
+
+		// Held to the same size limit, quota and approval as uploads
+		opts := uploadOptions{Quota: requestAllowance(r), Pending: needsApproval(r), Source: requestSource(r)}
+		name := ippDocumentName(req, format)
+		meta, err := storage.SaveNewFile(opts.file("", "", name), opts.body(body), expirationFor(0))
+		var over errOverQuota
+		var tooLarge errTooLarge
+		if errors.As(err, &over) || errors.As(err, &tooLarge) {
+			return ippUploadRefused(req, err)
+		}
+		if err != nil {
+			slog.Error("Failed to save printed document", "filename", name, "error", err)
+			return newIPPResponse(req, ippStatusInternalError)
+		}
+		slog.Info("Received print job", "filename", name, "id", meta.ID, "size", meta.Size, "client", clientIP(r))
+
+		resp := newIPPResponse(req, ippStatusOK)
+		addJobAttributes(resp, r, int(ippJobCounter.Add(1)))
+		return resp
+
+	case ippOpGetJobs:
+		// Jobs complete as soon as they are received, so nothing is queued
+		return newIPPResponse(req, ippStatusOK)
+
+	case ippOpGetJobAttributes, ippOpCancelJob:
+		jobID := ippJobID(req)
+		if jobID <= 0 || jobID > int(ippJobCounter.Load()) {
+			return newIPPResponse(req, ippStatusNotFound)
+		}
+		if req.code == ippOpCancelJob {
+			return newIPPResponse(req, ippStatusNotPossible)
+		}
+		resp := newIPPResponse(req, ippStatusOK)
+		addJobAttributes(resp, r, jobID)
+		return resp
+
+	default:
+		return newIPPResponse(req, ippStatusOperationNotSupported)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Without a metadata database, each commit is appended to metadata.journal
+// and synced before it is applied, so a change is durable once commit
+// returns even though metadata.json is only rewritten every
+// journalCheckpoint commits. Loading metadata.json replays the journal on
+// top of it.
+const (
+	journalName       = "metadata.journal"
+	journalCheckpoint = 100
+)
+
+// journalRecord is one commit: the entries it added or modified and the IDs
+// it removed.
+type journalRecord struct {
+	Put     []FileMetadata `json:"put,omitempty"`
+	Removed []string       `json:"removed,omitempty"`
+}
+
+func (fs *FileStorage) journalPath() string {
+	return filepath.Join(fs.dir, journalName)
+}
+
+// appendJournal durably records a commit. The directory is synced first so
+// blobs renamed into place by the commit survive a crash along with it.
+// Must be called with fs.mu held.
+func (fs *FileStorage) appendJournal(put []FileMetadata, removed []string) error {
+	line, err := json.Marshal(journalRecord{Put: put, Removed: removed})
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+
+	syncDir(fs.dir)
+	f, err := os.OpenFile(fs.journalPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata journal: %w", err)
+	}
+	_, err = f.Write(append(line, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write metadata journal: %w", err)
+	}
+
+	fs.journalRecords++
+	fs.journalVersion = statVersion(fs.journalPath())
+	return nil
+}
+
+// replayJournal applies the journal to fs.files and returns how many
+// records it held. A torn last line, from a crash while it was being
+// written, belongs to a commit that never returned and is ignored. Must be
+// called with fs.mu held.
+func (fs *FileStorage) replayJournal() (int, error) {
+	fs.journalVersion = statVersion(fs.journalPath())
+	fs.journalRecords = 0
+
+	data, err := os.ReadFile(fs.journalPath())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read metadata journal: %w", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, len(data)+1)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			break
+		}
+		fs.applyRecord(rec)
+		fs.journalRecords++
+	}
+	return fs.journalRecords, nil
+}
+
+// applyRecord applies a committed change to fs.files. Records set entries to
+// absolute values, so applying one twice is harmless.
+func (fs *FileStorage) applyRecord(rec journalRecord) {
+	if len(rec.Removed) > 0 {
+		removed := make(map[string]bool, len(rec.Removed))
+		for _, id := range rec.Removed {
+			removed[id] = true
+		}
+		kept := fs.files[:0]
+		for _, meta := range fs.files {
+			if !removed[meta.ID] {
+				kept = append(kept, meta)
+			}
+		}
+		fs.files = kept
+	}
+
+	index := make(map[string]int, len(fs.files))
+	for i, meta := range fs.files {
+		index[meta.ID] = i
+	}
+	for _, meta := range rec.Put {
+		if i, ok := index[meta.ID]; ok {
+			fs.files[i] = meta
+		} else {
+			index[meta.ID] = len(fs.files)
+			fs.files = append(fs.files, meta)
+		}
+	}
+}
+
+// checkpoint rewrites metadata.json with everything journaled so far and
+// starts a new journal. A crash in between just replays records that are
+// already in the file. Must be called with fs.mu held.
+func (fs *FileStorage) checkpoint() error {
+	if err := fs.saveMetadata(); err != nil {
+		return err
+	}
+	if err := os.Remove(fs.journalPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to reset metadata journal: %w", err)
+	}
+	fs.journalRecords = 0
+	fs.journalVersion = fileVersion{}
+	return nil
+}
+
+// syncDir persists renames and new entries in dir, where the platform
+// supports syncing a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// filterFiles keeps the files matching the listing's ?name= (part of the
+// name, in any case), ?minSize= and ?maxSize= (bytes, or e.g. 10MB), and
+// ?uploadedAfter= and ?uploadedBefore= (RFC 3339) filters.
+func filterFiles(r *http.Request, files []FileMetadata) ([]FileMetadata, error) {
+	q := r.URL.Query()
+	name := strings.ToLower(q.Get("name"))
+
+	minSize, maxSize := int64(-1), int64(-1)
+	for key, size := range map[string]*int64{"minSize": &minSize, "maxSize": &maxSize} {
+		if v := q.Get(key); v != "" {
+			n, err := parseSize(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			*size = n
+		}
+	}
+	var after, before time.Time
+	for key, t := range map[string]*time.Time{"uploadedAfter": &after, "uploadedBefore": &before} {
+		if v := q.Get(key); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an RFC 3339 time such as 2026-06-01T09:00:00Z", key)
+			}
+			*t = parsed
+		}
+	}
+	if name == "" && minSize < 0 && maxSize < 0 && after.IsZero() && before.IsZero() {
+		return files, nil
+	}
+
+	matching := []FileMetadata{}
+	for _, meta := range files {
+		switch {
+		case name != "" && !strings.Contains(strings.ToLower(meta.Name), name):
+		case minSize >= 0 && meta.Size < minSize:
+		case maxSize >= 0 && meta.Size > maxSize:
+		case !after.IsZero() && !meta.UploadedAt.After(after):
+		case !before.IsZero() && !meta.UploadedAt.Before(before):
+		default:
+			matching = append(matching, meta)
+		}
+	}
+	return matching, nil
+}
+
+// sortFiles orders a listing by ?sort=uploadedAt (the default), size or
+// name, with ?order=asc or desc. Names sort A to Z unless told otherwise,
+// and the others largest or newest first. Ties stay newest first.
+func sortFiles(r *http.Request, files []FileMetadata) error {
+	q := r.URL.Query()
+	by := q.Get("sort")
+	order := q.Get("order")
+	if order != "" && order != "asc" && order != "desc" {
+		return fmt.Errorf("order must be asc or desc")
+	}
+
+	var less func(a, b *FileMetadata) bool
+	switch by {
+	case "", "uploadedAt":
+		if order != "asc" {
+			// As listed already
+			return nil
+		}
+		less = func(a, b *FileMetadata) bool { return a.UploadedAt.Before(b.UploadedAt) }
+	case "size":
+		less = func(a, b *FileMetadata) bool { return a.Size < b.Size }
+		if order == "" {
+			order = "desc"
+		}
+	case "name":
+		less = func(a, b *FileMetadata) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) }
+	default:
+		return fmt.Errorf("sort must be uploadedAt, size or name")
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		if order == "desc" {
+			return less(&files[j], &files[i])
+		}
+		return less(&files[i], &files[j])
+	})
+	return nil
+}
@@ -9,14 +9,25 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
 var (
-	port    int
-	localIP string
-	storage *FileStorage
+	port         int
+	uploadsDir   string
+	localIP      string
+	storage      *FileStorage
+	notes        *NoteStorage
+	collections  *CollectionStorage
+	folders      *FolderStorage
+	expectations *ExpectStorage
+	rooms        *RoomStorage
+	cluster      *Cluster
+	push         *PushService
 )
 
 func getLocalIP() string {
@@ -35,11 +46,108 @@ func getLocalIP() string {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "self-update" {
+		if err := runSelfUpdate(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "self-update:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "inbox" {
+		if err := runInbox(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "inbox:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "download" {
+		if err := runDownload(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "download:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	flag.IntVar(&port, "port", 80, "Port to run the server on")
+	listen := flag.String("listen", "", "Address to listen on, e.g. 127.0.0.1 (default all interfaces)")
+	flag.StringVar(&uploadsDir, "dir", "./uploads", "Directory to store uploaded files in")
+	storageMode := flag.String("storage", "disk", "Where files are kept: disk (-dir, or -s3-bucket) or memory, which never writes files, their names, notes or rooms to disk")
+	maxUpload := flag.String("max-upload-size", "", "Largest file that may be uploaded (e.g. 4GB); larger uploads are cut off with 413 as soon as they go over")
+	flag.BoolVar(&fetchEnabled, "fetch", false, "Let clients have the server download a URL into storage with POST /api/fetch")
+	flag.DurationVar(&uploadTimeout, "upload-timeout", 2*time.Minute, "Drop an upload that takes longer than this to send the next 16KB; the deadline moves on as long as bytes keep flowing, 0 turns it off")
+	memoryLimit := flag.String("memory-limit", "1GB", "Most file contents -storage memory holds; uploads past it are refused")
+	clusterMode := flag.Bool("cluster", false, "Share the uploads directory with other sync-it instances")
+	faultInjection := flag.String("fault-injection", "", "For testing clients: make reads and writes of file contents randomly fail or stall, e.g. fail=5%,delay=20%,max-delay=2s")
+	persistAll := flag.Bool("persist", false, "Keep files across restarts instead of clearing them on startup and shutdown")
+	shutdownFlag := flag.String("shutdown-policy", "", "What shutting down does with files: keep-all, clear-expired-only or clear-all (default clear-all, or keep-all with -persist, -cluster or S3 storage)")
+	nodeID := flag.String("node-id", "", "Unique name of this instance in cluster mode (default hostname-pid)")
+	flag.StringVar(&basePath, "base-path", "", "URL path prefix when mounted under a sub-path by a reverse proxy (e.g. /sync)")
+	flag.StringVar(&externalURL, "external-url", "", "Public base URL used in generated links (e.g. https://files.home.lan)")
+	vapidSubject := flag.String("vapid-subject", "mailto:admin@sync-it.invalid", "Contact URI sent to browser push services (mailto: or https:)")
+	telegramToken := flag.String("telegram-token", "", "Telegram bot token; enables the Telegram bridge")
+	telegramChat := flag.Int64("telegram-chat", 0, "Telegram chat ID the bot accepts files from and announces uploads to")
+	matrixHomeserver := flag.String("matrix-homeserver", "", "Matrix homeserver URL; enables the Matrix bridge")
+	matrixToken := flag.String("matrix-token", "", "Matrix access token for the bridge account")
+	matrixRoom := flag.String("matrix-room", "", "Matrix room ID (!room:server) to ingest media from and announce uploads to")
+	hooks := hookFlag{}
+	flag.Var(hooks, "hook", "Run a command on a file event, as event=command (upload, download, delete, expire); repeatable")
+	convertHEIC := flag.Bool("convert-heic", false, "Add a JPEG copy of HEIC/HEIF uploads (requires heif-convert or ImageMagick)")
+	transcodeVideo := flag.Bool("transcode-video", false, "Add an H.264/AAC web copy of videos browsers can't play (requires ffmpeg)")
+	flag.DurationVar(&defaultExpiration, "default-expiration", 24*time.Hour, "Expiration for uploads that don't request one")
+	flag.DurationVar(&minExpiration, "min-expiration", 0, "Shortest expiration a file gets; shorter requests are raised to it (0 for no limit)")
+	flag.DurationVar(&maxExpiration, "max-expiration", 0, "Longest expiration a client may request; longer requests are clamped (0 for no limit)")
+	s3Bucket := flag.String("s3-bucket", "", "Store file contents in this S3 bucket instead of -dir (credentials from AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY)")
+	s3Endpoint := flag.String("s3-endpoint", "", "S3-compatible endpoint URL, e.g. http://minio:9000 (default AWS)")
+	s3Region := flag.String("s3-region", "us-east-1", "S3 region")
+	s3Prefix := flag.String("s3-prefix", "", "Key prefix for objects in the S3 bucket")
+	metaBackend := flag.String("meta", "json", "Where file metadata is kept: json (metadata.json), sqlite or bolt; the latter two need a build with -tags sqlite or -tags bolt")
+	metadataDBPath := flag.String("metadata-db", "", "Database file for -meta sqlite or bolt (default metadata.<backend> in -dir)")
+	compression := flag.String("compress", "", "Compress new uploads at rest with zstd or gzip, skipping already-compressed types; zstd needs a build with -tags zstd")
+	encryptionKey := flag.String("encryption-key", "", "Encrypt stored files with AES-256-GCM using this 32-byte key, as hex or base64 (default $SYNCIT_ENCRYPTION_KEY)")
+	encryptionKeyFile := flag.String("encryption-key-file", "", "Read the encryption key from this file, creating it with a random key if missing")
+	alertUsage := flag.String("alert-usage", "80,95", "Alert when storage usage crosses these percentages (empty to disable)")
+	storageLimit := flag.String("storage-limit", "", "Measure usage alerts and eviction against this much stored data (e.g. 50GB) instead of the disk holding -dir")
+	evictBelow := flag.String("evict-below", "", "Evict the least recently downloaded files before they expire when free space drops below this, e.g. 10% or 5GB")
+	deleteGrace := flag.Duration("delete-grace", 15*time.Minute, "Keep deleted and expired files hidden this long before removing their contents, so downloads under way can finish; 0 removes them at once")
+	trashRetention := flag.Duration("trash", 24*time.Hour, "Keep deleted files restorable from the trash this long, though never past their expiration; 0 turns the trash off")
+	scrubInterval := flag.Duration("scrub-interval", 0, "Re-hash stored files against their checksums this often (e.g. 24h) and quarantine damaged ones; 0 disables scheduled scrubs")
+	standbyDir := flag.String("standby-dir", "", "Keep a warm copy of stored files and metadata in this directory, e.g. on a USB drive, that can be served with -dir -persist")
+	standbyInterval := flag.Duration("standby-interval", 15*time.Minute, "Bring the -standby-dir copy up to date at least this often, besides shortly after files change")
+	archiveDir := flag.String("archive-dir", "", "Move expired files into this directory instead of deleting them, for an admin to browse and restore at /api/admin/archive")
+	archiveRetention := flag.Duration("archive-retention", 0, "Remove files from the -archive-dir after this long (e.g. 2160h); 0 keeps them for good")
+	clientQuota := flag.String("client-quota", "", "Bytes each client may keep stored (e.g. 5GB); uploads past it are refused")
+	clientQuotaOverrides := flag.String("client-quota-overrides", "", "Per-client quotas by IP, e.g. 192.168.1.20=50GB,10.0.0.5=0 (0 for no limit)")
+	clientQuotaBy := flag.String("client-quota-by", "ip", "Tell clients apart for quotas by ip or by API token")
+	flag.BoolVar(&approveUploads, "approve-uploads", false, "Hold guest uploads until an admin approves them (admins are requests from this host or with SYNCIT_ADMIN_KEY)")
+	metrics := flag.Bool("metrics", false, "Serve cleanup and request latency metrics for Prometheus at /metrics")
+	sloFlag := flag.String("slo", "/api/download/=200ms@99%", "Comma-separated latency objectives, route=latency@target, e.g. /api/download/=200ms@99% (empty for none)")
+	alertUploadSize := flag.String("alert-upload-size", "", "Alert when a single upload is larger than this (e.g. 2GB)")
+	alertWebhook := flag.String("alert-webhook", "", "URL that storage alerts are POSTed to as JSON")
+	alertEmail := flag.String("alert-email", "", "Comma-separated addresses to email storage alerts to (needs -smtp and -smtp-from)")
+	smtpAddr := flag.String("smtp", "", "SMTP server as host:port for alert emails and emailing files (credentials from SYNCIT_SMTP_USERNAME/SYNCIT_SMTP_PASSWORD)")
+	smtpFrom := flag.String("smtp-from", "", "Sender address for alert emails and emailed files")
+	emailAttachMax := flag.String("email-attach-max", "10MB", "Largest file /api/files/{id}/email attaches; larger ones are sent as a link (0 to always send a link)")
+	flag.StringVar(&importRoot, "import-root", "", "Directory whose files may be imported with /api/import from the server itself, hard-linked when possible")
+	flag.StringVar(&filenameUnicode, "filename-unicode", filenameNFC, "How Unicode in uploaded file names is stored: nfc (compose separate accents), ascii (transliterate) or keep")
+	flag.IntVar(&maxFilenameLength, "filename-max-length", 255, "Longest uploaded file name to store, in bytes; longer names are shortened keeping the extension (0 for no limit)")
+	importDir := flag.String("import", "", "Directory whose files are served in place, without copying, and never expire; read at startup")
+	outboxDir := flag.String("outbox", "", "Directory whose files are ingested and then removed, for local scripts to publish into")
+	throttleRules := throttleFlag{}
+	downloadSlots := flag.Int("download-slots", 0, "Serve at most this many large downloads at once and queue the rest; 0 means no queue")
+	downloadQueueMin := flag.String("download-queue-min", "16MB", "Downloads at least this size go through the -download-slots queue")
+	flag.Var(&throttleRules, "throttle", "Limit total throughput during a daily window, as [days] [HH:MM-HH:MM]=rate (e.g. \"mon-fri 09:00-17:00=2MB\"); first match wins; repeatable")
+	pin := flag.String("pin", "", "Require this PIN, exchanged at /api/bootstrap for a short-lived token, before the API can be used")
+	proxies := flag.String("trusted-proxies", "", "Comma-separated IPs/CIDRs of reverse proxies whose forwarded headers are trusted; without it, -base-path and -external-url stop requests from this host counting as admin")
+	var tenantFlags tenantFlag
+	flag.Var(&tenantFlags, "tenant", "Serve a separate store at /t/<name>/, as \"name=dir [flags]\" with its own flags such as -pin or -client-quota; repeatable")
+	logPath := flag.String("log-file", "sync-it.log", "File to write the JSON log to")
 	flag.Parse()
 
+	basePath = normalizeBasePath(basePath)
+	externalURL = strings.TrimSuffix(externalURL, "/")
+
 	// Configure logging to file
-	logFile, logErr := os.OpenFile("sync-it.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	logFile, logErr := os.OpenFile(*logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if logErr != nil {
 		slog.Error("Failed to open log file", "error", logErr)
 		os.Exit(1)
@@ -54,32 +162,482 @@ func main() {
 
 	slog.Info("Server starting")
 
+	var err error
+	trustedProxies, err = parseTrustedProxies(*proxies)
+	if err != nil {
+		slog.Error("Invalid -trusted-proxies", "error", err)
+		os.Exit(1)
+	}
+	if unnamedProxy() {
+		slog.Warn("-base-path or -external-url set without -trusted-proxies; requests from this host won't count as admin, use SYNCIT_ADMIN_KEY or an admin API key instead")
+	}
+	if defaultExpiration <= 0 {
+		slog.Error("-default-expiration must be positive")
+		os.Exit(1)
+	}
+	if minExpiration < 0 || maxExpiration < 0 || maxExpiration > 0 && minExpiration > maxExpiration {
+		slog.Error("-min-expiration must not be negative or longer than -max-expiration")
+		os.Exit(1)
+	}
+	if maxExpiration > 0 && defaultExpiration > maxExpiration {
+		defaultExpiration = maxExpiration
+	}
+	defaultExpiration = max(defaultExpiration, minExpiration)
+	if err := validFilenamePolicy(filenameUnicode); err != nil {
+		slog.Error("Invalid -filename-unicode", "error", err)
+		os.Exit(1)
+	}
+	if maxFilenameLength < 0 {
+		slog.Error("-filename-max-length can't be negative")
+		os.Exit(1)
+	}
+
+	if *maxUpload != "" {
+		if maxUploadSize, err = parseSize(*maxUpload); err != nil || maxUploadSize <= 0 {
+			slog.Error("Invalid -max-upload-size", "value", *maxUpload)
+			os.Exit(1)
+		}
+		slog.Info("Upload size limit enabled", "limit", formatSize(maxUploadSize))
+	}
+	if uploadTimeout < 0 {
+		slog.Error("-upload-timeout can't be negative")
+		os.Exit(1)
+	}
+
+	// State of notes, rooms etc. is kept in memory alone without a directory
+	stateDir := uploadsDir
+	var memLimit int64
+	switch *storageMode {
+	case "disk":
+	case "memory":
+		conflicts := map[string]bool{
+			"-cluster":         *clusterMode,
+			"-s3-bucket":       *s3Bucket != "",
+			"-meta":            *metaBackend != "json",
+			"-persist":         *persistAll,
+			"-convert-heic":    *convertHEIC,
+			"-transcode-video": *transcodeVideo,
+			"-standby-dir":     *standbyDir != "",
+			"-shutdown-policy": *shutdownFlag != "",
+		}
+		for name, set := range conflicts {
+			if set {
+				slog.Error(name + " can't be combined with -storage memory")
+				os.Exit(1)
+			}
+		}
+		if memLimit, err = parseSize(*memoryLimit); err != nil || memLimit <= 0 {
+			slog.Error("Invalid -memory-limit", "value", *memoryLimit)
+			os.Exit(1)
+		}
+		inMemory = true
+		stateDir = ""
+	default:
+		slog.Error("Invalid -storage (use disk or memory)", "storage", *storageMode)
+		os.Exit(1)
+	}
+
 	localIP = getLocalIP()
 
-	var err error
-	storage, err = NewFileStorage("./uploads")
+	// Registered before anything is stored, after any compiled-in decorators
+	// so it encrypts what they produce
+	key, err := loadEncryptionKey(*encryptionKey, *encryptionKeyFile)
 	if err != nil {
+		slog.Error("Invalid encryption key", "error", err)
+		os.Exit(1)
+	}
+	if key != nil {
+		decorator, err := newAESGCMDecorator(key)
+		if err != nil {
+			slog.Error("Failed to initialize encryption", "error", err)
+			os.Exit(1)
+		}
+		RegisterStorageDecorator(decorator)
+		slog.Info("Encryption at rest enabled")
+	}
+	if *faultInjection != "" {
+		faults, err := parseFaultInjection(*faultInjection)
+		if err != nil {
+			slog.Error("Invalid -fault-injection", "error", err)
+			os.Exit(1)
+		}
+		RegisterStorageDecorator(faults)
+		slog.Warn("Fault injection enabled; storage will fail on purpose", "settings", faults.String())
+	}
+
+	if inMemory {
+		storage = NewMemoryStorage(memLimit)
+		slog.Info("In-memory storage enabled", "limit", formatSize(memLimit))
+	} else if storage, err = NewFileStorage(uploadsDir); err != nil {
 		slog.Error("Failed to initialize storage", "error", err)
 		os.Exit(1)
 	}
 
-	// Clear all files on startup
-	if err := storage.ClearAllFiles(); err != nil {
-		slog.Warn("Failed to clear files on startup", "error", err)
+	if *metaBackend != "json" {
+		if *clusterMode || *s3Bucket != "" {
+			slog.Error("-meta can't be combined with -cluster or -s3-bucket, which rely on metadata.json", "meta", *metaBackend)
+			os.Exit(1)
+		}
+		db, err := OpenMetadataDB(*metaBackend, *metadataDBPath, uploadsDir)
+		if err != nil {
+			slog.Error("Failed to open metadata database", "error", err)
+			os.Exit(1)
+		}
+		if err := storage.UseMetadataDB(db); err != nil {
+			slog.Error("Failed to initialize metadata database", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Metadata database enabled", "backend", *metaBackend)
+	}
+
+	storage.UseDeleteGrace(*deleteGrace)
+	storage.UseTrash(*trashRetention)
+
+	if *compression != "" {
+		if err := storage.UseCompression(*compression); err != nil {
+			slog.Error("Invalid -compress", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Compression at rest enabled", "codec", *compression)
+	}
+
+	if *s3Bucket != "" {
+		blobs, err := NewS3BlobStore(*s3Endpoint, *s3Bucket, *s3Region, *s3Prefix)
+		if err != nil {
+			slog.Error("Invalid S3 configuration", "error", err)
+			os.Exit(1)
+		}
+		if err := storage.UseRemoteBlobs(blobs); err != nil {
+			slog.Error("Failed to initialize S3 storage", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("S3 storage enabled", "bucket", *s3Bucket, "endpoint", blobs.endpoint.String())
+	}
+
+	if len(throttleRules) > 0 {
+		throttle = NewBandwidthLimiter(throttleRules)
+		slog.Info("Bandwidth schedule enabled", "rules", throttleRules.String())
+	}
+
+	if *downloadSlots > 0 {
+		minSize, err := parseSize(*downloadQueueMin)
+		if err != nil {
+			slog.Error("Invalid -download-queue-min", "error", err)
+			os.Exit(1)
+		}
+		downloads = NewDownloadQueue(*downloadSlots, minSize)
+		slog.Info("Download queue enabled", "slots", *downloadSlots, "minSize", formatSize(minSize))
+	}
+
+	if *clientQuota != "" || *clientQuotaOverrides != "" {
+		var limit int64
+		overrides, err := parseQuotaOverrides(*clientQuotaOverrides)
+		if err == nil && *clientQuota != "" {
+			limit, err = parseSize(*clientQuota)
+		}
+		if err == nil {
+			quota, err = NewClientQuota(limit, overrides, *clientQuotaBy)
+		}
+		if err != nil {
+			slog.Error("Invalid client quota", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Client quotas enabled", "limit", formatSize(limit), "overrides", len(overrides), "by", *clientQuotaBy)
+	}
+
+	if *pin != "" {
+		auth, err = NewAuthenticator(stateDir, *pin)
+		if err != nil {
+			slog.Error("Failed to initialize authentication", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("PIN authentication enabled")
+
+		if apiKeys, err = NewAPIKeyStore(stateDir); err != nil {
+			slog.Error("Failed to load API keys", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	alertConfig := AlertConfig{Webhook: *alertWebhook, SMTPAddr: *smtpAddr, SMTPFrom: *smtpFrom}
+	if alertConfig.Thresholds, err = parseThresholds(*alertUsage); err == nil && *storageLimit != "" {
+		alertConfig.StorageLimit, err = parseSize(*storageLimit)
+	}
+	if inMemory && (alertConfig.StorageLimit == 0 || alertConfig.StorageLimit > memLimit) {
+		alertConfig.StorageLimit = memLimit
+	}
+	if err == nil && *alertUploadSize != "" {
+		alertConfig.UploadSize, err = parseSize(*alertUploadSize)
+	}
+	if *alertEmail != "" {
+		alertConfig.Email = strings.Split(*alertEmail, ",")
+	}
+	if err != nil {
+		slog.Error("Invalid alert settings", "error", err)
+		os.Exit(1)
+	}
+	if *s3Bucket != "" && alertConfig.StorageLimit == 0 {
+		// The local disk says nothing about the bucket
+		alertConfig.Thresholds = nil
+	}
+	alerts, err := NewAlerter(alertConfig)
+	if err != nil {
+		slog.Error("Invalid alert settings", "error", err)
+		os.Exit(1)
+	}
+	events.Subscribe(alerts.handleEvent)
+
+	if *smtpAddr != "" && *smtpFrom != "" {
+		attachMax, err := parseSize(*emailAttachMax)
+		if err != nil || attachMax < 0 {
+			slog.Error("Invalid -email-attach-max", "value", *emailAttachMax)
+			os.Exit(1)
+		}
+		mailer = NewMailer(*smtpAddr, *smtpFrom, attachMax)
+	}
+
+	if *evictBelow != "" {
+		if *s3Bucket != "" && alertConfig.StorageLimit == 0 {
+			slog.Error("-evict-below with S3 storage needs -storage-limit")
+			os.Exit(1)
+		}
+		if evictor, err = NewEvictor(*evictBelow, alertConfig.StorageLimit); err != nil {
+			slog.Error("Invalid eviction settings", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Eviction under disk pressure enabled", "minFree", evictor.String())
+	}
+
+	slos, err := parseSLOs(*sloFlag)
+	if err != nil {
+		slog.Error("Invalid -slo", "error", err)
+		os.Exit(1)
+	}
+	requestStats.SetSLOs(slos)
+
+	notes, err = NewNoteStorage(stateDir)
+	if err != nil {
+		slog.Error("Failed to initialize notes", "error", err)
+		os.Exit(1)
+	}
+
+	collections, err = NewCollectionStorage(stateDir)
+	if err != nil {
+		slog.Error("Failed to initialize collections", "error", err)
+		os.Exit(1)
+	}
+
+	folders, err = NewFolderStorage(stateDir)
+	if err != nil {
+		slog.Error("Failed to initialize folders", "error", err)
+		os.Exit(1)
+	}
+
+	expectations, err = NewExpectStorage(stateDir)
+	if err != nil {
+		slog.Error("Failed to initialize expected uploads", "error", err)
+		os.Exit(1)
+	}
+
+	rooms, err = NewRoomStorage(stateDir)
+	if err != nil {
+		slog.Error("Failed to initialize rooms", "error", err)
+		os.Exit(1)
+	}
+
+	push, err = NewPushService(stateDir, *vapidSubject)
+	if err != nil {
+		slog.Error("Failed to initialize push notifications", "error", err)
+		os.Exit(1)
+	}
+	events.Subscribe(push.handleEvent)
+
+	if len(hooks) > 0 {
+		events.Subscribe(hooks.handleEvent)
+	}
+	subscribeNotifiers()
+
+	if *convertHEIC || *transcodeVideo {
+		converter := &Converter{}
+		if *convertHEIC {
+			if err := converter.EnableHEIC(); err != nil {
+				slog.Error("Failed to enable HEIC conversion", "error", err)
+				os.Exit(1)
+			}
+		}
+		if *transcodeVideo {
+			if err := converter.EnableVideo(); err != nil {
+				slog.Error("Failed to enable video transcoding", "error", err)
+				os.Exit(1)
+			}
+		}
+		events.Subscribe(converter.handleEvent)
 	}
 
-	// Start cleanup goroutine
 	stopCleanup := make(chan bool)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *telegramToken != "" {
+		if *telegramChat == 0 {
+			slog.Error("-telegram-chat is required with -telegram-token")
+			os.Exit(1)
+		}
+		bot := NewTelegramBot(*telegramToken, *telegramChat)
+		events.Subscribe(bot.handleEvent)
+		go bot.Run(ctx)
+		slog.Info("Telegram bridge enabled", "chat", *telegramChat)
+	}
+
+	if *matrixHomeserver != "" {
+		if *matrixToken == "" || *matrixRoom == "" {
+			slog.Error("-matrix-token and -matrix-room are required with -matrix-homeserver")
+			os.Exit(1)
+		}
+		bot := NewMatrixBot(*matrixHomeserver, *matrixToken, *matrixRoom)
+		events.Subscribe(bot.handleEvent)
+		go bot.Run(ctx)
+		slog.Info("Matrix bridge enabled", "room", *matrixRoom)
+	}
+
+	if *outboxDir != "" {
+		outbox, err := NewOutbox(*outboxDir)
+		if err != nil {
+			slog.Error("Failed to initialize outbox", "error", err)
+			os.Exit(1)
+		}
+		go outbox.Run(ctx)
+		slog.Info("Outbox enabled", "dir", *outboxDir)
+	}
+
+	if *clusterMode {
+		// Peers share the directory, so never wipe it on startup or shutdown
+		cluster = NewCluster(uploadsDir, *nodeID)
+		storage.EnableSharedLocking()
+		go cluster.Run(stopCleanup)
+		slog.Info("Cluster mode enabled", "node", cluster.nodeID)
+	} else if *persistAll {
+		slog.Info("Keeping files across restarts")
+	} else if *s3Bucket == "" && !inMemory {
+		// Clear all files on startup, except those marked to be kept or
+		// when the last shutdown kept them all
+		ephemeral = true
+		if keptAtShutdown() {
+			slog.Info("Keeping the files kept at shutdown")
+		} else if err := storage.ClearAllFiles(); err != nil {
+			slog.Warn("Failed to clear files on startup", "error", err)
+		}
+		if damaged, err := storage.VerifyPersisted(); err != nil {
+			slog.Warn("Failed to verify kept files", "error", err)
+		} else if damaged > 0 {
+			slog.Warn("Quarantined damaged kept files", "files", damaged)
+		}
+	}
+	switch {
+	case *shutdownFlag == "" && ephemeral:
+		shutdownPolicy = shutdownClearAll
+	case *shutdownFlag == "":
+		shutdownPolicy = shutdownKeepAll
+	case !validShutdownPolicy(*shutdownFlag):
+		slog.Error("Invalid -shutdown-policy (use keep-all, clear-expired-only or clear-all)", "policy", *shutdownFlag)
+		os.Exit(1)
+	case *clusterMode && *shutdownFlag == shutdownClearAll:
+		slog.Error("-shutdown-policy clear-all can't be combined with -cluster")
+		os.Exit(1)
+	default:
+		shutdownPolicy = *shutdownFlag
+	}
+
+	if report, err := storage.Reconcile(); err != nil {
+		slog.Warn("Failed to reconcile storage", "error", err)
+	} else if report != (ReconcileReport{}) {
+		slog.Info("Reconciled storage", "orphanBlobs", report.OrphanBlobs, "freed", formatSize(report.OrphanBytes), "missingFiles", report.MissingFiles, "missingRenditions", report.MissingRenditions)
+	}
+
+	if *importDir != "" {
+		n, err := storage.ImportDir(*importDir)
+		if err != nil {
+			slog.Error("Failed to read -import directory", "dir", *importDir, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Serving imported files", "dir", *importDir, "files", n)
+	}
+
+	scrubber = NewScrubber(*scrubInterval)
+	go scrubber.Run(stopCleanup)
+	if *scrubInterval > 0 {
+		slog.Info("Integrity scrub enabled", "interval", scrubInterval.String())
+	}
+
+	if *standbyDir != "" {
+		dir, err := filepath.Abs(*standbyDir)
+		if err != nil {
+			slog.Error("Invalid -standby-dir", "error", err)
+			os.Exit(1)
+		}
+		// The copy is meant to survive losing the disk holding -dir
+		uploads, _ := filepath.Abs(uploadsDir)
+		if rel, err := filepath.Rel(uploads, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			slog.Error("-standby-dir must be outside -dir", "dir", dir)
+			os.Exit(1)
+		}
+		if *standbyInterval <= 0 {
+			slog.Error("-standby-interval must be positive", "interval", standbyInterval.String())
+			os.Exit(1)
+		}
+		standby = NewStandby(dir, *standbyInterval)
+		events.Subscribe(standby.handleEvent)
+		go standby.Run(stopCleanup)
+		slog.Info("Standby copy enabled", "dir", dir, "interval", standbyInterval.String())
+	}
+
+	if *archiveDir != "" {
+		dir, err := filepath.Abs(*archiveDir)
+		if err != nil {
+			slog.Error("Invalid -archive-dir", "error", err)
+			os.Exit(1)
+		}
+		uploads, _ := filepath.Abs(uploadsDir)
+		if rel, err := filepath.Rel(uploads, dir); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			slog.Error("-archive-dir must be outside -dir", "dir", dir)
+			os.Exit(1)
+		}
+		if *archiveRetention < 0 {
+			slog.Error("-archive-retention can't be negative", "retention", archiveRetention.String())
+			os.Exit(1)
+		}
+		if archive, err = OpenArchive(dir, *archiveRetention); err != nil {
+			slog.Error("Failed to open archive", "dir", dir, "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Archiving expired files", "dir", dir, "files", len(archive.files), "retention", archiveRetention.String())
+	}
+
+	// Start cleanup goroutine
 	go func() {
 		ticker := time.NewTicker(1 * time.Minute)
 		defer ticker.Stop()
+		clock := NewClockWatcher()
 
 		for {
 			select {
 			case <-ticker.C:
-				if err := storage.DeleteExpiredFiles(); err != nil {
-					slog.Error("Error cleaning up expired files", "error", err)
+				// Each node judges the requests it served
+				alerts.CheckSLOs()
+
+				// Runs before expiry so a jump forward doesn't wipe everything
+				if skew := clock.Check(); skew != 0 && cluster.IsLeader() {
+					slog.Warn("System clock jumped, adjusting file times", "skew", skew.String())
+					if err := storage.ShiftTimes(skew); err != nil {
+						slog.Error("Failed to adjust file times", "error", err)
+					}
 				}
+				if maintenance.Enabled() || !cluster.IsLeader() {
+					continue
+				}
+				runCleanup()
+				evictor.MakeRoom(0)
+				alerts.CheckUsage()
 			case <-stopCleanup:
 				return
 			}
@@ -88,17 +646,86 @@ func main() {
 
 	// API routes
 	http.HandleFunc("/api/info", handleInfo)
+	http.HandleFunc("/api/bootstrap", handleBootstrap)
 	http.HandleFunc("/api/upload", handleUpload)
+	http.HandleFunc("/api/upload/raw", handleRawUpload)
+	http.HandleFunc("/api/upload/", handlePutUpload)
+	http.HandleFunc("/api/fetch", handleFetches)
+	http.HandleFunc("/api/fetch/", handleFetch)
+	http.HandleFunc("/api/uploads", handleChunkedUploads)
+	http.HandleFunc("/api/uploads/", handleChunkedUpload)
+	http.HandleFunc("/api/share", handleShareTarget)
 	http.HandleFunc("/api/files", handleListFiles)
+	http.HandleFunc("/api/files/", handleFile)
+	http.HandleFunc("/api/files/groups", handleFileGroups)
+	http.HandleFunc("/api/folders", handleFolders)
+	http.HandleFunc("/api/folders/", handleFolder)
+	http.HandleFunc("/api/expect", handleExpectations)
+	http.HandleFunc("/api/expect/", handleExpectation)
 	http.HandleFunc("/api/download/", handleDownload)
+	http.HandleFunc("/api/download/zip", handleZipDownload)
+	http.HandleFunc("/api/download/tar.gz", handleTarDownload)
+	http.HandleFunc("/api/mirror", handleMirror)
+	http.HandleFunc("/api/by-hash/", handleByHash)
+	http.HandleFunc("/api/chunks/", handleChunks)
+	http.HandleFunc("/api/queue", handleQueue)
+	http.HandleFunc("/api/quota", handleQuota)
 	http.HandleFunc("/api/delete/", handleDelete)
+	http.HandleFunc("/api/persist/", handlePersist)
+	http.HandleFunc("/api/trash", handleTrash)
+	http.HandleFunc("/api/trash/", handleTrash)
+	http.HandleFunc("/api/restore/", handleRestore)
+	http.HandleFunc("/api/pending", handlePending)
+	http.HandleFunc("/api/pending/", handleApproval)
+	http.HandleFunc("/api/compose/pdf", handleComposePDF)
+	http.HandleFunc("/api/thumbnail/", handleThumbnail)
+	http.HandleFunc("/s/", handleSharePage)
+	http.HandleFunc("/api/push/key", handlePushKey)
+	http.HandleFunc("/api/push/subscribe", handlePushSubscribe)
+	http.HandleFunc("/api/push/unsubscribe", handlePushUnsubscribe)
+	http.HandleFunc("/api/notes", handleNotes)
+	http.HandleFunc("/api/notes/", handleNote)
+	http.HandleFunc("/api/collections", handleCollections)
+	http.HandleFunc("/api/collections/", handleCollection)
+	http.HandleFunc("/c/", handleGalleryPage)
+	http.HandleFunc("/api/rooms", handleRooms)
+	http.HandleFunc("/api/rooms/", handleRoom)
+	http.HandleFunc("/api/speedtest", handleSpeedtest)
+	http.HandleFunc("/ipp/print", handleIPP)
+	http.HandleFunc("/api/admin/maintenance", handleMaintenance)
+	http.HandleFunc("/api/admin/shutdown", handleShutdown)
+	http.HandleFunc("/api/admin/cleanup", handleCleanupStats)
+	http.HandleFunc("/api/admin/slo", handleSLOs)
+	http.HandleFunc("/api/admin/standby", handleStandby)
+	http.HandleFunc("/api/admin/archive", handleArchive)
+	http.HandleFunc("/api/admin/archive/", handleArchive)
+	http.HandleFunc("/api/admin/snapshot", handleSnapshots)
+	http.HandleFunc("/api/admin/snapshot/", handleSnapshots)
+	http.HandleFunc("/api/admin/rollback/", handleRollback)
+	http.HandleFunc("/api/admin/keys", handleAPIKeys)
+	http.HandleFunc("/api/admin/keys/", handleAPIKey)
+	http.HandleFunc("/api/import", handleImport)
+	http.HandleFunc("/api/integrity", handleIntegrity)
+
+	if *metrics {
+		http.HandleFunc("/metrics", handleMetrics)
+	}
 
 	// Static files
 	fs := http.FileServer(http.Dir("./static"))
 	http.Handle("/", fs)
 
-	addr := fmt.Sprintf(":%d", port)
-	server := &http.Server{Addr: addr}
+	if len(tenantFlags) > 0 {
+		for _, config := range tenantFlags {
+			tenant := NewTenant(config)
+			tenants[config.Name] = tenant
+			go tenant.Run()
+		}
+		http.HandleFunc("/t/", handleTenant)
+	}
+
+	addr := net.JoinHostPort(*listen, strconv.Itoa(port))
+	server := &http.Server{Addr: addr, Handler: withUploadDeadline(withBasePath(withAuth(withThrottle(withRequestMetrics(http.DefaultServeMux)))))}
 
 	// Handle graceful shutdown
 	done := make(chan bool)
@@ -106,16 +733,20 @@ func main() {
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
 	go func() {
-		<-quit
+		policy := shutdownPolicy
+		select {
+		case <-quit:
+		case policy = <-shutdownRequests:
+		}
 		fmt.Println("\nShutting down server...")
 
-		// Stop cleanup goroutine
+		// Stop cleanup goroutine and integrations
 		close(stopCleanup)
+		cancel()
 
-		// Clear all files on shutdown
-		if err := storage.ClearAllFiles(); err != nil {
-			slog.Warn("Failed to clear files on shutdown", "error", err)
-		}
+		applyShutdownPolicy(policy)
+		storage.Close()
+		stopTenants()
 
 		if err := server.Shutdown(context.Background()); err != nil {
 			slog.Error("Server shutdown error", "error", err)
@@ -124,8 +755,15 @@ func main() {
 	}()
 
 	fmt.Printf("Server starting...\n")
-	fmt.Printf("Local access:   http://localhost:%d\n", port)
-	fmt.Printf("Network access: http://%s:%d\n", localIP, port)
+	fmt.Printf("Local access:   http://localhost:%d%s/\n", port, basePath)
+	fmt.Printf("Network access: http://%s:%d%s/\n", localIP, port, basePath)
+	if externalURL != "" {
+		fmt.Printf("External URL:   %s/\n", externalURL)
+	}
+	fmt.Printf("IPP printer:    ipp://%s:%d%s/ipp/print\n", localIP, port, basePath)
+	for _, config := range tenantFlags {
+		fmt.Printf("Tenant %-8s %s\n", config.Name+":", tenants[config.Name].URL())
+	}
 
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		slog.Error("Server failed", "error", err)
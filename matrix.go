@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MatrixBot ingests media posted to a room and announces new uploads there.
+// End-to-end encrypted rooms are not supported.
+type MatrixBot struct {
+	homeserver string
+	token      string
+	roomID     string
+	userID     string
+	client     *http.Client
+	txnID      atomic.Int64
+
+	// IDs of files the bot ingested itself, so they aren't announced back
+	ingested map[string]bool
+	mu       sync.Mutex
+}
+
+type matrixEvent struct {
+	Type    string `json:"type"`
+	Sender  string `json:"sender"`
+	EventID string `json:"event_id"`
+	Content struct {
+		MsgType  string `json:"msgtype"`
+		Body     string `json:"body"`
+		Filename string `json:"filename"`
+		URL      string `json:"url"`
+	} `json:"content"`
+}
+
+type matrixSyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+func NewMatrixBot(homeserver, token, roomID string) *MatrixBot {
+	bot := &MatrixBot{
+		homeserver: strings.TrimSuffix(homeserver, "/"),
+		token:      token,
+		roomID:     roomID,
+		client:     &http.Client{Timeout: 90 * time.Second},
+		ingested:   make(map[string]bool),
+	}
+	bot.txnID.Store(time.Now().UnixNano())
+	return bot
+}
+
+func (m *MatrixBot) do(ctx context.Context, method, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, m.homeserver+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var merr struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&merr)
+		return fmt.Errorf("matrix %s %s: %s %s", method, path, resp.Status, merr.Error)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func (m *MatrixBot) sendText(text string) error {
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%d",
+		url.PathEscape(m.roomID), m.txnID.Add(1))
+	return m.do(context.Background(), http.MethodPut, path, map[string]string{
+		"msgtype": "m.text",
+		"body":    text,
+	}, nil)
+}
+
+// download fetches an mxc:// URI, preferring the authenticated media API and
+// falling back to the legacy endpoint on older homeservers.
+func (m *MatrixBot) download(ctx context.Context, mxc string) (io.ReadCloser, error) {
+	serverAndMedia, ok := strings.CutPrefix(mxc, "mxc://")
+	if !ok {
+		return nil, fmt.Errorf("invalid media uri %q", mxc)
+	}
+
+	var lastErr error
+	for _, prefix := range []string{"/_matrix/client/v1/media/download/", "/_matrix/media/v3/download/"} {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.homeserver+prefix+serverAndMedia, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+m.token)
+
+		resp, err := m.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp.Body, nil
+		}
+		resp.Body.Close()
+		lastErr = fmt.Errorf("media download returned %s", resp.Status)
+	}
+	return nil, lastErr
+}
+
+func (m *MatrixBot) ingest(ctx context.Context, ev matrixEvent) {
+	switch ev.Content.MsgType {
+	case "m.file", "m.image", "m.video", "m.audio":
+	default:
+		return
+	}
+	if ev.Content.URL == "" {
+		// Encrypted media carries a "file" object instead of a url
+		return
+	}
+
+	if maintenance.Enabled() {
+		return
+	}
+
+	name := ev.Content.Filename
+	if name == "" {
+		name = ev.Content.Body
+	}
+	if name == "" {
+		name = "matrix-" + time.Now().Format("20060102-150405")
+	}
+
+	body, err := m.download(ctx, ev.Content.URL)
+	if err != nil {
+		slog.Warn("Failed to download Matrix media", "event", ev.EventID, "error", err)
+		return
+	}
+	defer body.Close()
+
+	// Register before saving so the upload event isn't announced back
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, err := storage.SaveFile(name, body, expirationFor(0))
+	if err != nil {
+		slog.Error("Failed to save Matrix media", "filename", name, "error", err)
+		return
+	}
+	m.ingested[meta.ID] = true
+	slog.Info("File uploaded", "id", meta.ID, "filename", meta.Name, "size", meta.Size, "client", "matrix:"+ev.Sender)
+
+	go func() {
+		if err := m.sendText("Saved " + meta.Name + ": " + shareURL(meta)); err != nil {
+			slog.Warn("Failed to reply on Matrix", "error", err)
+		}
+	}()
+}
+
+// Run syncs with the homeserver until ctx is cancelled. Messages already in
+// the room when the bot starts are skipped.
+func (m *MatrixBot) Run(ctx context.Context) {
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := m.do(ctx, http.MethodGet, "/_matrix/client/v3/account/whoami", nil, &whoami); err != nil {
+		slog.Error("Matrix login check failed", "error", err)
+		return
+	}
+	m.userID = whoami.UserID
+
+	filter, _ := json.Marshal(map[string]any{
+		"room": map[string]any{
+			"rooms":    []string{m.roomID},
+			"timeline": map[string]any{"types": []string{"m.room.message"}},
+		},
+		"presence":     map[string]any{"not_types": []string{"*"}},
+		"account_data": map[string]any{"not_types": []string{"*"}},
+	})
+
+	since := ""
+	for ctx.Err() == nil {
+		params := url.Values{"filter": {string(filter)}, "timeout": {"30000"}}
+		if since == "" {
+			params.Set("timeout", "0")
+		} else {
+			params.Set("since", since)
+		}
+
+		var resp matrixSyncResponse
+		if err := m.do(ctx, http.MethodGet, "/_matrix/client/v3/sync?"+params.Encode(), nil, &resp); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Matrix sync failed", "error", err)
+			select {
+			case <-time.After(10 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		initial := since == ""
+		since = resp.NextBatch
+		if initial {
+			continue
+		}
+
+		for _, ev := range resp.Rooms.Join[m.roomID].Timeline.Events {
+			if ev.Type == "m.room.message" && ev.Sender != m.userID {
+				m.ingest(ctx, ev)
+			}
+		}
+	}
+}
+
+func (m *MatrixBot) handleEvent(e Event) {
+	if e.Type != EventFileUploaded {
+		return
+	}
+
+	m.mu.Lock()
+	own := m.ingested[e.File.ID]
+	delete(m.ingested, e.File.ID)
+	m.mu.Unlock()
+	if own {
+		return
+	}
+
+	text := fmt.Sprintf("New file: %s (%s) %s", e.File.Name, formatSize(e.File.Size), shareURL(e.File))
+	if err := m.sendText(text); err != nil {
+		slog.Warn("Failed to announce upload on Matrix", "error", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// availableMemory isn't implemented here, so chunk sizes are offered
+// without regard to memory.
+func availableMemory() (uint64, error) {
+	return 0, errors.New("available memory is not supported on this platform")
+}
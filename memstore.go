@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// inMemory is set with -storage memory, when file contents, metadata and
+// the state of notes, rooms etc. are kept in RAM and never written to disk.
+var inMemory bool
+
+// errStorageFull reports an upload that doesn't fit in -memory-limit.
+var errStorageFull = errors.New("not enough memory left to store this upload")
+
+// memoryBlobStore keeps blobs in RAM, at most limit bytes of them.
+type memoryBlobStore struct {
+	limit int64
+
+	mu    sync.Mutex
+	blobs map[string][]byte
+	used  int64 // committed blobs plus bytes being written
+}
+
+func newMemoryBlobStore(limit int64) *memoryBlobStore {
+	return &memoryBlobStore{limit: limit, blobs: map[string][]byte{}}
+}
+
+// reserve accounts for n more bytes, failing once the limit is reached.
+func (m *memoryBlobStore) reserve(n int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used+n > m.limit {
+		return errStorageFull
+	}
+	m.used += n
+	return nil
+}
+
+func (m *memoryBlobStore) release(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used -= n
+}
+
+type memoryBlobWriter struct {
+	store *memoryBlobStore
+	name  string
+	buf   bytes.Buffer
+	done  bool
+}
+
+func (w *memoryBlobWriter) Write(p []byte) (int, error) {
+	if err := w.store.reserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+	return w.buf.Write(p)
+}
+
+// Close replaces any blob of the same name with what was written.
+func (w *memoryBlobWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	m := w.store
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if old, ok := m.blobs[w.name]; ok {
+		m.used -= int64(len(old))
+	}
+	m.blobs[w.name] = w.buf.Bytes()
+	return nil
+}
+
+func (w *memoryBlobWriter) Abort() {
+	if w.done {
+		return
+	}
+	w.done = true
+	w.store.release(int64(w.buf.Len()))
+}
+
+func (m *memoryBlobStore) Create(name string) (BlobWriter, error) {
+	return &memoryBlobWriter{store: m, name: name}, nil
+}
+
+func (m *memoryBlobStore) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[name]
+	if !ok {
+		return nil, fmt.Errorf("open %s: %w", name, os.ErrNotExist)
+	}
+	// Blobs are never modified in place, so readers can share the bytes
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memoryBlobStore) Rename(from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[from]
+	if !ok {
+		return fmt.Errorf("rename %s: %w", from, os.ErrNotExist)
+	}
+	if old, ok := m.blobs[to]; ok {
+		m.used -= int64(len(old))
+	}
+	delete(m.blobs, from)
+	m.blobs[to] = data
+	return nil
+}
+
+func (m *memoryBlobStore) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.blobs[name]
+	if !ok {
+		return fmt.Errorf("remove %s: %w", name, os.ErrNotExist)
+	}
+	m.used -= int64(len(data))
+	delete(m.blobs, name)
+	return nil
+}
+
+// memoryMetadata is a metadataDB that keeps nothing: the file list lives in
+// FileStorage alone and is gone on restart, like the contents.
+type memoryMetadata struct{}
+
+func (memoryMetadata) Load() ([]FileMetadata, error)                    { return nil, nil }
+func (memoryMetadata) Apply(put []FileMetadata, removed []string) error { return nil }
+func (memoryMetadata) Close() error                                     { return nil }
+
+// NewMemoryStorage returns storage that holds up to limit bytes of file
+// contents in RAM.
+func NewMemoryStorage(limit int64) *FileStorage {
+	return &FileStorage{
+		blobs: newMemoryBlobStore(limit),
+		db:    memoryMetadata{},
+		files: []FileMetadata{},
+	}
+}
+
+// stateFile is where a store keeps its state under dir, or "" in memory mode,
+// when dir is empty and nothing is saved.
+func stateFile(dir, name string) string {
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, name)
+}
+
+// writeStateFile saves a store's state to path, or does nothing when path
+// is "".
+func writeStateFile(path string, data []byte, perm os.FileMode) error {
+	if path == "" {
+		return nil
+	}
+	return os.WriteFile(path, data, perm)
+}
+
+// rejectStorageFull answers 507 and returns true when err is errStorageFull.
+func rejectStorageFull(w http.ResponseWriter, err error) bool {
+	if !errors.Is(err, errStorageFull) {
+		return false
+	}
+	http.Error(w, errStorageFull.Error(), http.StatusInsufficientStorage)
+	return true
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metadataDB is an alternative to metadata.json that records each change
+// instead of rewriting the whole list. FileStorage still keeps every entry
+// in memory and only writes through to the database.
+type metadataDB interface {
+	Load() ([]FileMetadata, error)
+	// Apply upserts put and deletes removed in one transaction.
+	Apply(put []FileMetadata, removed []string) error
+	Close() error
+}
+
+// metadataBackends are the -meta choices besides "json". Backends that need
+// a third-party package register themselves from a file behind a build tag.
+var metadataBackends = map[string]func(path string) (metadataDB, error){
+	"sqlite": OpenSQLiteMetadata,
+}
+
+// metadataBackendTags names the build tag that enables each optional backend.
+var metadataBackendTags = map[string]string{
+	"sqlite": "sqlite",
+	"bolt":   "bolt",
+}
+
+// OpenMetadataDB opens backend at path, or at metadata.<backend> in dir when
+// path is empty.
+func OpenMetadataDB(backend, path, dir string) (metadataDB, error) {
+	open, ok := metadataBackends[backend]
+	if !ok {
+		if tag, known := metadataBackendTags[backend]; known {
+			return nil, fmt.Errorf("this build has no %s support; rebuild with -tags %s", backend, tag)
+		}
+		return nil, fmt.Errorf("unknown metadata backend %q (use json, sqlite or bolt)", backend)
+	}
+	if path == "" {
+		path = filepath.Join(dir, "metadata."+backend)
+	}
+	return open(path)
+}
+
+// sqliteDriver is the database/sql driver name used for -meta sqlite. No
+// driver is linked by default; build with -tags sqlite to include one.
+const sqliteDriver = "sqlite"
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS files (
+	id          TEXT PRIMARY KEY,
+	name        TEXT NOT NULL,
+	size        INTEGER NOT NULL,
+	uploaded_at INTEGER NOT NULL,
+	expires_at  INTEGER NOT NULL,
+	room        TEXT NOT NULL DEFAULT '',
+	renditions  TEXT NOT NULL DEFAULT '[]',
+	sha256      TEXT NOT NULL DEFAULT '',
+	compression TEXT NOT NULL DEFAULT '',
+	stored_size INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS files_expires_at ON files (expires_at);
+`
+
+// sqliteAddedColumns are columns added after the first schema, so databases
+// created by older versions are brought up to date on open.
+var sqliteAddedColumns = []struct{ name, definition string }{
+	{"sha256", "TEXT NOT NULL DEFAULT ''"},
+	{"compression", "TEXT NOT NULL DEFAULT ''"},
+	{"stored_size", "INTEGER NOT NULL DEFAULT 0"},
+	{"quarantined", "INTEGER NOT NULL DEFAULT 0"},
+	{"deleted_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"trashed", "INTEGER NOT NULL DEFAULT 0"},
+	{"folder", "TEXT NOT NULL DEFAULT ''"},
+	{"persist", "INTEGER NOT NULL DEFAULT 0"},
+	{"tags", "TEXT NOT NULL DEFAULT '[]'"},
+	{"metadata", "TEXT NOT NULL DEFAULT '{}'"},
+	{"uploader", "TEXT NOT NULL DEFAULT ''"},
+	{"pending", "INTEGER NOT NULL DEFAULT 0"},
+	{"last_downloaded_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"source", "TEXT NOT NULL DEFAULT 'null'"},
+	{"available_from", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// sqlMetadataDB stores one row per file. Times are Unix nanoseconds.
+type sqlMetadataDB struct {
+	db *sql.DB
+}
+
+func OpenSQLiteMetadata(path string) (metadataDB, error) {
+	if !driverAvailable(sqliteDriver) {
+		return nil, fmt.Errorf("this build has no SQLite driver; rebuild with -tags sqlite")
+	}
+
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, err
+	}
+	// One connection keeps writes serialized and the pragmas in effect
+	db.SetMaxOpenConns(1)
+
+	for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA busy_timeout=5000", sqliteSchema} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to initialize database: %w", err)
+		}
+	}
+	if err := addMissingColumns(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to upgrade database: %w", err)
+	}
+
+	return &sqlMetadataDB{db: db}, nil
+}
+
+func addMissingColumns(db *sql.DB) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info('files')")
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, col := range sqliteAddedColumns {
+		if existing[col.name] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE files ADD COLUMN " + col.name + " " + col.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func driverAvailable(name string) bool {
+	for _, d := range sql.Drivers() {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *sqlMetadataDB) Load() ([]FileMetadata, error) {
+	rows, err := m.db.Query("SELECT id, name, size, uploaded_at, expires_at, room, renditions, sha256, compression, stored_size, quarantined, deleted_at, trashed, folder, persist, tags, metadata, uploader, pending, last_downloaded_at, source, available_from FROM files ORDER BY uploaded_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []FileMetadata{}
+	for rows.Next() {
+		var meta FileMetadata
+		var uploadedAt, expiresAt, deletedAt, lastDownloadedAt, availableFrom int64
+		var renditions, tags, metadata, source string
+		if err := rows.Scan(&meta.ID, &meta.Name, &meta.Size, &uploadedAt, &expiresAt, &meta.Room, &renditions, &meta.SHA256, &meta.Compression, &meta.StoredSize, &meta.Quarantined, &deletedAt, &meta.Trashed, &meta.Folder, &meta.Persist, &tags, &metadata, &meta.Uploader, &meta.Pending, &lastDownloadedAt, &source, &availableFrom); err != nil {
+			return nil, err
+		}
+		meta.UploadedAt = time.Unix(0, uploadedAt)
+		meta.ExpiresAt = time.Unix(0, expiresAt)
+		if deletedAt != 0 {
+			meta.DeletedAt = time.Unix(0, deletedAt)
+		}
+		if lastDownloadedAt != 0 {
+			meta.LastDownloadedAt = time.Unix(0, lastDownloadedAt)
+		}
+		if availableFrom != 0 {
+			meta.AvailableFrom = time.Unix(0, availableFrom)
+		}
+		if err := json.Unmarshal([]byte(renditions), &meta.Renditions); err != nil {
+			return nil, fmt.Errorf("invalid renditions for %s: %w", meta.ID, err)
+		}
+		if len(meta.Renditions) == 0 {
+			meta.Renditions = nil
+		}
+		if err := json.Unmarshal([]byte(tags), &meta.Tags); err != nil {
+			return nil, fmt.Errorf("invalid tags for %s: %w", meta.ID, err)
+		}
+		if len(meta.Tags) == 0 {
+			meta.Tags = nil
+		}
+		if err := json.Unmarshal([]byte(metadata), &meta.Metadata); err != nil {
+			return nil, fmt.Errorf("invalid metadata for %s: %w", meta.ID, err)
+		}
+		if len(meta.Metadata) == 0 {
+			meta.Metadata = nil
+		}
+		if err := json.Unmarshal([]byte(source), &meta.Source); err != nil {
+			return nil, fmt.Errorf("invalid source for %s: %w", meta.ID, err)
+		}
+		files = append(files, meta)
+	}
+	return files, rows.Err()
+}
+
+func (m *sqlMetadataDB) Apply(put []FileMetadata, removed []string) error {
+	if len(put) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, meta := range put {
+		renditions, err := json.Marshal(meta.Renditions)
+		if err != nil {
+			return err
+		}
+		if meta.Renditions == nil {
+			renditions = []byte("[]")
+		}
+		tags, err := json.Marshal(meta.Tags)
+		if err != nil {
+			return err
+		}
+		if meta.Tags == nil {
+			tags = []byte("[]")
+		}
+		metadata, err := json.Marshal(meta.Metadata)
+		if err != nil {
+			return err
+		}
+		if meta.Metadata == nil {
+			metadata = []byte("{}")
+		}
+		source, err := json.Marshal(meta.Source)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO files (id, name, size, uploaded_at, expires_at, room, renditions, sha256, compression, stored_size, quarantined, deleted_at, trashed, folder, persist, tags, metadata, uploader, pending, last_downloaded_at, source, available_from)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET name = excluded.name, size = excluded.size,
+				uploaded_at = excluded.uploaded_at, expires_at = excluded.expires_at,
+				room = excluded.room, renditions = excluded.renditions, sha256 = excluded.sha256,
+				compression = excluded.compression, stored_size = excluded.stored_size,
+				quarantined = excluded.quarantined, deleted_at = excluded.deleted_at,
+				trashed = excluded.trashed, folder = excluded.folder,
+				persist = excluded.persist, tags = excluded.tags,
+				metadata = excluded.metadata, uploader = excluded.uploader,
+				pending = excluded.pending, last_downloaded_at = excluded.last_downloaded_at,
+				source = excluded.source, available_from = excluded.available_from`,
+			meta.ID, meta.Name, meta.Size, meta.UploadedAt.UnixNano(), meta.ExpiresAt.UnixNano(), meta.Room, string(renditions),
+			meta.SHA256, meta.Compression, meta.StoredSize, meta.Quarantined, unixNanoOrZero(meta.DeletedAt), meta.Trashed, meta.Folder, meta.Persist, string(tags), string(metadata), meta.Uploader, meta.Pending, unixNanoOrZero(meta.LastDownloadedAt), string(source), unixNanoOrZero(meta.AvailableFrom))
+		if err != nil {
+			return fmt.Errorf("failed to write metadata: %w", err)
+		}
+	}
+
+	// Delete in batches to stay under SQLite's bound-parameter limit
+	for len(removed) > 0 {
+		batch := removed[:min(len(removed), 500)]
+		removed = removed[len(batch):]
+
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(batch)), ",")
+		if _, err := tx.Exec("DELETE FROM files WHERE id IN ("+placeholders+")", args...); err != nil {
+			return fmt.Errorf("failed to delete metadata: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// unixNanoOrZero stores the zero time as 0 rather than its far-past
+// UnixNano.
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (m *sqlMetadataDB) Close() error {
+	return m.db.Close()
+}
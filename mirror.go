@@ -0,0 +1,177 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"html/template"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var mirrorTemplate = template.Must(template.New("mirror").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Title}}</title>
+    <link rel="stylesheet" href="style.css">
+</head>
+<body>
+    <div class="container mirror-page">
+        <header>
+            <h1>{{.Title}}</h1>
+            <p class="file-meta">{{len .Files}} files, {{.Size}}, as of {{.GeneratedAt}}</p>
+        </header>
+        <main class="file-list">
+{{- range .Files}}
+            <div class="file-item">
+                <div class="file-info">
+                    <div class="file-name">{{.Name}}</div>
+                    <div class="file-meta">{{.Description}}</div>
+                </div>
+                <div class="file-actions">
+                    <a href="{{.Href}}" class="download-btn" download>Download</a>
+                </div>
+            </div>
+{{- else}}
+            <div class="empty-state">No files</div>
+{{- end}}
+        </main>
+    </div>
+</body>
+</html>
+`))
+
+type mirrorPage struct {
+	Title       string
+	Size        string
+	GeneratedAt string
+	Files       []mirrorFile
+}
+
+type mirrorFile struct {
+	Name        string
+	Description string
+	Href        string
+}
+
+// mirrorHref is the link from index.html to a file stored as entry: each
+// segment escaped, so names with spaces, # or ? still work on any host.
+func mirrorHref(entry string) string {
+	segments := strings.Split(entry, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// handleMirror renders the room's files as a static site, GET /api/mirror,
+// for sharing a snapshot of the box beyond the LAN: a zip of an index.html
+// listing them with links into files/, the web UI's style.css and the files
+// themselves, to unpack onto any web host as they are. ?path= limits it to
+// a folder and everything beneath it, and ?title= names the page.
+func handleMirror(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	folder, err := cleanFolder(r.URL.Query().Get("path"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	title := strings.TrimSpace(r.URL.Query().Get("title"))
+	if title == "" {
+		title = "Sync-It"
+	}
+
+	var files []FileMetadata
+	for _, meta := range storage.ListRoomFiles(roomCode(room)) {
+		if inFolder(meta.Folder, folder) {
+			files = append(files, meta)
+		}
+	}
+	files, size := servableFiles(files)
+	if len(files) > maxZipFiles {
+		http.Error(w, "Too many files for one mirror; pick a folder with ?path=", http.StatusBadRequest)
+		return
+	}
+
+	// Listed by folder and name, as they are laid out in files/
+	entries := make([]string, len(files))
+	used := map[string]bool{}
+	for i := range files {
+		entries[i] = "files/" + zipEntryName(&files[i], used)
+	}
+	sort.Sort(byEntry{files, entries})
+
+	now := time.Now()
+	page := mirrorPage{Title: title, Size: formatSize(size), GeneratedAt: now.UTC().Format(shareTimeFormat)}
+	for i, meta := range files {
+		description := formatSize(meta.Size) + ", uploaded " + meta.UploadedAt.UTC().Format(shareTimeFormat)
+		if meta.Folder != "" {
+			description = meta.Folder + " · " + description
+		}
+		page.Files = append(page.Files, mirrorFile{Name: meta.Name, Description: description, Href: mirrorHref(entries[i])})
+	}
+	var index bytes.Buffer
+	if err := mirrorTemplate.Execute(&index, page); err != nil {
+		slog.Error("Failed to render mirror", "error", err)
+		http.Error(w, "Failed to render mirror", http.StatusInternalServerError)
+		return
+	}
+
+	release, ok := queueDownload(w, r, "mirror", size)
+	if !ok {
+		return
+	}
+	defer release()
+
+	name := "sync-it-mirror-" + now.Format("20060102-150405") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	zw := zip.NewWriter(w)
+	if entry, err := zw.CreateHeader(&zip.FileHeader{Name: "index.html", Method: zip.Deflate, Modified: now}); err == nil {
+		entry.Write(index.Bytes())
+	}
+	if css, err := os.ReadFile(filepath.Join("static", "style.css")); err == nil {
+		if entry, err := zw.CreateHeader(&zip.FileHeader{Name: "style.css", Method: zip.Deflate, Modified: now}); err == nil {
+			entry.Write(css)
+		}
+	}
+	for i := range files {
+		if err := writeZipEntry(zw, &files[i], entries[i]); err != nil {
+			abortDownload(r, &files[i], err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+	slog.Info("Mirror downloaded", "files", len(files), "size", formatSize(size), "client", clientIP(r))
+	markDownloaded(files)
+}
+
+// byEntry sorts files along with their entry names.
+type byEntry struct {
+	files   []FileMetadata
+	entries []string
+}
+
+func (b byEntry) Len() int           { return len(b.files) }
+func (b byEntry) Less(i, j int) bool { return b.entries[i] < b.entries[j] }
+func (b byEntry) Swap(i, j int) {
+	b.files[i], b.files[j] = b.files[j], b.files[i]
+	b.entries[i], b.entries[j] = b.entries[j], b.entries[i]
+}
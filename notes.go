@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoteNotFound = errors.New("note not found")
+	errNoteConflict = errors.New("note revision conflict")
+)
+
+// maxNoteRevisions is how many earlier revisions of a note are kept; older
+// ones are dropped as it is edited.
+const maxNoteRevisions = 50
+
+type NoteRevision struct {
+	Revision  int       `json:"revision"`
+	Title     string    `json:"title"`
+	Content   string    `json:"content"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type Note struct {
+	ID        string         `json:"id"`
+	Title     string         `json:"title"`
+	Content   string         `json:"content"`
+	Revision  int            `json:"revision"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+	History   []NoteRevision `json:"history,omitempty"`
+}
+
+func (n *Note) ETag() string {
+	return fmt.Sprintf("\"%s-%d\"", n.ID, n.Revision)
+}
+
+type NoteStorage struct {
+	file  string
+	notes []Note
+	mu    sync.RWMutex
+}
+
+func NewNoteStorage(dir string) (*NoteStorage, error) {
+	ns := &NoteStorage{
+		file:  stateFile(dir, "notes.json"),
+		notes: []Note{},
+	}
+
+	data, err := os.ReadFile(ns.file)
+	if os.IsNotExist(err) {
+		return ns, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read notes: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &ns.notes); err != nil {
+		return nil, fmt.Errorf("failed to parse notes: %w", err)
+	}
+
+	return ns, nil
+}
+
+func (ns *NoteStorage) save() error {
+	data, err := json.MarshalIndent(ns.notes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal notes: %w", err)
+	}
+
+	if err := writeStateFile(ns.file, data, 0644); err != nil {
+		return fmt.Errorf("failed to write notes: %w", err)
+	}
+
+	return nil
+}
+
+func (ns *NoteStorage) find(id string) int {
+	for i, n := range ns.notes {
+		if n.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// withoutHistory returns a copy of n suitable for listings and single gets.
+func withoutHistory(n Note) Note {
+	n.History = nil
+	return n
+}
+
+func (ns *NoteStorage) ListNotes() []Note {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	result := make([]Note, len(ns.notes))
+	for i, n := range ns.notes {
+		result[i] = withoutHistory(n)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UpdatedAt.After(result[j].UpdatedAt)
+	})
+
+	return result
+}
+
+func (ns *NoteStorage) CreateNote(title, content string) (*Note, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	id, err := generateID(func(id string) bool { return ns.find(id) != -1 })
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	note := Note{
+		ID:        id,
+		Title:     title,
+		Content:   content,
+		Revision:  1,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	ns.notes = append(ns.notes, note)
+
+	if err := ns.save(); err != nil {
+		ns.notes = ns.notes[:len(ns.notes)-1]
+		return nil, err
+	}
+
+	events.Publish(Event{Type: EventNoteCreated, Note: &note})
+
+	return &note, nil
+}
+
+func (ns *NoteStorage) GetNote(id string) (*Note, error) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	idx := ns.find(id)
+	if idx == -1 {
+		return nil, errNoteNotFound
+	}
+
+	note := withoutHistory(ns.notes[idx])
+	return &note, nil
+}
+
+func (ns *NoteStorage) GetHistory(id string) ([]NoteRevision, error) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+
+	idx := ns.find(id)
+	if idx == -1 {
+		return nil, errNoteNotFound
+	}
+
+	note := ns.notes[idx]
+	history := make([]NoteRevision, len(note.History), len(note.History)+1)
+	copy(history, note.History)
+	history = append(history, NoteRevision{
+		Revision:  note.Revision,
+		Title:     note.Title,
+		Content:   note.Content,
+		UpdatedAt: note.UpdatedAt,
+	})
+
+	return history, nil
+}
+
+// UpdateNote replaces the note's content if baseRevision matches the current
+// revision. A baseRevision of 0 skips the check.
+func (ns *NoteStorage) UpdateNote(id, title, content string, baseRevision int) (*Note, error) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	idx := ns.find(id)
+	if idx == -1 {
+		return nil, errNoteNotFound
+	}
+
+	prev := ns.notes[idx]
+	if baseRevision != 0 && baseRevision != prev.Revision {
+		current := withoutHistory(prev)
+		return &current, errNoteConflict
+	}
+
+	note := prev
+	note.History = append(append([]NoteRevision{}, prev.History...), NoteRevision{
+		Revision:  prev.Revision,
+		Title:     prev.Title,
+		Content:   prev.Content,
+		UpdatedAt: prev.UpdatedAt,
+	})
+	if len(note.History) > maxNoteRevisions {
+		note.History = note.History[len(note.History)-maxNoteRevisions:]
+	}
+	note.Title = title
+	note.Content = content
+	note.Revision = prev.Revision + 1
+	note.UpdatedAt = time.Now()
+
+	ns.notes[idx] = note
+
+	if err := ns.save(); err != nil {
+		ns.notes[idx] = prev
+		return nil, err
+	}
+
+	result := withoutHistory(note)
+	events.Publish(Event{Type: EventNoteUpdated, Note: &result})
+	return &result, nil
+}
+
+func (ns *NoteStorage) DeleteNote(id string) error {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	idx := ns.find(id)
+	if idx == -1 {
+		return errNoteNotFound
+	}
+
+	prev := ns.notes
+	deleted := withoutHistory(ns.notes[idx])
+	ns.notes = append(append([]Note{}, ns.notes[:idx]...), ns.notes[idx+1:]...)
+
+	if err := ns.save(); err != nil {
+		ns.notes = prev
+		return err
+	}
+
+	events.Publish(Event{Type: EventNoteDeleted, Note: &deleted})
+
+	return nil
+}
+
+type NotesResponse struct {
+	Notes []Note `json:"notes"`
+}
+
+type NoteHistoryResponse struct {
+	History []NoteRevision `json:"history"`
+}
+
+type noteRequest struct {
+	Title   string `json:"title"`
+	Content string `json:"content"`
+}
+
+const maxNoteSize = 1 << 20 // 1 MB
+
+func decodeNoteRequest(r *http.Request) (*noteRequest, error) {
+	var req noteRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxNoteSize)).Decode(&req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// parseNoteETag extracts the revision from an If-Match value produced by
+// Note.ETag. It returns 0 when the header is absent or "*".
+func parseNoteETag(id, header string) (int, bool) {
+	header = strings.TrimSpace(header)
+	if header == "" || header == "*" {
+		return 0, true
+	}
+
+	var rev int
+	prefix := "\"" + id + "-"
+	if !strings.HasPrefix(header, prefix) || !strings.HasSuffix(header, "\"") {
+		return 0, false
+	}
+	if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(header, prefix), "\""), "%d", &rev); err != nil || rev <= 0 {
+		return 0, false
+	}
+
+	return rev, true
+}
+
+func writeNote(w http.ResponseWriter, note *Note, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", note.ETag())
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(note)
+}
+
+func handleNotes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		resp := NotesResponse{Notes: notes.ListNotes()}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+	case http.MethodPost:
+		if rejectIfMaintenance(w) {
+			return
+		}
+
+		req, err := decodeNoteRequest(r)
+		if err != nil {
+			http.Error(w, "Invalid note", http.StatusBadRequest)
+			return
+		}
+
+		note, err := notes.CreateNote(req.Title, req.Content)
+		if err != nil {
+			slog.Error("Failed to create note", "error", err)
+			http.Error(w, "Failed to create note", http.StatusInternalServerError)
+			return
+		}
+
+		writeNote(w, note, http.StatusCreated)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleNote(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/notes/")
+	id, sub, _ := strings.Cut(rest, "/")
+	if id == "" {
+		http.Error(w, "Note ID required", http.StatusBadRequest)
+		return
+	}
+
+	if sub == "history" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		history, err := notes.GetHistory(id)
+		if err != nil {
+			http.Error(w, "Note not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(NoteHistoryResponse{History: history})
+		return
+	}
+	if sub != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		note, err := notes.GetNote(id)
+		if err != nil {
+			http.Error(w, "Note not found", http.StatusNotFound)
+			return
+		}
+
+		if r.Header.Get("If-None-Match") == note.ETag() {
+			w.Header().Set("ETag", note.ETag())
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		writeNote(w, note, http.StatusOK)
+
+	case http.MethodPut:
+		if rejectIfMaintenance(w) {
+			return
+		}
+
+		baseRevision, ok := parseNoteETag(id, r.Header.Get("If-Match"))
+		if !ok {
+			http.Error(w, "Note has been modified", http.StatusPreconditionFailed)
+			return
+		}
+
+		req, err := decodeNoteRequest(r)
+		if err != nil {
+			http.Error(w, "Invalid note", http.StatusBadRequest)
+			return
+		}
+
+		note, err := notes.UpdateNote(id, req.Title, req.Content, baseRevision)
+		if errors.Is(err, errNoteNotFound) {
+			http.Error(w, "Note not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errNoteConflict) {
+			// Return the current version so the client can merge
+			writeNote(w, note, http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to update note", "id", id, "error", err)
+			http.Error(w, "Failed to update note", http.StatusInternalServerError)
+			return
+		}
+
+		writeNote(w, note, http.StatusOK)
+
+	case http.MethodDelete:
+		if rejectIfMaintenance(w) {
+			return
+		}
+
+		if err := notes.DeleteNote(id); err != nil {
+			if errors.Is(err, errNoteNotFound) {
+				http.Error(w, "Note not found", http.StatusNotFound)
+				return
+			}
+			slog.Error("Failed to delete note", "id", id, "error", err)
+			http.Error(w, "Failed to delete note", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
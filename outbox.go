@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const outboxScanInterval = 5 * time.Second
+
+// Outbox ingests files that other processes on the host drop into a
+// directory, then removes them. A file is only picked up once its size and
+// modification time are unchanged between two scans, so half-written files
+// are left alone; names starting with "." or ending in .tmp/.part are
+// ignored entirely so writers can rename into place.
+type Outbox struct {
+	dir  string
+	seen map[string]fileVersion
+}
+
+func NewOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Outbox{dir: dir, seen: make(map[string]fileVersion)}, nil
+}
+
+func outboxIgnored(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(lower, ".tmp") || strings.HasSuffix(lower, ".part")
+}
+
+func (o *Outbox) ingest(name string) {
+	path := filepath.Join(o.dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Warn("Failed to open outbox file", "filename", name, "error", err)
+		return
+	}
+
+	meta, err := storage.SaveFile(name, f, expirationFor(0))
+	f.Close()
+	if err != nil {
+		slog.Error("Failed to ingest outbox file", "filename", name, "error", err)
+		return
+	}
+	slog.Info("File uploaded", "id", meta.ID, "filename", meta.Name, "size", meta.Size, "client", "outbox")
+
+	if err := os.Remove(path); err != nil {
+		slog.Warn("Failed to remove ingested outbox file", "filename", name, "error", err)
+	}
+}
+
+func (o *Outbox) scan() {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		slog.Warn("Failed to read outbox", "dir", o.dir, "error", err)
+		return
+	}
+
+	current := make(map[string]fileVersion)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || outboxIgnored(entry.Name()) {
+			continue
+		}
+
+		version := statVersion(filepath.Join(o.dir, entry.Name()))
+		if prev, ok := o.seen[entry.Name()]; ok && prev == version {
+			o.ingest(entry.Name())
+			continue
+		}
+		current[entry.Name()] = version
+	}
+	o.seen = current
+}
+
+// Run scans the outbox until ctx is cancelled. In cluster mode only the
+// leader ingests, so a file isn't picked up twice.
+func (o *Outbox) Run(ctx context.Context) {
+	ticker := time.NewTicker(outboxScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if maintenance.Enabled() || !cluster.IsLeader() {
+				continue
+			}
+			o.scan()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
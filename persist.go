@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ephemeral is set when files are cleared on startup and shutdown, i.e.
+// without -persist, -cluster or S3 storage.
+var ephemeral bool
+
+// SetPersist marks file id to be kept across restarts, or not.
+func (fs *FileStorage) SetPersist(id string, persist bool) (*FileMetadata, error) {
+	return fs.UpdateFile(id, func(meta *FileMetadata) { meta.Persist = persist })
+}
+
+// VerifyPersisted re-hashes the files kept from before the restart and
+// quarantines any whose contents changed while the server was down; ones
+// whose contents are missing are left to Reconcile. It returns how many were
+// quarantined.
+func (fs *FileStorage) VerifyPersisted() (int, error) {
+	var damaged []string
+	for _, meta := range fs.allFiles() {
+		if !meta.Persist || meta.SHA256 == "" || meta.Quarantined {
+			continue
+		}
+		if issue, _ := checkBlob(&meta); issue != nil {
+			slog.Warn("Kept file is damaged", "id", meta.ID, "name", meta.Name, "expected", issue.Expected, "actual", issue.Actual, "error", issue.Error)
+			damaged = append(damaged, meta.ID)
+		}
+	}
+	if len(damaged) == 0 {
+		return 0, nil
+	}
+	return len(damaged), fs.Quarantine(damaged)
+}
+
+// requestPersist reports whether an upload asked to be kept across
+// restarts, with a persistAcrossRestart form field or query parameter, or
+// an X-Persist-Across-Restart header for raw bodies.
+func requestPersist(r *http.Request) bool {
+	value := r.FormValue("persistAcrossRestart")
+	if value == "" {
+		value = r.Header.Get("X-Persist-Across-Restart")
+	}
+	persist, _ := strconv.ParseBool(value)
+	return persist
+}
+
+// handlePersist sets or clears a file's persistAcrossRestart flag:
+// POST /api/persist/{id} with {"persistAcrossRestart": true}.
+func handlePersist(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/persist/")
+	if id == "" {
+		http.Error(w, "File ID required", http.StatusBadRequest)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	if meta, _, err := storage.GetFile(id); err != nil || !inRoom(meta, room) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	var req struct {
+		Persist bool `json:"persistAcrossRestart"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := storage.SetPersist(id, req.Persist)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("File persistence changed", "id", id, "persistAcrossRestart", req.Persist, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newShareResponse(meta))
+}
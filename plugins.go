@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// Extensions are compiled in by adding a file to this package that registers
+// them from init, typically behind a build tag:
+//
+//	//go:build watermark
+//
+//	package main
+//
+//	func init() { RegisterProcessor(watermarkProcessor{}) }
+//
+// and building with `go build -tags watermark`.
+
+// Processor inspects or transforms uploads before they are stored. It may
+// rename the file, wrap the content reader, or return an error to reject the
+// upload.
+type Processor interface {
+	Name() string
+	Process(filename string, r io.Reader) (string, io.Reader, error)
+}
+
+// Notifier receives every file and note event after it happens.
+type Notifier interface {
+	Name() string
+	Notify(e Event)
+}
+
+// StorageDecorator wraps the stored bytes of every file, e.g. to compress or
+// encrypt them at rest. WrapWriter is applied when a file is saved and
+// WrapReader when it is read back. Decorators registered first sit closest to
+// the plaintext: register a compressor before an encryptor to compress and
+// then encrypt.
+type StorageDecorator interface {
+	Name() string
+	WrapWriter(w io.WriteCloser) (io.WriteCloser, error)
+	WrapReader(r io.ReadCloser) (io.ReadCloser, error)
+}
+
+var plugins struct {
+	processors []Processor
+	notifiers  []Notifier
+	decorators []StorageDecorator
+	mu         sync.RWMutex
+}
+
+func RegisterProcessor(p Processor) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.processors = append(plugins.processors, p)
+}
+
+func RegisterNotifier(n Notifier) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.notifiers = append(plugins.notifiers, n)
+}
+
+func RegisterStorageDecorator(d StorageDecorator) {
+	plugins.mu.Lock()
+	defer plugins.mu.Unlock()
+	plugins.decorators = append(plugins.decorators, d)
+}
+
+// PluginNames lists registered extensions by kind, for the info endpoint.
+func PluginNames() map[string][]string {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+
+	names := map[string][]string{}
+	for _, p := range plugins.processors {
+		names["processors"] = append(names["processors"], p.Name())
+	}
+	for _, n := range plugins.notifiers {
+		names["notifiers"] = append(names["notifiers"], n.Name())
+	}
+	for _, d := range plugins.decorators {
+		names["storageDecorators"] = append(names["storageDecorators"], d.Name())
+	}
+	return names
+}
+
+func hasProcessors() bool {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+	return len(plugins.processors) > 0
+}
+
+func hasStorageDecorators() bool {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+	return len(plugins.decorators) > 0
+}
+
+func runProcessors(filename string, r io.Reader) (string, io.Reader, error) {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+
+	for _, p := range plugins.processors {
+		var err error
+		filename, r, err = p.Process(filename, r)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+	return filename, r, nil
+}
+
+func decorateWriter(w io.WriteCloser) (io.WriteCloser, error) {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+
+	for i := len(plugins.decorators) - 1; i >= 0; i-- {
+		var err error
+		if w, err = plugins.decorators[i].WrapWriter(w); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func decorateReader(r io.ReadCloser) (io.ReadCloser, error) {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+
+	for i := len(plugins.decorators) - 1; i >= 0; i-- {
+		var err error
+		if r, err = plugins.decorators[i].WrapReader(r); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// subscribeNotifiers connects registered notifiers to the event bus.
+func subscribeNotifiers() {
+	plugins.mu.RLock()
+	defer plugins.mu.RUnlock()
+
+	for _, n := range plugins.notifiers {
+		events.Subscribe(n.Notify)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var (
+	trustedProxies []*net.IPNet
+	basePath       string
+	externalURL    string
+)
+
+// unnamedProxy reports whether -base-path or -external-url say a reverse
+// proxy is in front of the server while -trusted-proxies doesn't name it.
+// A proxy on the same host then makes every client look local.
+func unnamedProxy() bool {
+	return (basePath != "" || externalURL != "") && len(trustedProxies) == 0
+}
+
+// publicBaseURL is the root URL clients should use in generated links: the
+// configured external URL, or the server's own address otherwise.
+func publicBaseURL() string {
+	if externalURL != "" {
+		return externalURL
+	}
+	return fmt.Sprintf("http://%s:%d%s", localIP, port, basePath)
+}
+
+// normalizeBasePath turns "sync/", "/sync" etc. into "/sync", and "/" into "".
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// withBasePath serves h under basePath, for apps mounted on a sub-path by a
+// reverse proxy that forwards the prefix unchanged.
+func withBasePath(h http.Handler) http.Handler {
+	if basePath == "" {
+		return h
+	}
+
+	stripped := http.StripPrefix(basePath, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			// Relative asset and API links need the trailing slash
+			http.Redirect(w, r, basePath+"/", http.StatusMovedPermanently)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, basePath+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+// parseTrustedProxies parses a comma-separated list of IPs and CIDRs.
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedChain returns the client addresses recorded by proxies, nearest
+// hop last. The standard Forwarded header takes precedence over
+// X-Forwarded-For.
+func forwardedChain(r *http.Request) []string {
+	var chain []string
+
+	if values := r.Header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok || !strings.EqualFold(key, "for") {
+						continue
+					}
+					val = strings.Trim(val, "\"")
+					// Strip port and IPv6 brackets: for="[2001:db8::1]:4711"
+					if host, _, err := net.SplitHostPort(val); err == nil {
+						val = host
+					}
+					chain = append(chain, strings.Trim(val, "[]"))
+				}
+			}
+		}
+		return chain
+	}
+
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			chain = append(chain, strings.TrimSpace(addr))
+		}
+	}
+	return chain
+}
+
+// clientIP returns the address of the client that made the request. Forwarded
+// headers are only honored when the direct peer is a trusted proxy, and the
+// chain is walked from the nearest hop until the first untrusted address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	chain := forwardedChain(r)
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := net.ParseIP(chain[i])
+		if hop == nil {
+			// Obfuscated or unknown identifiers end the trusted chain
+			return host
+		}
+		host = hop.String()
+		if !isTrustedProxy(hop) {
+			return host
+		}
+	}
+	return host
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Web Push (RFC 8030) with VAPID authentication (RFC 8292) and aes128gcm
+// payload encryption (RFC 8291).
+
+const pushTTL = 24 * time.Hour
+
+var b64 = base64.RawURLEncoding
+
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+type pushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+}
+
+type PushService struct {
+	key           *ecdsa.PrivateKey
+	publicKey     []byte
+	subject       string
+	subsFile      string
+	subscriptions []PushSubscription
+	client        *http.Client
+	mu            sync.RWMutex
+}
+
+func NewPushService(dir, subject string) (*PushService, error) {
+	key, err := loadOrCreateVAPIDKey(stateFile(dir, "vapid.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := key.PublicKey.ECDH()
+	if err != nil {
+		return nil, fmt.Errorf("invalid vapid key: %w", err)
+	}
+
+	ps := &PushService{
+		key:           key,
+		publicKey:     pub.Bytes(),
+		subject:       subject,
+		subsFile:      stateFile(dir, "push_subscriptions.json"),
+		subscriptions: []PushSubscription{},
+		client:        &http.Client{Timeout: 30 * time.Second},
+	}
+
+	data, err := os.ReadFile(ps.subsFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read push subscriptions: %w", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &ps.subscriptions); err != nil {
+			return nil, fmt.Errorf("failed to parse push subscriptions: %w", err)
+		}
+	}
+
+	return ps, nil
+}
+
+func loadOrCreateVAPIDKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("failed to parse vapid key")
+		}
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse vapid key: %w", err)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read vapid key: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate vapid key: %w", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal vapid key: %w", err)
+	}
+	if err := writeStateFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write vapid key: %w", err)
+	}
+	return key, nil
+}
+
+func (ps *PushService) save() error {
+	data, err := json.MarshalIndent(ps.subscriptions, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal push subscriptions: %w", err)
+	}
+	if err := writeStateFile(ps.subsFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write push subscriptions: %w", err)
+	}
+	return nil
+}
+
+func (ps *PushService) Subscribe(sub PushSubscription) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for i, existing := range ps.subscriptions {
+		if existing.Endpoint == sub.Endpoint {
+			ps.subscriptions[i] = sub
+			return ps.save()
+		}
+	}
+	ps.subscriptions = append(ps.subscriptions, sub)
+	return ps.save()
+}
+
+func (ps *PushService) Unsubscribe(endpoint string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for i, existing := range ps.subscriptions {
+		if existing.Endpoint == endpoint {
+			ps.subscriptions = append(ps.subscriptions[:i], ps.subscriptions[i+1:]...)
+			return ps.save()
+		}
+	}
+	return nil
+}
+
+// vapidAuthorization builds the Authorization header for endpoint.
+func (ps *PushService) vapidAuthorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header := b64.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": ps.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + b64.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, ps.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, b64.EncodeToString(sig), b64.EncodeToString(ps.publicKey)), nil
+}
+
+// encryptPushPayload encrypts plaintext for a subscription as a single
+// aes128gcm record.
+func encryptPushPayload(sub PushSubscription, plaintext []byte) ([]byte, error) {
+	uaPublic, err := b64.DecodeString(sub.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	authSecret, err := b64.DecodeString(sub.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth secret: %w", err)
+	}
+
+	receiver, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	local, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := local.ECDH(receiver)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := local.PublicKey().Bytes()
+
+	prkKey, err := hkdf.Extract(sha256.New, shared, authSecret)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := "WebPush: info\x00" + string(uaPublic) + string(asPublic)
+	ikm, err := hkdf.Expand(sha256.New, prkKey, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Padding delimiter for the last (only) record
+	record := append(append([]byte{}, plaintext...), 0x02)
+
+	var buf bytes.Buffer
+	buf.Write(salt)
+	binary.Write(&buf, binary.BigEndian, uint32(4096))
+	buf.WriteByte(byte(len(asPublic)))
+	buf.Write(asPublic)
+	buf.Write(gcm.Seal(nil, nonce, record, nil))
+
+	return buf.Bytes(), nil
+}
+
+var errSubscriptionGone = errors.New("push subscription expired")
+
+func (ps *PushService) send(sub PushSubscription, payload []byte) error {
+	body, err := encryptPushPayload(sub, payload)
+	if err != nil {
+		return err
+	}
+	auth, err := ps.vapidAuthorization(sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprintf("%d", int(pushTTL.Seconds())))
+
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errSubscriptionGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Broadcast sends msg to every subscription, dropping ones the push service
+// reports as gone.
+func (ps *PushService) Broadcast(msg pushMessage) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	ps.mu.RLock()
+	subs := make([]PushSubscription, len(ps.subscriptions))
+	copy(subs, ps.subscriptions)
+	ps.mu.RUnlock()
+
+	for _, sub := range subs {
+		err := ps.send(sub, payload)
+		if errors.Is(err, errSubscriptionGone) {
+			slog.Info("Removing expired push subscription", "endpoint", sub.Endpoint)
+			ps.Unsubscribe(sub.Endpoint)
+		} else if err != nil {
+			slog.Warn("Failed to send push notification", "endpoint", sub.Endpoint, "error", err)
+		}
+	}
+}
+
+func (ps *PushService) handleEvent(e Event) {
+	switch e.Type {
+	case EventFileUploaded:
+		ps.Broadcast(pushMessage{
+			Title: "New file: " + e.File.Name,
+			Body:  formatSize(e.File.Size),
+			URL:   shareURL(e.File),
+		})
+	case EventNoteCreated, EventNoteUpdated:
+		title := e.Note.Title
+		if title == "" {
+			title = "Untitled note"
+		}
+		body := []rune(e.Note.Content)
+		if len(body) > 120 {
+			body = append(body[:120], '…')
+		}
+		ps.Broadcast(pushMessage{Title: title, Body: string(body), URL: publicBaseURL() + "/"})
+	}
+}
+
+func handlePushKey(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"publicKey": b64.EncodeToString(push.publicKey)})
+}
+
+func handlePushSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var sub PushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil || sub.Endpoint == "" || sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		http.Error(w, "Invalid subscription", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" {
+		http.Error(w, "Invalid subscription endpoint", http.StatusBadRequest)
+		return
+	}
+
+	if err := push.Subscribe(sub); err != nil {
+		slog.Error("Failed to save push subscription", "error", err)
+		http.Error(w, "Failed to save subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handlePushUnsubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Endpoint string `json:"endpoint"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Endpoint == "" {
+		http.Error(w, "Endpoint required", http.StatusBadRequest)
+		return
+	}
+
+	if err := push.Unsubscribe(req.Endpoint); err != nil {
+		slog.Error("Failed to remove push subscription", "error", err)
+		http.Error(w, "Failed to remove subscription", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
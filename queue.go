@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queueHold is how long a client told to come back keeps its place in line.
+const queueHold = time.Minute
+
+// DownloadQueue lets only a few large downloads run at once and makes the
+// rest wait their turn, first come first served. On a slow disk a handful of
+// sequential transfers finish sooner than many interleaved ones.
+type DownloadQueue struct {
+	slots   int
+	minSize int64
+
+	mu     sync.Mutex
+	active int
+	line   []*queueTicket
+}
+
+// queueTicket is a place in line for one client's download of one file.
+type queueTicket struct {
+	key    string
+	client string
+	file   string
+	since  time.Time
+	ready  chan struct{} // closed once a slot is handed to the ticket
+	admit  bool          // set with ready; the slot is the ticket's
+	holder *time.Timer   // drops the ticket if its client doesn't return
+}
+
+// downloads is nil unless -download-slots is set.
+var downloads *DownloadQueue
+
+func NewDownloadQueue(slots int, minSize int64) *DownloadQueue {
+	return &DownloadQueue{slots: slots, minSize: minSize}
+}
+
+// errQueued reports that the caller didn't reach the front in the time it
+// was prepared to wait.
+type errQueued struct{ position int }
+
+func (e errQueued) Error() string {
+	return fmt.Sprintf("queued at position %d", e.position)
+}
+
+// Enter waits for a download slot for client's download of file, for at
+// most wait (no limit if 0). On success the returned func frees the slot.
+// Otherwise the error is errQueued, and the client keeps its place for
+// queueHold, or ctx's error if the client went away.
+func (q *DownloadQueue) Enter(ctx context.Context, client, file string, wait time.Duration) (func(), error) {
+	key := client + "\x00" + file
+
+	q.mu.Lock()
+	t := q.find(key)
+	if t != nil && !t.holder.Stop() {
+		// Its hold ran out just now
+		t = nil
+	}
+	switch {
+	case t != nil:
+		// Back after being told to wait
+		t.holder = nil
+		q.admitNext()
+	case q.active < q.slots && len(q.line) == 0:
+		q.active++
+		q.mu.Unlock()
+		return q.leave, nil
+	default:
+		t = &queueTicket{key: key, client: client, file: file, since: time.Now(), ready: make(chan struct{})}
+		q.line = append(q.line, t)
+		// Slots may be free with only absent clients ahead
+		q.admitNext()
+	}
+	q.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-t.ready:
+		return q.leave, nil
+	case <-ctx.Done():
+		q.drop(t)
+		return nil, ctx.Err()
+	case <-timeout:
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t.admit {
+		// Reached the front just as the wait ran out
+		return q.leave, nil
+	}
+	t.holder = time.AfterFunc(queueHold, func() { q.drop(t) })
+	return nil, errQueued{position: q.position(t)}
+}
+
+// find returns the place key is holding in line while its client is away.
+func (q *DownloadQueue) find(key string) *queueTicket {
+	for _, t := range q.line {
+		if t.key == key && t.holder != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+func (q *DownloadQueue) position(t *queueTicket) int {
+	for i, queued := range q.line {
+		if queued == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// leave frees a slot and hands it to the next ticket in line.
+func (q *DownloadQueue) leave() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active--
+	q.admitNext()
+}
+
+// admitNext hands free slots to tickets whose clients are waiting. Clients
+// holding a place while away are admitted when they come back.
+func (q *DownloadQueue) admitNext() {
+	for i := 0; i < len(q.line) && q.active < q.slots; {
+		t := q.line[i]
+		if t.holder != nil {
+			i++
+			continue
+		}
+		q.line = append(q.line[:i], q.line[i+1:]...)
+		q.active++
+		t.admit = true
+		close(t.ready)
+	}
+}
+
+// drop gives up t's place, or the slot it was just handed.
+func (q *DownloadQueue) drop(t *queueTicket) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t.admit {
+		q.active--
+	} else if i := q.position(t); i > 0 {
+		q.line = append(q.line[:i-1], q.line[i:]...)
+	}
+	q.admitNext()
+}
+
+// preferredWait returns how long the client will wait, from an RFC 7240
+// "Prefer: wait=N" header; 0 means as long as it takes.
+func preferredWait(r *http.Request) time.Duration {
+	for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(pref), "wait="); ok {
+			if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+				// wait=0 still gets a moment for a slot that is about to free up
+				return max(time.Duration(n)*time.Second, 100*time.Millisecond)
+			}
+		}
+	}
+	return 0
+}
+
+// queueDownload holds a large download until a slot is free. It returns
+// false after responding with 503 and the client's place in line when the
+// client won't wait, or if it went away. Small downloads pass straight
+// through.
+func queueDownload(w http.ResponseWriter, r *http.Request, file string, size int64) (func(), bool) {
+	if downloads == nil || size < downloads.minSize || r.Method == http.MethodHead {
+		return func() {}, true
+	}
+
+	release, err := downloads.Enter(r.Context(), clientIP(r), file, preferredWait(r))
+	if queued, ok := err.(errQueued); ok {
+		w.Header().Set("X-Queue-Position", strconv.Itoa(queued.position))
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, fmt.Sprintf("Download queued at position %d, retry shortly", queued.position), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	if err != nil {
+		return nil, false
+	}
+	return release, true
+}
+
+type QueueEntry struct {
+	FileID   string    `json:"fileId"`
+	Position int       `json:"position"`
+	Since    time.Time `json:"since"`
+}
+
+type QueueResponse struct {
+	Slots   int          `json:"slots"`
+	Active  int          `json:"active"`
+	Waiting int          `json:"waiting"`
+	Yours   []QueueEntry `json:"yours"`
+}
+
+// handleQueue reports how busy the download queue is, and where the
+// caller's own downloads are in it.
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := QueueResponse{Yours: []QueueEntry{}}
+	if downloads != nil {
+		client := clientIP(r)
+		downloads.mu.Lock()
+		resp.Slots, resp.Active, resp.Waiting = downloads.slots, downloads.active, len(downloads.line)
+		for i, t := range downloads.line {
+			if t.client == client {
+				resp.Yours = append(resp.Yours, QueueEntry{FileID: t.file, Position: i + 1, Since: t.since})
+			}
+		}
+		downloads.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ClientQuota limits how many bytes each client may keep stored, counting
+// the live files it uploaded. Clients are told apart by IP address, or by
+// API token with -client-quota-by token.
+type ClientQuota struct {
+	limit     int64
+	overrides map[string]int64 // by client IP; 0 lifts the limit
+	byToken   bool
+}
+
+// quota is nil unless -client-quota or -client-quota-overrides is set.
+var quota *ClientQuota
+
+func NewClientQuota(limit int64, overrides map[string]int64, by string) (*ClientQuota, error) {
+	if by != "ip" && by != "token" {
+		return nil, fmt.Errorf("invalid -client-quota-by %q (use ip or token)", by)
+	}
+	return &ClientQuota{limit: limit, overrides: overrides, byToken: by == "token"}, nil
+}
+
+// parseQuotaOverrides reads per-client limits such as
+// "192.168.1.20=50GB,10.0.0.5=0".
+func parseQuotaOverrides(s string) (map[string]int64, error) {
+	overrides := map[string]int64{}
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		ip, size, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid quota override %q (use e.g. 192.168.1.20=50GB)", entry)
+		}
+		limit, err := parseSize(size)
+		if err != nil {
+			return nil, err
+		}
+		overrides[strings.TrimSpace(ip)] = limit
+	}
+	return overrides, nil
+}
+
+// clientID returns the opaque ID files uploaded by r's client are recorded
+// under, so listings don't give out addresses or tokens.
+func (q *ClientQuota) clientID(r *http.Request) string {
+	key := "ip:" + clientIP(r)
+	if token := requestToken(r); q.byToken && token != "" {
+		key = "token:" + token
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// limitFor returns r's client's limit, 0 for none.
+func (q *ClientQuota) limitFor(r *http.Request) int64 {
+	if limit, ok := q.overrides[clientIP(r)]; ok {
+		return limit
+	}
+	return q.limit
+}
+
+// ClientUsage returns how many live files client uploaded and their total
+// size.
+func (fs *FileStorage) ClientUsage(client string) (int, int64) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	var files int
+	var used int64
+	for i := range fs.files {
+		if meta := &fs.files[i]; meta.Uploader == client && !meta.deleted() {
+			files++
+			used += meta.Size
+		}
+	}
+	return files, used
+}
+
+// clientAllowance is what an upload's client may still store: its ID, and
+// the bytes left, or -1 if unlimited.
+type clientAllowance struct {
+	client    string
+	remaining int64
+}
+
+func requestAllowance(r *http.Request) clientAllowance {
+	if quota == nil {
+		return clientAllowance{remaining: -1}
+	}
+	a := clientAllowance{client: quota.clientID(r), remaining: -1}
+	if limit := quota.limitFor(r); limit > 0 {
+		_, used := storage.ClientUsage(a.client)
+		a.remaining = max(limit-used, 0)
+	}
+	return a
+}
+
+// errOverQuota reports an upload that would take its client past its limit.
+type errOverQuota struct{ remaining int64 }
+
+func (e errOverQuota) Error() string {
+	return fmt.Sprintf("upload exceeds your storage quota (%s left)", formatSize(e.remaining))
+}
+
+// check fails when an upload of size bytes won't fit; size may be -1 when
+// not known in advance.
+func (a clientAllowance) check(size int64) error {
+	if a.remaining >= 0 && size > a.remaining {
+		return errOverQuota{a.remaining}
+	}
+	return nil
+}
+
+// limit fails reads past what the client has left.
+func (a clientAllowance) limit(r io.Reader) io.Reader {
+	if a.remaining < 0 {
+		return r
+	}
+	return &quotaReader{r: r, remaining: a.remaining}
+}
+
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+	n         int64
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	n, err := qr.r.Read(p)
+	qr.n += int64(n)
+	if qr.n > qr.remaining {
+		return n, errOverQuota{qr.remaining}
+	}
+	return n, err
+}
+
+// rejectOverQuota answers 413 and returns true when err is errOverQuota.
+func rejectOverQuota(w http.ResponseWriter, err error) bool {
+	var over errOverQuota
+	if !errors.As(err, &over) {
+		return false
+	}
+	http.Error(w, over.Error(), http.StatusRequestEntityTooLarge)
+	return true
+}
+
+type QuotaResponse struct {
+	Limited   bool   `json:"limited"`
+	Limit     int64  `json:"limit,omitempty"`
+	Used      int64  `json:"used"`
+	Remaining int64  `json:"remaining,omitempty"`
+	Files     int    `json:"files"`
+	Client    string `json:"client,omitempty"`
+}
+
+// handleQuota reports the caller's storage quota and how much of it is
+// used, so clients can check before uploading.
+func handleQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp QuotaResponse
+	if quota != nil {
+		resp.Client = quota.clientID(r)
+		resp.Files, resp.Used = storage.ClientUsage(resp.Client)
+		if resp.Limit = quota.limitFor(r); resp.Limit > 0 {
+			resp.Limited = true
+			resp.Remaining = max(resp.Limit-resp.Used, 0)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// reconcileGrace is how old an unreferenced blob must be before it is
+// deleted when the directory is shared, so uploads still being written by
+// peers are left alone.
+const reconcileGrace = time.Hour
+
+// ReconcileReport describes what Reconcile cleaned up.
+type ReconcileReport struct {
+	OrphanBlobs       int
+	OrphanBytes       int64
+	MissingFiles      int
+	MissingRenditions int
+}
+
+// isBlobName reports whether name in the storage directory is file contents
+// sync-it wrote: a content address, a legacy ID-named blob, a rendition or an
+// upload that wasn't given its content address. Everything else there
+// (metadata, keys, other state) is never touched.
+func isBlobName(name string) bool {
+	if strings.HasSuffix(name, partialSuffix) {
+		return false
+	}
+	isHex := func(s string, n int) bool {
+		_, err := hex.DecodeString(s)
+		return len(s) == n && err == nil
+	}
+	if digest, ok := strings.CutPrefix(name, "sha256-"); ok {
+		return isHex(digest, 64)
+	}
+	if id, ok := strings.CutPrefix(name, "upload-"); ok {
+		return isHex(id, 32)
+	}
+	id, key, _ := strings.Cut(name, ".")
+	return isHex(id, 32) && !strings.ContainsAny(key, ".")
+}
+
+// isPartialBlob reports whether name is a blob still being written, or left
+// half-written by a crash.
+func isPartialBlob(name string) bool {
+	blob, ok := strings.CutSuffix(name, partialSuffix)
+	return ok && isBlobName(blob)
+}
+
+// Reconcile makes the storage directory and the metadata agree after a
+// crash: blobs no file refers to, such as interrupted uploads, are deleted,
+// and files or renditions whose contents are gone are dropped. It only
+// applies to local storage.
+func (fs *FileStorage) Reconcile() (ReconcileReport, error) {
+	var report ReconcileReport
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	local, ok := fs.blobs.(dirBlobStore)
+	if !ok {
+		return report, nil
+	}
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+
+	names, err := local.List()
+	if err != nil {
+		return report, err
+	}
+	present := map[string]bool{}
+	for _, name := range names {
+		present[name] = true
+	}
+
+	// Drop metadata whose contents are missing
+	referenced := map[string]bool{}
+	var put []FileMetadata
+	var removed []string
+	kept := []FileMetadata{}
+	for _, meta := range fs.files {
+		if !present[meta.blobName()] {
+			slog.Warn("Dropping file whose contents are missing", "id", meta.ID, "name", meta.Name)
+			removed = append(removed, meta.ID)
+			report.MissingFiles++
+			continue
+		}
+		referenced[meta.blobName()] = true
+
+		renditions := []Rendition{}
+		for _, r := range meta.Renditions {
+			if blob := renditionBlob(meta.ID, r.Key); present[blob] {
+				referenced[blob] = true
+				renditions = append(renditions, r)
+			} else {
+				report.MissingRenditions++
+			}
+		}
+		if len(renditions) != len(meta.Renditions) {
+			meta.Renditions = renditions
+			put = append(put, meta)
+		}
+		kept = append(kept, meta)
+	}
+	if len(put) > 0 || len(removed) > 0 {
+		prev := fs.files
+		fs.files = kept
+		if err := fs.commit(put, removed); err != nil {
+			fs.files = prev
+			return report, err
+		}
+	}
+
+	// Then delete contents nothing refers to
+	for name := range present {
+		if referenced[name] {
+			continue
+		}
+		info, err := os.Stat(local.LocalPath(name))
+		if err != nil || fs.lockFile != "" && time.Since(info.ModTime()) < reconcileGrace {
+			continue
+		}
+		if err := local.Remove(name); err != nil {
+			slog.Warn("Failed to delete orphaned blob", "name", name, "error", err)
+			continue
+		}
+		report.OrphanBlobs++
+		report.OrphanBytes += info.Size()
+	}
+
+	// And blobs whose writing never finished
+	partials, err := local.Partials()
+	if err != nil {
+		return report, err
+	}
+	for _, name := range partials {
+		info, err := os.Stat(local.LocalPath(name))
+		if err != nil || fs.lockFile != "" && time.Since(info.ModTime()) < reconcileGrace {
+			continue
+		}
+		if err := os.Remove(local.LocalPath(name)); err != nil {
+			slog.Warn("Failed to delete partial blob", "name", name, "error", err)
+			continue
+		}
+		report.OrphanBlobs++
+		report.OrphanBytes += info.Size()
+	}
+
+	return report, nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the histogram bucket bounds, in seconds.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.2, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations into latencyBuckets, plus one overflow bucket.
+type histogram struct {
+	counts [12]uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(seconds float64) {
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.counts[i]++
+	h.sum += seconds
+	h.count++
+}
+
+// quantile estimates the q-th quantile by interpolating within the bucket it
+// falls in, as Prometheus' histogram_quantile does. Values in the overflow
+// bucket are reported as the largest bound.
+func (h *histogram) quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var cumulative uint64
+	for i, n := range h.counts {
+		if float64(cumulative+n) < rank || n == 0 {
+			cumulative += n
+			continue
+		}
+		if i == len(latencyBuckets) {
+			return latencyBuckets[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		return lower + (latencyBuckets[i]-lower)*(rank-float64(cumulative))/float64(n)
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// routeStats is what was measured for one route: how long until the
+// response started, how long the whole request took, and the responses by
+// status class.
+type routeStats struct {
+	firstByte histogram
+	duration  histogram
+	statuses  map[string]uint64 // "2xx", "5xx", ...
+}
+
+// RequestStats keeps per-route latency histograms for /metrics and the SLOs.
+// Routes are the patterns handlers are registered under, so IDs in paths
+// don't make every download its own series.
+type RequestStats struct {
+	mu     sync.Mutex
+	routes map[string]*routeStats
+	slos   []*SLO
+}
+
+var requestStats = &RequestStats{routes: map[string]*routeStats{}}
+
+func (s *RequestStats) record(route string, status int, firstByte, duration time.Duration, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rs := s.routes[route]
+	if rs == nil {
+		rs = &routeStats{statuses: map[string]uint64{}}
+		s.routes[route] = rs
+	}
+	rs.firstByte.observe(firstByte.Seconds())
+	rs.duration.observe(duration.Seconds())
+	rs.statuses[fmt.Sprintf("%dxx", status/100)]++
+
+	for _, slo := range s.slos {
+		if slo.Route == route {
+			slo.record(now, status < 500 && firstByte <= slo.Threshold)
+		}
+	}
+}
+
+// RouteSummary is a route's traffic and latency percentiles, for the admin
+// API.
+type RouteSummary struct {
+	Route              string  `json:"route"`
+	Requests           uint64  `json:"requests"`
+	Errors             uint64  `json:"errors"`
+	FirstByteP50       float64 `json:"firstByteP50Seconds"`
+	FirstByteP99       float64 `json:"firstByteP99Seconds"`
+	DurationP50        float64 `json:"durationP50Seconds"`
+	DurationP99        float64 `json:"durationP99Seconds"`
+	DurationAvgSeconds float64 `json:"durationAvgSeconds"`
+}
+
+// Summaries returns every route seen so far, busiest first.
+func (s *RequestStats) Summaries() []RouteSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summaries := make([]RouteSummary, 0, len(s.routes))
+	for route, rs := range s.routes {
+		summaries = append(summaries, RouteSummary{
+			Route:              route,
+			Requests:           rs.duration.count,
+			Errors:             rs.statuses["5xx"],
+			FirstByteP50:       rs.firstByte.quantile(0.5),
+			FirstByteP99:       rs.firstByte.quantile(0.99),
+			DurationP50:        rs.duration.quantile(0.5),
+			DurationP99:        rs.duration.quantile(0.99),
+			DurationAvgSeconds: rs.duration.sum / float64(rs.duration.count),
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Requests != summaries[j].Requests {
+			return summaries[i].Requests > summaries[j].Requests
+		}
+		return summaries[i].Route < summaries[j].Route
+	})
+	return summaries
+}
+
+// writePrometheus writes the per-route histograms and request counts in the
+// Prometheus text format.
+func (s *RequestStats) writePrometheus(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	routes := make([]string, 0, len(s.routes))
+	for route := range s.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	writeHistogram := func(name, help string, get func(*routeStats) *histogram) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for _, route := range routes {
+			h := get(s.routes[route])
+			var cumulative uint64
+			for i, bound := range latencyBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s_bucket{route=%q,le=\"%g\"} %d\n", name, route, bound, cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket{route=%q,le=\"+Inf\"} %d\n", name, route, h.count)
+			fmt.Fprintf(w, "%s_sum{route=%q} %g\n%s_count{route=%q} %d\n", name, route, h.sum, name, route, h.count)
+		}
+	}
+	writeHistogram("sync_it_http_response_start_seconds", "Time until the response headers or first bytes were written.",
+		func(rs *routeStats) *histogram { return &rs.firstByte })
+	writeHistogram("sync_it_http_request_duration_seconds", "Time until the whole response was written.",
+		func(rs *routeStats) *histogram { return &rs.duration })
+
+	fmt.Fprintf(w, "# HELP sync_it_http_requests_total Requests served, by status class.\n# TYPE sync_it_http_requests_total counter\n")
+	for _, route := range routes {
+		statuses := s.routes[route].statuses
+		classes := make([]string, 0, len(statuses))
+		for class := range statuses {
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+		for _, class := range classes {
+			fmt.Fprintf(w, "sync_it_http_requests_total{route=%q,code=%q} %d\n", route, class, statuses[class])
+		}
+	}
+}
+
+// metricsWriter notes when the response starts and with which status.
+type metricsWriter struct {
+	http.ResponseWriter
+	status  int
+	started time.Time
+}
+
+func (w *metricsWriter) WriteHeader(status int) {
+	if w.started.IsZero() {
+		w.started = time.Now()
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *metricsWriter) Write(p []byte) (int, error) {
+	if w.started.IsZero() {
+		w.started = time.Now()
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *metricsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withRequestMetrics times every request against the route that served it.
+// It wraps the mux directly, so bandwidth throttling doesn't count against
+// how quickly a response started.
+func withRequestMetrics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mw := &metricsWriter{ResponseWriter: w}
+		h.ServeHTTP(mw, r)
+		end := time.Now()
+
+		// The mux fills in the pattern it matched
+		route := r.Pattern
+		if route == "" {
+			route = "other"
+		}
+		if mw.started.IsZero() {
+			mw.started, mw.status = end, http.StatusOK
+		}
+		requestStats.record(route, mw.status, mw.started.Sub(start), end.Sub(start), end)
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/orange-puff/sync-it/client"
+)
+
+// runDownload saves one file, resuming an earlier interrupted attempt; see
+// client.DownloadFile.
+func runDownload(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	server := fs.String("server", "", "Server URL, e.g. http://192.168.1.10:8080")
+	output := fs.String("o", "", "Where to save the file (default: its name, in the current directory)")
+	pin := fs.String("pin", "", "PIN for servers started with -pin")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: sync-it download <id> -server URL [-o path]")
+		fs.PrintDefaults()
+	}
+
+	var id string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		id, args = args[0], args[1:]
+	}
+	fs.Parse(args)
+	if id == "" {
+		id = fs.Arg(0)
+	}
+	if id == "" || *server == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := client.New(*server, client.Options{PIN: *pin})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	dest := *output
+	if dest == "" {
+		meta, err := c.Get(ctx, id)
+		if err != nil {
+			return err
+		}
+		dest = filepath.Base(filepath.Clean("/" + meta.Name))
+	}
+
+	if err := c.DownloadFile(ctx, id, dest); err != nil {
+		return fmt.Errorf("%w (run again to resume)", err)
+	}
+	fmt.Println("Saved", dest)
+	return nil
+}
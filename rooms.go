@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRoomNotFound = errors.New("room not found")
+
+// roomCodeAlphabet leaves out characters that are easy to misread aloud or
+// on a screen (0/O, 1/I/L).
+const (
+	roomCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	roomCodeLength   = 6
+)
+
+// Room is a temporary namespace with its own file list. Anyone with the code
+// can list, upload and download its files, but not the ones outside it.
+type Room struct {
+	Code      string    `json:"code"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// clampExpiration keeps files in the room from outliving it.
+func (room *Room) clampExpiration(d time.Duration) time.Duration {
+	if room == nil {
+		return d
+	}
+	return min(d, time.Until(room.ExpiresAt))
+}
+
+type RoomStorage struct {
+	file  string
+	rooms []Room
+	mu    sync.RWMutex
+}
+
+func NewRoomStorage(dir string) (*RoomStorage, error) {
+	rs := &RoomStorage{
+		file:  stateFile(dir, "rooms.json"),
+		rooms: []Room{},
+	}
+
+	data, err := os.ReadFile(rs.file)
+	if os.IsNotExist(err) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rooms: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &rs.rooms); err != nil {
+		return nil, fmt.Errorf("failed to parse rooms: %w", err)
+	}
+
+	return rs, nil
+}
+
+func (rs *RoomStorage) save() error {
+	data, err := json.MarshalIndent(rs.rooms, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rooms: %w", err)
+	}
+
+	if err := writeStateFile(rs.file, data, 0644); err != nil {
+		return fmt.Errorf("failed to write rooms: %w", err)
+	}
+
+	return nil
+}
+
+func (rs *RoomStorage) find(code string) int {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	for i, room := range rs.rooms {
+		if room.Code == code {
+			return i
+		}
+	}
+	return -1
+}
+
+func generateRoomCode() (string, error) {
+	bytes := make([]byte, roomCodeLength)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", fmt.Errorf("failed to generate room code: %w", err)
+	}
+	for i, b := range bytes {
+		bytes[i] = roomCodeAlphabet[int(b)%len(roomCodeAlphabet)]
+	}
+	return string(bytes), nil
+}
+
+func (rs *RoomStorage) CreateRoom(name string, ttl time.Duration) (*Room, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	code, err := generateRoomCode()
+	for err == nil && rs.find(code) != -1 {
+		code, err = generateRoomCode()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	room := Room{
+		Code:      code,
+		Name:      name,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+
+	rs.rooms = append(rs.rooms, room)
+
+	if err := rs.save(); err != nil {
+		rs.rooms = rs.rooms[:len(rs.rooms)-1]
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+// GetRoom looks a room up by code, ignoring case. Expired rooms are treated
+// as missing.
+func (rs *RoomStorage) GetRoom(code string) (*Room, error) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	idx := rs.find(code)
+	if idx == -1 || time.Now().After(rs.rooms[idx].ExpiresAt) {
+		return nil, errRoomNotFound
+	}
+
+	room := rs.rooms[idx]
+	return &room, nil
+}
+
+// CloseRoom removes a room before it expires.
+func (rs *RoomStorage) CloseRoom(code string) (*Room, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	idx := rs.find(code)
+	if idx == -1 {
+		return nil, errRoomNotFound
+	}
+
+	prev := rs.rooms
+	room := rs.rooms[idx]
+	rs.rooms = append(append([]Room{}, rs.rooms[:idx]...), rs.rooms[idx+1:]...)
+
+	if err := rs.save(); err != nil {
+		rs.rooms = prev
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+// RemoveExpired drops rooms past their expiration and returns them.
+func (rs *RoomStorage) RemoveExpired() ([]Room, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	now := time.Now()
+	active := []Room{}
+	var expired []Room
+	for _, room := range rs.rooms {
+		if now.After(room.ExpiresAt) {
+			expired = append(expired, room)
+		} else {
+			active = append(active, room)
+		}
+	}
+	if len(expired) == 0 {
+		return nil, nil
+	}
+
+	prev := rs.rooms
+	rs.rooms = active
+
+	if err := rs.save(); err != nil {
+		rs.rooms = prev
+		return nil, err
+	}
+
+	return expired, nil
+}
+
+// teardownRoom purges a closed or expired room's files and publishes
+// eventType with the room and everything removed from it. It returns the
+// files removed and the bytes that freed.
+func teardownRoom(room *Room, eventType string) ([]FileMetadata, int64) {
+	files, freed, err := storage.DeleteRoomFiles(room.Code)
+	if err != nil {
+		slog.Error("Failed to purge room files", "code", room.Code, "error", err)
+	}
+	if err := folders.Remove(room.Code, ""); err != nil {
+		slog.Error("Failed to remove room folders", "code", room.Code, "error", err)
+	}
+	if err := expectations.Remove(room.Code, ""); err != nil {
+		slog.Error("Failed to remove room's expected uploads", "code", room.Code, "error", err)
+	}
+	slog.Info("Room torn down", "code", room.Code, "event", eventType, "files", len(files))
+
+	events.Publish(Event{Type: eventType, Room: room, Files: files})
+	return files, freed
+}
+
+// DeleteExpiredRooms tears down rooms whose lifetime has run out. It runs
+// RoomExpiryResult is what one DeleteExpiredRooms pass removed.
+type RoomExpiryResult struct {
+	Rooms int
+	Files int
+	Freed int64
+}
+
+// DeleteExpiredRooms tears down rooms whose lifetime has run out. It runs
+// from the cleanup loop alongside file expiration.
+func DeleteExpiredRooms() (RoomExpiryResult, error) {
+	expired, err := rooms.RemoveExpired()
+	if err != nil {
+		return RoomExpiryResult{}, err
+	}
+	result := RoomExpiryResult{Rooms: len(expired)}
+	for i := range expired {
+		files, freed := teardownRoom(&expired[i], EventRoomExpired)
+		result.Files += len(files)
+		result.Freed += freed
+	}
+	return result, nil
+}
+
+type RoomResponse struct {
+	Room
+	URL string `json:"url"`
+}
+
+type roomRequest struct {
+	Name     string `json:"name"`
+	TTLHours int    `json:"ttlHours"`
+}
+
+// roomURL opens the web UI scoped to the room.
+func roomURL(code string) string {
+	return publicBaseURL() + "/?room=" + url.QueryEscape(code)
+}
+
+func writeRoom(w http.ResponseWriter, room *Room, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(RoomResponse{Room: *room, URL: roomURL(room.Code)})
+}
+
+// requestRoom returns the room a request is scoped to, named by the
+// X-Room-Code header or a room query parameter, or nil when there is none.
+// Unknown and expired codes are answered with 404 and ok is false.
+func requestRoom(w http.ResponseWriter, r *http.Request) (room *Room, ok bool) {
+	code := r.Header.Get("X-Room-Code")
+	if code == "" {
+		code = r.URL.Query().Get("room")
+	}
+	if code == "" {
+		return nil, true
+	}
+
+	room, err := rooms.GetRoom(code)
+	if err != nil {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return nil, false
+	}
+	return room, true
+}
+
+func roomCode(room *Room) string {
+	if room == nil {
+		return ""
+	}
+	return room.Code
+}
+
+// inRoom reports whether meta is visible to requests scoped to room; files
+// outside any room are only visible to requests without one.
+func inRoom(meta *FileMetadata, room *Room) bool {
+	return meta.Room == roomCode(room)
+}
+
+func handleRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	var req roomRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Invalid room", http.StatusBadRequest)
+			return
+		}
+	}
+
+	room, err := rooms.CreateRoom(strings.TrimSpace(req.Name), expirationFor(req.TTLHours))
+	if err != nil {
+		slog.Error("Failed to create room", "error", err)
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Room created", "code", room.Code, "expiresAt", room.ExpiresAt, "client", clientIP(r))
+
+	writeRoom(w, room, http.StatusCreated)
+}
+
+// handleRoom answers GET /api/rooms/{code}, which clients use to check a
+// code before joining, and DELETE, which closes the room and purges its
+// files.
+func handleRoom(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimPrefix(r.URL.Path, "/api/rooms/")
+
+	switch r.Method {
+	case http.MethodGet:
+		room, err := rooms.GetRoom(code)
+		if err != nil {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+
+		writeRoom(w, room, http.StatusOK)
+
+	case http.MethodDelete:
+		if rejectIfMaintenance(w) {
+			return
+		}
+
+		if _, err := rooms.GetRoom(code); err != nil {
+			http.Error(w, "Room not found", http.StatusNotFound)
+			return
+		}
+		room, err := rooms.CloseRoom(code)
+		if err != nil {
+			slog.Error("Failed to close room", "code", code, "error", err)
+			http.Error(w, "Failed to close room", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Room closed", "code", room.Code, "client", clientIP(r))
+
+		teardownRoom(room, EventRoomClosed)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
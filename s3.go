@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3BlobStore keeps blobs in an S3-compatible bucket (AWS S3, MinIO, R2, ...).
+// Requests are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	endpoint     *url.URL
+	bucket       string
+	prefix       string
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	client       *http.Client
+}
+
+// NewS3BlobStore configures a bucket. With an empty endpoint AWS is used with
+// virtual-hosted addressing; custom endpoints use path-style URLs, which is
+// what MinIO and most other implementations expect. Credentials come from
+// the standard AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY / AWS_SESSION_TOKEN
+// environment variables.
+func NewS3BlobStore(endpoint, bucket, region, prefix string) (*S3BlobStore, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("bucket is required")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	s := &S3BlobStore{
+		bucket:       bucket,
+		prefix:       strings.Trim(prefix, "/"),
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: 30 * time.Minute},
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.s3.%s.amazonaws.com", bucket, region)
+	} else {
+		s.pathStyle = true
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	s.endpoint = u
+
+	return s, nil
+}
+
+// s3Escape percent-encodes everything except unreserved characters and
+// slashes, as SigV4 requires for object keys.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '/' || c == '-' || c == '_' || c == '.' || c == '~' ||
+			('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func (s *S3BlobStore) objectURL(name string) *url.URL {
+	key := name
+	if s.prefix != "" {
+		key = s.prefix + "/" + name
+	}
+
+	u := *s.endpoint
+	path := u.Path + "/" + key
+	if s.pathStyle {
+		path = u.Path + "/" + s.bucket + "/" + key
+	}
+	u.Path = path
+	u.RawPath = s3Escape(path)
+	return &u
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds SigV4 headers to req. payloadHash is the hex SHA-256 of the body.
+func (s *S3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// Sign the host and every x-amz-* header, sorted by name
+	names := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func (s *S3BlobStore) do(method, name string, body io.Reader, size int64, payloadHash string, headers ...string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(name).String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	s.sign(req, payloadHash, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var s3err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&s3err)
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("s3 %s %s: %w", method, name, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("s3 %s %s: %s %s %s", method, name, resp.Status, s3err.Code, s3err.Message)
+	}
+	return resp, nil
+}
+
+// s3BlobWriter spools to a temporary file because a plain PUT needs the
+// length and hash of the body up front.
+type s3BlobWriter struct {
+	store *S3BlobStore
+	name  string
+	tmp   *os.File
+	hash  hash.Hash
+	size  int64
+}
+
+func (w *s3BlobWriter) Write(p []byte) (int, error) {
+	n, err := w.tmp.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *s3BlobWriter) Close() error {
+	defer w.Abort()
+
+	if _, err := w.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	resp, err := w.store.do(http.MethodPut, w.name, w.tmp, w.size, hex.EncodeToString(w.hash.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *s3BlobWriter) Abort() {
+	w.tmp.Close()
+	os.Remove(w.tmp.Name())
+}
+
+func (s *S3BlobStore) Create(name string) (BlobWriter, error) {
+	tmp, err := os.CreateTemp("", "sync-it-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobWriter{store: s, name: name, tmp: tmp, hash: sha256.New()}, nil
+}
+
+func (s *S3BlobStore) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, name, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Rename copies the object server-side and deletes the original, since S3
+// has no rename.
+func (s *S3BlobStore) Rename(from, to string) error {
+	source := s.objectURL(from).EscapedPath()
+	if !s.pathStyle {
+		source = "/" + s.bucket + source
+	}
+	resp, err := s.do(http.MethodPut, to, nil, 0, emptyPayloadHash, "X-Amz-Copy-Source", source)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return s.Remove(from)
+}
+
+func (s *S3BlobStore) Remove(name string) error {
+	resp, err := s.do(http.MethodDelete, name, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IntegrityIssue is a file whose stored contents failed the scrub.
+type IntegrityIssue struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Room     string `json:"room,omitempty"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// IntegrityReport is the outcome of one scrub. Files stored before digests
+// were recorded can't be checked and are counted as skipped.
+type IntegrityReport struct {
+	StartedAt  time.Time        `json:"startedAt"`
+	FinishedAt time.Time        `json:"finishedAt,omitzero"`
+	Checked    int              `json:"checked"`
+	Bytes      int64            `json:"bytes"`
+	Skipped    int              `json:"skipped"`
+	Corrupted  []IntegrityIssue `json:"corrupted"`
+}
+
+// Scrubber periodically re-hashes stored files against their recorded
+// SHA-256 and quarantines the ones that no longer match.
+type Scrubber struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	running bool
+	last    *IntegrityReport
+}
+
+// scrubber is always set; its interval is 0 when only manual scrubs run.
+var scrubber = &Scrubber{}
+
+func NewScrubber(interval time.Duration) *Scrubber {
+	return &Scrubber{interval: interval}
+}
+
+// Run scrubs every interval until stop is closed. Only the cluster leader
+// scrubs, and not during maintenance.
+func (s *Scrubber) Run(stop <-chan bool) {
+	if s.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !maintenance.Enabled() && cluster.IsLeader() {
+				s.Start()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Start begins a scrub in the background, reporting false if one is
+// already running.
+func (s *Scrubber) Start() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return false
+	}
+	s.running = true
+	go func() {
+		report := s.scrub()
+		s.mu.Lock()
+		s.running, s.last = false, &report
+		s.mu.Unlock()
+	}()
+	return true
+}
+
+func (s *Scrubber) scrub() IntegrityReport {
+	report := IntegrityReport{StartedAt: time.Now(), Corrupted: []IntegrityIssue{}}
+	slog.Info("Integrity scrub started")
+
+	// Files sharing contents are checked once, and share the verdict
+	checked := map[string]*IntegrityIssue{}
+	var quarantine []string
+	for _, meta := range storage.allFiles() {
+		if meta.deleted() {
+			continue
+		}
+		if meta.SHA256 == "" {
+			report.Skipped++
+			continue
+		}
+
+		issue, seen := checked[meta.blobName()]
+		if !seen {
+			var size int64
+			issue, size = checkBlob(&meta)
+			if issue == nil && size < 0 {
+				// Deleted while the scrub was running
+				continue
+			}
+			checked[meta.blobName()] = issue
+			report.Bytes += size
+		}
+		report.Checked++
+
+		if issue != nil {
+			issue := *issue
+			issue.ID, issue.Name, issue.Room = meta.ID, meta.Name, meta.Room
+			report.Corrupted = append(report.Corrupted, issue)
+			if !meta.Quarantined {
+				slog.Error("File failed integrity check", "id", meta.ID, "name", meta.Name, "expected", issue.Expected, "actual", issue.Actual, "error", issue.Error)
+				quarantine = append(quarantine, meta.ID)
+			}
+		}
+	}
+
+	if err := storage.Quarantine(quarantine); err != nil {
+		slog.Error("Failed to quarantine files", "error", err)
+	}
+
+	report.FinishedAt = time.Now()
+	slog.Info("Integrity scrub finished", "checked", report.Checked, "size", formatSize(report.Bytes), "corrupted", len(report.Corrupted), "duration", report.FinishedAt.Sub(report.StartedAt).Round(time.Second).String())
+	return report
+}
+
+// checkBlob hashes the contents of meta, returning an issue if they don't
+// match and the number of bytes read, which is -1 when the file no longer
+// exists.
+func checkBlob(meta *FileMetadata) (*IntegrityIssue, int64) {
+	blob, err := storage.OpenBlob(meta.ID)
+	if errors.Is(err, errInjectedFault) {
+		// Says nothing about the contents
+		return nil, 0
+	}
+	if err != nil {
+		if _, _, gone := storage.GetFile(meta.ID); gone != nil {
+			return nil, -1
+		}
+		return &IntegrityIssue{Expected: meta.SHA256, Error: err.Error()}, 0
+	}
+	defer blob.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, blob)
+	if errors.Is(err, errInjectedFault) {
+		return nil, size
+	}
+	if err != nil {
+		return &IntegrityIssue{Expected: meta.SHA256, Error: err.Error()}, size
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != meta.SHA256 {
+		return &IntegrityIssue{Expected: meta.SHA256, Actual: sum}, size
+	}
+	return nil, size
+}
+
+// allFiles returns every file, in all rooms.
+func (fs *FileStorage) allFiles() []FileMetadata {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return append([]FileMetadata(nil), fs.files...)
+}
+
+// Quarantine marks files whose contents are damaged so they are no longer
+// served. Uploading the same contents again replaces the damaged copy.
+func (fs *FileStorage) Quarantine(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	marked := map[string]bool{}
+	for _, id := range ids {
+		marked[id] = true
+	}
+	var put []FileMetadata
+	for i := range fs.files {
+		if marked[fs.files[i].ID] && !fs.files[i].Quarantined {
+			fs.files[i].Quarantined = true
+			put = append(put, fs.files[i])
+		}
+	}
+	return fs.commit(put, nil)
+}
+
+type IntegrityResponse struct {
+	Running         bool             `json:"running"`
+	IntervalSeconds int64            `json:"intervalSeconds,omitempty"`
+	Last            *IntegrityReport `json:"last"`
+}
+
+// handleIntegrity reports the last scrub: GET /api/integrity. POST starts
+// a scrub now. Both cover the whole store, so are for admins only.
+func handleIntegrity(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can check the store's integrity", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if rejectIfMaintenance(w) {
+			return
+		}
+		if !scrubber.Start() {
+			http.Error(w, "A scrub is already running", http.StatusConflict)
+			return
+		}
+		slog.Info("Integrity scrub requested", "client", clientIP(r))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scrubber.mu.Lock()
+	resp := IntegrityResponse{Running: scrubber.running, IntervalSeconds: int64(scrubber.interval.Seconds())}
+	if scrubber.last != nil {
+		last := *scrubber.last
+		resp.Last = &last
+	}
+	scrubber.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
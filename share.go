@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const thumbnailSize = 400
+
+// maxDecodePixels is the largest image decoded in full, for thumbnails and
+// PDF pages, as decoding takes about 4 bytes a pixel.
+const maxDecodePixels = 50_000_000
+
+// maxCachedThumbnails is how many thumbnails are kept so link previews
+// fetched again and again don't decode the original each time.
+const maxCachedThumbnails = 256
+
+// thumbnailCache holds encoded thumbnails by file ID; contents never change
+// under an ID. The oldest are dropped first.
+type thumbnailCache struct {
+	mu    sync.Mutex
+	data  map[string][]byte
+	order []string
+}
+
+var thumbnails = &thumbnailCache{data: map[string][]byte{}}
+
+func (c *thumbnailCache) Get(id string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.data[id]
+	return data, ok
+}
+
+func (c *thumbnailCache) Put(id string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.data[id]; ok {
+		return
+	}
+	if len(c.order) >= maxCachedThumbnails {
+		delete(c.data, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.data[id] = data
+	c.order = append(c.order, id)
+}
+
+var shareTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Name}} - Sync-It</title>
+    <meta property="og:type" content="website">
+    <meta property="og:site_name" content="Sync-It">
+    <meta property="og:title" content="{{.Name}}">
+    <meta property="og:description" content="{{.Description}}">
+    <meta property="og:url" content="{{.ShareURL}}">
+    <meta name="twitter:title" content="{{.Name}}">
+    <meta name="twitter:description" content="{{.Description}}">
+{{- if .ThumbnailURL}}
+    <meta property="og:image" content="{{.ThumbnailURL}}">
+    <meta name="twitter:card" content="summary_large_image">
+    <meta name="twitter:image" content="{{.ThumbnailURL}}">
+{{- else}}
+    <meta name="twitter:card" content="summary">
+{{- end}}
+    <link rel="stylesheet" href="{{.BasePath}}/style.css">
+</head>
+<body>
+    <div class="container share-page">
+        <header>
+            <h1>Sync-It</h1>
+        </header>
+        <main class="file-item">
+            <div class="file-info">
+                <div class="file-name">{{.Name}}</div>
+                <div class="file-meta">{{.Description}}</div>
+            </div>
+            <div class="file-actions">
+                <a href="{{.DownloadURL}}" class="download-btn" download>Download</a>
+{{- if .WebURL}}
+                <a href="{{.WebURL}}" class="share-btn" download>Web version</a>
+{{- end}}
+{{- if .OriginalURL}}
+                <a href="{{.OriginalURL}}" class="share-btn" download>Original</a>
+{{- end}}
+            </div>
+        </main>
+{{- if .ThumbnailURL}}
+        <img class="share-preview" src="{{.ThumbnailURL}}" alt="{{.Name}}">
+{{- end}}
+    </div>
+</body>
+</html>
+`))
+
+type sharePage struct {
+	Name         string
+	Description  string
+	ShareURL     string
+	DownloadURL  string
+	OriginalURL  string
+	WebURL       string
+	ThumbnailURL string
+	BasePath     string
+}
+
+func shareURL(meta *FileMetadata) string {
+	return publicBaseURL() + "/s/" + meta.ID + roomQuery(meta)
+}
+
+func thumbnailURL(meta *FileMetadata) string {
+	return publicBaseURL() + "/api/thumbnail/" + meta.ID + roomQuery(meta)
+}
+
+// roomQuery is the ?room= a link to a file in a room needs to find it.
+func roomQuery(meta *FileMetadata) string {
+	if meta.Room == "" {
+		return ""
+	}
+	return "?room=" + url.QueryEscape(meta.Room)
+}
+
+// shareTimeFormat is how rendered pages show times, in the zone named by
+// their ?tz= parameter.
+const shareTimeFormat = "Jan 2, 2006 15:04 MST"
+
+// requestLocation returns the IANA time zone named by ?tz=, e.g.
+// "Europe/Berlin", or the server's own zone when there is none or it is
+// unknown.
+func requestLocation(r *http.Request) *time.Location {
+	if name := r.URL.Query().Get("tz"); name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc
+		}
+	}
+	return time.Local
+}
+
+func formatSize(bytes int64) string {
+	const k = 1024
+	if bytes < k {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	units := []string{"KB", "MB", "GB", "TB"}
+	value := float64(bytes) / k
+	i := 0
+	for value >= k && i < len(units)-1 {
+		value /= k
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[i])
+}
+
+func isImageName(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// hasPreview reports whether a thumbnail can be made for meta, either from
+// the file itself or from its JPEG rendition.
+func hasPreview(meta *FileMetadata) bool {
+	return isImageName(meta.Name) || meta.Rendition("jpeg") != nil
+}
+
+func handleSharePage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/s/")
+	meta, _, err := storage.GetFile(id)
+	if err != nil || !inRoom(meta, room) {
+		fileNotFound(w, r)
+		return
+	}
+	if meta.expired(time.Now()) {
+		fileExpired(w, r, meta)
+		return
+	}
+	if meta.Quarantined {
+		fileQuarantined(w, r, meta)
+		return
+	}
+	if meta.embargoed(time.Now()) {
+		fileEmbargoed(w, r, meta)
+		return
+	}
+
+	description := formatSize(meta.Size)
+	if !meta.ExpiresAt.IsZero() {
+		description += " · expires " + meta.ExpiresAt.In(requestLocation(r)).Format(shareTimeFormat)
+	}
+	page := sharePage{
+		Name:        meta.Name,
+		Description: description,
+		ShareURL:    shareURL(meta),
+		DownloadURL: downloadURL(meta),
+		BasePath:    basePath,
+	}
+	if jpeg := meta.Rendition("jpeg"); jpeg != nil {
+		// Offer the copy every device can open
+		page.DownloadURL = renditionURL(meta, jpeg)
+		page.OriginalURL = downloadURL(meta)
+	}
+	if web := meta.Rendition("web"); web != nil {
+		page.WebURL = renditionURL(meta, web)
+	}
+	if hasPreview(meta) {
+		page.ThumbnailURL = thumbnailURL(meta)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := shareTemplate.Execute(w, page); err != nil {
+		slog.Error("Failed to render share page", "id", id, "error", err)
+	}
+}
+
+// scaleImage resizes src with nearest-neighbour sampling so its longest side
+// is at most maxSize.
+func scaleImage(src image.Image, maxSize int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSize && h <= maxSize {
+		return src
+	}
+
+	var dw, dh int
+	if w >= h {
+		dw, dh = maxSize, max(1, h*maxSize/w)
+	} else {
+		dw, dh = max(1, w*maxSize/h), maxSize
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy := b.Min.Y + y*h/dh
+		for x := 0; x < dw; x++ {
+			dst.Set(x, y, src.At(b.Min.X+x*w/dw, sy))
+		}
+	}
+	return dst
+}
+
+func handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/thumbnail/")
+	meta, _, err := storage.GetFile(id)
+	now := time.Now()
+	if err != nil || !inRoom(meta, room) || !hasPreview(meta) || meta.expired(now) || meta.Quarantined || meta.embargoed(now) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	data, ok := thumbnails.Get(id)
+	if !ok {
+		if data, err = makeThumbnail(meta); err != nil {
+			slog.Warn("Thumbnail not available", "id", id, "error", err)
+			http.Error(w, "Thumbnail not available", http.StatusNotFound)
+			return
+		}
+		thumbnails.Put(id, data)
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(data)
+}
+
+// makeThumbnail scales the image, or its JPEG rendition, down to
+// thumbnailSize. Images too large to decode safely are refused.
+func makeThumbnail(meta *FileMetadata) ([]byte, error) {
+	open := func() (io.ReadCloser, error) { return storage.OpenRendition(meta.ID, "jpeg") }
+	if isImageName(meta.Name) {
+		open = func() (io.ReadCloser, error) { return storage.OpenBlob(meta.ID) }
+	}
+
+	f, err := open()
+	if err != nil {
+		return nil, err
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxDecodePixels {
+		return nil, fmt.Errorf("image is %dx%d, too large to decode", cfg.Width, cfg.Height)
+	}
+
+	if f, err = open(); err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleImage(img, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
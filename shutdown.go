@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// What happens to files when the server shuts down. Files marked to be kept
+// across restarts survive clear-all too.
+const (
+	shutdownKeepAll      = "keep-all"
+	shutdownClearExpired = "clear-expired-only"
+	shutdownClearAll     = "clear-all"
+)
+
+// shutdownPolicy is what shutting down does to files, from -shutdown-policy:
+// clear-all when files are cleared on startup, keep-all otherwise.
+var shutdownPolicy string
+
+// shutdownRequests carries the policy of a shutdown asked for through
+// /api/admin/shutdown to main.
+var shutdownRequests = make(chan string, 1)
+
+// keepMarker is left in -dir by a shutdown that kept files, so that the
+// next startup doesn't clear them after all. A crash leaves none, and so
+// still starts afresh.
+const keepMarker = "keep-on-startup"
+
+func validShutdownPolicy(policy string) bool {
+	return policy == shutdownKeepAll || policy == shutdownClearExpired || policy == shutdownClearAll
+}
+
+// clearsOnRestart reports whether restarting removes files not marked to be
+// kept, for the web UI to offer marking them.
+func clearsOnRestart() bool {
+	return ephemeral && shutdownPolicy == shutdownClearAll
+}
+
+// applyShutdownPolicy does what policy says with the stored files.
+func applyShutdownPolicy(policy string) {
+	switch policy {
+	case shutdownClearAll:
+		if err := storage.ClearAllFiles(); err != nil {
+			slog.Warn("Failed to clear files on shutdown", "error", err)
+		}
+		return
+	case shutdownClearExpired:
+		runCleanup()
+	}
+	if ephemeral {
+		if err := writeFileAtomic(filepath.Join(storage.dir, keepMarker), []byte(policy+"\n"), 0644); err != nil {
+			slog.Warn("Failed to keep files for the next startup", "error", err)
+			return
+		}
+	}
+	slog.Info("Keeping files for the next startup", "policy", policy)
+}
+
+// keptAtShutdown reports whether the last shutdown kept the files, and
+// consumes its marker.
+func keptAtShutdown() bool {
+	err := os.Remove(filepath.Join(storage.dir, keepMarker))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("Failed to remove startup marker", "error", err)
+	}
+	return err == nil
+}
+
+type ShutdownResponse struct {
+	Policy string `json:"policy"`
+}
+
+// handleShutdown reports the shutdown policy (GET /api/admin/shutdown) or
+// shuts the server down (POST) with {"policy": "keep-all"}, say, to restart
+// it with other flags without losing files; without a policy the
+// -shutdown-policy one applies.
+func handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can shut the server down", http.StatusForbidden)
+		return
+	}
+
+	resp := ShutdownResponse{Policy: shutdownPolicy}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Policy string `json:"policy"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Policy != "" {
+		if !validShutdownPolicy(req.Policy) {
+			http.Error(w, "policy must be keep-all, clear-expired-only or clear-all", http.StatusBadRequest)
+			return
+		}
+		if cluster != nil && req.Policy == shutdownClearAll {
+			http.Error(w, "clear-all would remove the files of the whole cluster", http.StatusBadRequest)
+			return
+		}
+		resp.Policy = req.Policy
+	}
+
+	select {
+	case shutdownRequests <- resp.Policy:
+	default:
+		http.Error(w, "Already shutting down", http.StatusConflict)
+		return
+	}
+	slog.Warn("Shutdown requested", "policy", resp.Policy, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// A burn rate this high on both windows spends 2% of a 30-day error
+	// budget in an hour, the usual threshold for paging someone.
+	sloBurnAlert = 14.4
+
+	// SLOs aren't judged on fewer requests than this in the short window,
+	// so one slow request on an idle server doesn't raise an alert.
+	sloMinRequests = 10
+
+	sloShortWindow = 5 * time.Minute
+	sloLongWindow  = time.Hour
+)
+
+// SLO is an objective such as "99% of downloads start within 200ms": the
+// share of requests to Route that must respond without a server error and
+// start their response within Threshold.
+type SLO struct {
+	Route     string
+	Threshold time.Duration
+	Target    float64 // fraction, e.g. 0.99
+
+	// Per-minute counts for the last hour, indexed by minute modulo their
+	// number. Guarded by RequestStats.mu.
+	minutes [60]sloMinute
+	burning bool
+}
+
+type sloMinute struct {
+	minute      int64
+	good, total uint64
+}
+
+// parseSLOs reads objectives such as "/api/download/=200ms@99%", comma
+// separated. Routes are the patterns listed at /api/admin/slo.
+func parseSLOs(s string) ([]*SLO, error) {
+	var slos []*SLO
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		route, objective, ok := strings.Cut(entry, "=")
+		threshold, target, ok2 := strings.Cut(objective, "@")
+		if !ok || !ok2 || !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("invalid SLO %q (use e.g. /api/download/=200ms@99%%)", entry)
+		}
+		d, err := time.ParseDuration(threshold)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid SLO latency %q", threshold)
+		}
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(target, "%"), 64)
+		if err != nil || pct <= 0 || pct >= 100 {
+			return nil, fmt.Errorf("invalid SLO target %q (use a percentage below 100)", target)
+		}
+		slos = append(slos, &SLO{Route: route, Threshold: d, Target: pct / 100})
+	}
+	return slos, nil
+}
+
+// SetSLOs replaces the objectives requests are measured against.
+func (s *RequestStats) SetSLOs(slos []*SLO) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.slos = slos
+}
+
+func (o *SLO) record(now time.Time, good bool) {
+	minute := now.Unix() / 60
+	m := &o.minutes[minute%int64(len(o.minutes))]
+	if m.minute != minute {
+		*m = sloMinute{minute: minute}
+	}
+	m.total++
+	if good {
+		m.good++
+	}
+}
+
+// SLOWindow is how an objective fared over one window.
+type SLOWindow struct {
+	Requests uint64  `json:"requests"`
+	Good     uint64  `json:"good"`
+	Ratio    float64 `json:"ratio"`    // share of good requests, 1 when idle
+	BurnRate float64 `json:"burnRate"` // error budget spend, 1 = exactly on target
+}
+
+func (o *SLO) window(now time.Time, d time.Duration) SLOWindow {
+	current := now.Unix() / 60
+	oldest := current - int64(d/time.Minute) + 1
+
+	var w SLOWindow
+	for _, m := range o.minutes {
+		if m.minute >= oldest && m.minute <= current {
+			w.Requests += m.total
+			w.Good += m.good
+		}
+	}
+	w.Ratio = 1
+	if w.Requests > 0 {
+		w.Ratio = float64(w.Good) / float64(w.Requests)
+		w.BurnRate = (1 - w.Ratio) / (1 - o.Target)
+	}
+	return w
+}
+
+// SLOStatus is an objective's evaluation, for the admin API.
+type SLOStatus struct {
+	Route            string    `json:"route"`
+	ThresholdSeconds float64   `json:"thresholdSeconds"`
+	Target           float64   `json:"target"`
+	Short            SLOWindow `json:"last5m"`
+	Long             SLOWindow `json:"last1h"`
+
+	// Status is "ok"; "at-risk" when the last hour spent error budget
+	// faster than the target allows; or "burning" when both windows burn
+	// fast enough to alert on.
+	Status string `json:"status"`
+}
+
+func (o *SLO) evaluate(now time.Time) SLOStatus {
+	status := SLOStatus{
+		Route:            o.Route,
+		ThresholdSeconds: o.Threshold.Seconds(),
+		Target:           o.Target,
+		Short:            o.window(now, sloShortWindow),
+		Long:             o.window(now, sloLongWindow),
+		Status:           "ok",
+	}
+	switch {
+	case status.Short.Requests >= sloMinRequests && status.Short.BurnRate >= sloBurnAlert && status.Long.BurnRate >= sloBurnAlert:
+		status.Status = "burning"
+	case status.Long.BurnRate > 1:
+		status.Status = "at-risk"
+	}
+	return status
+}
+
+// EvaluateSLOs returns every objective's status.
+func (s *RequestStats) EvaluateSLOs(now time.Time) []SLOStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]SLOStatus, len(s.slos))
+	for i, slo := range s.slos {
+		statuses[i] = slo.evaluate(now)
+	}
+	return statuses
+}
+
+// CheckSLOs raises an alert when an objective starts burning its error
+// budget, and again only once it has recovered and starts burning again.
+func (a *Alerter) CheckSLOs() {
+	now := time.Now()
+	var burning []SLOStatus
+
+	requestStats.mu.Lock()
+	for _, slo := range requestStats.slos {
+		status := slo.evaluate(now)
+		if status.Status == "burning" && !slo.burning {
+			burning = append(burning, status)
+		}
+		slo.burning = status.Status == "burning"
+	}
+	requestStats.mu.Unlock()
+
+	for _, status := range burning {
+		a.raise(Alert{
+			Type: AlertSLOBurn,
+			Message: fmt.Sprintf("%s is missing its objective of %g%% within %s: %.1f%% good over 5m, %.1f%% over 1h (burn rate %.1f)",
+				status.Route, status.Target*100, time.Duration(status.ThresholdSeconds*float64(time.Second)), status.Short.Ratio*100, status.Long.Ratio*100, status.Short.BurnRate),
+			Route:    status.Route,
+			BurnRate: status.Short.BurnRate,
+		})
+	}
+}
+
+type SLOResponse struct {
+	Objectives []SLOStatus    `json:"objectives"`
+	Routes     []RouteSummary `json:"routes"`
+}
+
+// handleSLOs reports the objectives and per-route latency: GET /api/admin/slo.
+func handleSLOs(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can see latency objectives", http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SLOResponse{
+		Objectives: requestStats.EvaluateSLOs(time.Now()),
+		Routes:     requestStats.Summaries(),
+	})
+}
+
+// writeSLOMetrics writes each objective's burn rate per window, and its
+// target, in the Prometheus text format.
+func (s *RequestStats) writeSLOMetrics(w io.Writer) {
+	statuses := s.EvaluateSLOs(time.Now())
+	if len(statuses) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP sync_it_slo_burn_rate Error budget burn rate; 1 spends it exactly on target.\n# TYPE sync_it_slo_burn_rate gauge\n")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "sync_it_slo_burn_rate{route=%q,window=\"5m\"} %g\n", st.Route, st.Short.BurnRate)
+		fmt.Fprintf(w, "sync_it_slo_burn_rate{route=%q,window=\"1h\"} %g\n", st.Route, st.Long.BurnRate)
+	}
+	fmt.Fprintf(w, "# HELP sync_it_slo_target Share of requests the objective expects to be good.\n# TYPE sync_it_slo_target gauge\n")
+	for _, st := range statuses {
+		fmt.Fprintf(w, "sync_it_slo_target{route=%q} %g\n", st.Route, st.Target)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshotDir holds snapshots inside -dir. Each is a directory with a
+// snapshot.json of every file's metadata and hard links to their contents,
+// laid out as in -dir, so taking one copies nothing and costs no space until
+// the files it captured are removed from the store.
+const snapshotDir = ".snapshots"
+
+var (
+	errNoSnapshots      = errors.New("snapshots need local storage")
+	errSnapshotNotFound = errors.New("snapshot not found")
+)
+
+type Snapshot struct {
+	ID        string         `json:"id"`
+	CreatedAt time.Time      `json:"createdAt"`
+	Files     []FileMetadata `json:"files"`
+}
+
+// SnapshotInfo describes a snapshot without listing its files.
+type SnapshotInfo struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Files     int       `json:"files"`
+	Size      int64     `json:"size"`
+}
+
+func (s *Snapshot) info() SnapshotInfo {
+	info := SnapshotInfo{ID: s.ID, CreatedAt: s.CreatedAt, Files: len(s.Files)}
+	for _, meta := range s.Files {
+		info.Size += meta.Size
+	}
+	return info
+}
+
+type RollbackResult struct {
+	Files    int `json:"files"`
+	Restored int `json:"restored"` // files that had been deleted since
+	Removed  int `json:"removed"`  // files added since
+}
+
+func (fs *FileStorage) snapshotPath(id string, parts ...string) string {
+	return filepath.Join(append([]string{fs.dir, snapshotDir, id}, parts...)...)
+}
+
+func validSnapshotID(id string) bool {
+	return id != "" && strings.Trim(id, "0123456789-") == ""
+}
+
+// Snapshot captures the metadata of every file, including deleted ones
+// still in the trash, and links their contents into a new snapshot.
+func (fs *FileStorage) Snapshot() (*Snapshot, error) {
+	local, ok := fs.blobs.(dirBlobStore)
+	if !ok {
+		return nil, errNoSnapshots
+	}
+
+	// Read-locked: links are quick, and nothing can be removed meanwhile
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	now := time.Now()
+	id := now.UTC().Format("20060102-150405")
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(fs.snapshotPath(id)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		id = fmt.Sprintf("%s-%d", now.UTC().Format("20060102-150405"), n)
+	}
+	dest := dirBlobStore{dir: fs.snapshotPath(id)}
+	if err := os.MkdirAll(dest.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{ID: id, CreatedAt: now, Files: []FileMetadata{}}
+	for _, meta := range fs.files {
+		err := linkBlob(local, dest, meta.blobName())
+		if errors.Is(err, os.ErrNotExist) {
+			// Contents already released, waiting for a download to finish
+			continue
+		}
+		if err != nil {
+			os.RemoveAll(dest.dir)
+			return nil, fmt.Errorf("failed to link %s: %w", meta.ID, err)
+		}
+		renditions := []Rendition{}
+		for _, r := range meta.Renditions {
+			if linkBlob(local, dest, renditionBlob(meta.ID, r.Key)) == nil {
+				renditions = append(renditions, r)
+			}
+		}
+		if meta.Renditions != nil {
+			meta.Renditions = renditions
+		}
+		snap.Files = append(snap.Files, meta)
+	}
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(filepath.Join(dest.dir, "snapshot.json"), data, 0644)
+	}
+	if err != nil {
+		os.RemoveAll(dest.dir)
+		return nil, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// linkBlob hard-links blob from src into dest unless it is there already.
+func linkBlob(src, dest dirBlobStore, blob string) error {
+	path := dest.LocalPath(blob)
+	if _, err := os.Lstat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.Link(src.LocalPath(blob), path)
+}
+
+func (fs *FileStorage) loadSnapshot(id string) (*Snapshot, error) {
+	if !validSnapshotID(id) {
+		return nil, errSnapshotNotFound
+	}
+	data, err := os.ReadFile(fs.snapshotPath(id, "snapshot.json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errSnapshotNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %w", id, err)
+	}
+	return &snap, nil
+}
+
+// ListSnapshots returns the snapshots taken, newest first.
+func (fs *FileStorage) ListSnapshots() ([]SnapshotInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(fs.dir, snapshotDir))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	result := []SnapshotInfo{}
+	for _, e := range entries {
+		snap, err := fs.loadSnapshot(e.Name())
+		if err != nil {
+			// Cut short while being taken
+			continue
+		}
+		result = append(result, snap.info())
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.After(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+// DeleteSnapshot removes a snapshot, and with it the contents only it
+// still held on to.
+func (fs *FileStorage) DeleteSnapshot(id string) error {
+	if _, err := fs.loadSnapshot(id); err != nil {
+		return err
+	}
+	return os.RemoveAll(fs.snapshotPath(id))
+}
+
+// Rollback puts the store back as it was when snapshot id was taken: files
+// deleted since come back, linked from the snapshot where their contents
+// are gone, and files added since are removed. Files that would have
+// expired by now get the default expiration from now on instead, so undoing
+// a mistake doesn't just have them expire again at the next cleanup.
+func (fs *FileStorage) Rollback(id string) (RollbackResult, error) {
+	local, ok := fs.blobs.(dirBlobStore)
+	if !ok {
+		return RollbackResult{}, errNoSnapshots
+	}
+	snap, err := fs.loadSnapshot(id)
+	if err != nil {
+		return RollbackResult{}, err
+	}
+	src := dirBlobStore{dir: fs.snapshotPath(id)}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return RollbackResult{}, err
+	}
+	defer unlock()
+
+	for _, meta := range snap.Files {
+		if err := linkBlob(src, local, meta.blobName()); err != nil {
+			return RollbackResult{}, fmt.Errorf("failed to restore %s: %w", meta.ID, err)
+		}
+		for _, r := range meta.Renditions {
+			if err := linkBlob(src, local, renditionBlob(meta.ID, r.Key)); err != nil {
+				return RollbackResult{}, fmt.Errorf("failed to restore %s: %w", meta.ID, err)
+			}
+		}
+	}
+
+	now := time.Now()
+	live := map[string]bool{}
+	for _, meta := range fs.files {
+		live[meta.ID] = !meta.deleted()
+	}
+	result := RollbackResult{Files: len(snap.Files)}
+	kept := map[string]bool{}
+	for i := range snap.Files {
+		meta := &snap.Files[i]
+		kept[meta.ID] = true
+		if !live[meta.ID] && !meta.deleted() {
+			result.Restored++
+		}
+		if !meta.deleted() && now.After(meta.ExpiresAt) {
+			meta.ExpiresAt = now.Add(defaultExpiration)
+		}
+	}
+	var removed []FileMetadata
+	for _, meta := range fs.files {
+		if !kept[meta.ID] {
+			removed = append(removed, meta)
+		}
+	}
+	result.Removed = len(removed)
+
+	prev := fs.files
+	fs.files = snap.Files
+	if err := fs.commit(snap.Files, fileIDs(removed)); err != nil {
+		fs.files = prev
+		return RollbackResult{}, err
+	}
+	fs.releaseBlobs(removed)
+
+	return result, nil
+}
+
+// handleSnapshots takes a snapshot (POST /api/admin/snapshot), lists them
+// (GET) and removes one (DELETE /api/admin/snapshot/{id}).
+func handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can manage snapshots", http.StatusForbidden)
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/admin/snapshot"), "/")
+
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		snap, err := storage.Snapshot()
+		if errors.Is(err, errNoSnapshots) {
+			http.Error(w, "Snapshots need local storage, not S3 or -storage memory", http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to take snapshot", "error", err)
+			http.Error(w, "Failed to take snapshot", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Snapshot taken", "id", snap.ID, "files", len(snap.Files), "client", clientIP(r))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(snap.info())
+	case id == "" && r.Method == http.MethodGet:
+		snapshots, err := storage.ListSnapshots()
+		if err != nil {
+			slog.Error("Failed to list snapshots", "error", err)
+			http.Error(w, "Failed to list snapshots", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]SnapshotInfo{"snapshots": snapshots})
+	case id != "" && r.Method == http.MethodDelete:
+		err := storage.DeleteSnapshot(id)
+		if errors.Is(err, errSnapshotNotFound) {
+			http.Error(w, "Snapshot not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to delete snapshot", "id", id, "error", err)
+			http.Error(w, "Failed to delete snapshot", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Snapshot deleted", "id", id, "client", clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRollback restores a snapshot: POST /api/admin/rollback/{id}.
+func handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !isAdminRequest(r) {
+		http.Error(w, "Only an admin can roll back", http.StatusForbidden)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/admin/rollback/")
+	result, err := storage.Rollback(id)
+	switch {
+	case errors.Is(err, errSnapshotNotFound):
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return
+	case errors.Is(err, errNoSnapshots):
+		http.Error(w, "Snapshots need local storage, not S3 or -storage memory", http.StatusNotImplemented)
+		return
+	case err != nil:
+		slog.Error("Failed to roll back", "snapshot", id, "error", err)
+		http.Error(w, "Failed to roll back", http.StatusInternalServerError)
+		return
+	}
+	slog.Warn("Rolled back to snapshot", "snapshot", id, "files", result.Files, "restored", result.Restored, "removed", result.Removed, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSpeedtestSize = 25 << 20 // 25 MB
+	maxSpeedtestSize     = 1 << 30  // 1 GB
+)
+
+// speedtestBlock is random so transparent compression on the path can't
+// inflate the measurement; it is repeated to fill larger downloads.
+var speedtestBlock = sync.OnceValue(func() []byte {
+	block := make([]byte, 1<<20)
+	rand.Read(block)
+	return block
+})
+
+type SpeedtestResult struct {
+	Bytes      int64   `json:"bytes"`
+	DurationMs int64   `json:"durationMs"`
+	Mbps       float64 `json:"mbps"`
+}
+
+func handleSpeedtest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch r.Method {
+	case http.MethodGet:
+		size := int64(defaultSpeedtestSize)
+		if s := r.URL.Query().Get("size"); s != "" {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || n < 1 || n > maxSpeedtestSize {
+				http.Error(w, "size must be between 1 and 1073741824 bytes", http.StatusBadRequest)
+				return
+			}
+			size = n
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+
+		block := speedtestBlock()
+		for remaining := size; remaining > 0; {
+			n := min(remaining, int64(len(block)))
+			if _, err := w.Write(block[:n]); err != nil {
+				return
+			}
+			remaining -= n
+		}
+
+	case http.MethodPost:
+		start := time.Now()
+		n, err := io.Copy(io.Discard, http.MaxBytesReader(w, r.Body, maxSpeedtestSize))
+		if err != nil {
+			http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		elapsed := time.Since(start)
+
+		result := SpeedtestResult{Bytes: n, DurationMs: elapsed.Milliseconds()}
+		if elapsed > 0 {
+			result.Mbps = float64(n*8) / elapsed.Seconds() / 1e6
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
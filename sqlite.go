@@ -0,0 +1,9 @@
+//go:build sqlite
+
+package main
+
+// Links a pure-Go SQLite driver for -metadata-db. Add it to go.mod first:
+//
+//	go get modernc.org/sqlite
+//	go build -tags sqlite -o sync-it
+import _ "modernc.org/sqlite"
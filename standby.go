@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// standbySettle is how long after a file changes the standby copy is
+// updated, so a burst of uploads is mirrored in one pass.
+const standbySettle = 10 * time.Second
+
+// StandbyReport is the outcome of one pass over the standby copy.
+type StandbyReport struct {
+	StartedAt   time.Time `json:"startedAt"`
+	FinishedAt  time.Time `json:"finishedAt,omitzero"`
+	Files       int       `json:"files"`
+	Copied      int       `json:"copied"`
+	CopiedBytes int64     `json:"copiedBytes"`
+	Removed     int       `json:"removed"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Standby keeps a warm copy of the store in another directory, typically on
+// a removable drive: the stored blobs, laid out as in -dir, and a
+// metadata.json describing them, so the drive can be pulled at any time
+// and served with -dir pointing at it. Passes are incremental: blobs are
+// content-addressed, so only new ones are copied and ones no longer
+// referenced are removed.
+type Standby struct {
+	dir      string
+	interval time.Duration
+	kick     chan struct{}
+
+	mu      sync.Mutex
+	running bool
+	again   bool // asked for while running
+	last    *StandbyReport
+}
+
+// standby is nil unless -standby-dir is set.
+var standby *Standby
+
+func NewStandby(dir string, interval time.Duration) *Standby {
+	return &Standby{dir: dir, interval: interval, kick: make(chan struct{}, 1)}
+}
+
+// handleEvent schedules a pass when files change.
+func (s *Standby) handleEvent(e Event) {
+	if e.File == nil && len(e.Files) == 0 {
+		return
+	}
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run brings the copy up to date at startup, shortly after files change and
+// every interval in case a change was missed, until stop is closed.
+func (s *Standby) Run(stop <-chan bool) {
+	s.Start()
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.Start()
+		case <-s.kick:
+			select {
+			case <-time.After(standbySettle):
+				s.Start()
+			case <-stop:
+				return
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Start begins a pass in the background. If one is already running another
+// follows it, so changes made during a pass aren't missed.
+func (s *Standby) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		s.again = true
+		return
+	}
+	s.running = true
+	go func() {
+		for {
+			report := s.sync()
+			s.mu.Lock()
+			s.last = &report
+			if !s.again {
+				s.running = false
+				s.mu.Unlock()
+				return
+			}
+			s.again = false
+			s.mu.Unlock()
+		}
+	}()
+}
+
+func (s *Standby) sync() StandbyReport {
+	s.mu.Lock()
+	var lastError string
+	if s.last != nil {
+		lastError = s.last.Error
+	}
+	s.mu.Unlock()
+
+	report := StandbyReport{StartedAt: time.Now()}
+	if err := s.update(&report); err != nil {
+		report.Error = err.Error()
+		// Once per outage, not on every pass while the drive is unplugged
+		if report.Error != lastError {
+			slog.Warn("Failed to update standby copy", "dir", s.dir, "error", err)
+		}
+	} else if report.Copied > 0 || report.Removed > 0 {
+		slog.Info("Standby copy updated", "dir", s.dir, "files", report.Files, "copied", report.Copied, "size", formatSize(report.CopiedBytes), "removed", report.Removed)
+	}
+	report.FinishedAt = time.Now()
+	return report
+}
+
+// update copies the blobs of every file missing from the standby directory,
+// then replaces its metadata.json, and only then removes the blobs the new
+// metadata no longer refers to, so the copy is whole at every step.
+func (s *Standby) update(report *StandbyReport) error {
+	// Not created when missing: that is what an unplugged drive looks like
+	if info, err := os.Stat(s.dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("standby directory isn't available")
+	}
+	dest := dirBlobStore{dir: s.dir}
+
+	files := []FileMetadata{}
+	wanted := map[string]bool{}
+	for _, meta := range storage.allFiles() {
+		if meta.deleted() && !meta.Trashed {
+			// On its way out
+			continue
+		}
+		ok, err := s.copyBlob(dest, meta.blobName(), report)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// Removed since the list was taken
+			continue
+		}
+		wanted[meta.blobName()] = true
+
+		renditions := []Rendition{}
+		for _, r := range meta.Renditions {
+			blob := renditionBlob(meta.ID, r.Key)
+			ok, err := s.copyBlob(dest, blob, report)
+			if err != nil {
+				return err
+			}
+			if ok {
+				wanted[blob] = true
+				renditions = append(renditions, r)
+			}
+		}
+		if meta.Renditions != nil {
+			meta.Renditions = renditions
+		}
+		files = append(files, meta)
+	}
+	report.Files = len(files)
+
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal metadata: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, "metadata.json"), data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	present, err := dest.List()
+	if err != nil {
+		return err
+	}
+	for _, name := range present {
+		if wanted[name] {
+			continue
+		}
+		if err := dest.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		report.Removed++
+	}
+
+	// Left by passes cut short
+	partials, err := dest.Partials()
+	if err != nil {
+		return err
+	}
+	for _, name := range partials {
+		os.Remove(dest.LocalPath(name))
+	}
+	return nil
+}
+
+// copyBlob copies blob, as stored, into dest unless an up-to-date copy is
+// already there. It returns false when the blob no longer exists.
+func (s *Standby) copyBlob(dest dirBlobStore, blob string, report *StandbyReport) (bool, error) {
+	path := dest.LocalPath(blob)
+	if info, err := os.Stat(path); err == nil && copyCurrent(blob, info) {
+		return true, nil
+	}
+
+	// Keeps the blob from being removed while it is copied
+	done := storage.BeginRead(blob)
+	defer done()
+	src, err := storage.blobs.Open(blob)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	// A pass cut short by pulling the drive leaves a partial file at worst
+	dst, err := dest.Create(blob)
+	if err != nil {
+		return false, err
+	}
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		dst.Abort()
+		return false, fmt.Errorf("failed to copy %s: %w", blob, err)
+	}
+	if err := dst.Close(); err != nil {
+		return false, fmt.Errorf("failed to copy %s: %w", blob, err)
+	}
+	report.Copied++
+	report.CopiedBytes += n
+	return true, nil
+}
+
+// copyCurrent reports whether copied, the standby's file for blob, still
+// matches the original. Content-addressed blobs never change, but renditions
+// are replaced under the same name, so local originals are compared by size
+// and age; remote ones can't be checked cheaply and are trusted.
+func copyCurrent(blob string, copied os.FileInfo) bool {
+	path := storage.localPath(blob)
+	if path == "" {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Size() == copied.Size() && !info.ModTime().After(copied.ModTime())
+}
+
+type StandbyResponse struct {
+	Dir             string         `json:"dir"`
+	IntervalSeconds int64          `json:"intervalSeconds"`
+	Running         bool           `json:"running"`
+	Last            *StandbyReport `json:"last"`
+}
+
+// handleStandby reports the last pass over the standby copy:
+// GET /api/admin/standby. POST starts a pass now.
+func handleStandby(w http.ResponseWriter, r *http.Request) {
+	if standby == nil {
+		http.Error(w, "No standby directory configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !isAdminRequest(r) {
+			http.Error(w, "Only an admin can update the standby copy", http.StatusForbidden)
+			return
+		}
+		standby.Start()
+		slog.Info("Standby copy update requested", "client", clientIP(r))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	standby.mu.Lock()
+	resp := StandbyResponse{Dir: standby.dir, IntervalSeconds: int64(standby.interval.Seconds()), Running: standby.running, Last: standby.last}
+	standby.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -2,41 +2,176 @@ document.addEventListener('DOMContentLoaded', () => {
     const dropZone = document.getElementById('drop-zone');
     const fileInput = document.getElementById('file-input');
     const fileList = document.getElementById('file-list');
+    const downloadAll = document.getElementById('download-all');
+    const filesMore = document.getElementById('files-more');
     const serverAddress = document.getElementById('server-address');
     const uploadProgress = document.getElementById('upload-progress');
     const progressFill = uploadProgress.querySelector('.progress-fill');
     const progressText = uploadProgress.querySelector('.progress-text');
     const expirationHours = document.getElementById('expiration-hours');
+    const persistUpload = document.getElementById('persist-upload');
+    const notifyBtn = document.getElementById('notify-btn');
+
+    // Opened as ?room=CODE: only that room's files are listed and uploads go there
+    const room = new URLSearchParams(location.search).get('room');
+    const roomHeaders = room ? { 'X-Room-Code': room } : {};
+    const roomQuery = room ? `room=${encodeURIComponent(room)}` : '';
+
+    // Servers started with -pin hand out a short-lived token for the PIN.
+    // It is kept for this tab only and requested again once it expires.
+    const TOKEN_KEY = 'sync-it-token';
+
+    // An API key opened once as #key=... (e.g. on a kiosk tablet) is kept
+    // on the device and used instead of asking for the PIN.
+    const API_KEY = 'sync-it-api-key';
+    const keyParam = new URLSearchParams(location.hash.slice(1)).get('key');
+    if (keyParam) {
+        localStorage.setItem(API_KEY, keyParam);
+        history.replaceState(null, '', location.pathname + location.search);
+    }
+
+    function authHeaders() {
+        const token = sessionStorage.getItem(TOKEN_KEY) || localStorage.getItem(API_KEY);
+        return token ? { 'Authorization': `Bearer ${token}` } : {};
+    }
+
+    // Requests that fail together share one prompt
+    let pendingSignIn = null;
+    function signIn() {
+        pendingSignIn ||= promptForPIN().finally(() => { pendingSignIn = null; });
+        return pendingSignIn;
+    }
+
+    async function promptForPIN() {
+        for (let message = 'Enter the server PIN:'; ;) {
+            const pin = prompt(message);
+            if (pin === null) throw new Error('Authentication required');
+            const res = await fetch('api/bootstrap', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ pin }),
+            });
+            if (res.ok) {
+                const { token } = await res.json();
+                sessionStorage.setItem(TOKEN_KEY, token);
+                return;
+            }
+            if (res.status !== 403) throw new Error((await res.text()).trim());
+            message = 'Wrong PIN, try again:';
+        }
+    }
+
+    // fetch with the API token, asking for the PIN when the server wants one
+    async function apiFetch(url, options = {}) {
+        const send = () => fetch(url, { ...options, headers: { ...options.headers, ...authHeaders() } });
+        const res = await send();
+        if (res.status !== 401) return res;
+        sessionStorage.removeItem(TOKEN_KEY);
+        localStorage.removeItem(API_KEY);
+        await signIn();
+        return send();
+    }
 
     // Fetch and display server info
     async function loadServerInfo() {
         try {
-            const res = await fetch('/api/info');
+            const res = await fetch('api/info');
             const data = await res.json();
-            serverAddress.textContent = `http://${data.ip}:${data.port}`;
+            serverAddress.textContent = room ? `${data.url}?${roomQuery}` : data.url;
+            if (data.defaultExpirationHours) {
+                expirationHours.value = data.defaultExpirationHours;
+            }
+            if (data.minExpirationHours) {
+                expirationHours.min = data.minExpirationHours;
+            }
+            if (data.maxExpirationHours) {
+                expirationHours.max = data.maxExpirationHours;
+            }
+            if (data.clearsOnRestart) {
+                persistUpload.closest('.persist-option').classList.remove('hidden');
+            }
+            chunkedUploads = !data.inMemory;
+            maxUploadSize = data.maxUploadSize || 0;
         } catch (err) {
             serverAddress.textContent = 'Unable to load';
         }
     }
 
+    // Only the newest files are listed at first, as rendering thousands
+    // is slow; "Show more" adds another page
+    const FILES_PAGE = 200;
+    const FILES_PAGE_MAX = 1000; // the most the server lists at once
+    let filesShown = FILES_PAGE;
+    filesMore.addEventListener('click', () => {
+        filesShown += FILES_PAGE;
+        loadFiles();
+    });
+
     // Fetch and display files
     async function loadFiles() {
         try {
-            const res = await fetch('/api/files');
+            const res = await apiFetch(`api/files?limit=${Math.min(filesShown, FILES_PAGE_MAX)}`, { headers: roomHeaders });
+            if (res.status === 404 && room) {
+                fileList.innerHTML = '<p class="empty-state">This room has expired or does not exist</p>';
+                return;
+            }
+            if (res.status === 403) {
+                // An upload-only API key
+                fileList.innerHTML = `<p class="empty-state">${escapeHtml((await res.text()).trim())}</p>`;
+                return;
+            }
             const data = await res.json();
-            renderFiles(data.files);
+            while (data.nextOffset && data.files.length < filesShown) {
+                const next = await apiFetch(`api/files?offset=${data.nextOffset}&limit=${Math.min(filesShown - data.files.length, FILES_PAGE_MAX)}`, { headers: roomHeaders })
+                    .then(res => res.json());
+                data.files.push(...next.files);
+                data.nextOffset = next.nextOffset;
+            }
+            filesMore.hidden = !data.nextOffset;
+            filesMore.textContent = `Show more (${data.total - data.files.length} not shown)`;
+            const expected = await apiFetch('api/expect', { headers: roomHeaders })
+                .then(res => res.ok ? res.json() : { expected: [] })
+                .catch(() => ({ expected: [] }));
+            const pending = await apiFetch('api/pending', { headers: roomHeaders })
+                .then(res => res.ok ? res.json() : { files: [] })
+                .catch(() => ({ files: [] }));
+            renderFiles(data.files, expected.expected.filter(e => !e.fileId), pending.files);
         } catch (err) {
             fileList.innerHTML = '<p class="empty-state">Failed to load files</p>';
         }
     }
 
-    function renderFiles(files) {
-        if (!files || files.length === 0) {
+    function renderFiles(files, expected = [], pending = []) {
+        // Listed by ID so the link works without a token, like the others
+        const ids = (files || []).map(file => `id=${file.id}`);
+        downloadAll.classList.toggle('hidden', ids.length < 2);
+        downloadAll.textContent = filesMore.hidden ? 'Download all' : 'Download shown';
+        downloadAll.href = `api/download/zip?${ids.join('&')}${roomQuery ? '&' + roomQuery : ''}`;
+        if ((!files || files.length === 0) && expected.length === 0 && pending.length === 0) {
             fileList.innerHTML = '<p class="empty-state">No files uploaded yet</p>';
             return;
         }
 
-        fileList.innerHTML = files.map(file => `
+        fileList.innerHTML = pending.map(file => `
+            <div class="file-item file-pending">
+                <div class="file-info">
+                    <div class="file-name">${escapeHtml(file.name)}</div>
+                    <div class="file-meta">Waiting for approval · ${formatSize(file.size)} · ${formatDate(file.uploadedAt)}</div>
+                </div>
+                <div class="file-actions">
+                    <a href="api/download/${file.id}/${encodeURIComponent(file.name)}${roomQuery ? '?' + roomQuery : ''}" class="download-btn" download>Download</a>
+                    <button class="approve-btn" data-id="${file.id}">Approve</button>
+                    <button class="delete-btn reject-btn" data-id="${file.id}">Reject</button>
+                </div>
+            </div>
+        `).join('') + expected.map(e => `
+            <div class="file-item file-expected">
+                <div class="file-info">
+                    <div class="file-name">Waiting for ${escapeHtml(e.label || e.name || e.slug || 'an upload')}</div>
+                    <div class="file-meta">${e.size ? formatSize(e.size) + ' · ' : ''}Reserved ${formatDate(e.createdAt)} · Expires ${formatExpiration(e.expiresAt)}</div>
+                </div>
+            </div>
+        `).join('') + (files || []).map(file => `
             <div class="file-item">
                 <div class="file-icon">
                     <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2">
@@ -45,19 +180,28 @@ document.addEventListener('DOMContentLoaded', () => {
                     </svg>
                 </div>
                 <div class="file-info">
-                    <div class="file-name">${escapeHtml(file.name)}</div>
-                    <div class="file-meta">${formatSize(file.size)} · ${formatDate(file.uploadedAt)} · Expires ${formatExpiration(file.expiresAt)}</div>
+                    <div class="file-name">${escapeHtml(file.displayName || file.name)}</div>
+                    <div class="file-meta">${file.folder ? escapeHtml(file.folder) + ' · ' : ''}${formatSize(file.size)} · ${formatDate(file.uploadedAt)} · ${file.availableFrom && new Date(file.availableFrom) > new Date() ? 'Available ' + formatDate(file.availableFrom) + ' · ' : ''}${file.imported ? 'Shared from the server' : 'Expires ' + formatExpiration(file.expiresAt)}${file.quarantined ? ' · <span class="file-damaged">Damaged, upload again</span>' : ''}${formatSource(file.source)}${(file.tags || []).map(tag => ` <span class="file-tag">${escapeHtml(tag)}</span>`).join('')}</div>
                 </div>
                 <div class="file-actions">
-                    <a href="/api/download/${file.id}" class="download-btn" download>Download</a>
-                    <button class="delete-btn" data-id="${file.id}">Delete</button>
+                    <a href="s/${file.id}" class="share-btn" target="_blank">Share</a>
+                    <a href="api/download/${file.id}/${encodeURIComponent(file.name)}${roomQuery ? '?' + roomQuery : ''}" class="download-btn" download>Download</a>
+                    ${(file.renditions || []).map(r => `
+                    <a href="api/download/${file.id}/${encodeURIComponent(r.name)}?rendition=${encodeURIComponent(r.key)}${roomQuery ? '&' + roomQuery : ''}" class="download-btn" download>${escapeHtml(r.key.toUpperCase())}</a>`).join('')}
+                    ${file.imported ? '' : `<button class="delete-btn" data-id="${file.id}">Delete</button>`}
                 </div>
             </div>
         `).join('');
 
-        fileList.querySelectorAll('.delete-btn').forEach(btn => {
+        fileList.querySelectorAll('.delete-btn:not(.reject-btn)').forEach(btn => {
             btn.addEventListener('click', () => deleteFile(btn.dataset.id));
         });
+        fileList.querySelectorAll('.approve-btn').forEach(btn => {
+            btn.addEventListener('click', () => reviewFile(btn.dataset.id, 'approve'));
+        });
+        fileList.querySelectorAll('.reject-btn').forEach(btn => {
+            btn.addEventListener('click', () => reviewFile(btn.dataset.id, 'reject'));
+        });
     }
 
     function escapeHtml(text) {
@@ -66,6 +210,22 @@ document.addEventListener('DOMContentLoaded', () => {
         return div.innerHTML;
     }
 
+    // Who uploaded a file: the device name it gave, else its browser or
+    // tool and address, with the full user agent on hover
+    function formatSource(source) {
+        if (!source) return '';
+        const agent = source.userAgent || '';
+        const browser = (agent.match(/Edg|Firefox|Chrome|Safari|curl|Go-http-client|Wget/) || [])[0];
+        const os = (agent.match(/Android|iPhone|iPad|Windows|Mac OS X|Linux/) || [])[0];
+        let who = source.device;
+        if (!who) {
+            who = browser ? browser.replace('Edg', 'Edge').replace('Go-http-client', 'Go client') : 'unknown client';
+            if (os) who += ' on ' + os.replace('Mac OS X', 'macOS');
+            who += ' (' + source.ip + ')';
+        }
+        return ` · <span class="file-source" title="${escapeHtml(agent).replace(/"/g, '&quot;')}">from ${escapeHtml(who)}</span>`;
+    }
+
     function formatSize(bytes) {
         if (bytes === 0) return '0 B';
         const k = 1024;
@@ -99,47 +259,148 @@ document.addEventListener('DOMContentLoaded', () => {
         return 'in ' + Math.ceil(diff / 86400000) + ' days';
     }
 
-    // Upload file
-    async function uploadFile(file) {
+    // Files above this size go through the chunked upload API, which retries
+    // individual chunks instead of the whole file
+    const CHUNKED_THRESHOLD = 16 * 1024 * 1024;
+    const CHUNK_RETRIES = 5;
+    // Off when the server keeps files in memory and can't stage chunks
+    let chunkedUploads = true;
+    let maxUploadSize = 0;
+
+    function sendForm(file, retried = false) {
         const formData = new FormData();
         formData.append('file', file);
         formData.append('expirationHours', expirationHours.value);
+        formData.append('persistAcrossRestart', persistUpload.checked);
+
+        const xhr = new XMLHttpRequest();
+
+        xhr.upload.addEventListener('progress', (e) => {
+            if (e.lengthComputable) {
+                const percent = (e.loaded / e.total) * 100;
+                progressFill.style.width = percent + '%';
+            }
+        });
+
+        return new Promise((resolve, reject) => {
+            xhr.onload = () => {
+                if (xhr.status === 200) {
+                    resolve(JSON.parse(xhr.responseText));
+                } else if (xhr.status === 401 && !retried) {
+                    sessionStorage.removeItem(TOKEN_KEY);
+                    signIn().then(() => sendForm(file, true)).then(resolve, reject);
+                } else if ([413, 503, 507].includes(xhr.status) && xhr.responseText) {
+                    reject(new Error(xhr.responseText.trim()));
+                } else {
+                    reject(new Error('Upload failed'));
+                }
+            };
+            xhr.onerror = () => reject(new Error('Upload failed'));
+            xhr.open('POST', 'api/upload');
+            for (const [name, value] of Object.entries(authHeaders())) {
+                xhr.setRequestHeader(name, value);
+            }
+            if (room) {
+                xhr.setRequestHeader('X-Room-Code', room);
+            }
+            xhr.send(formData);
+        });
+    }
+
+    async function failure(res) {
+        const text = (await res.text()).trim();
+        return new Error([413, 503, 507].includes(res.status) && text ? text : 'Upload failed');
+    }
+
+    // Byte range of chunk n; chunks after a change of chunk size start at
+    // the offset of the segment they fall in.
+    function chunkRange(upload, n, size) {
+        const segments = upload.segments || [{ firstChunk: 0, offset: 0, chunkSize: upload.chunkSize }];
+        let seg = segments[0];
+        for (const s of segments) {
+            if (s.firstChunk <= n) seg = s;
+        }
+        const start = seg.offset + (n - seg.firstChunk) * seg.chunkSize;
+        return [start, Math.min(start + seg.chunkSize, size)];
+    }
+
+    async function sendChunked(file) {
+        let res = await apiFetch('api/uploads', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json', ...roomHeaders },
+            body: JSON.stringify({
+                name: file.name,
+                size: file.size,
+                expirationHours: parseInt(expirationHours.value, 10) || 0,
+                persistAcrossRestart: persistUpload.checked,
+            }),
+        });
+        if (!res.ok) throw await failure(res);
+        let upload = await res.json();
 
+        for (let n = 0; n < upload.totalChunks; n++) {
+            const [start, end] = chunkRange(upload, n, file.size);
+            const chunk = await file.slice(start, end).arrayBuffer();
+            const checksum = await sha256Hex(chunk);
+
+            for (let attempt = 1; ; attempt++) {
+                // Network errors, corrupted chunks (422) and server errors are retried
+                let retry = true;
+                try {
+                    res = await apiFetch(`api/uploads/${upload.id}/chunks/${n}`, {
+                        method: 'PUT',
+                        headers: { 'X-Chunk-SHA256': checksum, ...roomHeaders },
+                        body: chunk,
+                    });
+                    if (res.ok) break;
+                    retry = res.status === 422 || res.status >= 500;
+                } catch (err) {
+                    if (attempt >= CHUNK_RETRIES) throw err;
+                }
+                if (!retry || attempt >= CHUNK_RETRIES) throw await failure(res);
+                await new Promise(resolve => setTimeout(resolve, attempt * 1000));
+            }
+
+            progressFill.style.width = (end / file.size) * 100 + '%';
+
+            // Take up the chunk size the server suggests for how fast
+            // chunks are arriving; it only changes by factors of two
+            const preferred = parseInt(res.headers.get('X-Preferred-Chunk-Size'), 10);
+            if (preferred && preferred !== upload.chunkSize && n + 1 < upload.totalChunks) {
+                const resized = await apiFetch(`api/uploads/${upload.id}`, {
+                    method: 'PATCH',
+                    headers: { 'Content-Type': 'application/json', ...roomHeaders },
+                    body: JSON.stringify({ chunkSize: preferred }),
+                });
+                if (resized.ok) upload = await resized.json();
+            }
+        }
+
+        res = await apiFetch(`api/uploads/${upload.id}/complete`, { method: 'POST', headers: roomHeaders });
+        if (!res.ok) throw await failure(res);
+        return res.json();
+    }
+
+    // Upload file
+    async function uploadFile(file) {
         uploadProgress.classList.remove('hidden');
         progressFill.style.width = '0%';
         progressText.textContent = `Uploading ${file.name}...`;
 
         try {
-            const xhr = new XMLHttpRequest();
-
-            xhr.upload.addEventListener('progress', (e) => {
-                if (e.lengthComputable) {
-                    const percent = (e.loaded / e.total) * 100;
-                    progressFill.style.width = percent + '%';
-                }
-            });
-
-            await new Promise((resolve, reject) => {
-                xhr.onload = () => {
-                    if (xhr.status === 200) {
-                        resolve();
-                    } else {
-                        reject(new Error('Upload failed'));
-                    }
-                };
-                xhr.onerror = () => reject(new Error('Upload failed'));
-                xhr.open('POST', '/api/upload');
-                xhr.send(formData);
-            });
+            if (maxUploadSize && file.size > maxUploadSize) {
+                throw new Error(`${file.name} is larger than the ${formatSize(maxUploadSize)} limit`);
+            }
+            const uploaded = chunkedUploads && file.size > CHUNKED_THRESHOLD ? await sendChunked(file) : await sendForm(file);
 
-            progressText.textContent = 'Upload complete!';
+            progressText.textContent = uploaded.pending ? 'Uploaded, waiting for approval' : 'Upload complete!';
             setTimeout(() => {
                 uploadProgress.classList.add('hidden');
             }, 1500);
 
             loadFiles();
         } catch (err) {
-            progressText.textContent = 'Upload failed';
+            progressText.textContent = err.message;
             setTimeout(() => {
                 uploadProgress.classList.add('hidden');
             }, 2000);
@@ -154,7 +415,7 @@ document.addEventListener('DOMContentLoaded', () => {
 
     async function deleteFile(id) {
         try {
-            const res = await fetch(`/api/delete/${id}`, { method: 'DELETE' });
+            const res = await apiFetch(`api/delete/${id}`, { method: 'DELETE', headers: roomHeaders });
             if (res.ok) {
                 loadFiles();
             }
@@ -163,6 +424,17 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
+    async function reviewFile(id, action) {
+        try {
+            const res = await apiFetch(`api/pending/${id}/${action}`, { method: 'POST', headers: roomHeaders });
+            if (res.ok) {
+                loadFiles();
+            }
+        } catch (err) {
+            console.error('Review failed:', err);
+        }
+    }
+
     // Drag and drop handlers
     dropZone.addEventListener('dragover', (e) => {
         e.preventDefault();
@@ -195,7 +467,55 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     });
 
+    // Push notifications
+    function urlBase64ToUint8Array(base64) {
+        const padding = '='.repeat((4 - base64.length % 4) % 4);
+        const raw = atob((base64 + padding).replace(/-/g, '+').replace(/_/g, '/'));
+        return Uint8Array.from(raw, c => c.charCodeAt(0));
+    }
+
+    async function setupNotifications() {
+        if (!('serviceWorker' in navigator) || !('PushManager' in window)) return;
+
+        const registration = await navigator.serviceWorker.register('sw.js');
+        const existing = await registration.pushManager.getSubscription();
+        notifyBtn.textContent = existing ? 'Disable notifications' : 'Enable notifications';
+        notifyBtn.classList.remove('hidden');
+
+        notifyBtn.addEventListener('click', async () => {
+            try {
+                const current = await registration.pushManager.getSubscription();
+                if (current) {
+                    await apiFetch('api/push/unsubscribe', {
+                        method: 'POST',
+                        headers: { 'Content-Type': 'application/json' },
+                        body: JSON.stringify({ endpoint: current.endpoint })
+                    });
+                    await current.unsubscribe();
+                    notifyBtn.textContent = 'Enable notifications';
+                    return;
+                }
+
+                const res = await fetch('api/push/key');
+                const { publicKey } = await res.json();
+                const subscription = await registration.pushManager.subscribe({
+                    userVisibleOnly: true,
+                    applicationServerKey: urlBase64ToUint8Array(publicKey)
+                });
+                await apiFetch('api/push/subscribe', {
+                    method: 'POST',
+                    headers: { 'Content-Type': 'application/json' },
+                    body: JSON.stringify(subscription.toJSON())
+                });
+                notifyBtn.textContent = 'Disable notifications';
+            } catch (err) {
+                console.error('Notification setup failed:', err);
+            }
+        });
+    }
+
     // Initial load
     loadServerInfo();
     loadFiles();
+    setupNotifications().catch(err => console.error('Service worker registration failed:', err));
 });
@@ -0,0 +1,20 @@
+self.addEventListener('push', (event) => {
+    let data = { title: 'Sync-It', body: '', url: './' };
+    if (event.data) {
+        try {
+            data = Object.assign(data, event.data.json());
+        } catch (err) {
+            data.body = event.data.text();
+        }
+    }
+
+    event.waitUntil(self.registration.showNotification(data.title, {
+        body: data.body,
+        data: { url: data.url }
+    }));
+});
+
+self.addEventListener('notificationclick', (event) => {
+    event.notification.close();
+    event.waitUntil(clients.openWindow(event.notification.data.url));
+});
@@ -1,31 +1,196 @@
 package main
 
 import (
+	"bufio"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 )
 
 type FileMetadata struct {
-	ID         string    `json:"id"`
-	Name       string    `json:"name"`
-	Size       int64     `json:"size"`
-	UploadedAt time.Time `json:"uploadedAt"`
-	ExpiresAt  time.Time `json:"expiresAt"`
+	ID         string      `json:"id"`
+	Name       string      `json:"name"`
+	Size       int64       `json:"size"`
+	UploadedAt time.Time   `json:"uploadedAt"`
+	ExpiresAt  time.Time   `json:"expiresAt,omitzero"` // zero for files that never expire
+	Renditions []Rendition `json:"renditions,omitempty"`
+	Room       string      `json:"room,omitempty"`
+
+	// Folder places the file in a folder such as "/photos/2024"; empty is
+	// the top level.
+	Folder string `json:"folder,omitempty"`
+
+	// Tags are lowercase labels for grouping files, e.g. "invoices".
+	Tags []string `json:"tags,omitempty"`
+
+	// Metadata is whatever key/value pairs the uploader attached, such as
+	// a build number or device name; the server doesn't interpret it.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Uploader identifies the client that uploaded the file, for
+	// per-client quotas; it is an opaque hash, not an address.
+	Uploader string `json:"uploader,omitempty"`
+
+	// Source records where the upload came from, so it's clear whose
+	// files are filling the disk.
+	Source *UploadSource `json:"source,omitempty"`
+
+	// Pending holds a guest's upload back from listings and downloads
+	// until an admin approves it, with -approve-uploads.
+	Pending bool `json:"pending,omitempty"`
+
+	// Persist keeps the file when the server clears everything on
+	// startup and shutdown, as it does without -cluster or S3.
+	Persist bool `json:"persistAcrossRestart,omitempty"`
+
+	// SHA256 is the hex digest of the contents. Files with a digest are
+	// stored under it, so identical uploads share one blob.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Compression names the codec the blob was compressed with, and
+	// StoredSize is how much space it takes; both are empty when the
+	// contents are stored as they are.
+	Compression string `json:"compression,omitempty"`
+	StoredSize  int64  `json:"storedSize,omitempty"`
+
+	// AvailableFrom holds a file back until then: it is listed, but can't
+	// be downloaded or previewed. Its expiration counts from then too.
+	AvailableFrom time.Time `json:"availableFrom,omitzero"`
+
+	// Quarantined is set when the integrity scrub found the stored
+	// contents no longer match SHA256. Such files aren't served.
+	Quarantined bool `json:"quarantined,omitempty"`
+
+	// LastDownloadedAt is when the file was last downloaded, for evicting
+	// the least recently used files when disk space runs low.
+	LastDownloadedAt time.Time `json:"lastDownloadedAt,omitzero"`
+
+	// DeletedAt is when the file was deleted or expired, if it is being
+	// kept for the delete grace period before its contents are removed.
+	DeletedAt time.Time `json:"deletedAt,omitzero"`
+
+	// Trashed marks a deleted file as in the trash rather than expired, so
+	// it can still be restored until it is purged.
+	Trashed bool `json:"trashed,omitempty"`
+
+	// Imported files are served in place from a directory given with
+	// -import, from localFile, rather than stored. They never expire and
+	// can't be changed or deleted through the API.
+	Imported  bool `json:"imported,omitempty"`
+	localFile string
+
+	// DisplayName is filled in for listings when several files share a
+	// name, e.g. "report (2).pdf"; it is never stored.
+	DisplayName string `json:"displayName,omitempty"`
+
+	// SizeHuman ("4.2 MB") and ExpiresInSeconds are also only filled in
+	// for API responses, so clients needn't format sizes or work out
+	// countdowns themselves. ExpiresInSeconds is omitted once expired.
+	SizeHuman        string `json:"sizeHuman,omitempty"`
+	ExpiresInSeconds int64  `json:"expiresInSeconds,omitempty"`
+}
+
+// UploadSource describes the client an upload came from.
+type UploadSource struct {
+	IP string `json:"ip"`
+	// Device is the name the client gave itself with X-Device-Name.
+	Device string `json:"device,omitempty"`
+	// Token tells apart clients signed in with -pin: an opaque hash of the
+	// API token they used.
+	Token     string `json:"token,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// Rendition is an alternative version of a file produced after upload, such
+// as a JPEG copy of a HEIC photo. It is stored alongside the original and
+// removed with it.
+type Rendition struct {
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// blobName is where the contents are stored: content-addressed when the
+// digest is known, by ID for files stored before it was recorded.
+func (m *FileMetadata) blobName() string {
+	if m.SHA256 != "" {
+		return "sha256-" + m.SHA256
+	}
+	return m.ID
+}
+
+// expired reports whether the file's expiration has passed by now.
+func (m *FileMetadata) expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
+// embargoed reports whether the file is still held back by AvailableFrom.
+func (m *FileMetadata) embargoed(now time.Time) bool {
+	return now.Before(m.AvailableFrom)
+}
+
+// humanize fills in the presentation fields relative to now.
+func (m *FileMetadata) humanize(now time.Time) {
+	m.SizeHuman = formatSize(m.Size)
+	if !m.ExpiresAt.IsZero() {
+		m.ExpiresInSeconds = max(int64(m.ExpiresAt.Sub(now).Seconds()), 0)
+	}
+}
+
+func (m *FileMetadata) Rendition(key string) *Rendition {
+	for i := range m.Renditions {
+		if m.Renditions[i].Key == key {
+			return &m.Renditions[i]
+		}
+	}
+	return nil
 }
 
 type FileStorage struct {
 	dir          string
+	blobs        BlobStore
+	db           metadataDB
+	compression  string
+	grace        time.Duration
+	trash        time.Duration
+	mirror       bool
 	metadataFile string
 	files        []FileMetadata
+	imported     []FileMetadata // from -import, set before serving and never saved
+	version      fileVersion
+	lockFile     string
 	mu           sync.RWMutex
+	readers      blobReaders
+	storing      map[string]int // blobs being moved into place without mu held
+
+	journalVersion fileVersion
+	journalRecords int
+}
+
+// fileVersion identifies a revision of the metadata file on disk so changes
+// made by other processes sharing the directory can be detected.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func statVersion(path string) fileVersion {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileVersion{}
+	}
+	return fileVersion{modTime: info.ModTime(), size: info.Size()}
 }
 
 func NewFileStorage(dir string) (*FileStorage, error) {
@@ -33,8 +198,16 @@ func NewFileStorage(dir string) (*FileStorage, error) {
 		return nil, fmt.Errorf("failed to create uploads directory: %w", err)
 	}
 
+	blobs := dirBlobStore{dir: dir}
+	if moved, err := blobs.migrateFlat(); err != nil {
+		return nil, fmt.Errorf("failed to move files into subdirectories: %w", err)
+	} else if moved > 0 {
+		slog.Info("Moved stored files into subdirectories", "files", moved)
+	}
+
 	fs := &FileStorage{
 		dir:          dir,
+		blobs:        blobs,
 		metadataFile: filepath.Join(dir, "metadata.json"),
 		files:        []FileMetadata{},
 	}
@@ -50,88 +223,835 @@ func (fs *FileStorage) loadMetadata() error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	if err := fs.readMetadata(); err != nil {
+		return err
+	}
+	if fs.journalRecords > 0 {
+		slog.Info("Recovered metadata changes from journal", "changes", fs.journalRecords)
+	}
+	return nil
+}
+
+// readMetadata loads metadata.json and replays the journal on top of it.
+func (fs *FileStorage) readMetadata() error {
+	fs.version = statVersion(fs.metadataFile)
+
 	data, err := os.ReadFile(fs.metadataFile)
-	if os.IsNotExist(err) {
-		fs.files = []FileMetadata{}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	var files []FileMetadata
+	if err == nil {
+		if err := json.Unmarshal(data, &files); err != nil {
+			return fmt.Errorf("failed to parse metadata: %w", err)
+		}
+	}
+	if files == nil {
+		files = []FileMetadata{}
+	}
+	fs.files = files
+
+	_, err = fs.replayJournal()
+	return err
+}
+
+// changedOnDisk reports whether another process has written metadata since
+// it was last read.
+func (fs *FileStorage) changedOnDisk() bool {
+	return statVersion(fs.metadataFile) != fs.version || statVersion(fs.journalPath()) != fs.journalVersion
+}
+
+// metadataBlob is the blob a remote store keeps the metadata under.
+const metadataBlob = "metadata.json"
+
+// UseCompression compresses new uploads with the named codec, except those
+// whose type suggests they are already compressed.
+func (fs *FileStorage) UseCompression(name string) error {
+	if _, err := lookupCodec(name); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.compression = name
+	return nil
+}
+
+// UseDeleteGrace keeps deleted and expired files, hidden, for grace before
+// removing their contents, so downloads already under way can finish.
+func (fs *FileStorage) UseDeleteGrace(grace time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.grace = grace
+}
+
+// UseTrash keeps deleted files restorable for retention, or until they would
+// have expired if that is sooner.
+func (fs *FileStorage) UseTrash(retention time.Duration) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.trash = retention
+}
+
+// purgeAt returns when a deleted file's contents are removed.
+func (fs *FileStorage) purgeAt(meta *FileMetadata) time.Time {
+	at := meta.DeletedAt.Add(fs.grace)
+	if meta.Trashed {
+		kept := meta.DeletedAt.Add(fs.trash)
+		if meta.ExpiresAt.Before(kept) {
+			kept = meta.ExpiresAt
+		}
+		if kept.After(at) {
+			at = kept
+		}
+	}
+	return at
+}
+
+func (m *FileMetadata) deleted() bool {
+	return !m.DeletedAt.IsZero()
+}
+
+// listed reports whether the file is shown and served: not deleted, nor
+// waiting for approval.
+func (m *FileMetadata) listed() bool {
+	return !m.deleted() && !m.Pending
+}
+
+// UseRemoteBlobs stores file contents in b instead of the local directory and
+// mirrors the metadata there, restoring it on startup when the local copy is
+// missing (e.g. on a fresh VM).
+func (fs *FileStorage) UseRemoteBlobs(b BlobStore) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.blobs = b
+	fs.mirror = true
+
+	if _, err := os.Stat(fs.metadataFile); !os.IsNotExist(err) {
+		return nil
+	}
+
+	r, err := b.Open(metadataBlob)
+	if errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
 	if err != nil {
-		return fmt.Errorf("failed to read metadata: %w", err)
+		return fmt.Errorf("failed to fetch metadata: %w", err)
 	}
+	defer r.Close()
 
-	if err := json.Unmarshal(data, &fs.files); err != nil {
-		return fmt.Errorf("failed to parse metadata: %w", err)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to fetch metadata: %w", err)
 	}
+	if err := writeFileAtomic(fs.metadataFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return fs.readMetadata()
+}
 
+// UseMetadataDB keeps metadata in db instead of metadata.json. On first use
+// an existing metadata.json is imported and renamed to metadata.json.migrated.
+func (fs *FileStorage) UseMetadataDB(db metadataDB) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	files, err := db.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load metadata: %w", err)
+	}
+
+	if len(files) == 0 && len(fs.files) > 0 {
+		if err := db.Apply(fs.files, nil); err != nil {
+			return fmt.Errorf("failed to import metadata.json: %w", err)
+		}
+		if err := os.Rename(fs.metadataFile, fs.metadataFile+".migrated"); err != nil {
+			return fmt.Errorf("failed to import metadata.json: %w", err)
+		}
+		// Its journal was replayed into fs.files and imported with it
+		os.Remove(fs.journalPath())
+		files = fs.files
+	}
+
+	fs.db = db
+	fs.files = files
 	return nil
 }
 
+// EnableSharedLocking makes metadata mutations take an advisory lock on a
+// file in the storage directory, so processes sharing it serialize their
+// read-modify-write cycles.
+func (fs *FileStorage) EnableSharedLocking() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.lockFile = filepath.Join(fs.dir, "metadata.lock")
+}
+
+// beginMutation must be called with fs.mu held. When shared locking is on it
+// takes the directory lock and picks up any changes peers have saved, so the
+// mutation applies to the latest metadata instead of a stale copy.
+func (fs *FileStorage) beginMutation() (func(), error) {
+	if fs.lockFile == "" {
+		return func() {}, nil
+	}
+
+	unlock, err := lockFile(fs.lockFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.changedOnDisk() {
+		if err := fs.readMetadata(); err != nil {
+			unlock()
+			return nil, err
+		}
+	}
+
+	return unlock, nil
+}
+
+// ReloadIfChanged re-reads metadata when another process has rewritten it.
+func (fs *FileStorage) ReloadIfChanged() (bool, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !fs.changedOnDisk() {
+		return false, nil
+	}
+
+	if err := fs.readMetadata(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// commit persists a mutation of fs.files: put holds the added or modified
+// entries and removed the IDs of deleted ones. Databases apply just those;
+// otherwise they are journaled, and metadata.json is rewritten in full once
+// the journal is long enough, or on every commit when it's mirrored to S3.
+func (fs *FileStorage) commit(put []FileMetadata, removed []string) error {
+	if fs.db != nil {
+		return fs.db.Apply(put, removed)
+	}
+	if err := fs.appendJournal(put, removed); err != nil {
+		return err
+	}
+	if fs.mirror || fs.journalRecords >= journalCheckpoint {
+		if err := fs.checkpoint(); err != nil {
+			// The change is safe in the journal
+			slog.Warn("Failed to checkpoint metadata", "error", err)
+		}
+	}
+	return nil
+}
+
+func fileIDs(files []FileMetadata) []string {
+	ids := make([]string, len(files))
+	for i, meta := range files {
+		ids[i] = meta.ID
+	}
+	return ids
+}
+
 func (fs *FileStorage) saveMetadata() error {
 	data, err := json.MarshalIndent(fs.files, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal metadata: %w", err)
 	}
 
-	if err := os.WriteFile(fs.metadataFile, data, 0644); err != nil {
+	if err := writeFileAtomic(fs.metadataFile, data, 0644); err != nil {
 		return fmt.Errorf("failed to write metadata: %w", err)
 	}
+	fs.version = statVersion(fs.metadataFile)
+
+	if fs.mirror {
+		w, err := fs.blobs.Create(metadataBlob)
+		if err == nil {
+			if _, err = w.Write(data); err == nil {
+				err = w.Close()
+			} else {
+				w.Abort()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to mirror metadata: %w", err)
+		}
+	}
 
 	return nil
 }
 
-func generateID() string {
+// writeFileAtomic replaces path with data so that readers, and the file
+// after a crash, see either the old contents or the new ones in full. The
+// data is synced to disk before it is renamed over path.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// maxIDAttempts bounds how often generateID draws again after a collision.
+// With 128 random bits even one retry means the entropy source is broken.
+const maxIDAttempts = 5
+
+// generateID returns a random 128-bit hex ID that taken, if not nil, reports
+// as free.
+func generateID(taken func(id string) bool) (string, error) {
 	bytes := make([]byte, 16)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
+	for range maxIDAttempts {
+		if _, err := rand.Read(bytes); err != nil {
+			return "", fmt.Errorf("failed to generate ID: %w", err)
+		}
+		id := hex.EncodeToString(bytes)
+		if taken == nil || !taken(id) {
+			return id, nil
+		}
+		slog.Warn("Generated ID is already in use, retrying", "id", id)
+	}
+	return "", fmt.Errorf("failed to generate a unique ID")
+}
+
+// idTaken reports whether a new file with this ID would collide with an
+// existing one or with contents already stored under the ID, such as an
+// upload in progress. Must be called with fs.mu held.
+func (fs *FileStorage) idTaken(id string) bool {
+	for i := range fs.files {
+		if fs.files[i].ID == id {
+			return true
+		}
+	}
+	if fs.importedPath(id) != "" {
+		return true
+	}
+	for _, blob := range []string{id, "upload-" + id, "upload-" + id + partialSuffix} {
+		if path := fs.localPath(blob); path != "" {
+			if _, err := os.Lstat(path); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (fs *FileStorage) SaveFile(filename string, r io.Reader, expiration time.Duration) (*FileMetadata, error) {
+	return fs.SaveRoomFile("", filename, r, expiration)
+}
+
+// SaveRoomFile stores a file in the room with the given code; "" is the
+// main file list.
+func (fs *FileStorage) SaveRoomFile(room, filename string, r io.Reader, expiration time.Duration) (*FileMetadata, error) {
+	return fs.SaveFolderFile(room, "", filename, r, expiration)
+}
+
+// SaveFolderFile is SaveRoomFile into a folder of the room, as returned by
+// cleanFolder.
+func (fs *FileStorage) SaveFolderFile(room, folder, filename string, r io.Reader, expiration time.Duration) (*FileMetadata, error) {
+	return fs.SaveNewFile(FileMetadata{Room: room, Folder: folder, Name: filename}, r, expiration)
 }
 
-func (fs *FileStorage) SaveFile(filename string, r io.Reader, expirationHours int) (*FileMetadata, error) {
+// SaveNewFile stores a file described by meta, of which Name, Room, Folder,
+// Uploader, Source, Pending and AvailableFrom are used; the rest is filled
+// in.
+func (fs *FileStorage) SaveNewFile(meta FileMetadata, r io.Reader, expiration time.Duration) (*FileMetadata, error) {
+	filename, r, err := runProcessors(meta.Name, r)
+	if err != nil {
+		return nil, fmt.Errorf("upload rejected: %w", err)
+	}
+	filename = sanitizeFilename(filename)
+
 	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	id, err := generateID(fs.idTaken)
+	fs.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
 
-	id := generateID()
-	storedPath := filepath.Join(fs.dir, id)
+	compression := fs.compression
+	if compression != "" {
+		br := bufio.NewReader(r)
+		head, _ := br.Peek(512)
+		if !worthCompressing(filename, head) {
+			compression = ""
+		}
+		r = br
+	}
 
-	f, err := os.Create(storedPath)
+	// The digest is only known once everything is written, so write under
+	// a temporary name and then move it into place or drop it as a duplicate.
+	// Nothing is locked meanwhile, and nothing knows of the file until it is
+	// complete and recorded.
+	tmp := "upload-" + id
+	size, stored, sum, err := fs.writeBlob(tmp, r, compression)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create file: %w", err)
+		return nil, err
+	}
+
+	meta = FileMetadata{ID: id, Name: filename, Size: size, Room: meta.Room, Folder: meta.Folder, Uploader: meta.Uploader, Source: meta.Source, Pending: meta.Pending, AvailableFrom: meta.AvailableFrom, SHA256: sum}
+	if compression != "" {
+		meta.Compression, meta.StoredSize = compression, stored
 	}
-	defer f.Close()
+	return fs.addFile(tmp, meta, expiration)
+}
 
-	size, err := io.Copy(f, r)
+// addFile records meta, whose contents were written to the blob tmp, moving
+// tmp to its content address or dropping it when that blob already exists.
+// It takes fs.mu itself, and releases it while moving the blob, which with
+// some stores means copying the whole file, so a large upload doesn't hold
+// up listings, downloads and deletes meanwhile.
+func (fs *FileStorage) addFile(tmp string, meta FileMetadata, expiration time.Duration) (*FileMetadata, error) {
+	blob := meta.blobName()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	moved := false
+	if fs.blobRefs(blob) == 0 || fs.blobQuarantined(blob) {
+		if err := fs.moveUnlocked(tmp, blob); err != nil {
+			fs.blobs.Remove(tmp)
+			return nil, fmt.Errorf("failed to store file: %w", err)
+		}
+		moved = true
+	}
+
+	unlock, err := fs.beginMutation()
 	if err != nil {
-		os.Remove(storedPath)
-		return nil, fmt.Errorf("failed to write file: %w", err)
+		if moved {
+			fs.dropBlob(blob)
+		} else {
+			fs.blobs.Remove(tmp)
+		}
+		return nil, err
 	}
+	defer unlock()
 
-	now := time.Now()
-	expiresAt := now.Add(time.Duration(expirationHours) * time.Hour)
+	// Reloading the metadata may have removed the file whose contents were
+	// to be reused; then they may be gone as well
+	if !moved && fs.blobRefs(blob) == 0 {
+		if err := fs.moveBlob(tmp, blob); err != nil {
+			fs.blobs.Remove(tmp)
+			return nil, fmt.Errorf("failed to store file: %w", err)
+		}
+		moved = true
+	}
 
-	meta := FileMetadata{
-		ID:         id,
-		Name:       filename,
-		Size:       size,
-		UploadedAt: now,
-		ExpiresAt:  expiresAt,
+	var healed []FileMetadata
+	if !moved {
+		fs.blobs.Remove(tmp)
+		// Describe the blob as it was stored the first time
+		for i := range fs.files {
+			if fs.files[i].blobName() == blob {
+				meta.Compression, meta.StoredSize = fs.files[i].Compression, fs.files[i].StoredSize
+				break
+			}
+		}
+	} else {
+		// Fresh contents replace a damaged copy for every file sharing it
+		for i := range fs.files {
+			if fs.files[i].blobName() == blob {
+				fs.files[i].Quarantined = false
+				fs.files[i].Compression, fs.files[i].StoredSize = meta.Compression, meta.StoredSize
+				healed = append(healed, fs.files[i])
+			}
+		}
+	}
+
+	meta.UploadedAt = time.Now()
+	meta.ExpiresAt = meta.UploadedAt.Add(expiration)
+	if meta.AvailableFrom.After(meta.UploadedAt) {
+		meta.ExpiresAt = meta.AvailableFrom.Add(expiration)
 	}
 
 	fs.files = append(fs.files, meta)
 
-	if err := fs.saveMetadata(); err != nil {
-		os.Remove(storedPath)
+	if err := fs.commit(append(healed, meta), nil); err != nil {
+		// Healed files keep the new contents, which are sound either way
 		fs.files = fs.files[:len(fs.files)-1]
+		if moved {
+			fs.dropBlob(blob)
+		}
 		return nil, err
 	}
 
+	if meta.Pending {
+		events.Publish(Event{Type: EventFilePending, File: &meta})
+	} else {
+		events.Publish(Event{Type: EventFileUploaded, File: &meta})
+	}
+
 	return &meta, nil
 }
 
+// writeBlob stores r under name, compressed with the named codec if any and
+// then through any storage decorators. It returns the number of bytes read
+// from r, the compressed size (0 when not compressed) and their SHA-256.
+func (fs *FileStorage) writeBlob(name string, r io.Reader, compression string) (int64, int64, string, error) {
+	f, err := fs.blobs.Create(name)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("failed to create file: %w", err)
+	}
+
+	w, err := decorateWriter(f)
+	if err != nil {
+		f.Abort()
+		return 0, 0, "", fmt.Errorf("failed to create file: %w", err)
+	}
+
+	var dst io.Writer = w
+	var compressor io.WriteCloser
+	counter := &countingWriter{w: w}
+	if compression != "" {
+		codec, err := lookupCodec(compression)
+		if err == nil {
+			compressor, err = codec.NewWriter(counter)
+		}
+		if err != nil {
+			f.Abort()
+			return 0, 0, "", fmt.Errorf("failed to create file: %w", err)
+		}
+		dst = compressor
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(dst, io.TeeReader(r, h))
+	if err == nil && compressor != nil {
+		err = compressor.Close()
+	}
+	if err == nil {
+		// Flushes any decorators and commits the blob
+		err = w.Close()
+	}
+	if err != nil {
+		f.Abort()
+		return 0, 0, "", fmt.Errorf("failed to write file: %w", err)
+	}
+	return size, counter.n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// moveBlob renames a blob, copying the stored bytes as they are when the
+// store can't rename.
+func (fs *FileStorage) moveBlob(from, to string) error {
+	if renamer, ok := fs.blobs.(blobRenamer); ok {
+		return renamer.Rename(from, to)
+	}
+
+	src, err := fs.blobs.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.blobs.Create(to)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Abort()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return fs.blobs.Remove(from)
+}
+
+// moveUnlocked is moveBlob with fs.mu released for the duration. The blob
+// counts as in use meanwhile, so a file sharing it being deleted doesn't
+// remove it from under the move. Must be called with fs.mu held.
+func (fs *FileStorage) moveUnlocked(from, to string) error {
+	if fs.storing == nil {
+		fs.storing = map[string]int{}
+	}
+	fs.storing[to]++
+	fs.mu.Unlock()
+	err := fs.moveBlob(from, to)
+	fs.mu.Lock()
+	if fs.storing[to]--; fs.storing[to] == 0 {
+		delete(fs.storing, to)
+	}
+	return err
+}
+
+// dropBlob removes blob after an upload moved it into place but failed to
+// be recorded, unless a file refers to it or another upload is storing it.
+// Must be called with fs.mu held.
+func (fs *FileStorage) dropBlob(blob string) {
+	if fs.blobRefs(blob) == 0 && fs.storing[blob] == 0 {
+		fs.removeBlob(blob)
+	}
+}
+
+// blobQuarantined reports whether the scrub found blob damaged. Must be
+// called with fs.mu held.
+func (fs *FileStorage) blobQuarantined(blob string) bool {
+	for i := range fs.files {
+		if fs.files[i].blobName() == blob && fs.files[i].Quarantined {
+			return true
+		}
+	}
+	return false
+}
+
+// blobRefs counts the files stored in blob. Must be called with fs.mu held.
+func (fs *FileStorage) blobRefs(blob string) int {
+	refs := 0
+	for i := range fs.files {
+		if fs.files[i].blobName() == blob {
+			refs++
+		}
+	}
+	return refs
+}
+
+func renditionBlob(id, key string) string {
+	return id + "." + key
+}
+
+// localPath returns where blob is stored on disk, or "" when the blob store
+// isn't local.
+func (fs *FileStorage) localPath(blob string) string {
+	if local, ok := fs.blobs.(localBlobStore); ok {
+		return local.LocalPath(blob)
+	}
+	return ""
+}
+
+// plainPath is like localPath for the blob of meta, but also "" when the
+// file on disk is compressed and so isn't the uploaded bytes.
+func (fs *FileStorage) plainPath(meta *FileMetadata) string {
+	if meta.Compression != "" {
+		return ""
+	}
+	return fs.localPath(meta.blobName())
+}
+
+// BlobPath returns where the contents of file id are stored on disk, or ""
+// when the blob store isn't local or the contents are compressed.
+func (fs *FileStorage) BlobPath(id string) string {
+	if path := fs.importedPath(id); path != "" {
+		return path
+	}
+	blob, compression := fs.blobFor(id)
+	if compression != "" {
+		return ""
+	}
+	return fs.localPath(blob)
+}
+
+// blobFor returns the blob holding file id and the codec it is compressed with.
+func (fs *FileStorage) blobFor(id string) (string, string) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	for i := range fs.files {
+		if fs.files[i].ID == id {
+			return fs.files[i].blobName(), fs.files[i].Compression
+		}
+	}
+	return id, ""
+}
+
+func (fs *FileStorage) renditionPath(id, key string) string {
+	return fs.localPath(renditionBlob(id, key))
+}
+
+// releaseBlobs deletes the renditions of files that were just removed from
+// fs.files, and their contents unless another file still shares them.
+// Removing a blob only unlinks it, so the original of an imported hard link
+// is left alone, and blobs being downloaded are removed once that finishes.
+// It returns how many bytes that frees. Must be called with fs.mu held.
+func (fs *FileStorage) releaseBlobs(removed []FileMetadata) int64 {
+	var freed int64
+	for _, meta := range removed {
+		for _, r := range meta.Renditions {
+			if fs.removeBlob(renditionBlob(meta.ID, r.Key)) == nil {
+				freed += r.Size
+			}
+		}
+		if blob := meta.blobName(); fs.blobRefs(blob) == 0 && fs.storing[blob] == 0 {
+			err := fs.removeBlob(blob)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				slog.Warn("Failed to delete file contents", "id", meta.ID, "error", err)
+			}
+			if err == nil {
+				freed += meta.storedSize()
+			}
+		}
+	}
+	return freed
+}
+
+// AddRendition stores r as rendition key of file id, replacing any previous
+// rendition with the same key.
+func (fs *FileStorage) AddRendition(id, key, name string, r io.Reader) (*FileMetadata, error) {
+	blob := renditionBlob(id, key)
+
+	// Written unlocked like uploads; the store only puts a blob in place
+	// once it is complete, so a rendition being replaced stays whole
+	size, _, _, err := fs.writeBlob(blob, r, "")
+	if err != nil {
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		fs.blobs.Remove(blob)
+		return nil, err
+	}
+	defer unlock()
+
+	idx := -1
+	for i, meta := range fs.files {
+		if meta.ID == id {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		// Deleted while the rendition was being produced
+		fs.blobs.Remove(blob)
+		return nil, fmt.Errorf("file not found")
+	}
+
+	prev := fs.files[idx]
+	meta := prev
+	meta.Renditions = []Rendition{}
+	for _, existing := range prev.Renditions {
+		if existing.Key != key {
+			meta.Renditions = append(meta.Renditions, existing)
+		}
+	}
+	meta.Renditions = append(meta.Renditions, Rendition{Key: key, Name: name, Size: size})
+	fs.files[idx] = meta
+
+	if err := fs.commit([]FileMetadata{meta}, nil); err != nil {
+		fs.blobs.Remove(blob)
+		fs.files[idx] = prev
+		return nil, err
+	}
+
+	return &meta, nil
+}
+
+// assignDisplayNames gives every file whose name (ignoring case) is already
+// taken by an earlier upload a numbered DisplayName, so views that key on
+// names don't collapse them.
+func assignDisplayNames(files []FileMetadata) {
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return files[order[a]].UploadedAt.Before(files[order[b]].UploadedAt)
+	})
+
+	taken := make(map[string]bool, len(files))
+	for _, f := range files {
+		taken[strings.ToLower(f.Name)] = true
+	}
+
+	first := make(map[string]bool, len(files))
+	for _, i := range order {
+		key := strings.ToLower(files[i].Name)
+		if !first[key] {
+			first[key] = true
+			continue
+		}
+
+		ext := filepath.Ext(files[i].Name)
+		base := strings.TrimSuffix(files[i].Name, ext)
+		for n := 2; ; n++ {
+			candidate := fmt.Sprintf("%s (%d)%s", base, n, ext)
+			if !taken[strings.ToLower(candidate)] {
+				taken[strings.ToLower(candidate)] = true
+				files[i].DisplayName = candidate
+				break
+			}
+		}
+	}
+}
+
+// StoredBytes is the space taken by file contents and renditions, counting
+// shared blobs once.
+func (fs *FileStorage) StoredBytes() int64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	var total int64
+	seen := map[string]bool{}
+	for _, meta := range fs.files {
+		for _, r := range meta.Renditions {
+			total += r.Size
+		}
+		if seen[meta.blobName()] {
+			continue
+		}
+		seen[meta.blobName()] = true
+		total += meta.storedSize()
+	}
+	return total
+}
+
+// storedSize is how much space the file's contents take on disk, not
+// counting renditions.
+func (m *FileMetadata) storedSize() int64 {
+	if m.Compression != "" {
+		return m.StoredSize
+	}
+	return m.Size
+}
+
+// ListFiles returns the main file list, leaving out files in rooms.
 func (fs *FileStorage) ListFiles() []FileMetadata {
+	return fs.ListRoomFiles("")
+}
+
+func (fs *FileStorage) ListRoomFiles(room string) []FileMetadata {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 
-	result := make([]FileMetadata, len(fs.files))
-	copy(result, fs.files)
+	result := []FileMetadata{}
+	for _, meta := range fs.files {
+		if meta.Room == room && meta.listed() {
+			result = append(result, meta)
+		}
+	}
+	if room == "" {
+		result = append(result, fs.imported...)
+	}
+	assignDisplayNames(result)
+	now := time.Now()
+	for i := range result {
+		result[i].humanize(now)
+	}
 
 	sort.Slice(result, func(i, j int) bool {
 		return result[i].UploadedAt.After(result[j].UploadedAt)
@@ -141,29 +1061,109 @@ func (fs *FileStorage) ListFiles() []FileMetadata {
 }
 
 func (fs *FileStorage) GetFile(id string) (*FileMetadata, string, error) {
+	return fs.getFile(id, (*FileMetadata).listed)
+}
+
+// GetDeletedFile is GetFile for a file in its delete grace period.
+func (fs *FileStorage) GetDeletedFile(id string) (*FileMetadata, string, error) {
+	return fs.getFile(id, (*FileMetadata).deleted)
+}
+
+// GetPendingFile is GetFile for an upload waiting for approval.
+func (fs *FileStorage) GetPendingFile(id string) (*FileMetadata, string, error) {
+	return fs.getFile(id, func(m *FileMetadata) bool { return m.Pending && !m.deleted() })
+}
+
+func (fs *FileStorage) getFile(id string, match func(*FileMetadata) bool) (*FileMetadata, string, error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 
 	for _, meta := range fs.files {
-		if meta.ID == id {
-			path := filepath.Join(fs.dir, id)
-			if _, err := os.Stat(path); err != nil {
+		if meta.ID == id && match(&meta) {
+			if path := fs.localPath(meta.blobName()); path != "" {
+				if _, err := os.Stat(path); err != nil {
+					return nil, "", fmt.Errorf("file not found on disk")
+				}
+			}
+			return &meta, fs.plainPath(&meta), nil
+		}
+	}
+	for _, meta := range fs.imported {
+		if meta.ID == id && match(&meta) {
+			if _, err := os.Stat(meta.localFile); err != nil {
 				return nil, "", fmt.Errorf("file not found on disk")
 			}
-			return &meta, path, nil
+			return &meta, meta.localFile, nil
 		}
 	}
 
 	return nil, "", fmt.Errorf("file not found")
 }
 
+// OpenBlob returns the contents of file id, undoing any compression and
+// storage decorators.
+func (fs *FileStorage) OpenBlob(id string) (io.ReadCloser, error) {
+	if path := fs.importedPath(id); path != "" {
+		return os.Open(path)
+	}
+	return fs.openDecorated(fs.blobFor(id))
+}
+
+// OpenRendition returns the contents of rendition key of file id.
+func (fs *FileStorage) OpenRendition(id, key string) (io.ReadCloser, error) {
+	return fs.openDecorated(renditionBlob(id, key), "")
+}
+
+func (fs *FileStorage) openDecorated(name, compression string) (io.ReadCloser, error) {
+	return openDecoded(fs.blobs, name, compression)
+}
+
+// openDecoded opens blob name in blobs through the storage decorators and
+// the named compression codec, if any.
+func openDecoded(blobs BlobStore, name, compression string) (io.ReadCloser, error) {
+	var codec compressionCodec
+	if compression != "" {
+		var err error
+		if codec, err = lookupCodec(compression); err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+	}
+
+	f, err := blobs.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	r, err := decorateReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	if compression == "" {
+		return r, nil
+	}
+
+	plain, err := codec.NewReader(r)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return codecReadCloser{ReadCloser: plain, blob: r}, nil
+}
+
 func (fs *FileStorage) DeleteFile(id string) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	idx := -1
 	for i, meta := range fs.files {
-		if meta.ID == id {
+		if meta.ID == id && !meta.deleted() {
 			idx = i
 			break
 		}
@@ -173,61 +1173,224 @@ func (fs *FileStorage) DeleteFile(id string) error {
 		return fmt.Errorf("file not found")
 	}
 
-	path := filepath.Join(fs.dir, id)
-	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to delete file: %w", err)
+	deleted := fs.files[idx]
+	if fs.grace > 0 || fs.trash > 0 {
+		deleted.DeletedAt = time.Now()
+		deleted.Trashed = fs.trash > 0
+		fs.files[idx] = deleted
+		if err := fs.commit([]FileMetadata{deleted}, nil); err != nil {
+			return err
+		}
+	} else {
+		fs.files = append(fs.files[:idx], fs.files[idx+1:]...)
+		if err := fs.commit(nil, []string{id}); err != nil {
+			return err
+		}
+		fs.releaseBlobs([]FileMetadata{deleted})
 	}
 
-	fs.files = append(fs.files[:idx], fs.files[idx+1:]...)
+	events.Publish(Event{Type: EventFileDeleted, File: &deleted})
 
-	if err := fs.saveMetadata(); err != nil {
-		return err
+	return nil
+}
+
+// UpdateFile applies update to live file id's metadata and saves it.
+func (fs *FileStorage) UpdateFile(id string, update func(*FileMetadata)) (*FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
 
-	return nil
+	for i := range fs.files {
+		if fs.files[i].ID == id && !fs.files[i].deleted() {
+			update(&fs.files[i])
+			meta := fs.files[i]
+			if err := fs.commit([]FileMetadata{meta}, nil); err != nil {
+				return nil, err
+			}
+			return &meta, nil
+		}
+	}
+	return nil, fmt.Errorf("file not found")
 }
 
-func (fs *FileStorage) ClearAllFiles() error {
+// DeleteRoomFiles removes every file in the room and returns them, with the
+// bytes that freed. No per-file events are published; the caller reports
+// the room as a whole.
+func (fs *FileStorage) DeleteRoomFiles(room string) ([]FileMetadata, int64, error) {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer unlock()
+
+	kept := []FileMetadata{}
+	var removed []FileMetadata
 	for _, meta := range fs.files {
-		path := filepath.Join(fs.dir, meta.ID)
-		os.Remove(path)
+		if meta.Room == room {
+			removed = append(removed, meta)
+		} else {
+			kept = append(kept, meta)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, 0, nil
+	}
+
+	fs.files = kept
+
+	if err := fs.commit(nil, fileIDs(removed)); err != nil {
+		return nil, 0, err
+	}
+	freed := fs.releaseBlobs(removed)
+
+	return removed, freed, nil
+}
+
+// Close releases the metadata database, if one is in use, or folds the
+// journal into metadata.json.
+func (fs *FileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.db != nil {
+		return fs.db.Close()
+	}
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if fs.journalRecords == 0 {
+		return nil
 	}
+	return fs.checkpoint()
+}
 
-	fs.files = []FileMetadata{}
+// ClearAllFiles removes every file except live ones marked Persist.
+func (fs *FileStorage) ClearAllFiles() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
 
-	if err := fs.saveMetadata(); err != nil {
+	unlock, err := fs.beginMutation()
+	if err != nil {
 		return err
 	}
+	defer unlock()
+
+	kept := []FileMetadata{}
+	var removed []FileMetadata
+	for _, meta := range fs.files {
+		if meta.Persist && !meta.deleted() {
+			kept = append(kept, meta)
+		} else {
+			removed = append(removed, meta)
+		}
+	}
+	fs.files = kept
+
+	if err := fs.commit(nil, fileIDs(removed)); err != nil {
+		return err
+	}
+	fs.releaseBlobs(removed)
 
 	return nil
 }
 
-func (fs *FileStorage) DeleteExpiredFiles() error {
+// ShiftTimes moves every file's upload and expiration time by delta, so a
+// wall-clock jump doesn't change how much lifetime files have left.
+func (fs *FileStorage) ShiftTimes(delta time.Duration) error {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for i := range fs.files {
+		fs.files[i].UploadedAt = fs.files[i].UploadedAt.Add(delta)
+		fs.files[i].ExpiresAt = fs.files[i].ExpiresAt.Add(delta)
+		if fs.files[i].deleted() {
+			fs.files[i].DeletedAt = fs.files[i].DeletedAt.Add(delta)
+		}
+	}
+
+	return fs.commit(fs.files, nil)
+}
+
+// ExpiryResult is what one DeleteExpiredFiles pass did: how many files
+// expired, how many were removed for good, and the bytes that freed.
+type ExpiryResult struct {
+	Expired int
+	Removed int
+	Freed   int64
+}
+
+func (fs *FileStorage) DeleteExpiredFiles() (ExpiryResult, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return ExpiryResult{}, err
+	}
+	defer unlock()
+
 	now := time.Now()
-	var activeFiles []FileMetadata
+	var activeFiles, expiredFiles, purged, hidden []FileMetadata
 
 	for _, meta := range fs.files {
-		if now.After(meta.ExpiresAt) {
+		switch {
+		case meta.deleted():
+			// Deleted or expired earlier; remove once the grace period, or
+			// its time in the trash, is over
+			if !now.Before(fs.purgeAt(&meta)) {
+				purged = append(purged, meta)
+			} else {
+				activeFiles = append(activeFiles, meta)
+			}
+		case now.After(meta.ExpiresAt) && !archive.Holds(meta.ID):
+			// Expired, but not copied to the archive yet; kept until it is
+			activeFiles = append(activeFiles, meta)
+		case now.After(meta.ExpiresAt):
 			// File has expired, delete it
-			path := filepath.Join(fs.dir, meta.ID)
-			os.Remove(path)
-		} else {
+			expiredFiles = append(expiredFiles, meta)
+			if fs.grace > 0 {
+				meta.DeletedAt = now
+				hidden = append(hidden, meta)
+				activeFiles = append(activeFiles, meta)
+			} else {
+				purged = append(purged, meta)
+			}
+		default:
 			// File is still active
 			activeFiles = append(activeFiles, meta)
 		}
 	}
+	if len(purged) == 0 && len(hidden) == 0 {
+		return ExpiryResult{}, nil
+	}
 
 	fs.files = activeFiles
 
-	if err := fs.saveMetadata(); err != nil {
-		return err
+	if err := fs.commit(hidden, fileIDs(purged)); err != nil {
+		return ExpiryResult{}, err
 	}
+	freed := fs.releaseBlobs(purged)
 
-	return nil
+	for i := range expiredFiles {
+		events.Publish(Event{Type: EventFileExpired, File: &expiredFiles[i]})
+	}
+
+	return ExpiryResult{Expired: len(expiredFiles), Removed: len(purged), Freed: freed}, nil
 }
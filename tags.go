@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	maxTags      = 20
+	maxTagLength = 64
+)
+
+// normalizeTags lowercases and trims tags, dropping empty ones and
+// duplicates, so "Invoices" and "invoices " are the same tag.
+func normalizeTags(tags []string) ([]string, error) {
+	var result []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		switch {
+		case tag == "" || slices.Contains(result, tag):
+			continue
+		case len(tag) > maxTagLength:
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		case strings.ContainsAny(tag, ",\x00"):
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		result = append(result, tag)
+	}
+	if len(result) > maxTags {
+		return nil, fmt.Errorf("at most %d tags per file", maxTags)
+	}
+	return result, nil
+}
+
+// splitTags parses comma-separated tags, as sent in form fields and
+// headers; values may be repeated.
+func splitTags(values []string) ([]string, error) {
+	var tags []string
+	for _, value := range values {
+		tags = append(tags, strings.Split(value, ",")...)
+	}
+	return normalizeTags(tags)
+}
+
+// hasTags reports whether meta has every one of tags.
+func hasTags(meta *FileMetadata, tags []string) bool {
+	for _, tag := range tags {
+		if !slices.Contains(meta.Tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+type fileUpdate struct {
+	Tags     *[]string          `json:"tags"`
+	Metadata *map[string]string `json:"metadata"`
+}
+
+// handleFile returns a file's details (GET /api/files/{id}) or updates them:
+// PATCH /api/files/{id} with {"tags": [...]} and/or {"metadata": {...}}
+// replaces whichever is given.
+func handleFile(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/files/")
+	if fileID, ok := strings.CutSuffix(id, "/email"); ok && fileID != "" && !strings.Contains(fileID, "/") {
+		handleFileEmail(w, r, fileID)
+		return
+	}
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodPatch:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	meta, _, err := storage.GetFile(id)
+	if err != nil || !inRoom(meta, room) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(newShareResponse(meta))
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	var req fileUpdate
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req); err != nil || req.Tags == nil && req.Metadata == nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	var tags []string
+	if req.Tags != nil {
+		if tags, err = normalizeTags(*req.Tags); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	var metadata map[string]string
+	if req.Metadata != nil {
+		if metadata, err = validateMetadata(*req.Metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	meta, err = storage.UpdateFile(id, func(meta *FileMetadata) {
+		if req.Tags != nil {
+			meta.Tags = tags
+		}
+		if req.Metadata != nil {
+			meta.Metadata = metadata
+		}
+	})
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	slog.Info("File details changed", "id", id, "tags", meta.Tags, "metadataKeys", len(meta.Metadata), "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newShareResponse(meta))
+}
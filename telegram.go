@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const telegramAPI = "https://api.telegram.org"
+
+// TelegramBot ingests files sent to the bot in its configured chat and
+// announces new uploads there.
+type TelegramBot struct {
+	token  string
+	chatID int64
+	client *http.Client
+	offset int64
+
+	// IDs of files the bot ingested itself, so they aren't announced back
+	ingested map[string]bool
+	mu       sync.Mutex
+}
+
+type telegramFile struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	FileSize int64  `json:"file_size"`
+}
+
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Document *telegramFile  `json:"document"`
+	Video    *telegramFile  `json:"video"`
+	Audio    *telegramFile  `json:"audio"`
+	Voice    *telegramFile  `json:"voice"`
+	Photo    []telegramFile `json:"photo"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+func NewTelegramBot(token string, chatID int64) *TelegramBot {
+	return &TelegramBot{
+		token:    token,
+		chatID:   chatID,
+		client:   &http.Client{Timeout: 90 * time.Second},
+		ingested: make(map[string]bool),
+	}
+}
+
+// call invokes a Bot API method and decodes its result into out.
+func (t *TelegramBot) call(ctx context.Context, method string, params url.Values, out any) error {
+	endpoint := fmt.Sprintf("%s/bot%s/%s", telegramAPI, t.token, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.URL.RawQuery = params.Encode()
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("telegram %s: %s", method, envelope.Description)
+	}
+	if out != nil {
+		return json.Unmarshal(envelope.Result, out)
+	}
+	return nil
+}
+
+func (t *TelegramBot) sendMessage(text string) error {
+	return t.call(context.Background(), "sendMessage", url.Values{
+		"chat_id": {strconv.FormatInt(t.chatID, 10)},
+		"text":    {text},
+	}, nil)
+}
+
+func (t *TelegramBot) reply(msg *telegramMessage, text string) {
+	err := t.call(context.Background(), "sendMessage", url.Values{
+		"chat_id":             {strconv.FormatInt(msg.Chat.ID, 10)},
+		"reply_to_message_id": {strconv.FormatInt(msg.MessageID, 10)},
+		"text":                {text},
+	}, nil)
+	if err != nil {
+		slog.Warn("Failed to reply on Telegram", "error", err)
+	}
+}
+
+// attachment picks the file carried by msg, preferring the largest photo size.
+func (m *telegramMessage) attachment() (*telegramFile, string) {
+	switch {
+	case m.Document != nil:
+		return m.Document, m.Document.FileName
+	case m.Video != nil:
+		return m.Video, m.Video.FileName
+	case m.Audio != nil:
+		return m.Audio, m.Audio.FileName
+	case m.Voice != nil:
+		return m.Voice, ""
+	case len(m.Photo) > 0:
+		return &m.Photo[len(m.Photo)-1], ""
+	}
+	return nil, ""
+}
+
+func (t *TelegramBot) ingest(ctx context.Context, msg *telegramMessage) {
+	file, name := msg.attachment()
+	if file == nil {
+		return
+	}
+
+	if maintenance.Enabled() {
+		t.reply(msg, maintenance.Status().Message)
+		return
+	}
+
+	var info struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := t.call(ctx, "getFile", url.Values{"file_id": {file.FileID}}, &info); err != nil {
+		slog.Warn("Failed to resolve Telegram file", "error", err)
+		t.reply(msg, "Could not fetch that file (bots can only download files up to 20 MB)")
+		return
+	}
+	if name == "" {
+		name = "telegram-" + time.Now().Format("20060102-150405") + path.Ext(info.FilePath)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/file/bot%s/%s", telegramAPI, t.token, info.FilePath), nil)
+	if err != nil {
+		return
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		slog.Warn("Failed to download Telegram file", "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		slog.Warn("Failed to download Telegram file", "status", resp.Status)
+		return
+	}
+
+	// Register before saving so the upload event isn't announced back
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	meta, err := storage.SaveFile(name, resp.Body, expirationFor(0))
+	if err != nil {
+		slog.Error("Failed to save Telegram file", "filename", name, "error", err)
+		t.reply(msg, "Failed to save file")
+		return
+	}
+	t.ingested[meta.ID] = true
+	slog.Info("File uploaded", "id", meta.ID, "filename", meta.Name, "size", meta.Size, "client", "telegram")
+
+	go t.reply(msg, "Saved "+meta.Name+"\n"+shareURL(meta))
+}
+
+// Run long-polls for updates until ctx is cancelled.
+func (t *TelegramBot) Run(ctx context.Context) {
+	for ctx.Err() == nil {
+		var updates []telegramUpdate
+		err := t.call(ctx, "getUpdates", url.Values{
+			"offset":          {strconv.FormatInt(t.offset, 10)},
+			"timeout":         {"60"},
+			"allowed_updates": {`["message"]`},
+		}, &updates)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Telegram polling failed", "error", err)
+			select {
+			case <-time.After(10 * time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+
+		for _, u := range updates {
+			t.offset = u.UpdateID + 1
+			if u.Message == nil || u.Message.Chat.ID != t.chatID {
+				continue
+			}
+			t.ingest(ctx, u.Message)
+		}
+	}
+}
+
+func (t *TelegramBot) handleEvent(e Event) {
+	if e.Type != EventFileUploaded {
+		return
+	}
+
+	t.mu.Lock()
+	own := t.ingested[e.File.ID]
+	delete(t.ingested, e.File.ID)
+	t.mu.Unlock()
+	if own {
+		return
+	}
+
+	text := fmt.Sprintf("New file: %s (%s)\n%s", e.File.Name, formatSize(e.File.Size), shareURL(e.File))
+	if err := t.sendMessage(text); err != nil {
+		slog.Warn("Failed to announce upload on Telegram", "error", err)
+	}
+}
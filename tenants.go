@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Tenants are separate stores served under /t/{name}/ from one daemon. Each
+// runs as a child sync-it process with its own directory and flags (PIN,
+// quotas, expiration, ...) listening on loopback, and the main server proxies
+// to it, so nothing is shared between tenants but the port.
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+
+const tenantStopTimeout = 30 * time.Second
+
+// tenantFlag collects repeated -tenant "name=dir [flags]" values.
+type tenantFlag []tenantConfig
+
+type tenantConfig struct {
+	Name string
+	Dir  string
+	Args []string
+}
+
+func (t *tenantFlag) String() string {
+	var names []string
+	for _, c := range *t {
+		names = append(names, c.Name+"="+c.Dir)
+	}
+	return strings.Join(names, ", ")
+}
+
+func (t *tenantFlag) Set(value string) error {
+	name, rest, ok := strings.Cut(value, "=")
+	fields := strings.Fields(rest)
+	if !ok || len(fields) == 0 {
+		return fmt.Errorf("expected name=dir, optionally followed by flags")
+	}
+	name = strings.TrimSpace(name)
+	if !tenantNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid tenant name %q (use lowercase letters, digits and dashes)", name)
+	}
+	for _, c := range *t {
+		if c.Name == name {
+			return fmt.Errorf("tenant %q given twice", name)
+		}
+	}
+	for _, arg := range fields[1:] {
+		if strings.HasPrefix(strings.TrimLeft(arg, "-"), "tenant") {
+			return fmt.Errorf("tenants can't have tenants of their own")
+		}
+	}
+	*t = append(*t, tenantConfig{Name: name, Dir: fields[0], Args: fields[1:]})
+	return nil
+}
+
+// Tenant supervises one tenant's process, restarting it if it exits.
+type Tenant struct {
+	config tenantConfig
+	proxy  *httputil.ReverseProxy
+
+	mu       sync.Mutex
+	port     int
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	stopping bool
+}
+
+// tenants is keyed by name; empty without -tenant.
+var tenants = map[string]*Tenant{}
+
+func NewTenant(config tenantConfig) *Tenant {
+	t := &Tenant{config: config}
+	t.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			t.mu.Lock()
+			port := t.port
+			t.mu.Unlock()
+			pr.SetURL(&url.URL{Scheme: "http", Host: net.JoinHostPort("127.0.0.1", strconv.Itoa(port))})
+			// The tenant keeps the prefix and strips it itself
+			pr.Out.URL.Path = basePath + pr.In.URL.Path
+			pr.Out.URL.RawPath = ""
+			pr.SetXForwarded()
+			// Only the address this server resolved, so clients can't
+			// pose as local admins with headers of their own
+			pr.Out.Header.Set("X-Forwarded-For", clientIP(pr.In))
+		},
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("Tenant unavailable", "tenant", t.config.Name, "error", err)
+			http.Error(w, "This store is starting or unavailable, try again shortly", http.StatusBadGateway)
+		},
+	}
+	return t
+}
+
+// prefix is where the tenant is served, below the main server's base path.
+func (t *Tenant) prefix() string {
+	return basePath + "/t/" + t.config.Name
+}
+
+// URL is the tenant's public address.
+func (t *Tenant) URL() string {
+	return publicBaseURL() + "/t/" + t.config.Name + "/"
+}
+
+// freePort asks the kernel for an unused loopback port.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (t *Tenant) start() error {
+	if err := os.MkdirAll(t.config.Dir, 0755); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+
+	// The tenant's own flags first, so these win
+	args := append([]string{}, t.config.Args...)
+	args = append(args,
+		"-dir", t.config.Dir,
+		"-port", strconv.Itoa(port),
+		"-listen", "127.0.0.1",
+		"-base-path", t.prefix(),
+		"-external-url", strings.TrimSuffix(t.URL(), "/"),
+		"-trusted-proxies", "127.0.0.1",
+		"-log-file", t.config.Dir+string(os.PathSeparator)+"sync-it.log",
+	)
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	exited := make(chan struct{})
+	t.mu.Lock()
+	t.port, t.cmd, t.exited = port, cmd, exited
+	t.mu.Unlock()
+	slog.Info("Tenant started", "tenant", t.config.Name, "dir", t.config.Dir, "pid", cmd.Process.Pid)
+
+	go func() {
+		err := cmd.Wait()
+		close(exited)
+		t.mu.Lock()
+		stopping := t.stopping
+		t.mu.Unlock()
+		if !stopping {
+			status := fmt.Sprint(err)
+			if cmd.ProcessState != nil {
+				status = cmd.ProcessState.String()
+			}
+			slog.Error("Tenant exited", "tenant", t.config.Name, "status", status)
+		}
+	}()
+	return nil
+}
+
+// Run starts the tenant and restarts it whenever it exits, backing off while
+// it keeps failing, until Stop.
+func (t *Tenant) Run() {
+	backoff := time.Second
+	for {
+		t.mu.Lock()
+		stopping := t.stopping
+		t.mu.Unlock()
+		if stopping {
+			return
+		}
+
+		started := time.Now()
+		if err := t.start(); err != nil {
+			slog.Error("Failed to start tenant", "tenant", t.config.Name, "error", err)
+		} else {
+			t.mu.Lock()
+			exited := t.exited
+			t.mu.Unlock()
+			<-exited
+		}
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// Stop shuts the tenant down cleanly, killing it if it takes too long.
+func (t *Tenant) Stop() {
+	t.mu.Lock()
+	t.stopping = true
+	cmd, exited := t.cmd, t.exited
+	t.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+
+	if runtime.GOOS == "windows" || cmd.Process.Signal(syscall.SIGTERM) != nil {
+		cmd.Process.Kill()
+	}
+	select {
+	case <-exited:
+	case <-time.After(tenantStopTimeout):
+		slog.Warn("Tenant didn't stop in time, killing it", "tenant", t.config.Name)
+		cmd.Process.Kill()
+		<-exited
+	}
+}
+
+func stopTenants() {
+	var wg sync.WaitGroup
+	for _, t := range tenants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.Stop()
+		}()
+	}
+	wg.Wait()
+}
+
+// handleTenant proxies /t/{name}/... to the tenant's process.
+func handleTenant(w http.ResponseWriter, r *http.Request) {
+	name, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/t/"), "/")
+	t := tenants[name]
+	if t == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.URL.Path == "/t/"+name {
+		// Relative asset and API links need the trailing slash
+		http.Redirect(w, r, t.prefix()+"/", http.StatusMovedPermanently)
+		return
+	}
+	t.proxy.ServeHTTP(w, r)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleRule limits total server throughput to Rate bytes per second
+// during a daily window. A zero Rate means unlimited, so a later catch-all
+// rule can be lifted for part of the day.
+type throttleRule struct {
+	Days  [7]bool // indexed by time.Weekday; all true when no days are given
+	Start int     // minutes after midnight
+	End   int     // exclusive; End <= Start wraps past midnight
+	Rate  int64
+	raw   string
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// throttleFlag collects repeated -throttle rules, in order.
+type throttleFlag []throttleRule
+
+func (t *throttleFlag) String() string {
+	var parts []string
+	for _, rule := range *t {
+		parts = append(parts, rule.raw)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Set parses "[days] [HH:MM-HH:MM]=rate", e.g. "mon-fri 09:00-17:00=2MB" or
+// "22:00-07:00=unlimited". A bare rate such as "8MB" always applies.
+func (t *throttleFlag) Set(value string) error {
+	spec, rate, ok := strings.Cut(value, "=")
+	if !ok {
+		spec, rate = "", value
+	}
+
+	rule := throttleRule{End: 24 * 60, raw: value}
+	for i := range rule.Days {
+		rule.Days[i] = true
+	}
+
+	for _, field := range strings.Fields(spec) {
+		if strings.Contains(field, ":") {
+			start, end, ok := strings.Cut(field, "-")
+			if !ok {
+				return fmt.Errorf("invalid hours %q (use HH:MM-HH:MM)", field)
+			}
+			var err error
+			if rule.Start, err = parseClock(start); err != nil {
+				return err
+			}
+			if rule.End, err = parseClock(end); err != nil {
+				return err
+			}
+			continue
+		}
+		days, err := parseWeekdays(field)
+		if err != nil {
+			return err
+		}
+		rule.Days = days
+	}
+
+	var err error
+	if rule.Rate, err = parseRate(rate); err != nil {
+		return err
+	}
+	*t = append(*t, rule)
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	hh, mm, ok := strings.Cut(s, ":")
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if !ok || err1 != nil || err2 != nil || h < 0 || h > 24 || m < 0 || m > 59 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid time %q (use HH:MM)", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseWeekdays accepts a comma-separated list of days and ranges such as
+// "mon-fri" or "sat,sun"; ranges may wrap, as in "fri-mon".
+func parseWeekdays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(strings.ToLower(s), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, ok1 := weekdayNames[first]
+		to, ok2 := from, true
+		if isRange {
+			to, ok2 = weekdayNames[last]
+		}
+		if !ok1 || !ok2 {
+			return days, fmt.Errorf("invalid days %q (use e.g. mon-fri or sat,sun)", s)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseRate parses bytes per second as a size. "unlimited", "off" and 0
+// mean no limit.
+func parseRate(value string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "/S")
+	if s == "UNLIMITED" || s == "OFF" {
+		return 0, nil
+	}
+	n, err := parseSize(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid rate %q (use e.g. 500KB, 2MB or unlimited)", value)
+	}
+	return n, nil
+}
+
+// parseSize parses a byte count with an optional KB, MB, GB or TB suffix
+// (powers of 1024), e.g. "1.5GB".
+func parseSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSuffix(s, unit.suffix), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || !(n >= 0 && n < 1<<62) {
+		return 0, fmt.Errorf("invalid size %q (use e.g. 500MB or 2GB)", value)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+func (r throttleRule) matches(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if r.End > r.Start {
+		return r.Days[day] && minute >= r.Start && minute < r.End
+	}
+	// Overnight windows belong to the day they start on
+	if minute >= r.Start {
+		return r.Days[day]
+	}
+	return minute < r.End && r.Days[(day+6)%7]
+}
+
+// BandwidthLimiter is a token bucket shared by every transfer, whose rate
+// follows the first rule matching the current local time.
+type BandwidthLimiter struct {
+	rules []throttleRule
+
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// throttleChunk caps how much one read or write reserves at a time, so a
+// change of rate takes effect promptly and concurrent transfers interleave.
+const throttleChunk = 32 << 10
+
+func NewBandwidthLimiter(rules []throttleRule) *BandwidthLimiter {
+	return &BandwidthLimiter{rules: rules}
+}
+
+// Rate returns the limit in effect at t in bytes per second, 0 if none.
+func (l *BandwidthLimiter) Rate(t time.Time) int64 {
+	for _, rule := range l.rules {
+		if rule.matches(t) {
+			return rule.Rate
+		}
+	}
+	return 0
+}
+
+// wait blocks until n bytes may be transferred or ctx is done.
+func (l *BandwidthLimiter) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	rate := l.Rate(now)
+	if rate == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	if rate != l.rate {
+		// Start the new window without credit or debt from the old one
+		l.rate, l.tokens, l.last = rate, 0, now
+	}
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(rate), float64(rate))
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// throttle is nil unless -throttle rules are given.
+var throttle *BandwidthLimiter
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		if err := throttle.wait(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *throttledWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type throttledBody struct {
+	body io.ReadCloser
+	ctx  context.Context
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p[:min(len(p), throttleChunk)])
+	if n > 0 {
+		if werr := throttle.wait(b.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (b *throttledBody) Close() error {
+	return b.body.Close()
+}
+
+// withThrottle applies the bandwidth schedule to request and response bodies.
+func withThrottle(h http.Handler) http.Handler {
+	if throttle == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &throttledBody{body: r.Body, ctx: ctx}
+		}
+		h.ServeHTTP(&throttledWriter{ResponseWriter: w, ctx: ctx}, r)
+	})
+}
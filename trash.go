@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	errNotInTrash  = errors.New("file not in trash")
+	errTrashExpiry = errors.New("file has expired")
+)
+
+// TrashedFile is a deleted file that can still be restored until PurgeAt.
+type TrashedFile struct {
+	FileMetadata
+	PurgeAt time.Time `json:"purgeAt"`
+}
+
+type TrashResponse struct {
+	Files []TrashedFile `json:"files"`
+}
+
+// ListTrash returns the room's deleted files, most recently deleted first.
+// Files that expired rather than being deleted aren't included.
+func (fs *FileStorage) ListTrash(room string) []TrashedFile {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	result := []TrashedFile{}
+	now := time.Now()
+	for _, meta := range fs.files {
+		if meta.Room == room && meta.Trashed {
+			meta.humanize(now)
+			result = append(result, TrashedFile{FileMetadata: meta, PurgeAt: fs.purgeAt(&meta)})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].DeletedAt.After(result[j].DeletedAt)
+	})
+
+	return result
+}
+
+// trashed returns the trashed file id, or nil.
+func (fs *FileStorage) trashed(id string) *FileMetadata {
+	for i := range fs.files {
+		if fs.files[i].ID == id && fs.files[i].Trashed {
+			return &fs.files[i]
+		}
+	}
+	return nil
+}
+
+// RestoreFile takes file id out of the trash. It keeps its original
+// expiration, so a file whose lifetime ran out while in the trash can't be
+// restored.
+func (fs *FileStorage) RestoreFile(id string) (*FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	meta := fs.trashed(id)
+	if meta == nil {
+		return nil, errNotInTrash
+	}
+	if time.Now().After(meta.ExpiresAt) {
+		return nil, errTrashExpiry
+	}
+
+	meta.DeletedAt = time.Time{}
+	meta.Trashed = false
+	restored := *meta
+	if err := fs.commit([]FileMetadata{restored}, nil); err != nil {
+		return nil, err
+	}
+
+	events.Publish(Event{Type: EventFileRestored, File: &restored})
+
+	return &restored, nil
+}
+
+// PurgeTrash removes trashed files in room for good: just file id, or all of
+// them when id is empty. Downloads still reading a file finish first.
+func (fs *FileStorage) PurgeTrash(room, id string) ([]FileMetadata, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	unlock, err := fs.beginMutation()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	kept := []FileMetadata{}
+	var purged []FileMetadata
+	for _, meta := range fs.files {
+		if meta.Trashed && meta.Room == room && (id == "" || meta.ID == id) {
+			purged = append(purged, meta)
+		} else {
+			kept = append(kept, meta)
+		}
+	}
+	if len(purged) == 0 {
+		if id != "" {
+			return nil, errNotInTrash
+		}
+		return nil, nil
+	}
+
+	fs.files = kept
+
+	if err := fs.commit(nil, fileIDs(purged)); err != nil {
+		return nil, err
+	}
+	fs.releaseBlobs(purged)
+
+	return purged, nil
+}
+
+// handleTrash lists the trash (GET /api/trash) and purges it: DELETE
+// /api/trash empties it, DELETE /api/trash/{id} removes one file.
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/trash"), "/")
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if id != "" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(TrashResponse{Files: storage.ListTrash(roomCode(room))})
+	case http.MethodDelete:
+		if rejectIfMaintenance(w) {
+			return
+		}
+		purged, err := storage.PurgeTrash(roomCode(room), id)
+		if errors.Is(err, errNotInTrash) {
+			http.Error(w, "File not found in trash", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.Error("Failed to purge trash", "error", err)
+			http.Error(w, "Failed to purge trash", http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Trash purged", "files", len(purged), "client", clientIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRestore takes a file out of the trash: POST /api/restore/{id}.
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rejectIfMaintenance(w) {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/restore/")
+	if id == "" {
+		http.Error(w, "File ID required", http.StatusBadRequest)
+		return
+	}
+
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return
+	}
+	if !inTrash(id, roomCode(room)) {
+		http.Error(w, "File not found in trash", http.StatusNotFound)
+		return
+	}
+
+	meta, err := storage.RestoreFile(id)
+	switch {
+	case errors.Is(err, errNotInTrash):
+		http.Error(w, "File not found in trash", http.StatusNotFound)
+		return
+	case errors.Is(err, errTrashExpiry):
+		http.Error(w, "File has expired", http.StatusGone)
+		return
+	case err != nil:
+		slog.Error("Failed to restore file", "id", id, "error", err)
+		http.Error(w, "Failed to restore file", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("File restored", "id", id, "client", clientIP(r))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newShareResponse(meta))
+}
+
+func inTrash(id, room string) bool {
+	for _, meta := range storage.ListTrash(room) {
+		if meta.ID == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Set at build time:
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.releasePublicKey=<base64 ed25519 key>"
+var (
+	version          = "dev"
+	releasePublicKey = ""
+)
+
+const releaseEndpoint = "https://api.github.com/repos/orange-puff/sync-it/releases/latest"
+
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func (r *release) assetURL(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+func fetchBytes(client *http.Client, url string, limit int64) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+// expectedChecksum finds name in a sha256sum-style checksums file.
+func expectedChecksum(checksums []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+// replaceExecutable swaps the running binary for newPath. The rename is atomic
+// on Unix; Windows can't replace a running executable, so the old one is moved
+// aside first.
+func replaceExecutable(exe, newPath string) error {
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		os.Remove(old)
+		if err := os.Rename(exe, old); err != nil {
+			return err
+		}
+		if err := os.Rename(newPath, exe); err != nil {
+			os.Rename(old, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(newPath, exe)
+}
+
+func runSelfUpdate(args []string) error {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	endpoint := fs.String("endpoint", releaseEndpoint, "Release metadata URL (GitHub releases API format)")
+	publicKey := fs.String("public-key", releasePublicKey, "Base64 ed25519 key that signs checksums.txt")
+	force := fs.Bool("force", false, "Install even if the release matches the current version")
+	checkOnly := fs.Bool("check", false, "Only report whether an update is available")
+	fs.Parse(args)
+
+	if *publicKey == "" {
+		return fmt.Errorf("no release signing key is built in; pass -public-key")
+	}
+	key, err := base64.StdEncoding.DecodeString(*publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid release signing key")
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+
+	data, err := fetchBytes(client, *endpoint, 1<<20)
+	if err != nil {
+		return fmt.Errorf("failed to check for updates: %w", err)
+	}
+	var rel release
+	if err := json.Unmarshal(data, &rel); err != nil {
+		return fmt.Errorf("failed to parse release metadata: %w", err)
+	}
+
+	fmt.Printf("Current version: %s\nLatest release:  %s\n", version, rel.TagName)
+	if rel.TagName == version && !*force {
+		fmt.Println("Already up to date")
+		return nil
+	}
+	if *checkOnly {
+		fmt.Println("Update available")
+		return nil
+	}
+
+	assetName := fmt.Sprintf("sync-it_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		assetName += ".exe"
+	}
+	binURL, ok := rel.assetURL(assetName)
+	if !ok {
+		return fmt.Errorf("release %s has no build for %s/%s", rel.TagName, runtime.GOOS, runtime.GOARCH)
+	}
+	sumsURL, ok1 := rel.assetURL("checksums.txt")
+	sigURL, ok2 := rel.assetURL("checksums.txt.sig")
+	if !ok1 || !ok2 {
+		return fmt.Errorf("release %s is missing signed checksums", rel.TagName)
+	}
+
+	sums, err := fetchBytes(client, sumsURL, 1<<20)
+	if err != nil {
+		return fmt.Errorf("failed to download checksums: %w", err)
+	}
+	sigData, err := fetchBytes(client, sigURL, 1<<10)
+	if err != nil {
+		return fmt.Errorf("failed to download checksum signature: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigData)))
+	if err != nil {
+		// Accept a raw binary signature as well
+		sig = sigData
+	}
+	if !ed25519.Verify(key, sums, sig) {
+		return fmt.Errorf("checksum signature verification failed")
+	}
+
+	want, ok := expectedChecksum(sums, assetName)
+	if !ok {
+		return fmt.Errorf("checksums.txt has no entry for %s", assetName)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+
+	// Download next to the binary so the final rename stays on one filesystem
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".sync-it-update-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	resp, err := client.Get(binURL)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to download %s: %w", assetName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		tmp.Close()
+		return fmt.Errorf("failed to download %s: %s", assetName, resp.Status)
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), resp.Body); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to download %s: %w", assetName, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", assetName, got, want)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return err
+	}
+	if err := replaceExecutable(exe, tmp.Name()); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", exe, err)
+	}
+
+	fmt.Printf("Updated %s to %s; restart the server to use it\n", exe, rel.TagName)
+	return nil
+}
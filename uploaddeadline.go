@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// uploadProgressBytes is how much of a request body must arrive to win it
+// another -upload-timeout, so a connection sending a byte now and then to
+// stay open is still reaped.
+const uploadProgressBytes = 16 << 10
+
+// uploadTimeout is how long a request body may take to deliver the next
+// uploadProgressBytes before the connection is cut, 0 for no limit. The
+// deadline moves on as long as bytes keep flowing, so a slow but steady
+// upload over weak Wi-Fi runs for as long as it needs while a stalled one,
+// say from a phone that went out of range, is dropped instead of holding
+// its connection and partial file for good. Set with -upload-timeout.
+var uploadTimeout time.Duration
+
+// deadlineBody pushes the connection's read deadline back as the body it
+// wraps makes progress.
+type deadlineBody struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	r       *http.Request
+	read    int64 // bytes read so far
+	pending int64 // bytes read since the deadline last moved
+	logged  bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.pending += int64(n); b.pending >= uploadProgressBytes {
+		b.pending = 0
+		b.rc.SetReadDeadline(time.Now().Add(uploadTimeout))
+	}
+	if err == io.EOF {
+		// Done reading: the server goes on reading the connection in the
+		// background, and the deadline firing then would cancel the
+		// request while its response is still being written
+		b.rc.SetReadDeadline(time.Time{})
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && !b.logged {
+		b.logged = true
+		slog.Warn("Upload stalled, connection dropped", "path", b.r.URL.Path, "received", formatSize(b.read), "timeout", uploadTimeout.String(), "client", clientIP(b.r))
+	}
+	return n, err
+}
+
+// withUploadDeadline holds requests with a body to uploadTimeout. It must
+// see the server's own ResponseWriter, so goes outside every other wrapper.
+func withUploadDeadline(h http.Handler) http.Handler {
+	if uploadTimeout <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rc := http.NewResponseController(w)
+		if err := rc.SetReadDeadline(time.Now().Add(uploadTimeout)); err != nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		// Cleared after, or it would cut the connection while it idles
+		// between keep-alive requests
+		defer rc.SetReadDeadline(time.Time{})
+
+		r.Body = &deadlineBody{ReadCloser: r.Body, rc: rc, r: r}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// multipartOverhead is how much larger than the file a multipart upload's
+// body may be, for the other form fields and part headers.
+const multipartOverhead = 1 << 20
+
+// maxUploadSize is the largest file that may be uploaded, 0 for no limit.
+// Set with -max-upload-size.
+var maxUploadSize int64
+
+// errTooLarge reports an upload larger than the limit it was held to.
+type errTooLarge struct{ limit int64 }
+
+func (e errTooLarge) Error() string {
+	return fmt.Sprintf("upload is larger than the %s limit", formatSize(e.limit))
+}
+
+// checkUploadSize returns errTooLarge when a file of size bytes is too
+// large to upload; unknown sizes (-1) pass.
+func checkUploadSize(size int64) error {
+	if maxUploadSize > 0 && size > maxUploadSize {
+		return errTooLarge{maxUploadSize}
+	}
+	return nil
+}
+
+// sizeLimitedReader fails with errTooLarge as soon as more than limit bytes
+// have been read, so the upload is aborted and its partial contents removed
+// rather than stored in full first.
+type sizeLimitedReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64
+}
+
+// limitUpload holds r to maxUploadSize.
+func limitUpload(r io.Reader) io.Reader {
+	if maxUploadSize <= 0 {
+		return r
+	}
+	return &sizeLimitedReader{r: r, limit: maxUploadSize, remaining: maxUploadSize}
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	// One byte past the limit is enough to tell
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, errTooLarge{l.limit}
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// parseUploadForm parses a multipart upload, giving up with errTooLarge as
+// soon as the body is larger than an acceptable file could make it. Other
+// errors are left for r.FormFile to report.
+func parseUploadForm(w http.ResponseWriter, r *http.Request) error {
+	if maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+multipartOverhead)
+	}
+	// Parts past 100 MB are spooled to temporary files
+	var maxBytes *http.MaxBytesError
+	if err := r.ParseMultipartForm(100 << 20); errors.As(err, &maxBytes) {
+		return errTooLarge{maxUploadSize}
+	}
+	return nil
+}
+
+// rejectTooLarge answers 413 and returns true when err is errTooLarge or a
+// request body that went over http.MaxBytesReader.
+func rejectTooLarge(w http.ResponseWriter, err error) bool {
+	var tooLarge errTooLarge
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		http.Error(w, tooLarge.Error(), http.StatusRequestEntityTooLarge)
+	case errors.As(err, &maxBytes):
+		http.Error(w, errTooLarge{maxBytes.Limit}.Error(), http.StatusRequestEntityTooLarge)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// maxZipFiles bounds how many files one zip or tar download may ask for.
+const maxZipFiles = 1000
+
+// handleZipDownload streams the files asked for as one zip archive, built
+// as it is sent: GET /api/download/zip?id=...&id=..., POST with {"ids":
+// [...]}, or ?all=true for every file in the room. Files keep their folders
+// as directories in the archive.
+func handleZipDownload(w http.ResponseWriter, r *http.Request) {
+	files, size, ok := downloadSelection(w, r)
+	if !ok {
+		return
+	}
+
+	release, ok := queueDownload(w, r, "zip", size)
+	if !ok {
+		return
+	}
+	defer release()
+
+	name := "sync-it-" + time.Now().Format("20060102-150405") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	zw := zip.NewWriter(w)
+	used := map[string]bool{}
+	for i := range files {
+		meta := &files[i]
+		if err := writeZipEntry(zw, meta, zipEntryName(meta, used)); err != nil {
+			abortDownload(r, meta, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+	slog.Info("Zip downloaded", "files", len(files), "size", formatSize(size), "client", clientIP(r))
+	markDownloaded(files)
+}
+
+// handleTarDownload streams the files asked for as a gzipped tar, taking
+// the same requests as handleZipDownload at /api/download/tar.gz, so
+// `curl ... | tar -xz` unpacks them with their names, folders and upload
+// times.
+func handleTarDownload(w http.ResponseWriter, r *http.Request) {
+	files, size, ok := downloadSelection(w, r)
+	if !ok {
+		return
+	}
+
+	release, ok := queueDownload(w, r, "tar.gz", size)
+	if !ok {
+		return
+	}
+	defer release()
+
+	name := "sync-it-" + time.Now().Format("20060102-150405") + ".tar.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+
+	// Fastest level, as the network is the bottleneck and most large files
+	// don't shrink much
+	gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+	tw := tar.NewWriter(gz)
+	used := map[string]bool{}
+	for i := range files {
+		meta := &files[i]
+		if err := writeTarEntry(tw, meta, zipEntryName(meta, used)); err != nil {
+			abortDownload(r, meta, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return
+	}
+	if err := gz.Close(); err != nil {
+		return
+	}
+	slog.Info("Tar downloaded", "files", len(files), "size", formatSize(size), "client", clientIP(r))
+	markDownloaded(files)
+}
+
+// downloadSelection returns the servable files a zip or tar download asks
+// for and their total size, answering the request itself when it is
+// invalid. Like single downloads, listing IDs needs no token, as knowing
+// them is what grants access, but all=true does when a PIN is set.
+func downloadSelection(w http.ResponseWriter, r *http.Request) ([]FileMetadata, int64, bool) {
+	room, ok := requestRoom(w, r)
+	if !ok {
+		return nil, 0, false
+	}
+
+	var ids []string
+	all := false
+	switch r.Method {
+	case http.MethodGet:
+		all = r.URL.Query().Get("all") == "true"
+		ids = r.URL.Query()["id"]
+	case http.MethodPost:
+		var req struct {
+			IDs []string `json:"ids"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return nil, 0, false
+		}
+		ids = req.IDs
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return nil, 0, false
+	}
+
+	var files []FileMetadata
+	if all {
+		// Download links are exempt from the PIN; a listing of everything isn't
+		if token := requestToken(r); auth != nil && !auth.ValidToken(token) && !checkAPIKey(w, r, token) {
+			return nil, 0, false
+		}
+		files = storage.ListRoomFiles(roomCode(room))
+	} else {
+		if len(ids) == 0 {
+			http.Error(w, "File IDs required", http.StatusBadRequest)
+			return nil, 0, false
+		}
+		seen := map[string]bool{}
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			meta, _, err := storage.GetFile(id)
+			if err != nil || !inRoom(meta, room) {
+				http.Error(w, "File not found: "+id, http.StatusNotFound)
+				return nil, 0, false
+			}
+			files = append(files, *meta)
+		}
+	}
+
+	files, size := servableFiles(files)
+	if len(files) == 0 {
+		http.Error(w, "No files to download", http.StatusNotFound)
+		return nil, 0, false
+	}
+	if len(files) > maxZipFiles {
+		http.Error(w, fmt.Sprintf("At most %d files can be downloaded at once", maxZipFiles), http.StatusBadRequest)
+		return nil, 0, false
+	}
+	return files, size, true
+}
+
+// servableFiles leaves out the files that can't be downloaded right now,
+// and returns the total size of the rest.
+func servableFiles(files []FileMetadata) ([]FileMetadata, int64) {
+	now := time.Now()
+	var size int64
+	servable := files[:0]
+	for _, meta := range files {
+		if meta.expired(now) || meta.Quarantined || meta.embargoed(now) {
+			continue
+		}
+		servable = append(servable, meta)
+		size += meta.Size
+	}
+	return servable, size
+}
+
+// abortDownload gives up on an archive that failed part way through meta.
+func abortDownload(r *http.Request, meta *FileMetadata, err error) {
+	if r.Context().Err() == nil {
+		slog.Error("Failed to add file to download", "id", meta.ID, "error", err)
+	}
+	// Too late for an error status; cutting the connection keeps the
+	// client from taking a truncated archive as whole
+	panic(http.ErrAbortHandler)
+}
+
+func markDownloaded(files []FileMetadata) {
+	for i := range files {
+		events.Publish(Event{Type: EventFileDownloaded, File: &files[i]})
+		storage.MarkDownloaded(files[i].ID)
+	}
+}
+
+// zipEntryName places meta under its folder, numbering names already used
+// in the archive as the file list does: "report (2).pdf". Tar downloads
+// name their entries the same way.
+func zipEntryName(meta *FileMetadata, used map[string]bool) string {
+	dir := strings.TrimPrefix(meta.Folder, "/")
+	name := path.Join(dir, meta.Name)
+	ext := path.Ext(meta.Name)
+	for n := 2; used[name]; n++ {
+		name = path.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(meta.Name, ext), n, ext))
+	}
+	used[name] = true
+	return name
+}
+
+// writeZipEntry copies meta's contents into the archive uncompressed, as
+// most large files are compressed already and the network is the bottleneck.
+func writeZipEntry(zw *zip.Writer, meta *FileMetadata, name string) error {
+	defer storage.BeginRead(meta.blobName())()
+	blob, err := storage.OpenBlob(meta.ID)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: meta.UploadedAt})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, blob)
+	return err
+}
+
+// writeTarEntry copies meta's contents into the tar as a regular file
+// stamped with its upload time.
+func writeTarEntry(tw *tar.Writer, meta *FileMetadata, name string) error {
+	defer storage.BeginRead(meta.blobName())()
+	blob, err := storage.OpenBlob(meta.ID)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	// PAX keeps the time to the nanosecond; other formats round it to a
+	// second, which can land in the future
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Size: meta.Size, Mode: 0644, ModTime: meta.UploadedAt, Format: tar.FormatPAX}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, blob)
+	return err
+}
@@ -0,0 +1,30 @@
+//go:build zstd
+
+package main
+
+// Adds -compress zstd using a pure-Go encoder. Add the package to go.mod
+// first:
+//
+//	go get github.com/klauspost/compress
+//	go build -tags zstd -o sync-it
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	compressionCodecs["zstd"] = compressionCodec{
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	}
+}